@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stands in for the Safaricom Daraja API when testing M-Pesa payments.
+//
+// Accepts STK push requests and, after a delay, posts the callback the real
+// service would send once the payer answers the prompt on their phone:
+//
+//	go run ./cmd/darajamock -addr localhost:8089
+//	go run ./cmd/darajamock -result cancelled
+//	go run ./cmd/darajamock -result timeout      # no callback; queries keep saying it is processing
+//	go run ./cmd/darajamock -duplicates 2        # send each callback three times
+//
+// Point the API at it with MPESA_BASE_URL=http://localhost:8089.
+func main() {
+	addr := flag.String("addr", "localhost:8089", "address to listen on")
+	result := flag.String("result", "success", "outcome of every request: success, cancelled, insufficient or timeout")
+	delay := flag.Duration("delay", 5*time.Second, "time the payer takes to answer the prompt")
+	duplicates := flag.Int("duplicates", 0, "extra copies of each callback to send")
+	passKey := flag.String("passkey", "", "check request passwords against this pass key")
+	flag.Parse()
+
+	outcome, ok := outcomes[*result]
+	if !ok {
+		log.Fatalf("Unknown -result %q\n", *result)
+	}
+	m := &mock{outcome: outcome, delay: *delay, duplicates: *duplicates, passKey: *passKey, requests: map[string]*request{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/v1/generate", m.token)
+	mux.HandleFunc("/mpesa/stkpush/v1/processrequest", m.stkPush)
+	mux.HandleFunc("/mpesa/stkpushquery/v1/query", m.query)
+	log.Printf("Mock Daraja listening on %s, every request will end as %q\n", *addr, *result)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+type outcome struct {
+	Code        int
+	Description string
+	// Silent outcomes never call back, as when the phone cannot be reached
+	Silent bool
+}
+
+var outcomes = map[string]outcome{
+	"success":      {0, "The service request is processed successfully.", false},
+	"cancelled":    {1032, "Request cancelled by user", false},
+	"insufficient": {1, "The balance is insufficient for the transaction", false},
+	"timeout":      {1037, "DS timeout user cannot be reached", true},
+}
+
+const mockToken = "mock-access-token"
+
+type request struct {
+	MerchantRequestID string
+	CheckoutRequestID string
+	Amount            int64
+	PhoneNumber       string
+	CallbackURL       string
+	Answered          bool
+}
+
+type mock struct {
+	outcome    outcome
+	delay      time.Duration
+	duplicates int
+	passKey    string
+
+	mu       sync.Mutex
+	requests map[string]*request
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"requestId": randomID(8), "errorCode": code, "errorMessage": message})
+}
+
+func randomID(n int) string {
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return string(b)
+}
+
+func (m *mock) token(w http.ResponseWriter, r *http.Request) {
+	if key, secret, ok := r.BasicAuth(); !ok || key == "" || secret == "" {
+		writeError(w, http.StatusBadRequest, "400.008.01", "Invalid Authentication passed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": mockToken, "expires_in": "3599"})
+}
+
+func (m *mock) authorised(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+mockToken {
+		writeError(w, http.StatusUnauthorized, "404.001.04", "Invalid Access Token")
+		return false
+	}
+	return true
+}
+
+func (m *mock) checkPassword(shortCode, password, timestamp string) bool {
+	if m.passKey == "" {
+		return true
+	}
+	return password == base64.StdEncoding.EncodeToString([]byte(shortCode+m.passKey+timestamp))
+}
+
+func (m *mock) stkPush(w http.ResponseWriter, r *http.Request) {
+	if !m.authorised(w, r) {
+		return
+	}
+	var in struct {
+		BusinessShortCode string
+		Password          string
+		Timestamp         string
+		Amount            int64
+		PhoneNumber       string
+		CallBackURL       string
+		AccountReference  string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid JSON")
+		return
+	}
+	switch {
+	case !m.checkPassword(in.BusinessShortCode, in.Password, in.Timestamp):
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Password")
+		return
+	case in.Amount < 1:
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Amount")
+		return
+	case len(in.PhoneNumber) != 12 || !strings.HasPrefix(in.PhoneNumber, "254"):
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid PhoneNumber")
+		return
+	case !strings.HasPrefix(in.CallBackURL, "http"):
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid CallBackURL")
+		return
+	}
+
+	req := &request{
+		MerchantRequestID: randomID(5) + "-" + randomID(8),
+		CheckoutRequestID: "ws_CO_" + time.Now().Format("020120061504050") + randomID(6),
+		Amount:            in.Amount,
+		PhoneNumber:       in.PhoneNumber,
+		CallbackURL:       in.CallBackURL,
+	}
+	m.mu.Lock()
+	m.requests[req.CheckoutRequestID] = req
+	m.mu.Unlock()
+	log.Printf("STK push %s: KES %d from %s for %s\n", req.CheckoutRequestID, in.Amount, in.PhoneNumber, in.AccountReference)
+
+	go m.answer(req)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"MerchantRequestID":   req.MerchantRequestID,
+		"CheckoutRequestID":   req.CheckoutRequestID,
+		"ResponseCode":        "0",
+		"ResponseDescription": "Success. Request accepted for processing",
+		"CustomerMessage":     "Success. Request accepted for processing",
+	})
+}
+
+// answer waits for the simulated payer, then sends the callback and any
+// duplicates of it.
+func (m *mock) answer(req *request) {
+	time.Sleep(m.delay)
+	if m.outcome.Silent {
+		log.Printf("%s: payer did not answer, no callback sent\n", req.CheckoutRequestID)
+		return
+	}
+	m.mu.Lock()
+	req.Answered = true
+	m.mu.Unlock()
+
+	stk := map[string]any{
+		"MerchantRequestID": req.MerchantRequestID,
+		"CheckoutRequestID": req.CheckoutRequestID,
+		"ResultCode":        m.outcome.Code,
+		"ResultDesc":        m.outcome.Description,
+	}
+	if m.outcome.Code == 0 {
+		stk["CallbackMetadata"] = map[string]any{"Item": []map[string]any{
+			{"Name": "Amount", "Value": req.Amount},
+			{"Name": "MpesaReceiptNumber", "Value": randomID(10)},
+			{"Name": "Balance"},
+			{"Name": "TransactionDate", "Value": json.Number(time.Now().In(time.FixedZone("EAT", 3*60*60)).Format("20060102150405"))},
+			{"Name": "PhoneNumber", "Value": json.Number(req.PhoneNumber)},
+		}}
+	}
+	body, _ := json.Marshal(map[string]any{"Body": map[string]any{"stkCallback": stk}})
+
+	for i := 0; i <= m.duplicates; i++ {
+		res, err := http.Post(req.CallbackURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("%s: callback failed: %v\n", req.CheckoutRequestID, err)
+			continue
+		}
+		res.Body.Close()
+		log.Printf("%s: callback %d sent (%d %s), answered %d\n", req.CheckoutRequestID, i+1, m.outcome.Code, m.outcome.Description, res.StatusCode)
+	}
+}
+
+func (m *mock) query(w http.ResponseWriter, r *http.Request) {
+	if !m.authorised(w, r) {
+		return
+	}
+	var in struct {
+		CheckoutRequestID string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid JSON")
+		return
+	}
+	m.mu.Lock()
+	req, ok := m.requests[in.CheckoutRequestID]
+	answered := ok && req.Answered
+	m.mu.Unlock()
+	switch {
+	case !ok:
+		writeError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid CheckoutRequestID")
+		return
+	case !answered:
+		writeError(w, http.StatusInternalServerError, "500.001.1001", "The transaction is being processed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"ResponseCode":        "0",
+		"ResponseDescription": "The service request has been accepted successsfully",
+		"MerchantRequestID":   req.MerchantRequestID,
+		"CheckoutRequestID":   req.CheckoutRequestID,
+		"ResultCode":          fmt.Sprint(m.outcome.Code),
+		"ResultDesc":          m.outcome.Description,
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"web-service/internal/hl7"
+)
+
+// Stands in for a lab analyser when testing the HL7 interface.
+//
+// Replays the sample result messages against the MLLP listener, filling in
+// the specimen barcode of an order that has been received in the lab:
+//
+//	go run ./cmd/hl7sim -addr localhost:2575 -specimen S260000001
+//	go run ./cmd/hl7sim -file data/hl7/oru_chemistry.hl7 -specimen S260000002
+//
+// Or listens for the order messages the clinic sends to analysers and
+// acknowledges them:
+//
+//	go run ./cmd/hl7sim -listen localhost:2576
+func main() {
+	addr := flag.String("addr", "localhost:2575", "MLLP listener to send result messages to")
+	dir := flag.String("dir", "data/hl7", "directory of sample .hl7 messages to replay")
+	file := flag.String("file", "", "replay a single message file instead of the directory")
+	specimen := flag.String("specimen", "", "specimen number to put in place of {{SPECIMEN}}")
+	delay := flag.Duration("delay", time.Second, "pause between messages")
+	listen := flag.String("listen", "", "act as an analyser and accept order messages on this address")
+	flag.Parse()
+
+	if *listen != "" {
+		receiveOrders(*listen)
+		return
+	}
+
+	files := []string{*file}
+	if *file == "" {
+		var err error
+		files, err = filepath.Glob(filepath.Join(*dir, "*.hl7"))
+		if err != nil || len(files) == 0 {
+			log.Fatalf("No .hl7 files found in %s\n", *dir)
+		}
+		sort.Strings(files)
+	}
+	if *specimen == "" {
+		log.Fatalf("-specimen is required\n")
+	}
+
+	for i, name := range files {
+		if i > 0 {
+			time.Sleep(*delay)
+		}
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			log.Fatalf("Error reading %s: %v\n", name, err)
+		}
+		msg := strings.NewReplacer(
+			"{{SPECIMEN}}", *specimen,
+			"{{NOW}}", time.Now().Format(hl7.TimeFormat),
+			"{{CONTROL_ID}}", fmt.Sprintf("SIM%d%02d", time.Now().Unix(), i),
+		).Replace(strings.TrimSpace(string(raw)))
+		msg = strings.ReplaceAll(strings.ReplaceAll(msg, "\r\n", "\r"), "\n", "\r") + "\r"
+
+		ack, err := hl7.Send(context.Background(), *addr, []byte(msg), 10*time.Second)
+		if err != nil {
+			log.Fatalf("Error sending %s: %v\n", name, err)
+		}
+		msa, _ := ack.Segment("MSA")
+		log.Printf("%s -> %s %s\n", filepath.Base(name), msa.Field(1), msa.Field(3))
+	}
+}
+
+// receiveOrders prints each order message received and accepts it.
+func receiveOrders(addr string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Simulated analyser listening on %s\n", addr)
+	err := hl7.Serve(ctx, addr, nil, func(ctx context.Context, raw []byte, peer string) []byte {
+		fmt.Printf("--- %s from %s\n%s\n", time.Now().Format(time.RFC3339), peer, strings.ReplaceAll(string(raw), "\r", "\n"))
+		m, err := hl7.Parse(raw)
+		if err != nil {
+			log.Printf("Invalid message: %v\n", err)
+			return nil
+		}
+		return hl7.Ack(m, "SIMULATOR", "LAB", hl7.AckAccept, "", fmt.Sprintf("SIM%d", time.Now().UnixNano()))
+	})
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v\n", addr, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"web-service/database"
+	"web-service/internal/handlers/icd10"
+)
+
+// Loads the ICD-10 code list into the database. The list is licensed
+// separately and not kept in the repository; export every category and
+// subcategory of the WHO edition in use to a code,description CSV first.
+//
+//	go run ./cmd/icd10import -file data/icd10.csv
+func main() {
+	file := flag.String("file", "", "CSV file with code,description columns")
+	minCodes := flag.Int("min", 10000, "refuse files with fewer codes than this, 0 to load an extract for testing")
+	flag.Parse()
+	if *file == "" {
+		log.Fatalf("-file is required, the ICD-10 code list is not bundled\n")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v\n", *file, err)
+	}
+	defer f.Close()
+
+	database.Connect()
+	count, err := icd10.Import(context.Background(), database.GetDB(), f, *minCodes)
+	if err != nil {
+		log.Fatalf("Error importing ICD-10 codes: %v\n", err)
+	}
+
+	log.Printf("Imported %d ICD-10 codes from %s\n", count, *file)
+}
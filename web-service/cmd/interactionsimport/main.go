@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"web-service/database"
+	"web-service/internal/handlers/interactions"
+)
+
+// Loads the bundled drug interaction dataset into the database
+//
+//	go run ./cmd/interactionsimport -file data/drug_interactions.csv
+func main() {
+	file := flag.String("file", "data/drug_interactions.csv", "CSV file with drug_a,drug_b,severity,description columns")
+	flag.Parse()
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("Error opening %s: %v\n", *file, err)
+	}
+	defer f.Close()
+
+	database.Connect()
+	count, err := interactions.Import(context.Background(), database.GetDB(), f)
+	if err != nil {
+		log.Fatalf("Error importing drug interactions: %v\n", err)
+	}
+
+	log.Printf("Imported %d drug interactions from %s\n", count, *file)
+}
@@ -218,4 +218,26 @@ func GetAppointmentByID(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(appointment)
-}
\ No newline at end of file
+}
+// CheckInAppointment marks a scheduled appointment as arrived so an encounter can be opened from it.
+func CheckInAppointment(c *fiber.Ctx) error {
+	db := database.GetDB()
+	id := c.Params("id")
+
+	tag, err := db.Exec(context.Background(), `UPDATE appointments SET status='checked_in', updated_at=$1 WHERE id=$2 AND status='scheduled'`, time.Now(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check in appointment",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Appointment not found or not in scheduled status",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Appointment checked in successfully",
+	})
+}
@@ -1,57 +1,713 @@
 package billing
 
 import (
-        "github.com/gofiber/fiber/v2"
-        "web-service/database"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/tariff"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
 )
 
+func init() {
+	// Money goes out as JSON numbers, as the client has always read it; the
+	// decimal text is exact, so nothing is lost on the way
+	decimal.MarshalJSONWithoutQuotes = true
+}
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
 type Invoice struct {
-        ID        string  `json:"id"`
-        InvoiceNo string  `json:"invoiceNo"`
-        Patient   string  `json:"patient"`
-        Date      string  `json:"date"`
-        Amount    float64 `json:"amount"`
-        Status    string  `json:"status"`
-        Items     string  `json:"items"`
+	ID             string          `json:"id"`
+	InvoiceNumber  *string         `json:"invoice_number,omitempty"`
+	PatientID      string          `json:"patient_id"`
+	PatientName    string          `json:"patient_name"`
+	PhoneNumber    string          `json:"phone_number"`
+	AppointmentID  *string         `json:"appointment_id,omitempty"`
+	EncounterID    *string         `json:"encounter_id,omitempty"`
+	Status         string          `json:"status"`
+	PriceListID    string          `json:"price_list_id"`
+	Subtotal       decimal.Decimal `json:"subtotal"`
+	DiscountTotal  decimal.Decimal `json:"discount_total"`
+	TaxTotal       decimal.Decimal `json:"tax_total"`
+	Total          decimal.Decimal `json:"total"`
+	AmountCredited decimal.Decimal `json:"amount_credited"`
+	AmountPaid     decimal.Decimal `json:"amount_paid"`
+	Balance        decimal.Decimal `json:"balance"`
+	InsuranceID    *string         `json:"insurance_id,omitempty"`
+	SchemeID       *string         `json:"scheme_id,omitempty"`
+	InsurerShare   decimal.Decimal `json:"insurer_share"`
+	PatientShare   decimal.Decimal `json:"patient_share"`
+	InsurerBalance decimal.Decimal `json:"insurer_balance"`
+	PatientBalance decimal.Decimal `json:"patient_balance"`
+	Notes          *string         `json:"notes,omitempty"`
+	DueDate        *time.Time      `json:"due_date,omitempty"`
+	CreatedBy      *string         `json:"created_by,omitempty"`
+	IssuedBy       *string         `json:"issued_by,omitempty"`
+	IssuedAt       *time.Time      `json:"issued_at,omitempty"`
+	VoidReason     *string         `json:"void_reason,omitempty"`
+	VoidedBy       *string         `json:"voided_by,omitempty"`
+	VoidedAt       *time.Time      `json:"voided_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	Lines          []Line          `json:"lines"`
+	CreditNotes    []CreditNote    `json:"credit_notes"`
+	Payments       []Allocation    `json:"payments"`
 }
 
+const invoiceColumns = `b.id, b.invoice_number, b.patient_id, p.first_name || ' ' || p.last_name, b.phone_number, b.appointment_id,
+	b.encounter_id, b.status, b.price_list_id, b.subtotal, b.discount_total, b.tax_total, b.amount, b.amount_credited, b.amount_paid, b.insurance_id, b.scheme_id, b.insurer_share,
+	b.notes, b.due_date, b.created_by, b.issued_by, b.issued_at, b.void_reason, b.voided_by, b.voided_at, b.created_at, b.updated_at`
+
+func (inv *Invoice) scanTargets() []any {
+	return []any{&inv.ID, &inv.InvoiceNumber, &inv.PatientID, &inv.PatientName, &inv.PhoneNumber, &inv.AppointmentID,
+		&inv.EncounterID, &inv.Status, &inv.PriceListID, &inv.Subtotal, &inv.DiscountTotal, &inv.TaxTotal, &inv.Total, &inv.AmountCredited, &inv.AmountPaid, &inv.InsuranceID, &inv.SchemeID, &inv.InsurerShare,
+		&inv.Notes, &inv.DueDate, &inv.CreatedBy, &inv.IssuedBy, &inv.IssuedAt, &inv.VoidReason, &inv.VoidedBy, &inv.VoidedAt, &inv.CreatedAt, &inv.UpdatedAt}
+}
+
+// Fetch loads an invoice with its lines, the credit notes raised against it
+// and the payments applied to it.
+func Fetch(ctx context.Context, q querier, id string) (*Invoice, error) {
+	var inv Invoice
+	err := q.QueryRow(ctx, `SELECT `+invoiceColumns+` FROM billing b JOIN patients p ON p.id = b.patient_id WHERE b.id = $1`, id).
+		Scan(inv.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	inv.Balance = inv.Total.Sub(inv.AmountCredited).Sub(inv.AmountPaid)
+	if inv.Lines, err = fetchLines(ctx, q, inv.ID); err != nil {
+		return nil, err
+	}
+	if inv.CreditNotes, err = fetchCreditNotes(ctx, q, inv.ID); err != nil {
+		return nil, err
+	}
+	if inv.Payments, err = fetchAllocations(ctx, q, "invoice_id", inv.ID); err != nil {
+		return nil, err
+	}
+	inv.split()
+	return &inv, nil
+}
+
+// split works out what is still due from the insurer and the patient.
+// Insurance payments go to the insurer's share, all others to the patient's.
+func (inv *Invoice) split() {
+	insurerPaid := decimal.Zero
+	for _, a := range inv.Payments {
+		if a.Method == "insurance" {
+			insurerPaid = insurerPaid.Add(a.Amount)
+		}
+	}
+	inv.PatientShare = inv.Total.Sub(inv.InsurerShare)
+	inv.InsurerBalance = decimal.Max(decimal.Zero, decimal.Min(inv.InsurerShare.Sub(insurerPaid), inv.Balance))
+	inv.PatientBalance = inv.Balance.Sub(inv.InsurerBalance)
+}
+
+// StatusFor is the status of an issued invoice given what has been paid
+// against it. Nothing counts as paid until money has been received, so an
+// invoice that comes to nothing stays issued with a zero balance.
+func StatusFor(total, paid decimal.Decimal) string {
+	switch {
+	case paid.IsPositive() && paid.GreaterThanOrEqual(total):
+		return "paid"
+	case paid.IsPositive():
+		return "partially_paid"
+	}
+	return "issued"
+}
+
+// Summary is an invoice as listed on the billing screen, which reads the
+// invoiceNo, patient, date and items fields.
+type Summary struct {
+	ID             string          `json:"id"`
+	InvoiceNo      string          `json:"invoiceNo"`
+	PatientID      string          `json:"patient_id"`
+	Patient        string          `json:"patient"`
+	Date           time.Time       `json:"date"`
+	Amount         decimal.Decimal `json:"amount"`
+	AmountCredited decimal.Decimal `json:"amount_credited"`
+	AmountPaid     decimal.Decimal `json:"amount_paid"`
+	Balance        decimal.Decimal `json:"balance"`
+	Status         string          `json:"status"`
+	Items          string          `json:"items"`
+}
+
+// GetInvoices lists invoices, newest first, optionally for one patient or
+// in the given statuses. Drafts show as DRAFT until they are issued.
 func GetInvoices(c *fiber.Ctx) error {
-        db := database.GetDB()
-        rows, err := db.Query(c.Context(), `
-                SELECT b.id, 'INV-' || b.id as invoice_no, p.first_name || ' ' || p.last_name as patient, 
-                b.created_at::text, b.amount, b.status, 'Consultation' as items
-                FROM billing b
-                JOIN patients p ON b.patient_id = p.id
-        `)
-        if err != nil {
-                return c.Status(500).JSON(fiber.Map{"error": err.Error()})
-        }
-        defer rows.Close()
-
-        var invoices []Invoice
-        for rows.Next() {
-                var inv Invoice
-                if err := rows.Scan(&inv.ID, &inv.InvoiceNo, &inv.Patient, &inv.Date, &inv.Amount, &inv.Status, &inv.Items); err != nil {
-                        continue
-                }
-                invoices = append(invoices, inv)
-        }
-
-        if invoices == nil {
-                invoices = []Invoice{}
-        }
-
-        return c.JSON(invoices)
+	var statuses []string
+	if s := c.Query("status"); s != "" {
+		statuses = strings.Split(s, ",")
+	}
+	rows, err := database.GetDB().Query(context.Background(), `SELECT b.id, COALESCE(b.invoice_number, 'DRAFT'), b.patient_id,
+			p.first_name || ' ' || p.last_name, COALESCE(b.issued_at, b.created_at), b.amount, b.amount_credited, b.amount_paid, b.status,
+			COALESCE((SELECT string_agg(DISTINCT i.description, ', ') FROM invoice_items i WHERE i.invoice_id = b.id), '')
+		FROM billing b
+		JOIN patients p ON p.id = b.patient_id
+		WHERE ($1 = '' OR b.patient_id = $1) AND (COALESCE(cardinality($2::text[]), 0) = 0 OR b.status = ANY($2))
+		ORDER BY COALESCE(b.issued_at, b.created_at) DESC`, c.Query("patient_id"), statuses)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	invoices, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Summary, error) {
+		var s Summary
+		err := row.Scan(&s.ID, &s.InvoiceNo, &s.PatientID, &s.Patient, &s.Date, &s.Amount, &s.AmountCredited, &s.AmountPaid, &s.Status, &s.Items)
+		s.Balance = s.Amount.Sub(s.AmountCredited).Sub(s.AmountPaid)
+		return s, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(invoices)
+}
+
+func GetInvoice(c *fiber.Ctx) error {
+	inv, err := Fetch(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invoice not found",
+		})
+	}
+	return c.JSON(inv)
+}
+
+// lineRequest asks for a catalogue item to be billed. ItemID is the lab test,
+// medicine or service item id; lab tests and service items may also be given
+// by code.
+type lineRequest struct {
+	ItemType    string          `json:"item_type"`
+	ItemID      string          `json:"item_id"`
+	Description string          `json:"description"`
+	Quantity    int             `json:"quantity"`
+	Discount    decimal.Decimal `json:"discount"`
+}
+
+// manualSources are where lines added at the billing desk come from. Lines
+// from lab orders and dispensing are reversed there, not removed here.
+var manualSources = map[string]string{
+	"lab":          "laboratory",
+	"medicine":     "pharmacy",
+	"consultation": "service_item",
+	"procedure":    "service_item",
 }
 
+// priceLines prices requested lines from a price list.
+func priceLines(ctx context.Context, q querier, listID string, reqs []lineRequest) ([]Line, error) {
+	lines := make([]Line, 0, len(reqs))
+	for i, r := range reqs {
+		if r.Quantity == 0 {
+			r.Quantity = 1
+		}
+		if r.Quantity < 0 {
+			return nil, fmt.Errorf("%w: line %d: quantity must be positive", ErrInvalidLine, i+1)
+		}
+		p, err := tariff.Lookup(ctx, q, listID, r.ItemType, strings.TrimSpace(r.ItemID), time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		description := strings.TrimSpace(r.Description)
+		if description == "" {
+			description = p.Description
+		}
+		sourceType := manualSources[r.ItemType]
+		sourceID := p.ItemID
+		lines = append(lines, Line{
+			ItemType: r.ItemType, Description: description, Quantity: r.Quantity, UnitPrice: p.UnitPrice, Discount: r.Discount,
+			TaxRate: p.TaxRate, SourceType: &sourceType, SourceID: &sourceID,
+		})
+	}
+	return lines, nil
+}
+
+var errNotDraft = errors.New("only draft invoices can be changed")
+
+// lockDraft locks an invoice for changes, which are only allowed while it
+// is a draft.
+func lockDraft(ctx context.Context, tx pgx.Tx, id string) error {
+	var status string
+	err := tx.QueryRow(ctx, `SELECT status FROM billing WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+	if err != nil {
+		return err
+	}
+	if status != "draft" {
+		return errNotDraft
+	}
+	return nil
+}
+
+// invoiceError maps invoice errors to a response.
+func invoiceError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invoice not found",
+		})
+	case errors.Is(err, ErrInvalidLine), errors.Is(err, tariff.ErrInvalidItem), errors.Is(err, tariff.ErrUnknownItem):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, errNotDraft), errors.Is(err, errPreauthRequired):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error":   message,
+		"details": err.Error(),
+	})
+}
+
+type invoiceRequest struct {
+	PatientID     string        `json:"patient_id"`
+	AppointmentID *string       `json:"appointment_id"`
+	EncounterID   *string       `json:"encounter_id"`
+	Notes         *string       `json:"notes"`
+	DueDate       *string       `json:"due_date"`
+	Lines         []lineRequest `json:"lines"`
+}
+
+func parseDueDate(s *string) (*time.Time, error) {
+	if s == nil || *s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", *s)
+	if err != nil {
+		return nil, fmt.Errorf("due_date must be YYYY-MM-DD")
+	}
+	return &t, nil
+}
+
+// checkLinks confirms the appointment and encounter belong to the patient.
+func checkLinks(ctx context.Context, patientID string, appointmentID, encounterID *string) string {
+	db := database.GetDB()
+	var ok bool
+	if appointmentID != nil && *appointmentID != "" {
+		err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM appointments a JOIN patients p ON p.national_id = a.patient_national_id
+			WHERE a.id = $1 AND p.id = $2)`, *appointmentID, patientID).Scan(&ok)
+		if err != nil || !ok {
+			return "appointment_id is not an appointment of this patient"
+		}
+	}
+	if encounterID != nil && *encounterID != "" {
+		err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM encounters WHERE id = $1 AND patient_id = $2)`, *encounterID, patientID).Scan(&ok)
+		if err != nil || !ok {
+			return "encounter_id is not an encounter of this patient"
+		}
+	}
+	return ""
+}
+
+func emptyToNil(s *string) *string {
+	if s == nil || strings.TrimSpace(*s) == "" {
+		return nil
+	}
+	return s
+}
+
+// CreateInvoice starts a draft invoice for a patient with lines priced from
+// the tariff. The totals are worked out here, never taken from the client.
 func CreateInvoice(c *fiber.Ctx) error {
-        var inv Invoice
-        if err := c.BodyParser(&inv); err != nil {
-                return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
-        }
-
-        db := database.GetDB()
-        _ = db // Avoid unused variable error
-        // Simplified for now, in a real app we'd look up patient_id
-        return c.JSON(fiber.Map{"message": "Invoice created successfully"})
+	ctx := context.Background()
+	var req invoiceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if req.PatientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "patient_id is required",
+		})
+	}
+	req.AppointmentID, req.EncounterID = emptyToNil(req.AppointmentID), emptyToNil(req.EncounterID)
+	if msg := checkLinks(ctx, req.PatientID, req.AppointmentID, req.EncounterID); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	dueDate, err := parseDueDate(req.DueDate)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	lines, err := priceLines(ctx, tx, tariff.CashList, req.Lines)
+	if err != nil {
+		return invoiceError(c, err, "Failed to create invoice")
+	}
+	id := uuid.New().String()[:8]
+	now := time.Now()
+	tag, err := tx.Exec(ctx, `INSERT INTO billing (id, patient_id, phone_number, appointment_id, encounter_id, amount, status, notes,
+			due_date, created_by, created_at, updated_at)
+		SELECT $1, id, phone_number, $2, $3, 0, 'draft', $4, $5, $6, $7, $7 FROM patients WHERE id = $8`,
+		id, req.AppointmentID, req.EncounterID, emptyToNil(req.Notes), dueDate, middleware.CurrentUserID(c), now, req.PatientID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
+	if err == nil {
+		err = insertLines(ctx, tx, id, lines)
+	}
+	if err == nil {
+		err = recalculate(ctx, tx, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to create invoice")
+	}
+
+	inv, err := Fetch(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Invoice created successfully",
+		"invoice": inv,
+	})
+}
+
+type invoiceUpdate struct {
+	AppointmentID *string `json:"appointment_id"`
+	EncounterID   *string `json:"encounter_id"`
+	Notes         *string `json:"notes"`
+	DueDate       *string `json:"due_date"`
+}
+
+// UpdateInvoice changes the links, notes and due date of a draft invoice.
+func UpdateInvoice(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req invoiceUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	inv, err := Fetch(ctx, database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invoice not found",
+		})
+	}
+
+	if req.AppointmentID != nil {
+		inv.AppointmentID = emptyToNil(req.AppointmentID)
+	}
+	if req.EncounterID != nil {
+		inv.EncounterID = emptyToNil(req.EncounterID)
+	}
+	if req.Notes != nil {
+		inv.Notes = emptyToNil(req.Notes)
+	}
+	if req.DueDate != nil {
+		if inv.DueDate, err = parseDueDate(req.DueDate); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	if msg := checkLinks(ctx, inv.PatientID, inv.AppointmentID, inv.EncounterID); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	inv.UpdatedAt = time.Now()
+	err = lockDraft(ctx, tx, inv.ID)
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE billing SET appointment_id = $1, encounter_id = $2, notes = $3, due_date = $4, updated_at = $5
+			WHERE id = $6`, inv.AppointmentID, inv.EncounterID, inv.Notes, inv.DueDate, inv.UpdatedAt, inv.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to update invoice")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Invoice updated successfully",
+		"invoice": inv,
+	})
+}
+
+// AddInvoiceLines adds tariff-priced lines to a draft invoice.
+func AddInvoiceLines(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		Lines []lineRequest `json:"lines"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":   "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if len(req.Lines) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one line is required",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	err = lockDraft(ctx, tx, id)
+	var listID string
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT price_list_id FROM billing WHERE id = $1`, id).Scan(&listID)
+	}
+	var lines []Line
+	if err == nil {
+		lines, err = priceLines(ctx, tx, listID, req.Lines)
+	}
+	if err == nil {
+		err = insertLines(ctx, tx, id, lines)
+	}
+	if err == nil {
+		err = recalculate(ctx, tx, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to add invoice lines")
+	}
+
+	inv, err := Fetch(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Invoice lines added successfully",
+		"invoice": inv,
+	})
+}
+
+// RemoveInvoiceLine takes a line added at the billing desk off a draft invoice.
+func RemoveInvoiceLine(c *fiber.Ctx) error {
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	err = lockDraft(ctx, tx, id)
+	var sourceType *string
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT source_type FROM invoice_items WHERE id = $1 AND invoice_id = $2`, c.Params("lineId"), id).Scan(&sourceType)
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Invoice line not found",
+			})
+		}
+	}
+	if err == nil && (sourceType == nil || !isManualSource(*sourceType)) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Lines from lab orders and dispensing are reversed by cancelling the order or returning the medicine",
+		})
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM invoice_items WHERE id = $1`, c.Params("lineId"))
+	}
+	if err == nil {
+		err = recalculate(ctx, tx, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to remove invoice line")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Invoice line removed successfully",
+	})
+}
+
+func isManualSource(sourceType string) bool {
+	for _, s := range manualSources {
+		if s == sourceType {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueInvoice finalises a draft, giving it the next invoice number. Its
+// lines can no longer change; anything billed later goes on a new draft.
+// An insured invoice needs its pre-authorisations in place, and opens a
+// claim for the insurer's share.
+func IssueInvoice(c *fiber.Ctx) error {
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	err = lockDraft(ctx, tx, id)
+	var lineCount int
+	var total decimal.Decimal
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT (SELECT COUNT(*) FROM invoice_items WHERE invoice_id = $1), amount FROM billing WHERE id = $1`, id).
+			Scan(&lineCount, &total)
+	}
+	if err == nil && lineCount == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An invoice needs at least one line before it is issued",
+		})
+	}
+	if err == nil && total.IsNegative() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An invoice cannot be issued for a negative total",
+		})
+	}
+	if err == nil {
+		err = checkPreauthorisations(ctx, tx, id)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE billing SET invoice_number = 'INV-' || LPAD(nextval('invoice_number_seq')::text, 6, '0'),
+			status = $1, issued_by = $2, issued_at = $3, updated_at = $3 WHERE id = $4`,
+			StatusFor(total, decimal.Zero), middleware.CurrentUserID(c), time.Now(), id)
+	}
+	if err == nil {
+		err = openClaim(ctx, tx, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to issue invoice")
+	}
+
+	inv, err := Fetch(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Invoice issued successfully",
+		"invoice": inv,
+	})
+}
+
+// VoidInvoice cancels an invoice nothing has been paid or credited against. It keeps its
+// number, so the numbering has no gaps. An insurance claim that has not yet
+// been sent is withdrawn with it.
+func VoidInvoice(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A reason is required to void an invoice",
+		})
+	}
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	now := time.Now()
+	tag, err := tx.Exec(ctx, `UPDATE billing SET status = 'void', void_reason = $1, voided_by = $2, voided_at = $3, updated_at = $3
+		WHERE id = $4 AND status IN ('draft', 'issued') AND amount_paid = 0 AND amount_credited = 0`,
+		strings.TrimSpace(req.Reason), middleware.CurrentUserID(c), now, id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Failed to void invoice",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := Fetch(ctx, tx, id); err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Invoice not found",
+			})
+		}
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only invoices with nothing paid or credited against them can be voided",
+		})
+	}
+	var sent bool
+	err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM insurance_claims WHERE invoice_id = $1 AND status NOT IN ('draft', 'rejected'))`, id).Scan(&sent)
+	if err == nil && sent {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The invoice's insurance claim is with the insurer; it must be rejected before the invoice is voided",
+		})
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM insurance_claims WHERE invoice_id = $1 AND status = 'draft'`, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   "Failed to void invoice",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Invoice voided successfully",
+	})
 }
@@ -0,0 +1,25 @@
+package billing
+
+import "testing"
+
+func TestStatusFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		total string
+		paid  string
+		want  string
+	}{
+		{name: "nothing paid", total: "1000", paid: "0", want: "issued"},
+		{name: "part paid", total: "1000", paid: "400", want: "partially_paid"},
+		{name: "paid in full", total: "1000", paid: "1000", want: "paid"},
+		{name: "zero total", total: "0", paid: "0", want: "issued"},
+		{name: "more than the total", total: "1000", paid: "1200", want: "paid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StatusFor(dec(tt.total), dec(tt.paid)); got != tt.want {
+				t.Errorf("StatusFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// CreditNote takes charges back off an issued invoice, whose lines can no
+// longer change. Its amount comes off what is due on the invoice.
+type CreditNote struct {
+	ID               string          `json:"id"`
+	CreditNoteNumber string          `json:"credit_note_number"`
+	InvoiceID        string          `json:"invoice_id"`
+	Reason           string          `json:"reason"`
+	Subtotal         decimal.Decimal `json:"subtotal"`
+	TaxTotal         decimal.Decimal `json:"tax_total"`
+	Amount           decimal.Decimal `json:"amount"`
+	CreatedBy        string          `json:"created_by"`
+	CreatedAt        time.Time       `json:"created_at"`
+	Lines            []CreditLine    `json:"lines"`
+}
+
+// CreditLine credits part of an invoice line at the price and tax it was
+// charged.
+type CreditLine struct {
+	ID            string          `json:"id"`
+	CreditNoteID  string          `json:"credit_note_id"`
+	InvoiceItemID string          `json:"invoice_item_id"`
+	Description   string          `json:"description"`
+	Quantity      int             `json:"quantity"`
+	UnitPrice     decimal.Decimal `json:"unit_price"`
+	TaxRate       decimal.Decimal `json:"tax_rate"`
+	TaxAmount     decimal.Decimal `json:"tax_amount"`
+	Amount        decimal.Decimal `json:"amount"`
+}
+
+const creditNoteColumns = `id, credit_note_number, invoice_id, reason, subtotal, tax_total, amount, created_by, created_at`
+
+func (n *CreditNote) scanTargets() []any {
+	return []any{&n.ID, &n.CreditNoteNumber, &n.InvoiceID, &n.Reason, &n.Subtotal, &n.TaxTotal, &n.Amount, &n.CreatedBy, &n.CreatedAt}
+}
+
+const creditLineColumns = `id, credit_note_id, invoice_item_id, description, quantity, unit_price, tax_rate, tax_amount, amount`
+
+func (l *CreditLine) scanTargets() []any {
+	return []any{&l.ID, &l.CreditNoteID, &l.InvoiceItemID, &l.Description, &l.Quantity, &l.UnitPrice, &l.TaxRate, &l.TaxAmount, &l.Amount}
+}
+
+func fetchCreditNotes(ctx context.Context, q querier, invoiceID string) ([]CreditNote, error) {
+	rows, err := q.Query(ctx, `SELECT `+creditNoteColumns+` FROM credit_notes WHERE invoice_id = $1 ORDER BY created_at, id`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (CreditNote, error) {
+		var n CreditNote
+		err := row.Scan(n.scanTargets()...)
+		return n, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range notes {
+		rows, err := q.Query(ctx, `SELECT `+creditLineColumns+` FROM credit_note_items WHERE credit_note_id = $1 ORDER BY id`, notes[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		notes[i].Lines, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (CreditLine, error) {
+			var l CreditLine
+			err := row.Scan(l.scanTargets()...)
+			return l, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return notes, nil
+}
+
+// Reversal takes back some of a charge that another module put on an
+// invoice, found by the source it was billed from.
+type Reversal struct {
+	SourceType  string
+	SourceID    string
+	Quantity    int
+	Description string
+}
+
+// Credit is where a reversal was booked: credit lines on the draft that
+// carries the charge, or a credit note against the issued invoice.
+type Credit struct {
+	InvoiceID  string      `json:"invoice_id"`
+	CreditNote *CreditNote `json:"credit_note,omitempty"`
+}
+
+// charge is the invoice line a reversal takes back.
+type charge struct {
+	lineID    string
+	invoiceID string
+	itemType  string
+	unitPrice decimal.Decimal
+	taxRate   decimal.Decimal
+}
+
+// Reverse credits charges on the invoices that carry them, at the price and
+// tax they were charged rather than today's. A charge still on a draft gets a
+// credit line there; charges on an issued invoice are taken back by one
+// credit note against it. Charges that were never billed, or whose invoice
+// was voided, have nothing to reverse.
+func Reverse(ctx context.Context, tx pgx.Tx, reversals []Reversal, reason, staffID string) ([]Credit, error) {
+	var order []string
+	byInvoice := map[string][]Reversal{}
+	charges := map[string]charge{}
+	for _, r := range reversals {
+		var ch charge
+		err := tx.QueryRow(ctx, `SELECT i.id, i.invoice_id, i.item_type, i.unit_price, i.tax_rate FROM invoice_items i
+			JOIN billing b ON b.id = i.invoice_id
+			WHERE i.source_type = $1 AND i.source_id = $2 AND i.quantity > 0 AND b.status <> 'void'`,
+			r.SourceType, r.SourceID).Scan(&ch.lineID, &ch.invoiceID, &ch.itemType, &ch.unitPrice, &ch.taxRate)
+		if err == pgx.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := byInvoice[ch.invoiceID]; !ok {
+			order = append(order, ch.invoiceID)
+		}
+		byInvoice[ch.invoiceID] = append(byInvoice[ch.invoiceID], r)
+		charges[r.SourceType+"/"+r.SourceID] = ch
+	}
+
+	credits := make([]Credit, 0, len(order))
+	for _, invoiceID := range order {
+		var status string
+		err := tx.QueryRow(ctx, `SELECT status FROM billing WHERE id = $1 FOR UPDATE`, invoiceID).Scan(&status)
+		if err != nil {
+			return nil, err
+		}
+		if status == "void" {
+			continue
+		}
+
+		if status == "draft" {
+			var lines []Line
+			for _, r := range byInvoice[invoiceID] {
+				ch := charges[r.SourceType+"/"+r.SourceID]
+				sourceType, sourceID := r.SourceType, r.SourceID
+				lines = append(lines, Line{
+					ItemType: ch.itemType, Description: r.Description, Quantity: -r.Quantity, UnitPrice: ch.unitPrice, TaxRate: ch.taxRate,
+					SourceType: &sourceType, SourceID: &sourceID,
+				})
+			}
+			if err := insertLines(ctx, tx, invoiceID, lines); err != nil {
+				return nil, err
+			}
+			if err := recalculate(ctx, tx, invoiceID); err != nil {
+				return nil, err
+			}
+			credits = append(credits, Credit{InvoiceID: invoiceID})
+			continue
+		}
+
+		n, err := raiseCreditNote(ctx, tx, invoiceID, byInvoice[invoiceID], charges, reason, staffID)
+		if err != nil {
+			return nil, err
+		}
+		credits = append(credits, Credit{InvoiceID: invoiceID, CreditNote: n})
+	}
+	return credits, nil
+}
+
+// raiseCreditNote writes a credit note against a locked, issued invoice and
+// takes it off what is due there.
+func raiseCreditNote(ctx context.Context, tx pgx.Tx, invoiceID string, reversals []Reversal, charges map[string]charge, reason, staffID string) (*CreditNote, error) {
+	n := CreditNote{
+		ID:        uuid.New().String()[:8],
+		InvoiceID: invoiceID,
+		Reason:    reason,
+		CreatedBy: staffID,
+		CreatedAt: time.Now(),
+	}
+	for _, r := range reversals {
+		ch := charges[r.SourceType+"/"+r.SourceID]
+		l := Line{ItemType: ch.itemType, Quantity: r.Quantity, UnitPrice: ch.unitPrice, TaxRate: ch.taxRate}
+		if err := l.compute(); err != nil {
+			return nil, err
+		}
+		n.Lines = append(n.Lines, CreditLine{
+			ID: uuid.New().String()[:8], CreditNoteID: n.ID, InvoiceItemID: ch.lineID, Description: r.Description,
+			Quantity: r.Quantity, UnitPrice: l.UnitPrice, TaxRate: l.TaxRate, TaxAmount: l.TaxAmount, Amount: l.Amount,
+		})
+		n.Subtotal = n.Subtotal.Add(l.Amount)
+		n.TaxTotal = n.TaxTotal.Add(l.TaxAmount)
+	}
+	n.Amount = n.Subtotal.Add(n.TaxTotal)
+
+	err := tx.QueryRow(ctx, `INSERT INTO credit_notes (id, credit_note_number, invoice_id, reason, subtotal, tax_total, amount, created_by, created_at)
+		VALUES ($1, 'CN-' || LPAD(nextval('credit_note_number_seq')::text, 6, '0'), $2, $3, $4, $5, $6, $7, $8)
+		RETURNING credit_note_number`, n.ID, n.InvoiceID, n.Reason, n.Subtotal, n.TaxTotal, n.Amount, n.CreatedBy, n.CreatedAt).
+		Scan(&n.CreditNoteNumber)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range n.Lines {
+		_, err := tx.Exec(ctx, `INSERT INTO credit_note_items (`+creditLineColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, l.scanTargets()...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Exec(ctx, `UPDATE billing SET amount_credited = amount_credited + $1, updated_at = $2 WHERE id = $3`, n.Amount, n.CreatedAt, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	return &n, releaseOverpayment(ctx, tx, invoiceID, staffID)
+}
+
+// releaseOverpayment moves whatever was paid on a locked invoice beyond what
+// is now due back onto its payments as credit, most recent payment first,
+// and brings the invoice's status in line.
+func releaseOverpayment(ctx context.Context, tx pgx.Tx, invoiceID, staffID string) error {
+	var over decimal.Decimal
+	err := tx.QueryRow(ctx, `SELECT amount_paid - (amount - amount_credited) FROM billing WHERE id = $1`, invoiceID).Scan(&over)
+	if err != nil {
+		return err
+	}
+	if over.IsPositive() {
+		rows, err := tx.Query(ctx, `SELECT payment_id, SUM(amount) FROM payment_allocations WHERE invoice_id = $1
+			GROUP BY payment_id HAVING SUM(amount) > 0 ORDER BY MAX(created_at) DESC`, invoiceID)
+		if err != nil {
+			return err
+		}
+		type applied struct {
+			paymentID string
+			amount    decimal.Decimal
+		}
+		paid, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (applied, error) {
+			var a applied
+			err := row.Scan(&a.paymentID, &a.amount)
+			return a, err
+		})
+		if err != nil {
+			return err
+		}
+		for _, a := range paid {
+			if !over.IsPositive() {
+				break
+			}
+			take := decimal.Min(a.amount, over)
+			if err := insertAllocation(ctx, tx, a.paymentID, invoiceID, take.Neg(), nil, staffID); err != nil {
+				return err
+			}
+			over = over.Sub(take)
+		}
+	}
+	return applyToInvoice(ctx, tx, invoiceID, decimal.Zero)
+}
@@ -0,0 +1,150 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/mailer"
+	"web-service/internal/mailer/filesink"
+	"web-service/internal/mailer/smtp"
+	"web-service/internal/middleware"
+	"web-service/internal/pdfdoc"
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	mailerOnce sync.Once
+	outbox     mailer.Mailer
+)
+
+// mailOut is how invoices and receipts reach patients: MAILER=smtp sends them
+// through SMTP_HOST, anything else writes them to MAIL_DIR.
+func mailOut() mailer.Mailer {
+	mailerOnce.Do(func() {
+		switch config.GetVal("MAILER") {
+		case "smtp":
+			outbox = smtp.FromConfig()
+		default:
+			outbox = filesink.FromConfig()
+		}
+	})
+	return outbox
+}
+
+// sendDocument emails a PDF to the patient's address on file, or to to, and
+// answers with where it went. Only a supervisor may send it anywhere else.
+func sendDocument(c *fiber.Ctx, patientID, to, subject, body, filename string, pdf []byte) error {
+	ctx := context.Background()
+	var onFile string
+	database.GetDB().QueryRow(ctx, `SELECT email FROM patients WHERE id = $1`, patientID).Scan(&onFile)
+	if to == "" {
+		to = onFile
+	} else if !strings.EqualFold(strings.TrimSpace(to), onFile) && !middleware.HasRole(c, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only a supervisor can send to an address other than the patient's",
+		})
+	}
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A valid email address is needed, in to or on the patient's record",
+		})
+	}
+	clinic, _, _ := pdfdoc.Clinic()
+	from := config.GetVal("MAIL_FROM")
+	if from == "" {
+		from = (&mail.Address{Name: clinic, Address: "billing@localhost"}).String()
+	}
+	m := mailOut()
+	err = m.Send(ctx, mailer.Message{
+		From:    from,
+		To:      addr.String(),
+		Subject: subject,
+		Body:    fmt.Sprintf("%s\n\nRegards,\n%s\n", body, clinic),
+		Attachments: []mailer.Attachment{
+			{Filename: filename, ContentType: "application/pdf", Data: pdf},
+		},
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "The email could not be sent",
+			"details": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Email sent",
+		"to": addr.Address,
+		"mailer": m.Name(),
+	})
+}
+
+type emailRequest struct {
+	To string `json:"to"`
+}
+
+// EmailInvoice sends an issued invoice's PDF to the patient.
+func EmailInvoice(c *fiber.Ctx) error {
+	var req emailRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid input:",
+				"details": err.Error(),
+			})
+		}
+	}
+	inv, err := Fetch(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invoice not found",
+		})
+	}
+	if inv.Status == "draft" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Issue the invoice before sending it",
+		})
+	}
+	pdf, err := invoicePDF(context.Background(), database.GetDB(), inv)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	body := fmt.Sprintf("Dear %s,\n\nPlease find attached invoice %s for %s.", inv.PatientName, *inv.InvoiceNumber, money(inv.Total))
+	if inv.Status != "void" && inv.PatientBalance.IsPositive() {
+		body += fmt.Sprintf(" The balance due from you is %s.\n\n%s", money(inv.PatientBalance), paymentInstructions(*inv.InvoiceNumber))
+	}
+	return sendDocument(c, inv.PatientID, req.To, "Invoice "+*inv.InvoiceNumber, body, invoiceFilename(inv), pdf)
+}
+
+// EmailReceipt sends a payment's receipt PDF to the patient.
+func EmailReceipt(c *fiber.Ctx) error {
+	var req emailRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid input:",
+				"details": err.Error(),
+			})
+		}
+	}
+	y, err := FetchPayment(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payment not found",
+		})
+	}
+	pdf, err := receiptPDF(context.Background(), database.GetDB(), y)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	body := fmt.Sprintf("Dear %s,\n\nThank you for your payment of %s. Your receipt %s is attached.", y.PatientName, money(y.Amount), y.ReceiptNumber)
+	return sendDocument(c, y.PatientID, req.To, "Receipt "+y.ReceiptNumber, body, y.ReceiptNumber+".pdf", pdf)
+}
@@ -0,0 +1,167 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+
+	"web-service/database"
+	"web-service/internal/pdfdoc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/shopspring/decimal"
+)
+
+// invoiceFilename names an invoice's PDF after its number, or its id while
+// it is still a draft.
+func invoiceFilename(inv *Invoice) string {
+	if inv.InvoiceNumber != nil {
+		return *inv.InvoiceNumber + ".pdf"
+	}
+	return "draft-" + inv.ID + ".pdf"
+}
+
+// invoicePDF renders an invoice with its lines, tax by rate, the credit notes
+// raised against it, the payments made against it with the balance after
+// each, and how to pay what is left.
+func invoicePDF(ctx context.Context, q querier, inv *Invoice) ([]byte, error) {
+	title := "Invoice " + deref(inv.InvoiceNumber)
+	switch inv.Status {
+	case "draft":
+		title = "Draft invoice"
+	case "void":
+		title += " (VOID)"
+	}
+	var priceList string
+	q.QueryRow(ctx, `SELECT name FROM price_lists WHERE id = $1`, inv.PriceListID).Scan(&priceList)
+
+	date := inv.CreatedAt
+	if inv.IssuedAt != nil {
+		date = *inv.IssuedAt
+	}
+	due := "-"
+	if inv.DueDate != nil {
+		due = inv.DueDate.Format("02 Jan 2006")
+	}
+	doc := pdfdoc.New(title)
+	info := [][2]string{
+		{"Invoice number", deref(inv.InvoiceNumber)},
+		{"Date", date.Format("02 Jan 2006")},
+		{"Patient", inv.PatientName},
+		{"Patient ID", inv.PatientID},
+		{"Phone", inv.PhoneNumber},
+		{"Due date", due},
+		{"Price list", priceList},
+	}
+	if inv.SchemeID != nil {
+		var insurer, member string
+		err := q.QueryRow(ctx, `SELECT py.name || ' - ' || s.name, pi.member_number FROM insurance_schemes s
+			JOIN insurance_payers py ON py.id = s.payer_id
+			JOIN patient_insurance pi ON pi.id = $2
+			WHERE s.id = $1`, *inv.SchemeID, inv.InsuranceID).Scan(&insurer, &member)
+		if err != nil {
+			return nil, err
+		}
+		info = append(info, [2]string{"Insurer", insurer}, [2]string{"Member number", member})
+	}
+	doc.KeyValues(info)
+
+	// Lines, with taxable amounts and tax gathered by rate as they go
+	var rows [][]string
+	var rates []string
+	taxable := map[string]decimal.Decimal{}
+	tax := map[string]decimal.Decimal{}
+	for _, l := range inv.Lines {
+		rate := l.TaxRate.String()
+		rows = append(rows, []string{l.Description, fmt.Sprint(l.Quantity), money(l.UnitPrice), money(l.Discount), rate, money(l.TaxAmount),
+			money(l.Amount.Add(l.TaxAmount))})
+		if _, ok := taxable[rate]; !ok {
+			rates = append(rates, rate)
+		}
+		taxable[rate] = taxable[rate].Add(l.Amount)
+		tax[rate] = tax[rate].Add(l.TaxAmount)
+	}
+	doc.Table([]string{"Description", "Qty", "Unit price", "Discount", "Tax %", "Tax", "Amount"},
+		[]float64{66, 14, 24, 20, 14, 20, 22}, []string{"L", "R", "R", "R", "R", "R", "R"}, rows)
+
+	if inv.TaxTotal.IsPositive() {
+		rows = rows[:0]
+		for _, rate := range rates {
+			rows = append(rows, []string{rate + "%", money(taxable[rate]), money(tax[rate])})
+		}
+		doc.Heading("Tax")
+		doc.Table([]string{"Rate", "Taxable amount", "Tax"}, []float64{100, 40, 40}, []string{"L", "R", "R"}, rows)
+	}
+
+	rows = [][]string{
+		{"Subtotal", money(inv.Subtotal)},
+		{"Discount", money(inv.DiscountTotal.Neg())},
+		{"Tax", money(inv.TaxTotal)},
+		{"Total", money(inv.Total)},
+	}
+	if inv.SchemeID != nil {
+		rows = append(rows, []string{"Insurer's share", money(inv.InsurerShare)}, []string{"Patient's share", money(inv.PatientShare)})
+	}
+	if inv.AmountCredited.IsPositive() {
+		rows = append(rows, []string{"Credited", money(inv.AmountCredited.Neg())})
+	}
+	rows = append(rows, []string{"Paid", money(inv.AmountPaid)}, []string{"Balance due", money(inv.Balance)})
+	doc.Table([]string{"", "Amount"}, []float64{140, 40}, []string{"R", "R"}, rows)
+
+	if len(inv.CreditNotes) > 0 {
+		rows = rows[:0]
+		for _, n := range inv.CreditNotes {
+			rows = append(rows, []string{n.CreatedAt.Format("02 Jan 2006"), n.CreditNoteNumber, n.Reason, money(n.Amount)})
+		}
+		doc.Heading("Credit notes")
+		doc.Table([]string{"Date", "Credit note", "Reason", "Amount"}, []float64{30, 40, 80, 30}, []string{"L", "L", "L", "R"}, rows)
+	}
+
+	// Payments in the order they were applied; refunds and voids taken back
+	// off the invoice raise the balance again
+	if len(inv.Payments) > 0 {
+		rows = rows[:0]
+		balance := inv.Total.Sub(inv.AmountCredited)
+		for _, a := range inv.Payments {
+			balance = balance.Sub(a.Amount)
+			rows = append(rows, []string{a.CreatedAt.Format("02 Jan 2006"), a.ReceiptNumber, methodLabels[a.Method], money(a.Amount), money(balance)})
+		}
+		doc.Heading("Payments")
+		doc.Table([]string{"Date", "Receipt", "Method", "Amount", "Balance"}, []float64{30, 40, 40, 35, 35}, []string{"L", "L", "L", "R", "R"}, rows)
+	}
+
+	switch {
+	case inv.Status == "void":
+		doc.Paragraph("Voided", fmt.Sprintf("This invoice was voided on %s: %s", inv.VoidedAt.Format("02 Jan 2006 15:04"), deref(inv.VoidReason)))
+	case inv.Status == "draft":
+		doc.Paragraph("Draft", "This invoice has not been issued yet and its charges may change.")
+	case inv.PatientBalance.IsPositive():
+		text := paymentInstructions(*inv.InvoiceNumber)
+		if inv.InsurerBalance.IsPositive() {
+			text = fmt.Sprintf("%s of the balance is due from your insurer. %s", money(inv.InsurerBalance), text)
+		}
+		doc.Paragraph("How to pay", text)
+	case inv.InsurerBalance.IsPositive():
+		doc.Paragraph("Balance due", fmt.Sprintf("The balance of %s is due from your insurer.", money(inv.InsurerBalance)))
+	}
+	if inv.Notes != nil {
+		doc.Paragraph("Notes", *inv.Notes)
+	}
+	return doc.Bytes()
+}
+
+func GetInvoicePDF(c *fiber.Ctx) error {
+	inv, err := Fetch(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invoice not found",
+		})
+	}
+	body, err := invoicePDF(context.Background(), database.GetDB(), inv)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="%s"`, invoiceFilename(inv)))
+	return c.Send(body)
+}
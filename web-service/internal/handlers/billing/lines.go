@@ -0,0 +1,229 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"web-service/internal/handlers/tariff"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// Line is a priced entry on an invoice. A negative quantity credits the
+// patient, e.g. for returned medicines. Amount is the line total after
+// discount and before tax.
+type Line struct {
+	ID          string          `json:"id"`
+	InvoiceID   string          `json:"invoice_id"`
+	ItemType    string          `json:"item_type"`
+	Description string          `json:"description"`
+	Quantity    int             `json:"quantity"`
+	UnitPrice   decimal.Decimal `json:"unit_price"`
+	Discount    decimal.Decimal `json:"discount"`
+	TaxRate     decimal.Decimal `json:"tax_rate"`
+	TaxAmount   decimal.Decimal `json:"tax_amount"`
+	Amount      decimal.Decimal `json:"amount"`
+	SourceType  *string         `json:"source_type,omitempty"`
+	SourceID    *string         `json:"source_id,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+const lineColumns = `id, invoice_id, item_type, description, quantity, unit_price, discount, tax_rate, tax_amount, amount, source_type, source_id, created_at`
+
+func (l *Line) scanTargets() []any {
+	return []any{&l.ID, &l.InvoiceID, &l.ItemType, &l.Description, &l.Quantity, &l.UnitPrice, &l.Discount, &l.TaxRate, &l.TaxAmount, &l.Amount,
+		&l.SourceType, &l.SourceID, &l.CreatedAt}
+}
+
+var itemTypes = map[string]bool{"consultation": true, "lab": true, "medicine": true, "procedure": true}
+
+// ErrInvalidLine is returned for lines that cannot be priced.
+var ErrInvalidLine = errors.New("invalid invoice line")
+
+var hundred = decimal.NewFromInt(100)
+
+// compute works out the line amount and tax in exact decimals, rounding
+// money to cents.
+func (l *Line) compute() error {
+	if !itemTypes[l.ItemType] {
+		return fmt.Errorf("%w: item_type must be consultation, lab, medicine or procedure", ErrInvalidLine)
+	}
+	if l.Quantity == 0 {
+		return fmt.Errorf("%w: quantity cannot be zero", ErrInvalidLine)
+	}
+	if l.UnitPrice.IsNegative() || l.Discount.IsNegative() || l.TaxRate.IsNegative() {
+		return fmt.Errorf("%w: prices, discounts and tax rates cannot be negative", ErrInvalidLine)
+	}
+	l.UnitPrice = l.UnitPrice.Round(2)
+	l.Discount = l.Discount.Round(2)
+	gross := l.UnitPrice.Mul(decimal.NewFromInt(int64(l.Quantity)))
+	if l.Discount.IsPositive() && (l.Quantity < 0 || l.Discount.GreaterThan(gross)) {
+		return fmt.Errorf("%w: discount cannot exceed the line total", ErrInvalidLine)
+	}
+	l.Amount = gross.Sub(l.Discount)
+	l.TaxAmount = l.Amount.Mul(l.TaxRate).Div(hundred).Round(2)
+	return nil
+}
+
+func fetchLines(ctx context.Context, q querier, invoiceID string) ([]Line, error) {
+	rows, err := q.Query(ctx, `SELECT `+lineColumns+` FROM invoice_items WHERE invoice_id = $1 ORDER BY created_at, id`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Line, error) {
+		var l Line
+		err := row.Scan(l.scanTargets()...)
+		return l, err
+	})
+}
+
+// insertLines prices and stores lines on an invoice the caller has locked.
+func insertLines(ctx context.Context, tx pgx.Tx, invoiceID string, lines []Line) error {
+	now := time.Now()
+	for i := range lines {
+		l := &lines[i]
+		if err := l.compute(); err != nil {
+			return err
+		}
+		l.ID = uuid.New().String()[:8]
+		l.InvoiceID = invoiceID
+		l.CreatedAt = now
+		_, err := tx.Exec(ctx, `INSERT INTO invoice_items (`+lineColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+			l.scanTargets()...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// priceFromList prices lines on an invoice from its price list, at the
+// prices in effect when each line was added; with no line ids, every line
+// is repriced. Credits take the price of the charge they reverse when it is
+// on the same invoice. Lines for items the tariff no longer prices keep
+// their price.
+func priceFromList(ctx context.Context, tx pgx.Tx, invoiceID string, lineIDs []string) error {
+	var listID string
+	err := tx.QueryRow(ctx, `SELECT price_list_id FROM billing WHERE id = $1`, invoiceID).Scan(&listID)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(ctx, `SELECT i.id, i.item_type, i.quantity, i.discount, `+lineItem+`, i.created_at FROM invoice_items i
+		WHERE i.invoice_id = $1 AND i.quantity > 0 AND (COALESCE(cardinality($2::text[]), 0) = 0 OR i.id = ANY($2))`, invoiceID, lineIDs)
+	if err != nil {
+		return err
+	}
+	var itemIDs []string
+	lines, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Line, error) {
+		var l Line
+		var itemID string
+		err := row.Scan(&l.ID, &l.ItemType, &l.Quantity, &l.Discount, &itemID, &l.CreatedAt)
+		itemIDs = append(itemIDs, itemID)
+		return l, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range lines {
+		l := &lines[i]
+		p, err := tariff.Lookup(ctx, tx, listID, l.ItemType, itemIDs[i], l.CreatedAt)
+		if errors.Is(err, tariff.ErrUnknownItem) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		l.UnitPrice, l.TaxRate = p.UnitPrice, p.TaxRate
+		// A discount given against a higher price cannot exceed the new total
+		l.Discount = decimal.Min(l.Discount, p.UnitPrice.Round(2).Mul(decimal.NewFromInt(int64(l.Quantity))))
+		if err := l.compute(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `UPDATE invoice_items SET unit_price = $1, discount = $2, tax_rate = $3, tax_amount = $4, amount = $5 WHERE id = $6`,
+			l.UnitPrice, l.Discount, l.TaxRate, l.TaxAmount, l.Amount, l.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE invoice_items c SET unit_price = o.unit_price, tax_rate = o.tax_rate,
+			amount = c.quantity * o.unit_price - c.discount, tax_amount = ROUND((c.quantity * o.unit_price - c.discount) * o.tax_rate / 100, 2)
+		FROM invoice_items o
+		WHERE c.invoice_id = $1 AND c.quantity < 0 AND (COALESCE(cardinality($2::text[]), 0) = 0 OR c.id = ANY($2))
+			AND o.invoice_id = c.invoice_id AND o.quantity > 0 AND o.source_type = c.source_type AND o.source_id = c.source_id`,
+		invoiceID, lineIDs)
+	return err
+}
+
+// recalculate refreshes an invoice's totals from its lines, and the
+// insurer's share of them.
+func recalculate(ctx context.Context, tx pgx.Tx, invoiceID string) error {
+	_, err := tx.Exec(ctx, `UPDATE billing b SET subtotal = t.subtotal, discount_total = t.discount, tax_total = t.tax,
+			amount = t.subtotal - t.discount + t.tax, updated_at = $2
+		FROM (SELECT COALESCE(SUM(quantity * unit_price), 0) AS subtotal, COALESCE(SUM(discount), 0) AS discount,
+				COALESCE(SUM(tax_amount), 0) AS tax
+			FROM invoice_items WHERE invoice_id = $1) t
+		WHERE b.id = $1`, invoiceID, time.Now())
+	if err != nil {
+		return err
+	}
+	return applySplit(ctx, tx, invoiceID)
+}
+
+// ErrUnknownPatient is returned when opening an invoice for a patient who is
+// not registered.
+var ErrUnknownPatient = errors.New("patient not found")
+
+// OpenInvoice returns the patient's draft invoice, opening one if there is
+// none, and locks it for the rest of the transaction.
+func OpenInvoice(ctx context.Context, tx pgx.Tx, patientID string) (string, error) {
+	// Serialise per patient so concurrent callers share one draft
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('invoice:' || $1))`, patientID); err != nil {
+		return "", err
+	}
+
+	var id string
+	err := tx.QueryRow(ctx, `SELECT id FROM billing WHERE patient_id=$1 AND status='draft'
+		ORDER BY created_at DESC LIMIT 1 FOR UPDATE`, patientID).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != pgx.ErrNoRows {
+		return "", err
+	}
+
+	id = uuid.New().String()[:8]
+	tag, err := tx.Exec(ctx, `INSERT INTO billing (id, patient_id, phone_number, amount, status, created_at, updated_at)
+		SELECT $1, id, phone_number, 0, 'draft', $2, $2 FROM patients WHERE id=$3`, id, time.Now(), patientID)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", fmt.Errorf("%w: %s", ErrUnknownPatient, patientID)
+	}
+	return id, nil
+}
+
+// AddLines puts the lines on the patient's open invoice, prices them from
+// its price list and updates its total.
+func AddLines(ctx context.Context, tx pgx.Tx, patientID string, lines []Line) (string, error) {
+	invoiceID, err := OpenInvoice(ctx, tx, patientID)
+	if err != nil {
+		return "", err
+	}
+	if err := insertLines(ctx, tx, invoiceID, lines); err != nil {
+		return "", err
+	}
+	ids := make([]string, len(lines))
+	for i, l := range lines {
+		ids[i] = l.ID
+	}
+	if err := priceFromList(ctx, tx, invoiceID, ids); err != nil {
+		return "", err
+	}
+	return invoiceID, recalculate(ctx, tx, invoiceID)
+}
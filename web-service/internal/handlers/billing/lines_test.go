@@ -0,0 +1,113 @@
+package billing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func dec(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func TestLineCompute(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      Line
+		unitPrice string
+		amount    string
+		tax       string
+		wantErr   bool
+	}{
+		{
+			name:      "untaxed",
+			line:      Line{ItemType: "consultation", Quantity: 1, UnitPrice: dec("1500")},
+			unitPrice: "1500", amount: "1500", tax: "0",
+		},
+		{
+			name:      "tax rounded to cents",
+			line:      Line{ItemType: "medicine", Quantity: 3, UnitPrice: dec("11.11"), TaxRate: dec("16")},
+			unitPrice: "11.11", amount: "33.33", tax: "5.33",
+		},
+		{
+			name:      "tax half a cent rounds up",
+			line:      Line{ItemType: "medicine", Quantity: 1, UnitPrice: dec("0.25"), TaxRate: dec("2")},
+			unitPrice: "0.25", amount: "0.25", tax: "0.01",
+		},
+		{
+			name:      "unit price rounded to cents",
+			line:      Line{ItemType: "procedure", Quantity: 2, UnitPrice: dec("10.005")},
+			unitPrice: "10.01", amount: "20.02", tax: "0",
+		},
+		{
+			name:      "discount before tax",
+			line:      Line{ItemType: "lab", Quantity: 2, UnitPrice: dec("500"), Discount: dec("100"), TaxRate: dec("16")},
+			unitPrice: "500", amount: "900", tax: "144",
+		},
+		{
+			name:      "discount equal to the line total",
+			line:      Line{ItemType: "lab", Quantity: 1, UnitPrice: dec("500"), Discount: dec("500"), TaxRate: dec("16")},
+			unitPrice: "500", amount: "0", tax: "0",
+		},
+		{
+			name:      "negative quantity credits with tax",
+			line:      Line{ItemType: "medicine", Quantity: -2, UnitPrice: dec("50"), TaxRate: dec("16")},
+			unitPrice: "50", amount: "-100", tax: "-16",
+		},
+		{
+			name:    "discount above the line total",
+			line:    Line{ItemType: "lab", Quantity: 1, UnitPrice: dec("500"), Discount: dec("500.01")},
+			wantErr: true,
+		},
+		{
+			name:    "discount on a credit line",
+			line:    Line{ItemType: "medicine", Quantity: -1, UnitPrice: dec("50"), Discount: dec("5")},
+			wantErr: true,
+		},
+		{
+			name:    "zero quantity",
+			line:    Line{ItemType: "medicine", Quantity: 0, UnitPrice: dec("50")},
+			wantErr: true,
+		},
+		{
+			name:    "negative price",
+			line:    Line{ItemType: "medicine", Quantity: 1, UnitPrice: dec("-50")},
+			wantErr: true,
+		},
+		{
+			name:    "negative tax rate",
+			line:    Line{ItemType: "medicine", Quantity: 1, UnitPrice: dec("50"), TaxRate: dec("-16")},
+			wantErr: true,
+		},
+		{
+			name:    "unknown item type",
+			line:    Line{ItemType: "bed", Quantity: 1, UnitPrice: dec("50")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tt.line
+			err := l.compute()
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidLine) {
+					t.Fatalf("compute() error = %v, want ErrInvalidLine", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compute() error = %v", err)
+			}
+			if !l.UnitPrice.Equal(dec(tt.unitPrice)) {
+				t.Errorf("UnitPrice = %s, want %s", l.UnitPrice, tt.unitPrice)
+			}
+			if !l.Amount.Equal(dec(tt.amount)) {
+				t.Errorf("Amount = %s, want %s", l.Amount, tt.amount)
+			}
+			if !l.TaxAmount.Equal(dec(tt.tax)) {
+				t.Errorf("TaxAmount = %s, want %s", l.TaxAmount, tt.tax)
+			}
+		})
+	}
+}
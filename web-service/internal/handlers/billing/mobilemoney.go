@@ -0,0 +1,407 @@
+package billing
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/middleware"
+	"web-service/internal/payprovider"
+	"web-service/internal/payprovider/mpesa"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	providerOnce sync.Once
+	provider     payprovider.Provider
+)
+
+// mobileMoney is the provider patients pay through from their phones. The
+// client is shared so its access token is reused between requests.
+func mobileMoney() payprovider.Provider {
+	providerOnce.Do(func() {
+		provider = mpesa.FromConfig()
+	})
+	return provider
+}
+
+type MobilePayment struct {
+	ID                string          `json:"id"`
+	Provider          string          `json:"provider"`
+	InvoiceID         string          `json:"invoice_id"`
+	PatientID         string          `json:"patient_id"`
+	PhoneNumber       string          `json:"phone_number"`
+	Amount            decimal.Decimal `json:"amount"`
+	CheckoutID        string          `json:"checkout_id"`
+	Status            string          `json:"status"`
+	ResultCode        *string         `json:"result_code,omitempty"`
+	ResultDescription *string         `json:"result_description,omitempty"`
+	ProviderReceipt   *string         `json:"provider_receipt,omitempty"`
+	PaymentID         *string         `json:"payment_id,omitempty"`
+	RequestedBy       string          `json:"requested_by"`
+	CreatedAt         time.Time       `json:"created_at"`
+	CompletedAt       *time.Time      `json:"completed_at,omitempty"`
+}
+
+const mobilePaymentColumns = `id, provider, invoice_id, patient_id, phone_number, amount, checkout_id, status, result_code, result_description,
+	provider_receipt, payment_id, requested_by, created_at, completed_at`
+
+func (m *MobilePayment) scanTargets() []any {
+	return []any{&m.ID, &m.Provider, &m.InvoiceID, &m.PatientID, &m.PhoneNumber, &m.Amount, &m.CheckoutID, &m.Status, &m.ResultCode, &m.ResultDescription,
+		&m.ProviderReceipt, &m.PaymentID, &m.RequestedBy, &m.CreatedAt, &m.CompletedAt}
+}
+
+// RequestMobilePayment prompts the patient's phone to pay an invoice's
+// balance, or part of it. The outcome arrives on the callback.
+func RequestMobilePayment(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		PhoneNumber string          `json:"phone_number"`
+		Amount      decimal.Decimal `json:"amount"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	inv, err := Fetch(ctx, database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Invoice not found",
+		})
+	}
+	if (inv.Status != "issued" && inv.Status != "partially_paid") || !inv.PatientBalance.IsPositive() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only issued invoices with a balance due from the patient can be paid",
+		})
+	}
+	// Mobile money moves whole shillings, so the patient is asked for the
+	// balance rounded up; anything over it stays on the payment as credit
+	due := inv.PatientBalance.Ceil()
+	if req.Amount.IsZero() {
+		req.Amount = due
+	}
+	req.Amount = req.Amount.Ceil()
+	if !req.Amount.IsPositive() || req.Amount.GreaterThan(due) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "amount must be positive and no more than the balance of " + money(due),
+		})
+	}
+	if req.PhoneNumber == "" {
+		req.PhoneNumber = inv.PhoneNumber
+	}
+	phone, err := mpesa.NormalisePhone(req.PhoneNumber)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialise requests per invoice so the patient is never prompted twice
+	// for the same bill
+	var pending bool
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('mobile_money:' || $1))`, inv.ID)
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM mobile_money_requests WHERE invoice_id = $1 AND status = 'pending')`, inv.ID).
+			Scan(&pending)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check for pending payment requests",
+			"details": err.Error(),
+		})
+	}
+	if pending {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A payment request for this invoice is still waiting for the patient",
+		})
+	}
+
+	p := mobileMoney()
+	sent, err := p.Request(ctx, payprovider.Request{
+		PhoneNumber: phone, Amount: req.Amount, Reference: deref(inv.InvoiceNumber), Description: "Medical bill",
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "The payment request could not be sent",
+			"details": err.Error(),
+		})
+	}
+
+	m := MobilePayment{
+		ID:          uuid.New().String()[:8],
+		Provider:    p.Name(),
+		InvoiceID:   inv.ID,
+		PatientID:   inv.PatientID,
+		PhoneNumber: phone,
+		Amount:      req.Amount,
+		CheckoutID:  sent.CheckoutID,
+		Status:      "pending",
+		RequestedBy: middleware.CurrentUserID(c),
+		CreatedAt:   time.Now(),
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO mobile_money_requests (id, provider, invoice_id, patient_id, phone_number, amount, checkout_id,
+			merchant_request_id, status, requested_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		m.ID, m.Provider, m.InvoiceID, m.PatientID, m.PhoneNumber, m.Amount, m.CheckoutID, sent.MerchantRequestID, m.Status, m.RequestedBy, m.CreatedAt)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_mobile_money_requests_pending_invoice" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A payment request for this invoice is still waiting for the patient",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save payment request",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": sent.Message,
+		"request": m,
+	})
+}
+
+// GetMobilePayment lets the billing desk follow a request until the patient
+// has answered it.
+func GetMobilePayment(c *fiber.Ctx) error {
+	var m MobilePayment
+	err := database.GetDB().QueryRow(context.Background(), `SELECT `+mobilePaymentColumns+` FROM mobile_money_requests WHERE id = $1`,
+		c.Params("id")).Scan(m.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payment request not found",
+		})
+	}
+	return c.JSON(m)
+}
+
+// reconcile applies a provider's result to its request. Results for
+// requests that are already completed or failed are ignored, so repeated
+// callbacks are harmless. A request that timed out still takes a late
+// success, as the patient has paid.
+func reconcile(ctx context.Context, p payprovider.Provider, res *payprovider.Result) error {
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var m MobilePayment
+	err = tx.QueryRow(ctx, `SELECT `+mobilePaymentColumns+` FROM mobile_money_requests WHERE provider = $1 AND checkout_id = $2 FOR UPDATE`,
+		p.Name(), res.CheckoutID).Scan(m.scanTargets()...)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("no payment request with checkout id %s", res.CheckoutID)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE mobile_money_requests SET callback_count = callback_count + 1 WHERE id = $1`, m.ID); err != nil {
+		return err
+	}
+	if m.Status == "completed" || m.Status == "failed" || res.Status == payprovider.StatusPending {
+		return tx.Commit(ctx)
+	}
+
+	now := time.Now()
+	if res.Status == payprovider.StatusFailed {
+		_, err = tx.Exec(ctx, `UPDATE mobile_money_requests SET status = 'failed', result_code = $1, result_description = $2, completed_at = $3
+			WHERE id = $4`, res.ResultCode, res.Description, now, m.ID)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		return err
+	}
+
+	// Queries do not return the provider's receipt; the checkout id stands in
+	receipt := res.Receipt
+	if receipt == "" {
+		receipt = res.CheckoutID
+	}
+	// The payer approves the amount that was requested, so that is what is
+	// recorded whatever a callback claims
+	paymentID, err := payMobile(ctx, tx, &m, m.Amount, receipt)
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE mobile_money_requests SET status = 'completed', result_code = $1, result_description = $2,
+				provider_receipt = $3, payment_id = $4, completed_at = $5
+			WHERE id = $6`, res.ResultCode, res.Description, receipt, paymentID, now, m.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	return err
+}
+
+// payMobile records the money received against the request's invoice, up
+// to what the patient owes on it; anything over pays the patient's other
+// invoices or stays as credit. A receipt already recorded, e.g. keyed in by
+// the cashier, is linked rather than recorded twice.
+func payMobile(ctx context.Context, tx pgx.Tx, m *MobilePayment, amount decimal.Decimal, receipt string) (string, error) {
+	var paymentID string
+	err := tx.QueryRow(ctx, `SELECT id FROM payments WHERE method = 'mobile_money' AND reference = $1 AND status <> 'void'`, receipt).Scan(&paymentID)
+	if err == nil {
+		return paymentID, nil
+	}
+	if err != pgx.ErrNoRows {
+		return "", err
+	}
+
+	_, status, due, err := invoiceDue(ctx, tx, m.InvoiceID, false)
+	if err != nil {
+		return "", err
+	}
+	var allocations []AllocationRequest
+	if (status == "issued" || status == "partially_paid") && due.IsPositive() {
+		allocations = []AllocationRequest{{InvoiceID: m.InvoiceID, Amount: decimal.Min(amount, due)}}
+	}
+	notes := fmt.Sprintf("%s payment from %s", m.Provider, m.PhoneNumber)
+	return RecordPayment(ctx, tx, PaymentInput{
+		PatientID: m.PatientID, Method: "mobile_money", Amount: amount, Reference: &receipt, Notes: &notes, StaffID: m.RequestedBy,
+	}, allocations)
+}
+
+// confirm asks the provider for the outcome a callback reports, so a forged
+// callback cannot record a payment. Only the provider's receipt, which
+// queries do not return, is taken from the callback.
+func confirm(ctx context.Context, p payprovider.Provider, res *payprovider.Result) (*payprovider.Result, error) {
+	confirmed, err := p.Query(ctx, res.CheckoutID)
+	if err != nil {
+		return nil, err
+	}
+	if confirmed.Status != res.Status {
+		return nil, fmt.Errorf("callback for %s reports %s but the provider reports %s", res.CheckoutID, res.Status, confirmed.Status)
+	}
+	if confirmed.Status == payprovider.StatusCompleted && confirmed.Receipt == "" {
+		confirmed.Receipt = res.Receipt
+	}
+	return confirmed, nil
+}
+
+// MobileMoneyCallback receives results from the provider. Callbacks are
+// refused until MPESA_CALLBACK_TOKEN is set, and each result is confirmed
+// with the provider before it is applied. Otherwise it always acknowledges,
+// as the provider does not act on errors; results that cannot be matched or
+// confirmed are logged, and the pending check picks them up later.
+func MobileMoneyCallback(c *fiber.Ctx) error {
+	token := config.GetVal("MPESA_CALLBACK_TOKEN")
+	if token == "" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Mobile money callbacks are not configured",
+		})
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.Query("token"))) != 1 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid callback token",
+		})
+	}
+	ctx := context.Background()
+	p := mobileMoney()
+	res, err := p.ParseCallback(c.Body())
+	if err == nil && res.Status != payprovider.StatusPending {
+		res, err = confirm(ctx, p, res)
+	}
+	if err == nil {
+		err = reconcile(ctx, p, res)
+	}
+	if err != nil {
+		log.Printf("Mobile money callback not applied: %v", err)
+	}
+	return c.JSON(fiber.Map{
+		"ResultCode": 0,
+		"ResultDesc": "Accepted",
+	})
+}
+
+func mobileMoneyTimeout() time.Duration {
+	d, err := time.ParseDuration(config.GetVal("MPESA_TIMEOUT"))
+	if err != nil || d <= 0 {
+		return 2 * time.Minute
+	}
+	return d
+}
+
+// CheckPendingMobilePayments asks the provider about requests that have
+// had no callback within MPESA_TIMEOUT, and times out those still
+// unanswered.
+func CheckPendingMobilePayments(ctx context.Context) (int, error) {
+	p := mobileMoney()
+	rows, err := database.GetDB().Query(ctx, `SELECT checkout_id FROM mobile_money_requests
+		WHERE status = 'pending' AND provider = $1 AND created_at < $2`, p.Name(), time.Now().Add(-mobileMoneyTimeout()))
+	if err != nil {
+		return 0, err
+	}
+	checkoutIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	timedOut := 0
+	for _, id := range checkoutIDs {
+		res, err := p.Query(ctx, id)
+		if err != nil {
+			log.Printf("Mobile money status query for %s failed: %v", id, err)
+			res = &payprovider.Result{CheckoutID: id, Status: payprovider.StatusPending}
+		}
+		if res.Status != payprovider.StatusPending {
+			if err := reconcile(ctx, p, res); err != nil {
+				log.Printf("Mobile money result for %s not applied: %v", id, err)
+			}
+			continue
+		}
+		tag, err := database.GetDB().Exec(ctx, `UPDATE mobile_money_requests SET status = 'timed_out', result_description = $1, completed_at = $2
+			WHERE provider = $3 AND checkout_id = $4 AND status = 'pending'`, "No response from the payer", time.Now(), p.Name(), id)
+		if err != nil {
+			return timedOut, err
+		}
+		timedOut += int(tag.RowsAffected())
+	}
+	return timedOut, nil
+}
+
+// StartMobileMoneyJob checks pending requests every MPESA_CHECK_INTERVAL
+// (30s by default) until ctx is cancelled.
+func StartMobileMoneyJob(ctx context.Context) {
+	interval, err := time.ParseDuration(config.GetVal("MPESA_CHECK_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		timedOut, err := CheckPendingMobilePayments(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("Mobile money check failed: %v", err)
+		} else if timedOut > 0 {
+			log.Printf("Mobile money check: %d requests timed out", timedOut)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,660 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+)
+
+type Payment struct {
+	ID            string          `json:"id"`
+	ReceiptNumber string          `json:"receipt_number"`
+	PatientID     string          `json:"patient_id"`
+	PatientName   string          `json:"patient_name"`
+	Method        string          `json:"method"`
+	Amount        decimal.Decimal `json:"amount"`
+	Reference     *string         `json:"reference,omitempty"`
+	Notes         *string         `json:"notes,omitempty"`
+	Status        string          `json:"status"`
+	Allocated     decimal.Decimal `json:"allocated"`
+	Refunded      decimal.Decimal `json:"refunded"`
+	Unallocated   decimal.Decimal `json:"unallocated"`
+	ReceivedBy    string          `json:"received_by"`
+	ReceivedAt    time.Time       `json:"received_at"`
+	VoidReason    *string         `json:"void_reason,omitempty"`
+	VoidedBy      *string         `json:"voided_by,omitempty"`
+	VoidedAt      *time.Time      `json:"voided_at,omitempty"`
+	Allocations   []Allocation    `json:"allocations,omitempty"`
+	Refunds       []Refund        `json:"refunds,omitempty"`
+}
+
+const paymentColumns = `y.id, y.receipt_number, y.patient_id, p.first_name || ' ' || p.last_name, y.method, y.amount, y.reference, y.notes,
+	y.status, (SELECT COALESCE(SUM(amount), 0) FROM payment_allocations WHERE payment_id = y.id),
+	(SELECT COALESCE(SUM(amount), 0) FROM payment_refunds WHERE payment_id = y.id),
+	y.received_by, y.received_at, y.void_reason, y.voided_by, y.voided_at`
+
+func (y *Payment) scanTargets() []any {
+	return []any{&y.ID, &y.ReceiptNumber, &y.PatientID, &y.PatientName, &y.Method, &y.Amount, &y.Reference, &y.Notes,
+		&y.Status, &y.Allocated, &y.Refunded,
+		&y.ReceivedBy, &y.ReceivedAt, &y.VoidReason, &y.VoidedBy, &y.VoidedAt}
+}
+
+func (y *Payment) balance() {
+	y.Unallocated = y.Amount.Sub(y.Refunded).Sub(y.Allocated)
+}
+
+// Allocation is part of a payment applied to an invoice. Refunds and voids
+// reverse allocations with negative entries.
+type Allocation struct {
+	ID            string          `json:"id"`
+	PaymentID     string          `json:"payment_id"`
+	ReceiptNumber string          `json:"receipt_number"`
+	Method        string          `json:"method"`
+	InvoiceID     string          `json:"invoice_id"`
+	InvoiceNumber *string         `json:"invoice_number,omitempty"`
+	Amount        decimal.Decimal `json:"amount"`
+	RefundID      *string         `json:"refund_id,omitempty"`
+	CreatedBy     string          `json:"created_by"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+const allocationColumns = `a.id, a.payment_id, y.receipt_number, y.method, a.invoice_id, b.invoice_number, a.amount, a.refund_id, a.created_by, a.created_at`
+
+func (a *Allocation) scanTargets() []any {
+	return []any{&a.ID, &a.PaymentID, &a.ReceiptNumber, &a.Method, &a.InvoiceID, &a.InvoiceNumber, &a.Amount, &a.RefundID, &a.CreatedBy, &a.CreatedAt}
+}
+
+func fetchAllocations(ctx context.Context, q querier, column, id string) ([]Allocation, error) {
+	rows, err := q.Query(ctx, `SELECT `+allocationColumns+` FROM payment_allocations a
+		JOIN payments y ON y.id = a.payment_id
+		JOIN billing b ON b.id = a.invoice_id
+		WHERE a.`+column+` = $1 ORDER BY a.created_at, a.id`, id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Allocation, error) {
+		var a Allocation
+		err := row.Scan(a.scanTargets()...)
+		return a, err
+	})
+}
+
+type Refund struct {
+	ID         string          `json:"id"`
+	PaymentID  string          `json:"payment_id"`
+	Amount     decimal.Decimal `json:"amount"`
+	Method     string          `json:"method"`
+	Reference  *string         `json:"reference,omitempty"`
+	Reason     string          `json:"reason"`
+	RefundedBy string          `json:"refunded_by"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+const refundColumns = `id, payment_id, amount, method, reference, reason, refunded_by, created_at`
+
+func (r *Refund) scanTargets() []any {
+	return []any{&r.ID, &r.PaymentID, &r.Amount, &r.Method, &r.Reference, &r.Reason, &r.RefundedBy, &r.CreatedAt}
+}
+
+// FetchPayment loads a payment with its allocations and refunds.
+func FetchPayment(ctx context.Context, q querier, id string) (*Payment, error) {
+	var y Payment
+	err := q.QueryRow(ctx, `SELECT `+paymentColumns+` FROM payments y JOIN patients p ON p.id = y.patient_id WHERE y.id = $1`, id).
+		Scan(y.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	y.balance()
+	if y.Allocations, err = fetchAllocations(ctx, q, "payment_id", y.ID); err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, `SELECT `+refundColumns+` FROM payment_refunds WHERE payment_id = $1 ORDER BY created_at`, y.ID)
+	if err == nil {
+		y.Refunds, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Refund, error) {
+			var r Refund
+			err := row.Scan(r.scanTargets()...)
+			return r, err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &y, nil
+}
+
+var paymentMethods = map[string]bool{"cash": true, "card": true, "mobile_money": true, "insurance": true}
+
+var (
+	errAllocation     = errors.New("invalid allocation")
+	errPaymentState   = errors.New("payment cannot be changed")
+	outstandingStatus = []string{"issued", "partially_paid"}
+)
+
+// ErrDuplicateRef is returned when a payment's reference has already been
+// used for the same method.
+var ErrDuplicateRef = errors.New("a payment with this reference has already been recorded")
+
+// applyToInvoice moves an invoice's amount paid by delta and brings its
+// status in line.
+func applyToInvoice(ctx context.Context, tx pgx.Tx, invoiceID string, delta decimal.Decimal) error {
+	var total, paid decimal.Decimal
+	err := tx.QueryRow(ctx, `UPDATE billing SET amount_paid = amount_paid + $1, updated_at = $2 WHERE id = $3
+		RETURNING amount - amount_credited, amount_paid`, delta, time.Now(), invoiceID).Scan(&total, &paid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `UPDATE billing SET status = $1 WHERE id = $2 AND status <> 'void'`, StatusFor(total, paid), invoiceID)
+	return err
+}
+
+func insertAllocation(ctx context.Context, tx pgx.Tx, paymentID, invoiceID string, amount decimal.Decimal, refundID *string, staffID string) error {
+	_, err := tx.Exec(ctx, `INSERT INTO payment_allocations (id, payment_id, invoice_id, amount, refund_id, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, uuid.New().String()[:8], paymentID, invoiceID, amount, refundID, staffID, time.Now())
+	if err == nil {
+		err = applyToInvoice(ctx, tx, invoiceID, amount)
+	}
+	return err
+}
+
+// AllocationRequest applies part of a payment to an invoice.
+type AllocationRequest struct {
+	InvoiceID string          `json:"invoice_id"`
+	Amount    decimal.Decimal `json:"amount"`
+}
+
+// invoiceDue locks an invoice and works out what is still due on it from
+// the insurer, for insurance payments, or from the patient otherwise. The
+// patient is not asked for the part the insurer is expected to pay.
+func invoiceDue(ctx context.Context, tx pgx.Tx, invoiceID string, insurer bool) (patientID, status string, due decimal.Decimal, err error) {
+	var balance, insurerDue decimal.Decimal
+	err = tx.QueryRow(ctx, `SELECT b.patient_id, b.status, b.amount - b.amount_credited - b.amount_paid,
+			b.insurer_share - (SELECT COALESCE(SUM(a.amount), 0) FROM payment_allocations a JOIN payments y ON y.id = a.payment_id
+				WHERE a.invoice_id = b.id AND y.method = 'insurance')
+		FROM billing b WHERE b.id = $1 FOR UPDATE OF b`, invoiceID).Scan(&patientID, &status, &balance, &insurerDue)
+	if err != nil {
+		return "", "", decimal.Zero, err
+	}
+	insurerDue = decimal.Max(decimal.Zero, decimal.Min(insurerDue, balance))
+	if insurer {
+		return patientID, status, insurerDue, nil
+	}
+	return patientID, status, balance.Sub(insurerDue), nil
+}
+
+// allocate applies the unallocated part of a locked payment to invoices.
+// Without explicit allocations it pays off the patient's oldest invoices
+// first; whatever is left stays on the payment as credit.
+func allocate(ctx context.Context, tx pgx.Tx, y *Payment, reqs []AllocationRequest, staffID string) error {
+	insurer := y.Method == "insurance"
+	available := y.Unallocated
+	if len(reqs) == 0 {
+		rows, err := tx.Query(ctx, `SELECT id FROM billing
+			WHERE patient_id = $1 AND status = ANY($2) AND amount - amount_credited > amount_paid
+			ORDER BY issued_at, id FOR UPDATE`, y.PatientID, outstandingStatus)
+		if err != nil {
+			return err
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			_, _, due, err := invoiceDue(ctx, tx, id, insurer)
+			if err != nil {
+				return err
+			}
+			if amount := decimal.Min(due, available); amount.IsPositive() {
+				reqs = append(reqs, AllocationRequest{InvoiceID: id, Amount: amount})
+				available = available.Sub(amount)
+			}
+		}
+		available = y.Unallocated
+	}
+
+	for i, r := range reqs {
+		if !r.Amount.IsPositive() {
+			continue
+		}
+		if r.Amount.GreaterThan(available) {
+			return fmt.Errorf("%w: allocations come to more than the %s left on the payment", errAllocation, y.Unallocated.StringFixed(2))
+		}
+		patientID, status, due, err := invoiceDue(ctx, tx, r.InvoiceID, insurer)
+		if err == pgx.ErrNoRows {
+			return fmt.Errorf("%w: allocation %d: invoice %s not found", errAllocation, i+1, r.InvoiceID)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case patientID != y.PatientID:
+			return fmt.Errorf("%w: allocation %d: invoice belongs to another patient", errAllocation, i+1)
+		case status != "issued" && status != "partially_paid":
+			return fmt.Errorf("%w: allocation %d: only issued invoices with a balance can be paid", errAllocation, i+1)
+		case r.Amount.GreaterThan(due):
+			return fmt.Errorf("%w: allocation %d: amount is more than the %s due on the invoice", errAllocation, i+1, due.StringFixed(2))
+		}
+		if err := insertAllocation(ctx, tx, y.ID, r.InvoiceID, r.Amount, nil, staffID); err != nil {
+			return err
+		}
+		available = available.Sub(r.Amount)
+	}
+	return nil
+}
+
+// paymentError maps payment errors to a response.
+func paymentError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payment not found",
+		})
+	case errors.Is(err, errAllocation):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, errPaymentState), errors.Is(err, ErrDuplicateRef):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"details": err.Error(),
+	})
+}
+
+func GetPayments(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+
+	filter := `WHERE ($1 = '' OR y.patient_id = $1) AND ($2 = '' OR y.method = $2) AND ($3 = '' OR y.status = $3)`
+	args := []any{c.Query("patient_id"), c.Query("method"), c.Query("status")}
+
+	var total int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM payments y `+filter, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rows, err := db.Query(ctx, `SELECT `+paymentColumns+` FROM payments y JOIN patients p ON p.id = y.patient_id `+filter+`
+		ORDER BY y.received_at DESC LIMIT $4 OFFSET $5`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	payments, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Payment, error) {
+		var y Payment
+		err := row.Scan(y.scanTargets()...)
+		y.balance()
+		return y, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"items": payments,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+func GetPayment(c *fiber.Ctx) error {
+	y, err := FetchPayment(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payment not found",
+		})
+	}
+	return c.JSON(y)
+}
+
+type paymentRequest struct {
+	PatientID   string              `json:"patient_id"`
+	Method      string              `json:"method"`
+	Amount      decimal.Decimal     `json:"amount"`
+	Reference   *string             `json:"reference"`
+	Notes       *string             `json:"notes"`
+	Allocations []AllocationRequest `json:"allocations"`
+}
+
+// PaymentInput is a payment to record, from the cashier or a payment provider.
+type PaymentInput struct {
+	PatientID string
+	Method    string
+	Amount    decimal.Decimal
+	Reference *string
+	Notes     *string
+	StaffID   string
+}
+
+// RecordPayment stores a payment under the next receipt number and
+// allocates it to the given invoices, or to the patient's oldest ones.
+func RecordPayment(ctx context.Context, tx pgx.Tx, in PaymentInput, allocations []AllocationRequest) (string, error) {
+	id := uuid.New().String()[:8]
+	now := time.Now()
+	_, err := tx.Exec(ctx, `INSERT INTO payments (id, receipt_number, patient_id, method, amount, reference, notes, received_by, received_at, created_at, updated_at)
+		VALUES ($1, 'RCT-' || LPAD(nextval('receipt_number_seq')::text, 6, '0'), $2, $3, $4, $5, $6, $7, $8, $8, $8)`,
+		id, in.PatientID, in.Method, in.Amount.Round(2), in.Reference, in.Notes, in.StaffID, now)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.ConstraintName == "uq_payments_reference" {
+		return "", ErrDuplicateRef
+	}
+	if err != nil {
+		return "", err
+	}
+	y, err := FetchPayment(ctx, tx, id)
+	if err == nil {
+		err = allocate(ctx, tx, y, allocations, in.StaffID)
+	}
+	return id, err
+}
+
+// CreatePayment records money received from a patient.
+func CreatePayment(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req paymentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	req.Reference, req.Notes = emptyToNil(req.Reference), emptyToNil(req.Notes)
+	switch {
+	case req.PatientID == "":
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "patient_id is required",
+		})
+	case !paymentMethods[req.Method]:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "method must be cash, card, mobile_money or insurance",
+		})
+	case !req.Amount.Round(2).IsPositive():
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "amount must be positive",
+		})
+	case req.Method != "cash" && req.Reference == nil:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "reference is required for card, mobile money and insurance payments",
+		})
+	}
+	var exists bool
+	if err := database.GetDB().QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM patients WHERE id = $1)`, req.PatientID).Scan(&exists); err != nil || !exists {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id, err := RecordPayment(ctx, tx, PaymentInput{
+		PatientID: req.PatientID, Method: req.Method, Amount: req.Amount, Reference: req.Reference, Notes: req.Notes,
+		StaffID: middleware.CurrentUserID(c),
+	}, req.Allocations)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return paymentError(c, err, "Failed to record payment")
+	}
+
+	y, err := FetchPayment(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Payment recorded successfully",
+		"payment": y,
+	})
+}
+
+// lockPayment loads a payment for changes, holding its row until commit.
+func lockPayment(ctx context.Context, tx pgx.Tx, id string) (*Payment, error) {
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM payments WHERE id = $1 FOR UPDATE`, id); err != nil {
+		return nil, err
+	}
+	return FetchPayment(ctx, tx, id)
+}
+
+// AllocatePayment applies credit left on a payment to invoices.
+func AllocatePayment(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		Allocations []AllocationRequest `json:"allocations"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	y, err := lockPayment(ctx, tx, c.Params("id"))
+	if err == nil && (y.Status == "void" || !y.Unallocated.IsPositive()) {
+		err = fmt.Errorf("%w: nothing is left on the payment to allocate", errPaymentState)
+	}
+	if err == nil {
+		err = allocate(ctx, tx, y, req.Allocations, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return paymentError(c, err, "Failed to allocate payment")
+	}
+
+	y, err = FetchPayment(ctx, database.GetDB(), y.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Payment allocated successfully",
+		"payment": y,
+	})
+}
+
+// release takes amount back off the invoices a locked payment was applied
+// to, most recent first, after using up any unallocated credit.
+func release(ctx context.Context, tx pgx.Tx, y *Payment, amount decimal.Decimal, refundID *string, staffID string) error {
+	remaining := amount.Sub(decimal.Max(y.Unallocated, decimal.Zero))
+	if !remaining.IsPositive() {
+		return nil
+	}
+	rows, err := tx.Query(ctx, `SELECT invoice_id, SUM(amount) FROM payment_allocations WHERE payment_id = $1
+		GROUP BY invoice_id HAVING SUM(amount) > 0 ORDER BY MAX(created_at) DESC`, y.ID)
+	if err != nil {
+		return err
+	}
+	applied, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AllocationRequest, error) {
+		var r AllocationRequest
+		err := row.Scan(&r.InvoiceID, &r.Amount)
+		return r, err
+	})
+	if err != nil {
+		return err
+	}
+	for _, r := range applied {
+		if !remaining.IsPositive() {
+			break
+		}
+		take := decimal.Min(r.Amount, remaining)
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM billing WHERE id = $1 FOR UPDATE`, r.InvoiceID); err != nil {
+			return err
+		}
+		if err := insertAllocation(ctx, tx, y.ID, r.InvoiceID, take.Neg(), refundID, staffID); err != nil {
+			return err
+		}
+		remaining = remaining.Sub(take)
+	}
+	return nil
+}
+
+type refundRequest struct {
+	Amount    decimal.Decimal `json:"amount"`
+	Method    string          `json:"method"`
+	Reference *string         `json:"reference"`
+	Reason    string          `json:"reason"`
+}
+
+// RefundPayment gives back part or all of a payment. It needs a supervisor
+// and a reason; the invoices it paid are reopened for the amount refunded.
+func RefundPayment(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req refundRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	req.Amount = req.Amount.Round(2)
+	switch {
+	case req.Reason == "":
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A reason is required for a refund",
+		})
+	case !req.Amount.IsPositive():
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "amount must be positive",
+		})
+	case req.Method != "" && !paymentMethods[req.Method]:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "method must be cash, card, mobile_money or insurance",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	staffID := middleware.CurrentUserID(c)
+	y, err := lockPayment(ctx, tx, c.Params("id"))
+	if err == nil && y.Status == "void" {
+		err = fmt.Errorf("%w: the payment has been voided", errPaymentState)
+	}
+	if err == nil && req.Amount.GreaterThan(y.Amount.Sub(y.Refunded)) {
+		err = fmt.Errorf("%w: at most %s can be refunded", errPaymentState, y.Amount.Sub(y.Refunded).StringFixed(2))
+	}
+	refundID := uuid.New().String()[:8]
+	if err == nil {
+		if req.Method == "" {
+			req.Method = y.Method
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO payment_refunds (`+refundColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			refundID, y.ID, req.Amount, req.Method, emptyToNil(req.Reference), req.Reason, staffID, time.Now())
+	}
+	if err == nil {
+		err = release(ctx, tx, y, req.Amount, &refundID, staffID)
+	}
+	if err == nil {
+		status := "partially_refunded"
+		if y.Refunded.Add(req.Amount).Equal(y.Amount) {
+			status = "refunded"
+		}
+		_, err = tx.Exec(ctx, `UPDATE payments SET status = $1, updated_at = $2 WHERE id = $3`, status, time.Now(), y.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return paymentError(c, err, "Failed to refund payment")
+	}
+
+	y, err = FetchPayment(ctx, database.GetDB(), y.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Payment refunded successfully",
+		"payment": y,
+	})
+}
+
+// VoidPayment cancels a payment recorded in error. It needs a supervisor
+// and a reason, keeps its receipt number, and takes it off every invoice it
+// paid. Payments that have been partly refunded cannot be voided.
+func VoidPayment(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A reason is required to void a payment",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	staffID := middleware.CurrentUserID(c)
+	y, err := lockPayment(ctx, tx, c.Params("id"))
+	if err == nil && y.Status != "received" {
+		err = fmt.Errorf("%w: only payments that have not been refunded or voided can be voided", errPaymentState)
+	}
+	if err == nil {
+		err = release(ctx, tx, y, y.Amount, nil, staffID)
+	}
+	if err == nil {
+		now := time.Now()
+		_, err = tx.Exec(ctx, `UPDATE payments SET status = 'void', void_reason = $1, voided_by = $2, voided_at = $3, updated_at = $3
+			WHERE id = $4`, strings.TrimSpace(req.Reason), staffID, now, y.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return paymentError(c, err, "Failed to void payment")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Payment voided successfully",
+	})
+}
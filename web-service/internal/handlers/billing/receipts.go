@@ -0,0 +1,146 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/pdfdoc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/shopspring/decimal"
+)
+
+var methodLabels = map[string]string{
+	"cash": "Cash", "card": "Card", "mobile_money": "Mobile money", "insurance": "Insurance",
+}
+
+func money(v decimal.Decimal) string {
+	return v.StringFixed(2)
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return "-"
+	}
+	return *s
+}
+
+// paymentInstructions tells the patient how to pay what is still due on an
+// invoice. PAYMENT_INSTRUCTIONS replaces the wording, with {invoice} standing
+// for the invoice number.
+func paymentInstructions(invoiceNumber string) string {
+	if s := config.GetVal("PAYMENT_INSTRUCTIONS"); s != "" {
+		return strings.ReplaceAll(s, "{invoice}", invoiceNumber)
+	}
+	if code := config.GetVal("MPESA_SHORTCODE"); code != "" {
+		return fmt.Sprintf("Pay by M-Pesa to paybill %s with account number %s, or at the cashier quoting the invoice number.", code, invoiceNumber)
+	}
+	return "Pay at the cashier quoting invoice number " + invoiceNumber + "."
+}
+
+// receiptPDF renders a payment's receipt, showing what it paid, the balance
+// it left on each invoice, and any refunds or void against it.
+func receiptPDF(ctx context.Context, q querier, y *Payment) ([]byte, error) {
+	var cashier string
+	q.QueryRow(ctx, `SELECT first_name || ' ' || last_name FROM staff WHERE id = $1`, y.ReceivedBy).Scan(&cashier)
+
+	title := "Receipt " + y.ReceiptNumber
+	if y.Status == "void" {
+		title += " (VOID)"
+	}
+	doc := pdfdoc.New(title)
+	doc.KeyValues([][2]string{
+		{"Receipt number", y.ReceiptNumber},
+		{"Date", y.ReceivedAt.Format("02 Jan 2006 15:04")},
+		{"Received from", y.PatientName},
+		{"Patient ID", y.PatientID},
+		{"Method", methodLabels[y.Method]},
+		{"Reference", deref(y.Reference)},
+		{"Amount", money(y.Amount)},
+		{"Received by", cashier},
+	})
+
+	// Net amount per invoice, in the order they were paid
+	var order []string
+	applied := map[string]decimal.Decimal{}
+	numbers := map[string]string{}
+	last := map[string]Allocation{}
+	for _, a := range y.Allocations {
+		if _, ok := applied[a.InvoiceID]; !ok {
+			order = append(order, a.InvoiceID)
+			numbers[a.InvoiceID] = deref(a.InvoiceNumber)
+		}
+		applied[a.InvoiceID] = applied[a.InvoiceID].Add(a.Amount)
+		if a.Amount.IsPositive() {
+			last[a.InvoiceID] = a
+		}
+	}
+	var rows [][]string
+	var due []string
+	for _, id := range order {
+		if !applied[id].IsPositive() {
+			continue
+		}
+		// What was left on the invoice once this payment was applied, and
+		// what is left on it now
+		var after, now decimal.Decimal
+		a := last[id]
+		err := q.QueryRow(ctx, `SELECT b.amount - COALESCE((SELECT SUM(amount) FROM credit_notes
+				WHERE invoice_id = b.id AND created_at <= $2), 0) - COALESCE((SELECT SUM(amount) FROM payment_allocations
+				WHERE invoice_id = b.id AND (created_at, id) <= ($2, $3)), 0), b.amount - b.amount_credited - b.amount_paid
+			FROM billing b WHERE b.id = $1`, id, a.CreatedAt, a.ID).Scan(&after, &now)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []string{numbers[id], money(applied[id]), money(after)})
+		if now.IsPositive() {
+			due = append(due, numbers[id])
+		}
+	}
+	if y.Unallocated.IsPositive() {
+		rows = append(rows, []string{"Credit on account", money(y.Unallocated), ""})
+	}
+	if len(rows) > 0 {
+		doc.Heading("Applied to")
+		doc.Table([]string{"Invoice", "Amount", "Balance after"}, []float64{100, 40, 40}, []string{"L", "R", "R"}, rows)
+	}
+
+	if len(y.Refunds) > 0 {
+		rows = rows[:0]
+		for _, r := range y.Refunds {
+			rows = append(rows, []string{r.CreatedAt.Format("02 Jan 2006"), methodLabels[r.Method], r.Reason, money(r.Amount)})
+		}
+		doc.Heading("Refunds")
+		doc.Table([]string{"Date", "Method", "Reason", "Amount"}, []float64{30, 30, 90, 30}, []string{"L", "L", "L", "R"}, rows)
+	}
+	if y.Status == "void" {
+		doc.Paragraph("Voided", fmt.Sprintf("This payment was voided on %s: %s", y.VoidedAt.Format("02 Jan 2006 15:04"), deref(y.VoidReason)))
+	}
+	if y.Status != "void" && len(due) > 0 {
+		doc.Paragraph("Balance due", paymentInstructions(strings.Join(due, ", ")))
+	}
+	if y.Notes != nil {
+		doc.Paragraph("Notes", *y.Notes)
+	}
+	return doc.Bytes()
+}
+
+func GetReceiptPDF(c *fiber.Ctx) error {
+	y, err := FetchPayment(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payment not found",
+		})
+	}
+	body, err := receiptPDF(context.Background(), database.GetDB(), y)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="%s.pdf"`, y.ReceiptNumber))
+	return c.Send(body)
+}
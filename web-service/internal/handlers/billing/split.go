@@ -0,0 +1,247 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/tariff"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// lineItem is the catalogue item behind an invoice line: the lab test or
+// medicine for lines from lab orders and dispensing, the service item for
+// consultations and procedures.
+const lineItem = `CASE i.source_type
+		WHEN 'lab_order_item' THEN (SELECT test_id FROM lab_order_items WHERE id = i.source_id)
+		WHEN 'dispensation_item' THEN (SELECT medicine_id FROM dispensation_items WHERE id = i.source_id)
+		WHEN 'service_item' THEN (SELECT id FROM service_items WHERE id = i.source_id OR code = i.source_id LIMIT 1)
+		ELSE i.source_id END`
+
+// applySplit works out the insurer's share of an invoice under its scheme:
+// the charges for covered item types less the patient's co-pay. Invoices
+// without insurance are the patient's alone.
+func applySplit(ctx context.Context, tx pgx.Tx, invoiceID string) error {
+	var schemeID *string
+	var total decimal.Decimal
+	err := tx.QueryRow(ctx, `SELECT scheme_id, amount FROM billing WHERE id = $1`, invoiceID).Scan(&schemeID, &total)
+	if err != nil || schemeID == nil {
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE billing SET insurer_share = 0 WHERE id = $1`, invoiceID)
+		}
+		return err
+	}
+
+	var covered, copayValue decimal.Decimal
+	var copayType string
+	var copayCap *decimal.Decimal
+	err = tx.QueryRow(ctx, `SELECT COALESCE((SELECT SUM(i.amount + i.tax_amount) FROM invoice_items i
+			WHERE i.invoice_id = $1 AND i.item_type = ANY(s.covered_item_types)), 0), s.copay_type, s.copay_value, s.copay_cap
+		FROM insurance_schemes s WHERE s.id = $2`, invoiceID, *schemeID).Scan(&covered, &copayType, &copayValue, &copayCap)
+	if err != nil {
+		return err
+	}
+
+	share := insurerShare(total, covered, copayType, copayValue, copayCap)
+	_, err = tx.Exec(ctx, `UPDATE billing SET insurer_share = $1 WHERE id = $2`, share, invoiceID)
+	return err
+}
+
+// insurerShare is what the insurer pays of covered charges once the patient's
+// co-pay is taken off: a fixed amount, or a percentage optionally capped. It
+// is never more than the invoice total nor less than zero.
+func insurerShare(total, covered decimal.Decimal, copayType string, copayValue decimal.Decimal, copayCap *decimal.Decimal) decimal.Decimal {
+	copay := decimal.Zero
+	switch copayType {
+	case "fixed":
+		copay = decimal.Min(copayValue, covered)
+	case "percentage":
+		copay = covered.Mul(copayValue).Div(hundred).Round(2)
+		if copayCap != nil {
+			copay = decimal.Min(copay, *copayCap)
+		}
+	}
+	return decimal.Max(decimal.Zero, decimal.Min(covered.Sub(copay), total))
+}
+
+var errPreauthRequired = errors.New("pre-authorisation required")
+
+// checkPreauthorisations confirms every covered line priced above the
+// scheme's threshold has an approved, unexpired pre-authorisation for the
+// same item, for at least the line's amount.
+func checkPreauthorisations(ctx context.Context, tx pgx.Tx, invoiceID string) error {
+	rows, err := tx.Query(ctx, `SELECT i.description FROM invoice_items i
+		JOIN billing b ON b.id = i.invoice_id
+		JOIN insurance_schemes s ON s.id = b.scheme_id
+		WHERE i.invoice_id = $1 AND i.quantity > 0 AND i.item_type = ANY(s.covered_item_types)
+			AND s.preauth_threshold IS NOT NULL AND i.amount + i.tax_amount > s.preauth_threshold
+			AND NOT EXISTS (SELECT 1 FROM insurance_preauthorisations a
+				WHERE a.insurance_id = b.insurance_id AND a.status = 'approved' AND a.item_type = i.item_type
+					AND a.item_id = `+lineItem+` AND i.amount + i.tax_amount <= a.approved_amount
+					AND (a.valid_until IS NULL OR a.valid_until >= CURRENT_DATE))
+		ORDER BY i.created_at, i.id`, invoiceID)
+	if err != nil {
+		return err
+	}
+	missing, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", errPreauthRequired, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Preauthorisations lists the numbers of the approved pre-authorisations
+// behind an invoice's lines, for the insurer's claim.
+func Preauthorisations(ctx context.Context, q querier, invoiceID string) ([]string, error) {
+	rows, err := q.Query(ctx, `SELECT DISTINCT a.preauth_number FROM invoice_items i
+		JOIN billing b ON b.id = i.invoice_id
+		JOIN insurance_preauthorisations a ON a.insurance_id = b.insurance_id AND a.status = 'approved'
+			AND a.item_type = i.item_type AND a.item_id = `+lineItem+`
+		WHERE i.invoice_id = $1 ORDER BY a.preauth_number`, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// openClaim starts the insurer's claim for an invoice being issued. It is a
+// draft until it goes out in a batch.
+func openClaim(ctx context.Context, tx pgx.Tx, invoiceID string) error {
+	now := time.Now()
+	_, err := tx.Exec(ctx, `INSERT INTO insurance_claims (id, claim_number, invoice_id, patient_id, insurance_id, scheme_id, payer_id,
+			claimed_amount, created_at, updated_at)
+		SELECT $1, 'CLM-' || LPAD(nextval('claim_number_seq')::text, 6, '0'), b.id, b.patient_id, b.insurance_id, b.scheme_id, s.payer_id,
+			b.insurer_share, $2, $2
+		FROM billing b JOIN insurance_schemes s ON s.id = b.scheme_id
+		WHERE b.id = $3 AND b.insurer_share > 0`, uuid.New().String()[:8], now, invoiceID)
+	return err
+}
+
+// SetInvoiceInsurance bills a draft invoice to one of the patient's
+// insurance covers at the insurer's prices, splitting it between the
+// insurer and the patient.
+func SetInvoiceInsurance(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		InsuranceID string `json:"insurance_id"`
+	}
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.InsuranceID) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "insurance_id is required",
+		})
+	}
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	err = lockDraft(ctx, tx, id)
+	var schemeID *string
+	var current bool
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT i.scheme_id, i.valid_from <= CURRENT_DATE AND (i.valid_to IS NULL OR i.valid_to >= CURRENT_DATE)
+				AND COALESCE(s.active AND p.active, FALSE)
+			FROM patient_insurance i JOIN billing b ON b.patient_id = i.patient_id
+			LEFT JOIN insurance_schemes s ON s.id = i.scheme_id
+			LEFT JOIN insurance_payers p ON p.id = s.payer_id
+			WHERE i.id = $1 AND b.id = $2`, strings.TrimSpace(req.InsuranceID), id).Scan(&schemeID, &current)
+		if err == pgx.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "insurance_id is not a cover of this patient",
+			})
+		}
+	}
+	if err == nil && schemeID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The cover is not linked to a configured scheme",
+		})
+	}
+	if err == nil && !current {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The cover has expired or its scheme is no longer active",
+		})
+	}
+	var listID string
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT payer_id FROM insurance_schemes WHERE id = $1`, *schemeID).Scan(&listID)
+	}
+	if err == nil {
+		listID, err = tariff.ListForPayer(ctx, tx, listID)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE billing SET insurance_id = $1, scheme_id = $2, price_list_id = $3, updated_at = $4 WHERE id = $5`,
+			strings.TrimSpace(req.InsuranceID), *schemeID, listID, time.Now(), id)
+	}
+	if err == nil {
+		err = priceFromList(ctx, tx, id, nil)
+	}
+	if err == nil {
+		err = recalculate(ctx, tx, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to set invoice insurance")
+	}
+
+	inv, err := Fetch(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Invoice insurance set successfully",
+		"invoice": inv,
+	})
+}
+
+// RemoveInvoiceInsurance bills a draft invoice wholly to the patient, at
+// cash prices.
+func RemoveInvoiceInsurance(c *fiber.Ctx) error {
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	err = lockDraft(ctx, tx, id)
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE billing SET insurance_id = NULL, scheme_id = NULL, price_list_id = $1, updated_at = $2 WHERE id = $3`,
+			tariff.CashList, time.Now(), id)
+	}
+	if err == nil {
+		err = priceFromList(ctx, tx, id, nil)
+	}
+	if err == nil {
+		err = recalculate(ctx, tx, id)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return invoiceError(c, err, "Failed to remove invoice insurance")
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Invoice insurance removed successfully",
+	})
+}
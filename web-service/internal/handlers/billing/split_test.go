@@ -0,0 +1,44 @@
+package billing
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestInsurerShare(t *testing.T) {
+	capAt := func(s string) *decimal.Decimal {
+		d := dec(s)
+		return &d
+	}
+	tests := []struct {
+		name       string
+		total      string
+		covered    string
+		copayType  string
+		copayValue string
+		copayCap   *decimal.Decimal
+		want       string
+	}{
+		{name: "no co-pay", total: "1000", covered: "1000", copayType: "none", copayValue: "0", want: "1000"},
+		{name: "only covered items", total: "1000", covered: "600", copayType: "none", copayValue: "0", want: "600"},
+		{name: "fixed co-pay", total: "1000", covered: "1000", copayType: "fixed", copayValue: "200", want: "800"},
+		{name: "fixed co-pay above covered charges", total: "1000", covered: "150", copayType: "fixed", copayValue: "200", want: "0"},
+		{name: "percentage co-pay", total: "1000", covered: "1000", copayType: "percentage", copayValue: "10", want: "900"},
+		{name: "percentage co-pay rounded to cents", total: "33.33", covered: "33.33", copayType: "percentage", copayValue: "15", want: "28.33"},
+		{name: "percentage co-pay under its cap", total: "1000", covered: "1000", copayType: "percentage", copayValue: "10", copayCap: capAt("500"), want: "900"},
+		{name: "percentage co-pay held to its cap", total: "10000", covered: "10000", copayType: "percentage", copayValue: "20", copayCap: capAt("500"), want: "9500"},
+		{name: "zero cap", total: "1000", covered: "1000", copayType: "percentage", copayValue: "20", copayCap: capAt("0"), want: "1000"},
+		{name: "no more than the total after credits", total: "700", covered: "1000", copayType: "none", copayValue: "0", want: "700"},
+		{name: "never negative", total: "-100", covered: "-100", copayType: "none", copayValue: "0", want: "0"},
+		{name: "nothing covered", total: "1000", covered: "0", copayType: "fixed", copayValue: "200", want: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := insurerShare(dec(tt.total), dec(tt.covered), tt.copayType, dec(tt.copayValue), tt.copayCap)
+			if !got.Equal(dec(tt.want)) {
+				t.Errorf("insurerShare() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
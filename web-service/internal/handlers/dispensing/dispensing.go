@@ -0,0 +1,367 @@
+package dispensing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/billing"
+	"web-service/internal/handlers/pharmacy"
+	"web-service/internal/handlers/prescriptions"
+	"web-service/internal/handlers/tariff"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// Dispensation is one handover of medicines, against a prescription or over the counter.
+type Dispensation struct {
+	ID             string    `json:"id"`
+	DispenseType   string    `json:"dispense_type"`
+	PrescriptionID *string   `json:"prescription_id,omitempty"`
+	PatientID      *string   `json:"patient_id,omitempty"`
+	CustomerName   *string   `json:"customer_name,omitempty"`
+	InvoiceID      *string   `json:"invoice_id,omitempty"`
+	Notes          *string   `json:"notes,omitempty"`
+	DispensedBy    string    `json:"dispensed_by"`
+	Items          []Item    `json:"items"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type Item struct {
+	ID                 string              `json:"id"`
+	DispensationID     string              `json:"dispensation_id"`
+	PrescriptionItemID *string             `json:"prescription_item_id,omitempty"`
+	MedicineID         string              `json:"medicine_id"`
+	MedicineName       string              `json:"medicine_name,omitempty"`
+	Quantity           int                 `json:"quantity"`
+	ReturnedQuantity   int                 `json:"returned_quantity"`
+	UnitPrice          decimal.Decimal     `json:"unit_price"`
+	Batches            []pharmacy.Movement `json:"batches,omitempty"`
+}
+
+const dispensationColumns = `id, dispense_type, prescription_id, patient_id, customer_name, invoice_id, notes, dispensed_by, created_at`
+
+func (d *Dispensation) scanTargets() []any {
+	return []any{&d.ID, &d.DispenseType, &d.PrescriptionID, &d.PatientID, &d.CustomerName, &d.InvoiceID, &d.Notes, &d.DispensedBy, &d.CreatedAt}
+}
+
+// errDispense marks problems with the request rather than the database.
+var errDispense = errors.New("cannot dispense")
+
+func fetchItems(ctx context.Context, dispensationID string) ([]Item, error) {
+	db := database.GetDB()
+	rows, err := db.Query(ctx, `SELECT i.id, i.dispensation_id, i.prescription_item_id, i.medicine_id, m.name, i.quantity, i.returned_quantity, i.unit_price
+		FROM dispensation_items i JOIN pharmacy m ON m.id = i.medicine_id
+		WHERE i.dispensation_id=$1 ORDER BY m.name, i.id`, dispensationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		var it Item
+		if err := rows.Scan(&it.ID, &it.DispensationID, &it.PrescriptionItemID, &it.MedicineID, &it.MedicineName, &it.Quantity, &it.ReturnedQuantity, &it.UnitPrice); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// Fetch loads a dispensation with its lines.
+func Fetch(id string) (*Dispensation, error) {
+	ctx := context.Background()
+	var d Dispensation
+	err := database.GetDB().QueryRow(ctx, `SELECT `+dispensationColumns+` FROM dispensations WHERE id=$1`, id).Scan(d.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	if d.Items, err = fetchItems(ctx, d.ID); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func GetDispensations(c *fiber.Ctx) error {
+	ctx := context.Background()
+	rows, err := database.GetDB().Query(ctx, `SELECT `+dispensationColumns+` FROM dispensations
+		WHERE ($1 = '' OR patient_id=$1) AND ($2 = '' OR prescription_id=$2)
+		ORDER BY created_at DESC`, c.Query("patient_id"), c.Query("prescription_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	list := []Dispensation{}
+	for rows.Next() {
+		var d Dispensation
+		if err := rows.Scan(d.scanTargets()...); err != nil {
+			rows.Close()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		list = append(list, d)
+	}
+	rows.Close()
+
+	for i := range list {
+		if list[i].Items, err = fetchItems(ctx, list[i].ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	return c.JSON(list)
+}
+
+func GetDispensation(c *fiber.Ctx) error {
+	d, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Dispensation not found",
+		})
+	}
+	return c.JSON(d)
+}
+
+type dispenseRequest struct {
+	PrescriptionID string  `json:"prescription_id"`
+	PatientID      string  `json:"patient_id"`
+	CustomerName   string  `json:"customer_name"`
+	Notes          *string `json:"notes"`
+	Items          []struct {
+		PrescriptionItemID string `json:"prescription_item_id"`
+		MedicineID         string `json:"medicine_id"`
+		Quantity           int    `json:"quantity"`
+	} `json:"items"`
+}
+
+// Dispense hands over medicines against a prescription or as an OTC sale.
+// Stock is taken from batches first-expiry-first-out, the prescription's
+// dispensed quantities are updated, and when the customer is a registered
+// patient the lines are added to their open invoice, all in one transaction.
+// Prescriptions may be dispensed in several parts, up to quantity x (refills + 1).
+func Dispense(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req dispenseRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if len(req.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one item is required",
+		})
+	}
+
+	staffID := middleware.CurrentUserID(c)
+	d := Dispensation{
+		ID:          uuid.New().String()[:8],
+		Notes:       req.Notes,
+		DispensedBy: staffID,
+		CreatedAt:   time.Now(),
+	}
+
+	var rx *prescriptions.Prescription
+	rxItems := map[string]*prescriptions.Item{}
+	if req.PrescriptionID != "" {
+		var err error
+		if rx, err = prescriptions.Fetch(req.PrescriptionID); err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Prescription not found",
+			})
+		}
+		if !prescriptions.Verify(rx) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Prescription signature is not valid, refer back to the prescriber",
+			})
+		}
+		for i := range rx.Items {
+			rxItems[rx.Items[i].ID] = &rx.Items[i]
+		}
+		d.DispenseType = "prescription"
+		d.PrescriptionID = &rx.ID
+		d.PatientID = &rx.PatientID
+	} else {
+		d.DispenseType = "otc"
+		if req.PatientID != "" {
+			d.PatientID = &req.PatientID
+		}
+		if name := strings.TrimSpace(req.CustomerName); name != "" {
+			d.CustomerName = &name
+		}
+		if d.PatientID == nil && d.CustomerName == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "patient_id or customer_name is required for OTC sales",
+			})
+		}
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	if rx != nil {
+		// Lock the prescription and re-read what has been dispensed so far
+		var status string
+		err = tx.QueryRow(ctx, `SELECT status FROM prescriptions WHERE id=$1 FOR UPDATE`, rx.ID).Scan(&status)
+		if err == nil && status != "active" && status != "partially_dispensed" {
+			err = fmt.Errorf("%w: prescription is %s", errDispense, status)
+		}
+		for id, it := range rxItems {
+			if err != nil {
+				break
+			}
+			err = tx.QueryRow(ctx, `SELECT dispensed_quantity FROM prescription_items WHERE id=$1`, id).Scan(&it.DispensedQuantity)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `INSERT INTO dispensations (`+dispensationColumns+`) VALUES ($1, $2, $3, $4, $5, NULL, $6, $7, $8)`,
+			d.ID, d.DispenseType, d.PrescriptionID, d.PatientID, d.CustomerName, d.Notes, d.DispensedBy, d.CreatedAt)
+	}
+
+	// Take stock in medicine order, so dispensations running at the same time
+	// lock batches in the same order and cannot deadlock
+	medicineOf := func(i int) string {
+		if line, ok := rxItems[req.Items[i].PrescriptionItemID]; ok {
+			return line.MedicineID
+		}
+		return req.Items[i].MedicineID
+	}
+	sort.SliceStable(req.Items, func(i, j int) bool { return medicineOf(i) < medicineOf(j) })
+
+	var lines []billing.Line
+	for _, in := range req.Items {
+		if err != nil {
+			break
+		}
+		it := Item{ID: uuid.New().String()[:8], DispensationID: d.ID, MedicineID: in.MedicineID, Quantity: in.Quantity}
+		reason := "otc_sale"
+		if rx != nil {
+			reason = "prescription"
+			line, ok := rxItems[in.PrescriptionItemID]
+			if !ok {
+				err = fmt.Errorf("%w: item %s is not on this prescription", errDispense, in.PrescriptionItemID)
+				break
+			}
+			if remaining := line.Quantity*(line.Refills+1) - line.DispensedQuantity; in.Quantity > remaining {
+				err = fmt.Errorf("%w: only %d of %s left to dispense", errDispense, remaining, line.MedicineName)
+				break
+			}
+			it.PrescriptionItemID = &line.ID
+			it.MedicineID = line.MedicineID
+			line.DispensedQuantity += in.Quantity
+		}
+		if it.Quantity <= 0 {
+			err = fmt.Errorf("%w: quantity must be positive", errDispense)
+			break
+		}
+
+		var active bool
+		err = tx.QueryRow(ctx, `SELECT name, COALESCE(`+tariff.CashPriceNow("medicine", "pharmacy.id")+`, price), active FROM pharmacy WHERE id=$1`,
+			it.MedicineID).Scan(&it.MedicineName, &it.UnitPrice, &active)
+		if err == pgx.ErrNoRows || (err == nil && !active) {
+			err = fmt.Errorf("%w: medicine %s is not available", errDispense, it.MedicineID)
+		}
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO dispensation_items (id, dispensation_id, prescription_item_id, medicine_id, quantity, unit_price)
+			VALUES ($1, $2, $3, $4, $5, $6)`, it.ID, d.ID, it.PrescriptionItemID, it.MedicineID, it.Quantity, it.UnitPrice)
+		if err == nil {
+			it.Batches, err = pharmacy.RecordMovement(ctx, tx, pharmacy.Movement{
+				MedicineID:   it.MedicineID,
+				MovementType: "dispense",
+				Quantity:     it.Quantity,
+				ReasonCode:   reason,
+				PatientID:    d.PatientID,
+				Reference:    &it.ID,
+				StaffID:      &staffID,
+			})
+		}
+		if err == nil && it.PrescriptionItemID != nil {
+			_, err = tx.Exec(ctx, `UPDATE prescription_items SET dispensed_quantity=dispensed_quantity+$1 WHERE id=$2`, it.Quantity, *it.PrescriptionItemID)
+		}
+		sourceType := "dispensation_item"
+		lines = append(lines, billing.Line{
+			ItemType: "medicine", Description: it.MedicineName, Quantity: it.Quantity, UnitPrice: it.UnitPrice,
+			SourceType: &sourceType, SourceID: &it.ID,
+		})
+		d.Items = append(d.Items, it)
+	}
+
+	if err == nil && rx != nil {
+		err = updatePrescriptionStatus(ctx, tx, rx.ID)
+	}
+	if err == nil && d.PatientID != nil {
+		var invoiceID string
+		invoiceID, err = billing.AddLines(ctx, tx, *d.PatientID, lines)
+		d.InvoiceID = &invoiceID
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE dispensations SET invoice_id=$1 WHERE id=$2`, invoiceID, d.ID)
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if resp, ok := requestError(c, err); ok {
+		return resp
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to dispense",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Dispensed successfully",
+		"dispensation": d,
+	})
+}
+
+// requestError turns stock and validation failures into client errors.
+func requestError(c *fiber.Ctx, err error) (error, bool) {
+	switch {
+	case errors.Is(err, errDispense), errors.Is(err, pharmacy.ErrInvalidMovement):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		}), true
+	case errors.Is(err, pharmacy.ErrInsufficientStock):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Not enough unexpired stock to dispense",
+		}), true
+	case errors.Is(err, billing.ErrUnknownPatient):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+		}), true
+	}
+	return nil, false
+}
+
+// updatePrescriptionStatus derives the prescription status from what has
+// been dispensed against its lines.
+func updatePrescriptionStatus(ctx context.Context, tx pgx.Tx, prescriptionID string) error {
+	_, err := tx.Exec(ctx, `UPDATE prescriptions p SET status = CASE
+			WHEN NOT EXISTS (SELECT 1 FROM prescription_items WHERE prescription_id=p.id AND dispensed_quantity < quantity * (refills + 1)) THEN 'dispensed'
+			WHEN EXISTS (SELECT 1 FROM prescription_items WHERE prescription_id=p.id AND dispensed_quantity > 0) THEN 'partially_dispensed'
+			ELSE 'active' END,
+		updated_at=$2
+		WHERE id=$1`, prescriptionID, time.Now())
+	return err
+}
@@ -0,0 +1,170 @@
+package dispensing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"web-service/database"
+	"web-service/internal/handlers/billing"
+	"web-service/internal/handlers/pharmacy"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+)
+
+type returnRequest struct {
+	Reason string `json:"reason"`
+	Items  []struct {
+		DispensationItemID string `json:"dispensation_item_id"`
+		Quantity           int    `json:"quantity"`
+	} `json:"items"`
+}
+
+// ReturnItems takes dispensed medicines back into the batches they came from,
+// reopens the prescription quantity and credits the charge on the invoice it
+// was billed on, at the price charged.
+func ReturnItems(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req returnRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A reason and at least one item are required",
+		})
+	}
+	d, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Dispensation not found",
+		})
+	}
+	items := map[string]*Item{}
+	for i := range d.Items {
+		items[d.Items[i].ID] = &d.Items[i]
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	staffID := middleware.CurrentUserID(c)
+	var reversals []billing.Reversal
+	var movements []pharmacy.Movement
+	for _, in := range req.Items {
+		it, ok := items[in.DispensationItemID]
+		if !ok {
+			err = fmt.Errorf("%w: item %s is not part of this dispensation", errDispense, in.DispensationItemID)
+			break
+		}
+		// Lock the line so concurrent returns cannot exceed what was handed over
+		err = tx.QueryRow(ctx, `SELECT returned_quantity FROM dispensation_items WHERE id=$1 FOR UPDATE`, it.ID).Scan(&it.ReturnedQuantity)
+		if err != nil {
+			break
+		}
+		if in.Quantity <= 0 || in.Quantity > it.Quantity-it.ReturnedQuantity {
+			err = fmt.Errorf("%w: up to %d of %s can be returned", errDispense, it.Quantity-it.ReturnedQuantity, it.MedicineName)
+			break
+		}
+
+		// Put stock back into the batches it was taken from, latest expiry first
+		rows, qerr := tx.Query(ctx, `SELECT s.batch_id, -SUM(s.quantity)::int
+			FROM stock_movements s JOIN stock_batches b ON b.id = s.batch_id
+			WHERE s.reference=$1 AND s.movement_type IN ('dispense', 'return')
+			GROUP BY s.batch_id, b.expiry_date HAVING -SUM(s.quantity) > 0
+			ORDER BY b.expiry_date DESC NULLS FIRST`, it.ID)
+		if qerr != nil {
+			err = qerr
+			break
+		}
+		type held struct {
+			batchID  string
+			quantity int
+		}
+		var batches []held
+		for rows.Next() {
+			var h held
+			if err = rows.Scan(&h.batchID, &h.quantity); err != nil {
+				break
+			}
+			batches = append(batches, h)
+		}
+		rows.Close()
+		if err != nil {
+			break
+		}
+
+		remaining := in.Quantity
+		for _, h := range batches {
+			if remaining == 0 || err != nil {
+				break
+			}
+			qty := min(h.quantity, remaining)
+			remaining -= qty
+			var written []pharmacy.Movement
+			written, err = pharmacy.RecordMovement(ctx, tx, pharmacy.Movement{
+				MedicineID:   it.MedicineID,
+				BatchID:      h.batchID,
+				MovementType: "return",
+				Quantity:     qty,
+				ReasonCode:   "patient_return",
+				PatientID:    d.PatientID,
+				Reference:    &it.ID,
+				Notes:        &req.Reason,
+				StaffID:      &staffID,
+			})
+			movements = append(movements, written...)
+		}
+		if err != nil {
+			break
+		}
+
+		it.ReturnedQuantity += in.Quantity
+		_, err = tx.Exec(ctx, `UPDATE dispensation_items SET returned_quantity=$1 WHERE id=$2`, it.ReturnedQuantity, it.ID)
+		if err == nil && it.PrescriptionItemID != nil {
+			_, err = tx.Exec(ctx, `UPDATE prescription_items SET dispensed_quantity=dispensed_quantity-$1 WHERE id=$2`, in.Quantity, *it.PrescriptionItemID)
+		}
+		if err != nil {
+			break
+		}
+		reversals = append(reversals, billing.Reversal{
+			SourceType: "dispensation_item", SourceID: it.ID, Quantity: in.Quantity, Description: "Returned: " + it.MedicineName,
+		})
+	}
+
+	if err == nil && d.PrescriptionID != nil {
+		err = updatePrescriptionStatus(ctx, tx, *d.PrescriptionID)
+	}
+	var credits []billing.Credit
+	if err == nil {
+		credits, err = billing.Reverse(ctx, tx, reversals, req.Reason, staffID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if resp, ok := requestError(c, err); ok {
+		return resp
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record return",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Return recorded successfully",
+		"dispensation": d,
+		"movements": movements,
+		"credits": credits,
+	})
+}
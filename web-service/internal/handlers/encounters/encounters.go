@@ -0,0 +1,389 @@
+package encounters
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/prescriptions"
+	"web-service/internal/handlers/vitals"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Encounter is a single clinical visit with its SOAP note. Once signed the
+// note is locked and further information can only be added as an addendum.
+type Encounter struct {
+	ID            string     `json:"id"`
+	PatientID     string     `json:"patient_id"`
+	AppointmentID *string    `json:"appointment_id,omitempty"`
+	ClinicianID   string     `json:"clinician_id"`
+	EncounterType string     `json:"encounter_type"`
+	Status        string     `json:"status"`
+	Subjective    *string    `json:"subjective,omitempty"`
+	Objective     *string    `json:"objective,omitempty"`
+	Assessment    *string    `json:"assessment,omitempty"`
+	Plan          *string    `json:"plan,omitempty"`
+	OpenedAt      time.Time  `json:"opened_at"`
+	SignedAt      *time.Time `json:"signed_at,omitempty"`
+	SignedBy      *string    `json:"signed_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type Addendum struct {
+	ID          string    `json:"id"`
+	EncounterID string    `json:"encounter_id"`
+	AuthorID    string    `json:"author_id"`
+	Content     string    `json:"content"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+const encounterColumns = `id, patient_id, appointment_id, clinician_id, encounter_type, status, subjective, objective, assessment, plan, opened_at, signed_at, signed_by, created_at, updated_at`
+
+func (e *Encounter) scanTargets() []any {
+	return []any{&e.ID, &e.PatientID, &e.AppointmentID, &e.ClinicianID, &e.EncounterType, &e.Status, &e.Subjective, &e.Objective,
+		&e.Assessment, &e.Plan, &e.OpenedAt, &e.SignedAt, &e.SignedBy, &e.CreatedAt, &e.UpdatedAt}
+}
+
+// editable checks that the encounter exists, is still open and belongs to the caller.
+// It returns a non-zero HTTP status with a message when the change must be refused.
+func editable(encounterID, userID string) (int, string) {
+	db := database.GetDB()
+	var status, clinicianID string
+	err := db.QueryRow(context.Background(), `SELECT status, clinician_id FROM encounters WHERE id=$1`, encounterID).Scan(&status, &clinicianID)
+	if err != nil {
+		return fiber.StatusNotFound, "Encounter not found"
+	}
+	if status == "signed" {
+		return fiber.StatusConflict, "Encounter has been signed, add an addendum instead"
+	}
+	if clinicianID != userID {
+		return fiber.StatusForbidden, "Only the encounter clinician can change this note"
+	}
+	return 0, ""
+}
+
+// OpenEncounter starts a visit, either from a checked-in appointment or as a walk-in for a patient.
+func OpenEncounter(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var e Encounter
+	if err := c.BodyParser(&e); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	ctx := context.Background()
+	if e.AppointmentID != nil && *e.AppointmentID != "" {
+		var status string
+		err := db.QueryRow(ctx, `
+			SELECT p.id, a.status FROM appointments a
+			JOIN patients p ON p.national_id = a.patient_national_id
+			WHERE a.id = $1`, *e.AppointmentID).Scan(&e.PatientID, &status)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Appointment or its patient not found",
+				"details": err.Error(),
+			})
+		}
+		if status != "checked_in" {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Appointment must be checked in before an encounter is opened",
+			})
+		}
+		e.EncounterType = "appointment"
+	} else {
+		if e.PatientID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Either appointment_id or patient_id is required",
+			})
+		}
+		e.AppointmentID = nil
+		e.EncounterType = "walk_in"
+	}
+
+	e.ID = uuid.New().String()[:8]
+	e.ClinicianID = middleware.CurrentUserID(c)
+	e.Status = "open"
+	e.OpenedAt = time.Now()
+	e.SignedAt = nil
+	e.SignedBy = nil
+	e.CreatedAt = time.Now()
+	e.UpdatedAt = time.Now()
+
+	_, err := db.Exec(ctx, `INSERT INTO encounters (`+encounterColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		e.ID, e.PatientID, e.AppointmentID, e.ClinicianID, e.EncounterType, e.Status, e.Subjective, e.Objective,
+		e.Assessment, e.Plan, e.OpenedAt, e.SignedAt, e.SignedBy, e.CreatedAt, e.UpdatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to open encounter",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Encounter opened successfully",
+		"encounter": e,
+	})
+}
+
+// GetEncounters lists encounters filtered by patient_id, clinician_id and status.
+func GetEncounters(c *fiber.Ctx) error {
+	db := database.GetDB()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+
+	filter := `WHERE ($1 = '' OR patient_id = $1) AND ($2 = '' OR clinician_id = $2) AND ($3 = '' OR status = $3)`
+	args := []any{c.Query("patient_id"), c.Query("clinician_id"), c.Query("status")}
+
+	var total int
+	if err := db.QueryRow(context.Background(), `SELECT COUNT(*) FROM encounters `+filter, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	rows, err := db.Query(context.Background(), `SELECT `+encounterColumns+` FROM encounters `+filter+`
+		ORDER BY opened_at DESC LIMIT $4 OFFSET $5`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch encounters",
+			"details": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	list := []Encounter{}
+	for rows.Next() {
+		var e Encounter
+		if err := rows.Scan(e.scanTargets()...); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		list = append(list, e)
+	}
+
+	return c.JSON(fiber.Map{
+		"items": list,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+// GetEncounter returns the note together with everything linked to the visit.
+func GetEncounter(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var e Encounter
+	err := db.QueryRow(context.Background(), `SELECT `+encounterColumns+` FROM encounters WHERE id=$1`, c.Params("id")).Scan(e.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Encounter not found",
+			"details": err.Error(),
+		})
+	}
+
+	diagnoses, err := fetchDiagnoses(e.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	orders, err := fetchOrders(e.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	readings, err := vitals.FetchVitals(e.PatientID, e.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	addenda, err := fetchAddenda(e.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	prescribed, err := prescriptions.List(e.PatientID, e.ID, nil)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"encounter":     e,
+		"diagnoses":     diagnoses,
+		"orders":        orders,
+		"vitals":        readings,
+		"prescriptions": prescribed,
+		"addenda":       addenda,
+	})
+}
+
+// UpdateNote saves the SOAP sections of an open encounter. Sections left out
+// of the request keep their current text.
+func UpdateNote(c *fiber.Ctx) error {
+	db := database.GetDB()
+	id := c.Params("id")
+	var e Encounter
+	if err := c.BodyParser(&e); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if status, msg := editable(id, middleware.CurrentUserID(c)); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	// The status check is repeated in the UPDATE so a concurrent sign-off wins
+	tag, err := db.Exec(context.Background(), `UPDATE encounters SET subjective=COALESCE($1, subjective), objective=COALESCE($2, objective),
+		assessment=COALESCE($3, assessment), plan=COALESCE($4, plan), updated_at=$5 WHERE id=$6 AND status='open'`,
+		e.Subjective, e.Objective, e.Assessment, e.Plan, time.Now(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update encounter",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Encounter has been signed, add an addendum instead",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Encounter updated successfully",
+	})
+}
+
+// SignEncounter locks the note. The assessment and plan must be filled in first.
+func SignEncounter(c *fiber.Ctx) error {
+	db := database.GetDB()
+	id := c.Params("id")
+	userID := middleware.CurrentUserID(c)
+
+	if status, msg := editable(id, userID); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var e Encounter
+	err = tx.QueryRow(ctx, `UPDATE encounters SET status='signed', signed_at=$1, signed_by=$2, updated_at=$1
+		WHERE id=$3 AND status='open' AND COALESCE(assessment, '') <> '' AND COALESCE(plan, '') <> ''
+		RETURNING `+encounterColumns, time.Now(), userID, id).Scan(e.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Encounter cannot be signed, the assessment and plan are required",
+		})
+	}
+
+	if e.AppointmentID != nil {
+		_, err = tx.Exec(ctx, `UPDATE appointments SET status='completed', updated_at=$1 WHERE id=$2`, time.Now(), *e.AppointmentID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to sign encounter",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Encounter signed successfully",
+		"encounter": e,
+	})
+}
+
+func fetchAddenda(encounterID string) ([]Addendum, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT id, encounter_id, author_id, content, created_at FROM encounter_addenda WHERE encounter_id=$1 ORDER BY created_at ASC`, encounterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	addenda := []Addendum{}
+	for rows.Next() {
+		var a Addendum
+		if err := rows.Scan(&a.ID, &a.EncounterID, &a.AuthorID, &a.Content, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, a)
+	}
+	return addenda, rows.Err()
+}
+
+// AddAddendum appends to a signed encounter without touching the original note.
+func AddAddendum(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var a Addendum
+	if err := c.BodyParser(&a); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if strings.TrimSpace(a.Content) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Addendum content is required",
+		})
+	}
+
+	var status string
+	err := db.QueryRow(context.Background(), `SELECT status FROM encounters WHERE id=$1`, c.Params("id")).Scan(&status)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Encounter not found",
+		})
+	}
+	if status != "signed" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Encounter is still open, edit the note instead",
+		})
+	}
+
+	a.ID = uuid.New().String()[:8]
+	a.EncounterID = c.Params("id")
+	a.AuthorID = middleware.CurrentUserID(c)
+	a.CreatedAt = time.Now()
+
+	_, err = db.Exec(context.Background(), `INSERT INTO encounter_addenda (id, encounter_id, author_id, content, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		a.ID, a.EncounterID, a.AuthorID, a.Content, a.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add addendum",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Addendum added successfully",
+		"addendum": a,
+	})
+}
@@ -0,0 +1,228 @@
+package encounters
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/icd10"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type Diagnosis struct {
+	ID          string    `json:"id"`
+	EncounterID string    `json:"encounter_id"`
+	ICD10Code   *string   `json:"icd10_code,omitempty"`
+	Description string    `json:"description"`
+	IsPrimary   bool      `json:"is_primary"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Order struct {
+	ID          string    `json:"id"`
+	EncounterID string    `json:"encounter_id"`
+	OrderType   string    `json:"order_type"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var orderTypes = map[string]bool{"lab": true, "imaging": true, "procedure": true, "referral": true, "other": true}
+
+func fetchDiagnoses(encounterID string) ([]Diagnosis, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT id, encounter_id, icd10_code, description, is_primary, created_at FROM encounter_diagnoses WHERE encounter_id=$1 ORDER BY is_primary DESC, created_at ASC`, encounterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	diagnoses := []Diagnosis{}
+	for rows.Next() {
+		var d Diagnosis
+		if err := rows.Scan(&d.ID, &d.EncounterID, &d.ICD10Code, &d.Description, &d.IsPrimary, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		diagnoses = append(diagnoses, d)
+	}
+	return diagnoses, rows.Err()
+}
+
+func fetchOrders(encounterID string) ([]Order, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT id, encounter_id, order_type, description, status, created_at FROM encounter_orders WHERE encounter_id=$1 ORDER BY created_at ASC`, encounterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		var o Order
+		if err := rows.Scan(&o.ID, &o.EncounterID, &o.OrderType, &o.Description, &o.Status, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func AddDiagnosis(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var d Diagnosis
+	if err := c.BodyParser(&d); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if d.ICD10Code == nil || strings.TrimSpace(*d.ICD10Code) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "ICD-10 code is required",
+		})
+	}
+	code, err := icd10.Lookup(*d.ICD10Code)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unknown ICD-10 code",
+		})
+	}
+	d.ICD10Code = &code.Code
+	if strings.TrimSpace(d.Description) == "" {
+		d.Description = code.Description
+	}
+
+	d.EncounterID = c.Params("id")
+	if status, msg := editable(d.EncounterID, middleware.CurrentUserID(c)); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	d.ID = uuid.New().String()[:8]
+	d.CreatedAt = time.Now()
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	// An encounter has at most one primary diagnosis
+	if d.IsPrimary {
+		_, err = tx.Exec(ctx, `UPDATE encounter_diagnoses SET is_primary=FALSE WHERE encounter_id=$1`, d.EncounterID)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `INSERT INTO encounter_diagnoses (id, encounter_id, icd10_code, description, is_primary, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+			d.ID, d.EncounterID, d.ICD10Code, d.Description, d.IsPrimary, d.CreatedAt)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add diagnosis",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Diagnosis added successfully",
+		"diagnosis": d,
+	})
+}
+
+func DeleteDiagnosis(c *fiber.Ctx) error {
+	db := database.GetDB()
+	if status, msg := editable(c.Params("id"), middleware.CurrentUserID(c)); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	_, err := db.Exec(context.Background(), `DELETE FROM encounter_diagnoses WHERE id=$1 AND encounter_id=$2`, c.Params("diagnosisId"), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete diagnosis",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Diagnosis deleted successfully",
+	})
+}
+
+func AddOrder(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var o Order
+	if err := c.BodyParser(&o); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	o.OrderType = strings.ToLower(o.OrderType)
+	if !orderTypes[o.OrderType] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Order type must be one of lab, imaging, procedure, referral, other",
+		})
+	}
+	if strings.TrimSpace(o.Description) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Order description is required",
+		})
+	}
+
+	o.EncounterID = c.Params("id")
+	if status, msg := editable(o.EncounterID, middleware.CurrentUserID(c)); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	o.ID = uuid.New().String()[:8]
+	o.Status = "requested"
+	o.CreatedAt = time.Now()
+
+	_, err := db.Exec(context.Background(), `INSERT INTO encounter_orders (id, encounter_id, order_type, description, status, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		o.ID, o.EncounterID, o.OrderType, o.Description, o.Status, o.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add order",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Order added successfully",
+		"order": o,
+	})
+}
+
+func DeleteOrder(c *fiber.Ctx) error {
+	db := database.GetDB()
+	if status, msg := editable(c.Params("id"), middleware.CurrentUserID(c)); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	_, err := db.Exec(context.Background(), `DELETE FROM encounter_orders WHERE id=$1 AND encounter_id=$2`, c.Params("orderId"), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete order",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Order deleted successfully",
+	})
+}
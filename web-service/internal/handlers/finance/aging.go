@@ -0,0 +1,115 @@
+package finance
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// outstanding is every issued invoice with money still owed on it, split
+// between what the insurer and the patient still owe and aged in days from
+// the date it was issued.
+const outstanding = `SELECT b.id, b.patient_id, p.first_name || ' ' || p.last_name AS patient_name, s.payer_id,
+		CURRENT_DATE - b.issued_at::date AS age,
+		GREATEST(0, LEAST(b.insurer_share - COALESCE((SELECT SUM(a.amount) FROM payment_allocations a JOIN payments y ON y.id = a.payment_id
+			WHERE a.invoice_id = b.id AND y.method = 'insurance'), 0), b.amount - b.amount_credited - b.amount_paid)) AS insurer_due,
+		b.amount - b.amount_credited - b.amount_paid AS balance
+	FROM billing b
+	JOIN patients p ON p.id = b.patient_id
+	LEFT JOIN insurance_schemes s ON s.id = b.scheme_id
+	WHERE b.status IN ('issued', 'partially_paid')`
+
+// AgingRow is what one patient or insurer owes, by how long it has been owed.
+type AgingRow struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Invoices   int             `json:"invoices"`
+	Days0To30  decimal.Decimal `json:"days_0_30"`
+	Days31To60 decimal.Decimal `json:"days_31_60"`
+	Days61To90 decimal.Decimal `json:"days_61_90"`
+	Over90     decimal.Decimal `json:"days_over_90"`
+	Total      decimal.Decimal `json:"total"`
+}
+
+func (r *AgingRow) add(o AgingRow) {
+	r.Invoices += o.Invoices
+	r.Days0To30 = r.Days0To30.Add(o.Days0To30)
+	r.Days31To60 = r.Days31To60.Add(o.Days31To60)
+	r.Days61To90 = r.Days61To90.Add(o.Days61To90)
+	r.Over90 = r.Over90.Add(o.Over90)
+	r.Total = r.Total.Add(o.Total)
+}
+
+// agingBases are who a receivable is owed by: the patient's share of each
+// invoice, or the share billed to their insurer.
+var agingBases = map[string]struct{ key, name, due, join string }{
+	"patient": {"o.patient_id", "o.patient_name", "o.balance - o.insurer_due", ""},
+	"insurer": {"o.payer_id", "r.name", "o.insurer_due", "JOIN insurance_payers r ON r.id = o.payer_id"},
+}
+
+// GetReceivables ages what is owed on issued invoices into 0-30, 31-60,
+// 61-90 and over 90 days, per patient or with ?by=insurer per insurer.
+func GetReceivables(c *fiber.Ctx) error {
+	by := c.Query("by", "patient")
+	basis, ok := agingBases[by]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "by must be patient or insurer",
+		})
+	}
+
+	rows, err := database.GetDB().Query(context.Background(), `SELECT `+basis.key+`, `+basis.name+`, COUNT(*),
+			COALESCE(SUM(o.due) FILTER (WHERE o.age <= 30), 0), COALESCE(SUM(o.due) FILTER (WHERE o.age BETWEEN 31 AND 60), 0),
+			COALESCE(SUM(o.due) FILTER (WHERE o.age BETWEEN 61 AND 90), 0), COALESCE(SUM(o.due) FILTER (WHERE o.age > 90), 0), SUM(o.due)
+		FROM (SELECT o.*, `+basis.due+` AS due FROM (`+outstanding+`) o) o `+basis.join+`
+		WHERE o.due > 0
+		GROUP BY 1, 2
+		ORDER BY SUM(o.due) DESC, 2`)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to build receivables report",
+			"details": err.Error(),
+		})
+	}
+	aging, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AgingRow, error) {
+		var r AgingRow
+		err := row.Scan(&r.ID, &r.Name, &r.Invoices, &r.Days0To30, &r.Days31To60, &r.Days61To90, &r.Over90, &r.Total)
+		return r, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	total := AgingRow{Name: "Total"}
+	t := table{
+		title:   "Receivables aging by " + by,
+		info:    [][2]string{{"As of", time.Now().Format("02 Jan 2006")}, {"Aged from", "Invoice date"}},
+		headers: []string{"ID", "Name", "Invoices", "0-30", "31-60", "61-90", "Over 90", "Total"},
+		widths:  []float64{18, 44, 16, 20, 20, 20, 20, 22},
+		align:   []string{"L", "L", "R", "R", "R", "R", "R", "R"},
+	}
+	for _, r := range aging {
+		total.add(r)
+		t.rows = append(t.rows, agingCells(r))
+	}
+	t.rows = append(t.rows, agingCells(total))
+
+	return send(c, fiber.Map{
+		"as_of": time.Now().Format("2006-01-02"),
+		"by":    by,
+		"rows":  aging,
+		"total": total,
+	}, t, "receivables-"+by+"-"+time.Now().Format("20060102"))
+}
+
+func agingCells(r AgingRow) []string {
+	return []string{r.ID, r.Name, strconv.Itoa(r.Invoices), money(r.Days0To30), money(r.Days31To60), money(r.Days61To90), money(r.Over90),
+		money(r.Total)}
+}
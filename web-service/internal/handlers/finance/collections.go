@@ -0,0 +1,97 @@
+package finance
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// collected is money received, less voided payments, and money refunded,
+// as one row per receipt or refund.
+const collected = `SELECT received_at AS at, method, received_by AS staff_id, 1 AS receipts, amount AS received, 0 AS refunded
+		FROM payments WHERE status <> 'void'
+	UNION ALL SELECT created_at, method, refunded_by, 0, 0, amount FROM payment_refunds`
+
+// DayCollection is one day's takings by one payment method.
+type DayCollection struct {
+	Date string `json:"date"`
+	MethodTotal
+}
+
+// GetCollections totals each day's takings from ?from= to ?to= by payment
+// method. Voided payments are left out; refunds count on the day they were
+// given.
+func GetCollections(c *fiber.Ctx) error {
+	from, to, err := parseRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	rows, err := database.GetDB().Query(context.Background(), `SELECT to_char(t.at, 'YYYY-MM-DD'), t.method, SUM(t.receipts),
+			SUM(t.received), SUM(t.refunded), SUM(t.received) - SUM(t.refunded)
+		FROM (`+collected+`) t
+		WHERE t.at >= $1 AND t.at < $2
+		GROUP BY 1, 2
+		ORDER BY 1, 2`, from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to build collections report",
+			"details": err.Error(),
+		})
+	}
+	days, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DayCollection, error) {
+		var d DayCollection
+		err := row.Scan(&d.Date, &d.Method, &d.Receipts, &d.Received, &d.Refunded, &d.Net)
+		return d, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	byMethod := map[string]*MethodTotal{}
+	total := MethodTotal{Method: "total"}
+	t := table{
+		title:   "Collections",
+		info:    [][2]string{{"Period", period(from, to)}, {"Printed", time.Now().Format("02 Jan 2006 15:04")}},
+		headers: []string{"Date", "Method", "Receipts", "Received", "Refunded", "Net"},
+		widths:  []float64{28, 36, 20, 32, 32, 32},
+		align:   []string{"L", "L", "R", "R", "R", "R"},
+	}
+	for _, d := range days {
+		m, ok := byMethod[d.Method]
+		if !ok {
+			m = &MethodTotal{Method: d.Method}
+			byMethod[d.Method] = m
+		}
+		m.add(d.MethodTotal)
+		total.add(d.MethodTotal)
+		t.rows = append(t.rows, []string{d.Date, methodLabels[d.Method], strconv.Itoa(d.Receipts), money(d.Received), money(d.Refunded), money(d.Net)})
+	}
+	methods := []MethodTotal{}
+	for _, m := range byMethod {
+		methods = append(methods, *m)
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Method < methods[j].Method })
+	for _, m := range methods {
+		t.rows = append(t.rows, []string{"Total", methodLabels[m.Method], strconv.Itoa(m.Receipts), money(m.Received), money(m.Refunded), money(m.Net)})
+	}
+	t.rows = append(t.rows, []string{"Total", "All methods", strconv.Itoa(total.Receipts), money(total.Received), money(total.Refunded),
+		money(total.Net)})
+
+	return send(c, fiber.Map{
+		"from":    from.Format("2006-01-02"),
+		"to":      to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"days":    days,
+		"methods": methods,
+		"total":   total,
+	}, t, "collections-"+from.Format("20060102"))
+}
@@ -0,0 +1,125 @@
+// Package finance reports on money owed and collected: receivables aging
+// for patients and insurers, daily collections, and the cash each cashier
+// takes over a shift.
+package finance
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"time"
+
+	"web-service/internal/pdfdoc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+}
+
+// table is a report as it is printed or exported.
+type table struct {
+	title   string
+	info    [][2]string
+	headers []string
+	widths  []float64
+	align   []string
+	rows    [][]string
+}
+
+// send writes a report as JSON, or as CSV or PDF when ?format= asks for it.
+func send(c *fiber.Ctx, data any, t table, filename string) error {
+	var body []byte
+	var err error
+	format := c.Query("format", "json")
+	switch format {
+	case "json":
+		return c.JSON(data)
+	case "csv":
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write(t.headers)
+		w.WriteAll(t.rows)
+		body, err = buf.Bytes(), w.Error()
+		c.Set(fiber.HeaderContentType, "text/csv")
+	case "pdf":
+		doc := pdfdoc.New(t.title)
+		doc.KeyValues(t.info)
+		doc.Table(t.headers, t.widths, t.align, t.rows)
+		body, err = doc.Bytes()
+		c.Set(fiber.HeaderContentType, "application/pdf")
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format must be json, csv or pdf",
+		})
+	}
+	if err != nil {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to export report",
+			"details": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+	return c.Send(body)
+}
+
+func money(v decimal.Decimal) string {
+	return v.StringFixed(2)
+}
+
+// parseRange reads the ?from= and ?to= dates of a report, both inclusive
+// and today by default. The end returned is the start of the day after.
+func parseRange(c *fiber.Ctx) (from, to time.Time, err error) {
+	now := time.Now()
+	from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if q := c.Query("from"); q != "" {
+		if from, err = time.ParseInLocation("2006-01-02", q, time.Local); err != nil {
+			return from, to, errors.New("Invalid from date, expected YYYY-MM-DD")
+		}
+	}
+	to = from
+	if q := c.Query("to"); q != "" {
+		if to, err = time.ParseInLocation("2006-01-02", q, time.Local); err != nil {
+			return from, to, errors.New("Invalid to date, expected YYYY-MM-DD")
+		}
+	}
+	if to.Before(from) {
+		return from, to, errors.New("to cannot be before from")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// period describes a report's dates for its heading.
+func period(from, to time.Time) string {
+	last := to.AddDate(0, 0, -1)
+	if last.Equal(from) {
+		return from.Format("02 Jan 2006")
+	}
+	return from.Format("02 Jan 2006") + " - " + last.Format("02 Jan 2006")
+}
+
+var methodLabels = map[string]string{
+	"cash": "Cash", "card": "Card", "mobile_money": "Mobile money", "insurance": "Insurance",
+}
+
+// MethodTotal is what was taken and given back by one payment method.
+type MethodTotal struct {
+	Method   string          `json:"method"`
+	Receipts int             `json:"receipts"`
+	Received decimal.Decimal `json:"received"`
+	Refunded decimal.Decimal `json:"refunded"`
+	Net      decimal.Decimal `json:"net"`
+}
+
+func (m *MethodTotal) add(o MethodTotal) {
+	m.Receipts += o.Receipts
+	m.Received = m.Received.Add(o.Received)
+	m.Refunded = m.Refunded.Add(o.Refunded)
+	m.Net = m.Received.Sub(m.Refunded)
+}
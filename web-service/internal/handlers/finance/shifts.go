@@ -0,0 +1,368 @@
+package finance
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+)
+
+// Shift is a cashier's spell at the till, from counting in an opening float
+// to counting the drawer at close. While it is open the cash figures are
+// worked out from the payments and refunds the cashier has recorded.
+type Shift struct {
+	ID           string           `json:"id"`
+	CashierID    string           `json:"cashier_id"`
+	CashierName  string           `json:"cashier_name"`
+	Status       string           `json:"status"`
+	OpeningFloat decimal.Decimal  `json:"opening_float"`
+	OpenedAt     time.Time        `json:"opened_at"`
+	CashReceived decimal.Decimal  `json:"cash_received"`
+	CashRefunded decimal.Decimal  `json:"cash_refunded"`
+	ExpectedCash decimal.Decimal  `json:"expected_cash"`
+	CountedCash  *decimal.Decimal `json:"counted_cash,omitempty"`
+	Variance     *decimal.Decimal `json:"variance,omitempty"`
+	ClosedAt     *time.Time       `json:"closed_at,omitempty"`
+	ClosedBy     *string          `json:"closed_by,omitempty"`
+	Notes        *string          `json:"notes,omitempty"`
+	Collections  []MethodTotal    `json:"collections,omitempty"`
+}
+
+// inShift limits collected rows to a shift's cashier and hours.
+const inShift = `t.staff_id = s.cashier_id AND t.at >= s.opened_at AND (s.closed_at IS NULL OR t.at < s.closed_at)`
+
+const shiftColumns = `s.id, s.cashier_id, st.first_name || ' ' || st.last_name, s.status, s.opening_float, s.opened_at,
+	COALESCE(s.cash_received, (SELECT COALESCE(SUM(t.received), 0) FROM (` + collected + `) t WHERE t.method = 'cash' AND ` + inShift + `)),
+	COALESCE(s.cash_refunded, (SELECT COALESCE(SUM(t.refunded), 0) FROM (` + collected + `) t WHERE t.method = 'cash' AND ` + inShift + `)),
+	s.counted_cash, s.variance, s.closed_at, s.closed_by, s.notes`
+
+const shiftTables = `cashier_shifts s JOIN staff st ON st.id = s.cashier_id`
+
+func (s *Shift) scanTargets() []any {
+	return []any{&s.ID, &s.CashierID, &s.CashierName, &s.Status, &s.OpeningFloat, &s.OpenedAt, &s.CashReceived, &s.CashRefunded,
+		&s.CountedCash, &s.Variance, &s.ClosedAt, &s.ClosedBy, &s.Notes}
+}
+
+func (s *Shift) expected() {
+	s.ExpectedCash = s.OpeningFloat.Add(s.CashReceived).Sub(s.CashRefunded)
+}
+
+func scanShift(row pgx.CollectableRow) (Shift, error) {
+	var s Shift
+	err := row.Scan(s.scanTargets()...)
+	s.expected()
+	return s, err
+}
+
+// fetchShift loads a shift with its takings by payment method.
+func fetchShift(ctx context.Context, q querier, id string) (*Shift, error) {
+	rows, err := q.Query(ctx, `SELECT `+shiftColumns+` FROM `+shiftTables+` WHERE s.id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	s, err := pgx.CollectExactlyOneRow(rows, scanShift)
+	if err != nil {
+		return nil, err
+	}
+	rows, err = q.Query(ctx, `SELECT t.method, SUM(t.receipts), SUM(t.received), SUM(t.refunded), SUM(t.received) - SUM(t.refunded)
+		FROM (`+collected+`) t, cashier_shifts s
+		WHERE s.id = $1 AND `+inShift+`
+		GROUP BY 1 ORDER BY 1`, id)
+	if err != nil {
+		return nil, err
+	}
+	s.Collections, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (MethodTotal, error) {
+		var m MethodTotal
+		err := row.Scan(&m.Method, &m.Receipts, &m.Received, &m.Refunded, &m.Net)
+		return m, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetShifts lists shifts, newest first, optionally for one cashier or
+// status.
+func GetShifts(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+
+	filter := `WHERE ($1 = '' OR s.cashier_id = $1) AND ($2 = '' OR s.status = $2)`
+	args := []any{c.Query("cashier_id"), c.Query("status")}
+
+	var total int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM cashier_shifts s `+filter, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rows, err := db.Query(ctx, `SELECT `+shiftColumns+` FROM `+shiftTables+` `+filter+`
+		ORDER BY s.opened_at DESC LIMIT $3 OFFSET $4`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	shifts, err := pgx.CollectRows(rows, scanShift)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"items": shifts,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+// GetShift shows a shift to its cashier or a supervisor.
+func GetShift(c *fiber.Ctx) error {
+	s, err := fetchShift(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Shift not found",
+		})
+	}
+	if s.CashierID != middleware.CurrentUserID(c) && !middleware.HasRole(c, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the cashier or a supervisor can view this shift",
+		})
+	}
+	return c.JSON(s)
+}
+
+// GetCurrentShift returns the caller's open shift with what the drawer
+// should hold so far.
+func GetCurrentShift(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var id string
+	err := database.GetDB().QueryRow(ctx, `SELECT id FROM cashier_shifts WHERE cashier_id = $1 AND status = 'open'`,
+		middleware.CurrentUserID(c)).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No open shift",
+		})
+	}
+	var s *Shift
+	if err == nil {
+		s, err = fetchShift(ctx, database.GetDB(), id)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(s)
+}
+
+// OpenShift starts a shift for the caller with the float counted into the
+// drawer.
+func OpenShift(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		OpeningFloat decimal.Decimal `json:"opening_float"`
+		Notes        *string         `json:"notes"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if req.OpeningFloat.IsNegative() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "opening_float cannot be negative",
+		})
+	}
+	if req.Notes != nil && strings.TrimSpace(*req.Notes) == "" {
+		req.Notes = nil
+	}
+
+	id := uuid.New().String()[:8]
+	now := time.Now()
+	_, err := database.GetDB().Exec(ctx, `INSERT INTO cashier_shifts (id, cashier_id, opening_float, opened_at, notes, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $4, $4)`, id, middleware.CurrentUserID(c), req.OpeningFloat.Round(2), now, req.Notes)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.ConstraintName == "uq_cashier_shifts_open" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "You already have an open shift; close it first",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to open shift",
+			"details": err.Error(),
+		})
+	}
+
+	s, err := fetchShift(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Shift opened successfully",
+		"shift": s,
+	})
+}
+
+// CloseShift records the cash counted in the drawer and keeps what was
+// expected and the difference. A cashier closes their own shift; a
+// supervisor can close anyone's. A difference needs an explanation.
+func CloseShift(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req struct {
+		CountedCash *decimal.Decimal `json:"counted_cash"`
+		Notes       string           `json:"notes"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if req.CountedCash == nil || req.CountedCash.IsNegative() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "counted_cash is required and cannot be negative",
+		})
+	}
+	counted := req.CountedCash.Round(2)
+	req.Notes = strings.TrimSpace(req.Notes)
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	staffID := middleware.CurrentUserID(c)
+	var cashierID, status string
+	err = tx.QueryRow(ctx, `SELECT cashier_id, status FROM cashier_shifts WHERE id = $1 FOR UPDATE`, c.Params("id")).Scan(&cashierID, &status)
+	if err == pgx.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Shift not found",
+		})
+	}
+	if err == nil && cashierID != staffID && !middleware.HasRole(c, "admin") {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the cashier or a supervisor can close this shift",
+		})
+	}
+	if err == nil && status != "open" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The shift is already closed",
+		})
+	}
+
+	// Close first so the figures are worked out up to the closing time
+	var s *Shift
+	now := time.Now()
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE cashier_shifts SET status = 'closed', closed_at = $1, closed_by = $2, counted_cash = $3, updated_at = $1
+			WHERE id = $4`, now, staffID, counted, c.Params("id"))
+	}
+	if err == nil {
+		s, err = fetchShift(ctx, tx, c.Params("id"))
+	}
+	if err == nil {
+		variance := counted.Sub(s.ExpectedCash)
+		if !variance.IsZero() && req.Notes == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "The count is " + variance.StringFixed(2) + " against the " + s.ExpectedCash.StringFixed(2) + " expected; notes must explain the difference",
+			})
+		}
+		s.CountedCash, s.Variance = &counted, &variance
+		if req.Notes != "" {
+			s.Notes = &req.Notes
+		}
+		_, err = tx.Exec(ctx, `UPDATE cashier_shifts SET cash_received = $1, cash_refunded = $2, expected_cash = $3, variance = $4, notes = $5
+			WHERE id = $6`, s.CashReceived, s.CashRefunded, s.ExpectedCash, variance, s.Notes, s.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to close shift",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Shift closed successfully",
+		"shift": s,
+	})
+}
+
+// GetShiftReport is the end-of-day report of the shifts opened from ?from=
+// to ?to=, optionally for one ?cashier_id=, with what each drawer should
+// have held against what was counted.
+func GetShiftReport(c *fiber.Ctx) error {
+	from, to, err := parseRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rows, err := database.GetDB().Query(context.Background(), `SELECT `+shiftColumns+` FROM `+shiftTables+`
+		WHERE s.opened_at >= $1 AND s.opened_at < $2 AND ($3 = '' OR s.cashier_id = $3)
+		ORDER BY s.opened_at`, from, to, c.Query("cashier_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to build shift report",
+			"details": err.Error(),
+		})
+	}
+	shifts, err := pgx.CollectRows(rows, scanShift)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var expected, counted, variance decimal.Decimal
+	t := table{
+		title:   "Cashier shifts",
+		info:    [][2]string{{"Period", period(from, to)}, {"Printed", time.Now().Format("02 Jan 2006 15:04")}},
+		headers: []string{"Cashier", "Opened", "Closed", "Float", "Cash in", "Cash out", "Expected", "Counted", "Variance"},
+		widths:  []float64{30, 22, 22, 16, 18, 18, 18, 18, 18},
+		align:   []string{"L", "L", "L", "R", "R", "R", "R", "R", "R"},
+	}
+	for _, s := range shifts {
+		closed, count, diff := "open", "-", "-"
+		if s.ClosedAt != nil {
+			closed = s.ClosedAt.Format("02/01 15:04")
+			count, diff = money(*s.CountedCash), money(*s.Variance)
+			counted = counted.Add(*s.CountedCash)
+			variance = variance.Add(*s.Variance)
+		}
+		expected = expected.Add(s.ExpectedCash)
+		t.rows = append(t.rows, []string{s.CashierName, s.OpenedAt.Format("02/01 15:04"), closed, money(s.OpeningFloat), money(s.CashReceived),
+			money(s.CashRefunded), money(s.ExpectedCash), count, diff})
+	}
+	t.rows = append(t.rows, []string{"Total", "", "", "", "", "", money(expected), money(counted), money(variance)})
+
+	return send(c, fiber.Map{
+		"from":   from.Format("2006-01-02"),
+		"to":     to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"shifts": shifts,
+		"totals": fiber.Map{"expected_cash": expected, "counted_cash": counted, "variance": variance},
+	}, t, "shifts-"+from.Format("20060102"))
+}
@@ -0,0 +1,177 @@
+package icd10
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+type Code struct {
+	Code         string `json:"code"`
+	Description  string `json:"description"`
+	Chapter      string `json:"chapter"`
+	ChapterTitle string `json:"chapter_title"`
+}
+
+// MorbidityRow is the number of diagnoses recorded for one chapter or code.
+type MorbidityRow struct {
+	Key         string `json:"key"`
+	Description string `json:"description"`
+	Chapter     string `json:"chapter"`
+	Diagnoses   int    `json:"diagnoses"`
+	Patients    int    `json:"patients"`
+}
+
+// A query shaped like a code (letter, digit, ...) is matched as a code prefix
+var codePattern = regexp.MustCompile(`^[A-Za-z][0-9][0-9A-Za-z.]*$`)
+
+// Lookup fetches a single code, it is used to validate coded diagnoses.
+func Lookup(code string) (Code, error) {
+	db := database.GetDB()
+	var ic Code
+	err := db.QueryRow(context.Background(), `SELECT code, description, chapter, chapter_title FROM icd10_codes WHERE code=$1`, NormaliseCode(code)).Scan(
+		&ic.Code, &ic.Description, &ic.Chapter, &ic.ChapterTitle,
+	)
+	return ic, err
+}
+
+func SearchCodes(c *fiber.Ctx) error {
+	db := database.GetDB()
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Search query q is required",
+		})
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit < 1 || limit > 50 {
+		limit = 20
+	}
+
+	var query string
+	var arg string
+	if codePattern.MatchString(q) {
+		query = `SELECT code, description, chapter, chapter_title FROM icd10_codes WHERE code LIKE $1 ORDER BY code LIMIT $2`
+		arg = NormaliseCode(q) + "%"
+	} else {
+		query = `SELECT code, description, chapter, chapter_title FROM icd10_codes
+			WHERE to_tsvector('english', description) @@ plainto_tsquery('english', $1)
+			ORDER BY ts_rank(to_tsvector('english', description), plainto_tsquery('english', $1)) DESC, code
+			LIMIT $2`
+		arg = q
+	}
+
+	rows, err := db.Query(context.Background(), query, arg, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to search ICD-10 codes",
+			"details": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	codes := []Code{}
+	for rows.Next() {
+		var ic Code
+		if err := rows.Scan(&ic.Code, &ic.Description, &ic.Chapter, &ic.ChapterTitle); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		codes = append(codes, ic)
+	}
+
+	return c.JSON(codes)
+}
+
+func GetCode(c *fiber.Ctx) error {
+	ic, err := Lookup(c.Params("code"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "ICD-10 code not found",
+		})
+	}
+
+	return c.JSON(ic)
+}
+
+// GetMorbidityReport counts coded encounter diagnoses between from and to,
+// grouped by chapter or by code.
+func GetMorbidityReport(c *fiber.Ctx) error {
+	db := database.GetDB()
+
+	groupBy := c.Query("group_by", "chapter")
+	if groupBy != "chapter" && groupBy != "code" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "group_by must be chapter or code",
+		})
+	}
+
+	to := time.Now()
+	from := to.AddDate(0, -1, 0)
+	if q := c.Query("from"); q != "" {
+		t, err := time.Parse("2006-01-02", q)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from date, expected YYYY-MM-DD",
+			})
+		}
+		from = t
+	}
+	if q := c.Query("to"); q != "" {
+		t, err := time.Parse("2006-01-02", q)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to date, expected YYYY-MM-DD",
+			})
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	primaryOnly := c.Query("primary_only") == "true"
+
+	var keyColumns string
+	if groupBy == "chapter" {
+		keyColumns = `ic.chapter, ic.chapter_title, ic.chapter`
+	} else {
+		keyColumns = `ic.code, ic.description, ic.chapter`
+	}
+
+	rows, err := db.Query(context.Background(), `
+		SELECT `+keyColumns+`, COUNT(*), COUNT(DISTINCT e.patient_id)
+		FROM encounter_diagnoses d
+		JOIN icd10_codes ic ON ic.code = d.icd10_code
+		JOIN encounters e ON e.id = d.encounter_id
+		WHERE e.opened_at >= $1 AND e.opened_at < $2 AND ($3 = FALSE OR d.is_primary)
+		GROUP BY 1, 2, 3
+		ORDER BY 4 DESC, 1`, from, to, primaryOnly)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to build morbidity report",
+			"details": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	report := []MorbidityRow{}
+	for rows.Next() {
+		var r MorbidityRow
+		if err := rows.Scan(&r.Key, &r.Description, &r.Chapter, &r.Diagnoses, &r.Patients); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		report = append(report, r)
+	}
+
+	return c.JSON(fiber.Map{
+		"group_by": groupBy,
+		"from":     from.Format("2006-01-02"),
+		"to":       to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"rows":     report,
+	})
+}
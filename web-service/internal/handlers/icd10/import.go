@@ -0,0 +1,73 @@
+package icd10
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Import loads a code,description CSV file into icd10_codes. Existing codes are
+// updated so the command can be re-run when a newer edition is released. A
+// file with fewer than minCodes entries is refused, as coded diagnoses need
+// the full classification rather than an extract.
+func Import(ctx context.Context, db *pgxpool.Pool, r io.Reader, minCodes int) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+	if strings.ToLower(header[0]) != "code" || strings.ToLower(header[1]) != "description" {
+		return 0, fmt.Errorf("unexpected header %v, expected code,description", header)
+	}
+
+	batch := &pgx.Batch{}
+	now := time.Now()
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		code := NormaliseCode(record[0])
+		description := strings.TrimSpace(record[1])
+		number, title, ok := ChapterOf(code)
+		if !ok || description == "" {
+			return 0, fmt.Errorf("line %d: invalid entry %q", line, code)
+		}
+
+		batch.Queue(`INSERT INTO icd10_codes (code, description, chapter, chapter_title, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $5)
+			ON CONFLICT (code) DO UPDATE SET description=EXCLUDED.description, chapter=EXCLUDED.chapter,
+				chapter_title=EXCLUDED.chapter_title, updated_at=EXCLUDED.updated_at`,
+			code, description, number, title, now)
+	}
+
+	if batch.Len() < minCodes {
+		return 0, fmt.Errorf("only %d codes in the file, expected the full list of at least %d", batch.Len(), minCodes)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return batch.Len(), nil
+}
@@ -0,0 +1,389 @@
+package insurance
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/billing"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// Batch is a set of claims sent to one payer together.
+type Batch struct {
+	ID            string          `json:"id"`
+	BatchNumber   string          `json:"batch_number"`
+	PayerID       string          `json:"payer_id"`
+	PayerName     string          `json:"payer_name"`
+	Status        string          `json:"status"`
+	ClaimCount    int             `json:"claim_count"`
+	TotalClaimed  decimal.Decimal `json:"total_claimed"`
+	TotalApproved decimal.Decimal `json:"total_approved"`
+	TotalPaid     decimal.Decimal `json:"total_paid"`
+	CreatedBy     string          `json:"created_by"`
+	SubmittedBy   *string         `json:"submitted_by,omitempty"`
+	SubmittedAt   *time.Time      `json:"submitted_at,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+	Claims        []Claim         `json:"claims,omitempty"`
+}
+
+const batchColumns = `t.id, t.batch_number, t.payer_id, y.name, t.status,
+	(SELECT COUNT(*) FROM insurance_claims WHERE batch_id = t.id),
+	(SELECT COALESCE(SUM(claimed_amount), 0) FROM insurance_claims WHERE batch_id = t.id),
+	(SELECT COALESCE(SUM(approved_amount), 0) FROM insurance_claims WHERE batch_id = t.id),
+	(SELECT COALESCE(SUM(paid_amount), 0) FROM insurance_claims WHERE batch_id = t.id),
+	t.created_by, t.submitted_by, t.submitted_at, t.created_at, t.updated_at`
+
+func (t *Batch) scanTargets() []any {
+	return []any{&t.ID, &t.BatchNumber, &t.PayerID, &t.PayerName, &t.Status, &t.ClaimCount, &t.TotalClaimed, &t.TotalApproved,
+		&t.TotalPaid, &t.CreatedBy, &t.SubmittedBy, &t.SubmittedAt, &t.CreatedAt, &t.UpdatedAt}
+}
+
+func fetchBatch(ctx context.Context, q querier, id string) (*Batch, error) {
+	var t Batch
+	err := q.QueryRow(ctx, `SELECT `+batchColumns+` FROM insurance_claim_batches t JOIN insurance_payers y ON y.id = t.payer_id
+		WHERE t.id = $1`, id).Scan(t.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	if t.Claims, err = fetchClaims(ctx, q, `WHERE c.batch_id = $1 ORDER BY c.claim_number`, id); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func GetBatches(c *fiber.Ctx) error {
+	rows, err := database.GetDB().Query(context.Background(), `SELECT `+batchColumns+` FROM insurance_claim_batches t
+		JOIN insurance_payers y ON y.id = t.payer_id
+		WHERE ($1 = '' OR t.payer_id = $1) AND ($2 = '' OR t.status = $2) ORDER BY t.created_at DESC`, c.Query("payer_id"), c.Query("status"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	batches, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Batch, error) {
+		var t Batch
+		err := row.Scan(t.scanTargets()...)
+		return t, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(batches)
+}
+
+func GetBatch(c *fiber.Ctx) error {
+	t, err := fetchBatch(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Claim batch not found",
+		})
+	}
+	return c.JSON(t)
+}
+
+type batchRequest struct {
+	PayerID  string   `json:"payer_id"`
+	ClaimIDs []string `json:"claim_ids"`
+}
+
+// CreateBatch gathers a payer's draft claims that are not yet in a batch,
+// or just the ones listed, into a new batch.
+func CreateBatch(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req batchRequest
+	if err := c.BodyParser(&req); err != nil || req.PayerID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "payer_id is required",
+		})
+	}
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := uuid.New().String()[:8]
+	now := time.Now()
+	_, err = tx.Exec(ctx, `INSERT INTO insurance_claim_batches (id, batch_number, payer_id, created_by, created_at, updated_at)
+		VALUES ($1, 'BAT-' || LPAD(nextval('claim_batch_number_seq')::text, 6, '0'), $2, $3, $4, $4)`,
+		id, req.PayerID, middleware.CurrentUserID(c), now)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "payer_id is not a payer",
+		})
+	}
+	tag, err := tx.Exec(ctx, `UPDATE insurance_claims SET batch_id = $1, updated_at = $2
+		WHERE payer_id = $3 AND status = 'draft' AND batch_id IS NULL AND (COALESCE(cardinality($4::text[]), 0) = 0 OR id = ANY($4))`,
+		id, now, req.PayerID, req.ClaimIDs)
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The payer has no draft claims waiting to be batched",
+		})
+	}
+	if err == nil && len(req.ClaimIDs) > 0 && tag.RowsAffected() != int64(len(req.ClaimIDs)) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Some claims are not draft claims of this payer waiting to be batched",
+		})
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create claim batch",
+			"details": err.Error(),
+		})
+	}
+
+	t, err := fetchBatch(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Claim batch created successfully",
+		"batch": t,
+	})
+}
+
+// SubmitBatch marks a draft batch and its claims as sent to the payer.
+func SubmitBatch(c *fiber.Ctx) error {
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	staffID := middleware.CurrentUserID(c)
+	now := time.Now()
+	tag, err := tx.Exec(ctx, `UPDATE insurance_claim_batches SET status = 'submitted', submitted_by = $1, submitted_at = $2, updated_at = $2
+		WHERE id = $3 AND status = 'draft'`, staffID, now, id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only draft batches can be submitted",
+		})
+	}
+	var claimIDs []string
+	if err == nil {
+		var rows pgx.Rows
+		rows, err = tx.Query(ctx, `UPDATE insurance_claims SET status = 'submitted', updated_at = $1 WHERE batch_id = $2 RETURNING id`, now, id)
+		if err == nil {
+			claimIDs, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		}
+	}
+	if err == nil && len(claimIDs) == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The batch has no claims left to submit",
+		})
+	}
+	for _, claimID := range claimIDs {
+		if err != nil {
+			break
+		}
+		err = recordEvent(ctx, tx, claimID, "submitted", nil, staffID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to submit claim batch",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Claim batch submitted successfully",
+	})
+}
+
+// claimLine is an invoice line as sent to the payer.
+type claimLine struct {
+	ItemType    string          `json:"item_type" xml:"ItemType"`
+	Description string          `json:"description" xml:"Description"`
+	Quantity    int             `json:"quantity" xml:"Quantity"`
+	UnitPrice   decimal.Decimal `json:"unit_price" xml:"UnitPrice"`
+	Discount    decimal.Decimal `json:"discount" xml:"Discount"`
+	Tax         decimal.Decimal `json:"tax" xml:"Tax"`
+	Amount      decimal.Decimal `json:"amount" xml:"Amount"`
+}
+
+// claimRecord is a claim as sent to the payer: the covered lines of the
+// invoice, the patient's co-pay and the amount claimed.
+type claimRecord struct {
+	ClaimNumber       string          `json:"claim_number" xml:"ClaimNumber"`
+	InvoiceNumber     string          `json:"invoice_number" xml:"InvoiceNumber"`
+	InvoiceDate       string          `json:"invoice_date" xml:"InvoiceDate"`
+	MemberNumber      string          `json:"member_number" xml:"MemberNumber"`
+	PatientName       string          `json:"patient_name" xml:"PatientName"`
+	PrincipalMember   string          `json:"principal_member" xml:"PrincipalMember"`
+	Relationship      string          `json:"relationship" xml:"Relationship"`
+	SchemeCode        string          `json:"scheme_code" xml:"SchemeCode"`
+	InvoiceTotal      decimal.Decimal `json:"invoice_total" xml:"InvoiceTotal"`
+	Copay             decimal.Decimal `json:"copay" xml:"Copay"`
+	ClaimedAmount     decimal.Decimal `json:"claimed_amount" xml:"ClaimedAmount"`
+	Preauthorisations []string        `json:"preauthorisations" xml:"Preauthorisations>PreauthNumber"`
+	Lines             []claimLine     `json:"lines" xml:"Lines>Line"`
+}
+
+type batchRecord struct {
+	XMLName      xml.Name        `json:"-" xml:"ClaimBatch"`
+	BatchNumber  string          `json:"batch_number" xml:"BatchNumber"`
+	PayerCode    string          `json:"payer_code" xml:"PayerCode"`
+	PayerName    string          `json:"payer_name" xml:"PayerName"`
+	SubmittedAt  string          `json:"submitted_at" xml:"SubmittedAt"`
+	ClaimCount   int             `json:"claim_count" xml:"ClaimCount"`
+	TotalClaimed decimal.Decimal `json:"total_claimed" xml:"TotalClaimed"`
+	Claims       []claimRecord   `json:"claims" xml:"Claims>Claim"`
+}
+
+// buildExport gathers what the payer needs to assess each claim in a batch.
+func buildExport(ctx context.Context, t *Batch) (*batchRecord, string, error) {
+	db := database.GetDB()
+	out := &batchRecord{BatchNumber: t.BatchNumber, PayerName: t.PayerName, ClaimCount: t.ClaimCount, TotalClaimed: t.TotalClaimed,
+		Claims: []claimRecord{}}
+	var format string
+	err := db.QueryRow(ctx, `SELECT code, claim_format FROM insurance_payers WHERE id = $1`, t.PayerID).Scan(&out.PayerCode, &format)
+	if err != nil {
+		return nil, "", err
+	}
+	if t.SubmittedAt != nil {
+		out.SubmittedAt = t.SubmittedAt.Format("2006-01-02")
+	}
+
+	for _, cl := range t.Claims {
+		r := claimRecord{ClaimNumber: cl.ClaimNumber, MemberNumber: cl.MemberNumber, PatientName: cl.PatientName, ClaimedAmount: cl.ClaimedAmount}
+		var covered []string
+		err := db.QueryRow(ctx, `SELECT i.principal_member_name, i.principal_relationship, s.code, s.covered_item_types
+			FROM patient_insurance i JOIN insurance_schemes s ON s.id = $2 WHERE i.id = $1`, cl.InsuranceID, cl.SchemeID).
+			Scan(&r.PrincipalMember, &r.Relationship, &r.SchemeCode, &covered)
+		if err != nil {
+			return nil, "", err
+		}
+		inv, err := billing.Fetch(ctx, db, cl.InvoiceID)
+		if err != nil {
+			return nil, "", err
+		}
+		r.InvoiceNumber = deref(inv.InvoiceNumber)
+		if inv.IssuedAt != nil {
+			r.InvoiceDate = inv.IssuedAt.Format("2006-01-02")
+		}
+		r.InvoiceTotal = inv.Total
+		r.Copay = inv.Total.Sub(cl.ClaimedAmount)
+		if r.Preauthorisations, err = billing.Preauthorisations(ctx, db, inv.ID); err != nil {
+			return nil, "", err
+		}
+		r.Lines = []claimLine{}
+		for _, l := range inv.Lines {
+			if !contains(covered, l.ItemType) {
+				continue
+			}
+			r.Lines = append(r.Lines, claimLine{
+				ItemType: l.ItemType, Description: l.Description, Quantity: l.Quantity, UnitPrice: l.UnitPrice, Discount: l.Discount,
+				Tax: l.TaxAmount, Amount: l.Amount.Add(l.TaxAmount),
+			})
+		}
+		out.Claims = append(out.Claims, r)
+	}
+	return out, format, nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// csvExport writes one row per claim line, the claim's details repeated on
+// each.
+func csvExport(b *batchRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"batch_number", "payer_code", "claim_number", "invoice_number", "invoice_date", "member_number", "patient_name",
+		"principal_member", "relationship", "scheme_code", "preauthorisations", "invoice_total", "copay", "claimed_amount",
+		"item_type", "description", "quantity", "unit_price", "discount", "tax", "amount"})
+	for _, r := range b.Claims {
+		for _, l := range r.Lines {
+			w.Write([]string{b.BatchNumber, b.PayerCode, r.ClaimNumber, r.InvoiceNumber, r.InvoiceDate, r.MemberNumber, r.PatientName,
+				r.PrincipalMember, r.Relationship, r.SchemeCode, strings.Join(r.Preauthorisations, ";"), r.InvoiceTotal.StringFixed(2),
+				r.Copay.StringFixed(2), r.ClaimedAmount.StringFixed(2), l.ItemType, l.Description, strconv.Itoa(l.Quantity),
+				l.UnitPrice.StringFixed(2), l.Discount.StringFixed(2), l.Tax.StringFixed(2), l.Amount.StringFixed(2)})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// ExportBatch downloads a batch for submission to the payer, in the
+// payer's claim format unless ?format= asks for csv, json or xml.
+func ExportBatch(c *fiber.Ctx) error {
+	ctx := context.Background()
+	t, err := fetchBatch(ctx, database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Claim batch not found",
+		})
+	}
+	b, format, err := buildExport(ctx, t)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to export claim batch",
+			"details": err.Error(),
+		})
+	}
+	if f := c.Query("format"); f != "" {
+		format = f
+	}
+
+	var body []byte
+	var contentType string
+	switch format {
+	case "csv":
+		body, err = csvExport(b)
+		contentType = "text/csv"
+	case "json":
+		body, err = json.MarshalIndent(b, "", "  ")
+		contentType = fiber.MIMEApplicationJSON
+	case "xml":
+		body, err = xml.MarshalIndent(b, "", "  ")
+		body = append([]byte(xml.Header), body...)
+		contentType = fiber.MIMEApplicationXML
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "format must be csv, json or xml",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to export claim batch",
+			"details": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, t.BatchNumber, format))
+	return c.Send(body)
+}
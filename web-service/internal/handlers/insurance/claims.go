@@ -0,0 +1,424 @@
+package insurance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/billing"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// Claim asks a payer for its share of one issued invoice.
+type Claim struct {
+	ID              string           `json:"id"`
+	ClaimNumber     string           `json:"claim_number"`
+	InvoiceID       string           `json:"invoice_id"`
+	InvoiceNumber   *string          `json:"invoice_number,omitempty"`
+	PatientID       string           `json:"patient_id"`
+	PatientName     string           `json:"patient_name"`
+	InsuranceID     string           `json:"insurance_id"`
+	MemberNumber    string           `json:"member_number"`
+	SchemeID        string           `json:"scheme_id"`
+	SchemeName      string           `json:"scheme_name"`
+	PayerID         string           `json:"payer_id"`
+	PayerName       string           `json:"payer_name"`
+	BatchID         *string          `json:"batch_id,omitempty"`
+	Status          string           `json:"status"`
+	ClaimedAmount   decimal.Decimal  `json:"claimed_amount"`
+	ApprovedAmount  *decimal.Decimal `json:"approved_amount,omitempty"`
+	PaidAmount      decimal.Decimal  `json:"paid_amount"`
+	QueryNote       *string          `json:"query_note,omitempty"`
+	QueryResponse   *string          `json:"query_response,omitempty"`
+	RejectionReason *string          `json:"rejection_reason,omitempty"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+	Events          []Event          `json:"events,omitempty"`
+}
+
+const claimColumns = `c.id, c.claim_number, c.invoice_id, b.invoice_number, c.patient_id, p.first_name || ' ' || p.last_name, c.insurance_id,
+	i.member_number, c.scheme_id, s.name, c.payer_id, y.name, c.batch_id, c.status, c.claimed_amount, c.approved_amount, c.paid_amount,
+	c.query_note, c.query_response, c.rejection_reason, c.created_at, c.updated_at`
+
+const claimTables = `insurance_claims c JOIN billing b ON b.id = c.invoice_id JOIN patients p ON p.id = c.patient_id
+	JOIN patient_insurance i ON i.id = c.insurance_id JOIN insurance_schemes s ON s.id = c.scheme_id
+	JOIN insurance_payers y ON y.id = c.payer_id`
+
+func (cl *Claim) scanTargets() []any {
+	return []any{&cl.ID, &cl.ClaimNumber, &cl.InvoiceID, &cl.InvoiceNumber, &cl.PatientID, &cl.PatientName, &cl.InsuranceID,
+		&cl.MemberNumber, &cl.SchemeID, &cl.SchemeName, &cl.PayerID, &cl.PayerName, &cl.BatchID, &cl.Status, &cl.ClaimedAmount,
+		&cl.ApprovedAmount, &cl.PaidAmount, &cl.QueryNote, &cl.QueryResponse, &cl.RejectionReason, &cl.CreatedAt, &cl.UpdatedAt}
+}
+
+// Event is a step in a claim's history.
+type Event struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Note      *string   `json:"note,omitempty"`
+	StaffID   string    `json:"staff_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type querier interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+func fetchClaims(ctx context.Context, q querier, where string, args ...any) ([]Claim, error) {
+	rows, err := q.Query(ctx, `SELECT `+claimColumns+` FROM `+claimTables+` `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Claim, error) {
+		var cl Claim
+		err := row.Scan(cl.scanTargets()...)
+		return cl, err
+	})
+}
+
+func fetchClaim(ctx context.Context, q querier, id string) (*Claim, error) {
+	var cl Claim
+	err := q.QueryRow(ctx, `SELECT `+claimColumns+` FROM `+claimTables+` WHERE c.id = $1`, id).Scan(cl.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, `SELECT id, status, note, staff_id, created_at FROM insurance_claim_events
+		WHERE claim_id = $1 ORDER BY created_at, id`, id)
+	if err != nil {
+		return nil, err
+	}
+	cl.Events, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Event, error) {
+		var e Event
+		err := row.Scan(&e.ID, &e.Status, &e.Note, &e.StaffID, &e.CreatedAt)
+		return e, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cl, nil
+}
+
+func recordEvent(ctx context.Context, tx pgx.Tx, claimID, status string, note *string, staffID string) error {
+	_, err := tx.Exec(ctx, `INSERT INTO insurance_claim_events (id, claim_id, status, note, staff_id, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		uuid.New().String()[:8], claimID, status, note, staffID, time.Now())
+	return err
+}
+
+func GetClaims(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+
+	filter := `WHERE ($1 = '' OR c.status = $1) AND ($2 = '' OR c.payer_id = $2) AND ($3 = '' OR c.patient_id = $3)
+		AND ($4 = '' OR c.batch_id = $4) AND (NOT $5 OR c.batch_id IS NULL)`
+	args := []any{c.Query("status"), c.Query("payer_id"), c.Query("patient_id"), c.Query("batch_id"), c.QueryBool("unbatched")}
+
+	var total int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM insurance_claims c `+filter, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	claims, err := fetchClaims(ctx, db, filter+` ORDER BY c.created_at DESC LIMIT $6 OFFSET $7`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"items": claims,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+func GetClaim(c *fiber.Ctx) error {
+	cl, err := fetchClaim(context.Background(), database.GetDB(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Claim not found",
+		})
+	}
+	return c.JSON(cl)
+}
+
+var (
+	errClaimInput = errors.New("invalid claim update")
+	errClaimState = errors.New("claim cannot be changed")
+)
+
+// rollUp brings a sent batch's status in line with its claims: queried while
+// any claim is, then approved and paid once every claim that was not
+// rejected is.
+func rollUp(ctx context.Context, tx pgx.Tx, batchID *string) error {
+	if batchID == nil {
+		return nil
+	}
+	rows, err := tx.Query(ctx, `SELECT status FROM insurance_claims WHERE batch_id = $1`, *batchID)
+	if err != nil {
+		return err
+	}
+	statuses, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	count := map[string]int{}
+	for _, s := range statuses {
+		count[s]++
+	}
+	open := len(statuses) - count["rejected"]
+	status := "submitted"
+	switch {
+	case open == 0:
+		status = "rejected"
+	case count["queried"] > 0:
+		status = "queried"
+	case count["paid"] == open:
+		status = "paid"
+	case count["approved"]+count["paid"] == open:
+		status = "approved"
+	}
+	_, err = tx.Exec(ctx, `UPDATE insurance_claim_batches SET status = $1, updated_at = $2 WHERE id = $3 AND status <> 'draft'`,
+		status, time.Now(), *batchID)
+	return err
+}
+
+// changeClaim moves a locked claim from one of the given statuses to the
+// next, applying any changes that go with it and recording the step. apply
+// may leave the claim in another status than to.
+func changeClaim(c *fiber.Ctx, from []string, to string, note *string, apply func(context.Context, pgx.Tx, *Claim) error) error {
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	id := c.Params("id")
+	_, err = tx.Exec(ctx, `SELECT 1 FROM insurance_claims WHERE id = $1 FOR UPDATE`, id)
+	var cl *Claim
+	if err == nil {
+		cl, err = fetchClaim(ctx, tx, id)
+	}
+	if err == nil && !contains(from, cl.Status) {
+		err = fmt.Errorf("%w: only %s claims can be marked %s", errClaimState, strings.Join(from, " or "), to)
+	}
+	if err == nil {
+		cl.Status = to
+		err = apply(ctx, tx, cl)
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE insurance_claims SET status = $1, updated_at = $2 WHERE id = $3`, cl.Status, time.Now(), id)
+	}
+	if err == nil {
+		err = recordEvent(ctx, tx, id, cl.Status, note, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = rollUp(ctx, tx, cl.BatchID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return claimError(c, err, "Failed to update claim")
+	}
+
+	cl, err = fetchClaim(ctx, database.GetDB(), id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Claim " + cl.Status,
+		"claim": cl,
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// claimError maps claim errors to a response.
+func claimError(c *fiber.Ctx, err error, message string) error {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Claim not found",
+		})
+	case errors.Is(err, errClaimInput):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, errClaimState), errors.Is(err, billing.ErrDuplicateRef):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+		"details": err.Error(),
+	})
+}
+
+type noteRequest struct {
+	Note string `json:"note"`
+}
+
+func parseNote(c *fiber.Ctx) *string {
+	var req noteRequest
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Note) == "" {
+		return nil
+	}
+	note := strings.TrimSpace(req.Note)
+	return &note
+}
+
+// QueryClaim records a question from the payer about a submitted claim.
+func QueryClaim(c *fiber.Ctx) error {
+	note := parseNote(c)
+	if note == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A note of the payer's query is required",
+		})
+	}
+	return changeClaim(c, []string{"submitted"}, "queried", note, func(ctx context.Context, tx pgx.Tx, cl *Claim) error {
+		_, err := tx.Exec(ctx, `UPDATE insurance_claims SET query_note = $1, query_response = NULL WHERE id = $2`, *note, cl.ID)
+		return err
+	})
+}
+
+// RespondToClaimQuery answers the payer's query and puts the claim back
+// with them.
+func RespondToClaimQuery(c *fiber.Ctx) error {
+	note := parseNote(c)
+	if note == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A response to the query is required",
+		})
+	}
+	return changeClaim(c, []string{"queried"}, "submitted", note, func(ctx context.Context, tx pgx.Tx, cl *Claim) error {
+		_, err := tx.Exec(ctx, `UPDATE insurance_claims SET query_response = $1 WHERE id = $2`, *note, cl.ID)
+		return err
+	})
+}
+
+// ApproveClaim records the amount the payer has agreed to pay. If it is less
+// than was claimed, the difference moves to the patient's share of the
+// invoice.
+func ApproveClaim(c *fiber.Ctx) error {
+	var req struct {
+		ApprovedAmount *decimal.Decimal `json:"approved_amount"`
+		Note           string           `json:"note"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	note := &req.Note
+	if strings.TrimSpace(req.Note) == "" {
+		note = nil
+	}
+	return changeClaim(c, []string{"submitted", "queried"}, "approved", note, func(ctx context.Context, tx pgx.Tx, cl *Claim) error {
+		amount := cl.ClaimedAmount
+		if req.ApprovedAmount != nil {
+			amount = req.ApprovedAmount.Round(2)
+		}
+		if amount.IsNegative() || amount.GreaterThan(cl.ClaimedAmount) {
+			return fmt.Errorf("%w: approved_amount must be between 0 and the %s claimed", errClaimInput, cl.ClaimedAmount.StringFixed(2))
+		}
+		_, err := tx.Exec(ctx, `UPDATE insurance_claims SET approved_amount = $1 WHERE id = $2`, amount, cl.ID)
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE billing SET insurer_share = $1, updated_at = $2 WHERE id = $3`, amount, time.Now(), cl.InvoiceID)
+		}
+		return err
+	})
+}
+
+// RejectClaim records the payer's refusal. The whole invoice falls to the
+// patient.
+func RejectClaim(c *fiber.Ctx) error {
+	note := parseNote(c)
+	if note == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A note of the rejection reason is required",
+		})
+	}
+	return changeClaim(c, []string{"submitted", "queried"}, "rejected", note, func(ctx context.Context, tx pgx.Tx, cl *Claim) error {
+		_, err := tx.Exec(ctx, `UPDATE insurance_claims SET rejection_reason = $1 WHERE id = $2`, *note, cl.ID)
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE billing SET insurer_share = 0, updated_at = $1 WHERE id = $2`, time.Now(), cl.InvoiceID)
+		}
+		return err
+	})
+}
+
+type claimPaymentRequest struct {
+	Amount    *decimal.Decimal `json:"amount"`
+	Reference string           `json:"reference"`
+	Notes     *string          `json:"notes"`
+}
+
+// PayClaim records a remittance from the payer against an approved claim as
+// an insurance payment on the invoice. The claim is paid once the approved
+// amount has been received.
+func PayClaim(c *fiber.Ctx) error {
+	var req claimPaymentRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	req.Reference = strings.TrimSpace(req.Reference)
+	if req.Reference == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The payer's remittance reference is required",
+		})
+	}
+	note := "Remittance " + req.Reference
+	return changeClaim(c, []string{"approved"}, "paid", &note, func(ctx context.Context, tx pgx.Tx, cl *Claim) error {
+		outstanding := cl.ApprovedAmount.Sub(cl.PaidAmount)
+		amount := outstanding
+		if req.Amount != nil {
+			amount = req.Amount.Round(2)
+		}
+		if !amount.IsPositive() || amount.GreaterThan(outstanding) {
+			return fmt.Errorf("%w: amount must be positive and no more than the %s outstanding", errClaimInput, outstanding.StringFixed(2))
+		}
+		// One remittance pays a whole batch, so the payment is referenced
+		// by the remittance and the claim it settles
+		reference := req.Reference + "/" + cl.ClaimNumber
+		_, err := billing.RecordPayment(ctx, tx, billing.PaymentInput{
+			PatientID: cl.PatientID, Method: "insurance", Amount: amount, Reference: &reference, Notes: req.Notes,
+			StaffID: middleware.CurrentUserID(c),
+		}, []billing.AllocationRequest{{InvoiceID: cl.InvoiceID, Amount: amount}})
+		if err != nil {
+			return err
+		}
+		if amount.LessThan(outstanding) {
+			cl.Status = "approved"
+		}
+		_, err = tx.Exec(ctx, `UPDATE insurance_claims SET paid_amount = paid_amount + $1 WHERE id = $2`, amount, cl.ID)
+		return err
+	})
+}
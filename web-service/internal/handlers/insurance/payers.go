@@ -0,0 +1,399 @@
+// Package insurance handles the payers and schemes insured patients are
+// billed to, pre-authorisation of expensive services, and the claims sent
+// to payers for their share of invoices.
+package insurance
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// Payer is an insurer or corporate that settles claims.
+type Payer struct {
+	ID           string    `json:"id"`
+	Code         string    `json:"code"`
+	Name         string    `json:"name"`
+	ClaimFormat  string    `json:"claim_format"`
+	ContactEmail *string   `json:"contact_email,omitempty"`
+	Active       bool      `json:"active"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Schemes      []Scheme  `json:"schemes"`
+}
+
+const payerColumns = `id, code, name, claim_format, contact_email, active, created_at, updated_at`
+
+func (p *Payer) scanTargets() []any {
+	return []any{&p.ID, &p.Code, &p.Name, &p.ClaimFormat, &p.ContactEmail, &p.Active, &p.CreatedAt, &p.UpdatedAt}
+}
+
+var claimFormats = map[string]bool{"csv": true, "json": true, "xml": true}
+
+func (p *Payer) validate() string {
+	p.Code = strings.ToUpper(strings.TrimSpace(p.Code))
+	p.Name = strings.TrimSpace(p.Name)
+	if p.ClaimFormat == "" {
+		p.ClaimFormat = "csv"
+	}
+	switch {
+	case p.Code == "" || p.Name == "":
+		return "code and name are required"
+	case !claimFormats[p.ClaimFormat]:
+		return "claim_format must be csv, json or xml"
+	}
+	return ""
+}
+
+// Scheme is a plan offered by a payer. It sets which item types are
+// covered, the patient's co-pay, and the line amount above which a service
+// needs pre-authorisation.
+type Scheme struct {
+	ID               string           `json:"id"`
+	PayerID          string           `json:"payer_id"`
+	Code             string           `json:"code"`
+	Name             string           `json:"name"`
+	CoveredItemTypes []string         `json:"covered_item_types"`
+	CopayType        string           `json:"copay_type"`
+	CopayValue       decimal.Decimal  `json:"copay_value"`
+	CopayCap         *decimal.Decimal `json:"copay_cap,omitempty"`
+	PreauthThreshold *decimal.Decimal `json:"preauth_threshold,omitempty"`
+	Active           bool             `json:"active"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+
+const schemeColumns = `id, payer_id, code, name, covered_item_types, copay_type, copay_value, copay_cap, preauth_threshold, active,
+	created_at, updated_at`
+
+func (s *Scheme) scanTargets() []any {
+	return []any{&s.ID, &s.PayerID, &s.Code, &s.Name, &s.CoveredItemTypes, &s.CopayType, &s.CopayValue, &s.CopayCap, &s.PreauthThreshold,
+		&s.Active, &s.CreatedAt, &s.UpdatedAt}
+}
+
+var itemTypes = map[string]bool{"consultation": true, "lab": true, "medicine": true, "procedure": true}
+
+var hundred = decimal.NewFromInt(100)
+
+func (s *Scheme) validate() string {
+	s.Code = strings.ToUpper(strings.TrimSpace(s.Code))
+	s.Name = strings.TrimSpace(s.Name)
+	if s.CopayType == "" {
+		s.CopayType = "none"
+	}
+	if s.CoveredItemTypes == nil {
+		s.CoveredItemTypes = []string{"consultation", "lab", "medicine", "procedure"}
+	}
+	for _, t := range s.CoveredItemTypes {
+		if !itemTypes[t] {
+			return "covered_item_types may only contain consultation, lab, medicine and procedure"
+		}
+	}
+	switch {
+	case s.Code == "" || s.Name == "":
+		return "code and name are required"
+	case s.CopayType != "none" && s.CopayType != "fixed" && s.CopayType != "percentage":
+		return "copay_type must be none, fixed or percentage"
+	case s.CopayValue.IsNegative():
+		return "copay_value cannot be negative"
+	case s.CopayType == "percentage" && s.CopayValue.GreaterThan(hundred):
+		return "A percentage co-pay cannot be more than 100"
+	case s.CopayCap != nil && s.CopayCap.IsNegative(), s.PreauthThreshold != nil && s.PreauthThreshold.IsNegative():
+		return "copay_cap and preauth_threshold cannot be negative"
+	}
+	if s.CopayType == "none" {
+		s.CopayValue = decimal.Zero
+	}
+	s.CopayValue = s.CopayValue.Round(2)
+	return ""
+}
+
+func fetchSchemes(ctx context.Context, payerID string, includeInactive bool) ([]Scheme, error) {
+	rows, err := database.GetDB().Query(ctx, `SELECT `+schemeColumns+` FROM insurance_schemes
+		WHERE payer_id = $1 AND (active OR $2) ORDER BY name`, payerID, includeInactive)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Scheme, error) {
+		var s Scheme
+		err := row.Scan(s.scanTargets()...)
+		return s, err
+	})
+}
+
+func fetchPayer(ctx context.Context, id string) (*Payer, error) {
+	var p Payer
+	err := database.GetDB().QueryRow(ctx, `SELECT `+payerColumns+` FROM insurance_payers WHERE id = $1`, id).Scan(p.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	if p.Schemes, err = fetchSchemes(ctx, p.ID, true); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetPayers lists payers with their active schemes.
+func GetPayers(c *fiber.Ctx) error {
+	ctx := context.Background()
+	includeInactive := c.QueryBool("include_inactive")
+	rows, err := database.GetDB().Query(ctx, `SELECT `+payerColumns+` FROM insurance_payers WHERE active OR $1 ORDER BY name`, includeInactive)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	payers, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Payer, error) {
+		var p Payer
+		err := row.Scan(p.scanTargets()...)
+		return p, err
+	})
+	for i := range payers {
+		if err != nil {
+			break
+		}
+		payers[i].Schemes, err = fetchSchemes(ctx, payers[i].ID, includeInactive)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(payers)
+}
+
+func GetPayer(c *fiber.Ctx) error {
+	p, err := fetchPayer(context.Background(), c.Params("id"))
+	if err == pgx.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payer not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(p)
+}
+
+func CreatePayer(c *fiber.Ctx) error {
+	var p Payer
+	if err := c.BodyParser(&p); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if msg := p.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	now := time.Now()
+	p.ID = uuid.New().String()[:8]
+	p.Active = true
+	p.CreatedAt = now
+	p.UpdatedAt = now
+	p.Schemes = []Scheme{}
+	_, err := database.GetDB().Exec(context.Background(), `INSERT INTO insurance_payers (`+payerColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		p.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to create payer",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Payer created successfully",
+		"payer": p,
+	})
+}
+
+type payerUpdate struct {
+	Code         *string `json:"code"`
+	Name         *string `json:"name"`
+	ClaimFormat  *string `json:"claim_format"`
+	ContactEmail *string `json:"contact_email"`
+	Active       *bool   `json:"active"`
+}
+
+func UpdatePayer(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req payerUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	p, err := fetchPayer(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payer not found",
+		})
+	}
+
+	if req.Code != nil {
+		p.Code = *req.Code
+	}
+	if req.Name != nil {
+		p.Name = *req.Name
+	}
+	if req.ClaimFormat != nil {
+		p.ClaimFormat = *req.ClaimFormat
+	}
+	if req.ContactEmail != nil {
+		p.ContactEmail = req.ContactEmail
+	}
+	if req.Active != nil {
+		p.Active = *req.Active
+	}
+	if msg := p.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	p.UpdatedAt = time.Now()
+
+	_, err = database.GetDB().Exec(ctx, `UPDATE insurance_payers SET code = $1, name = $2, claim_format = $3, contact_email = $4,
+		active = $5, updated_at = $6 WHERE id = $7`, p.Code, p.Name, p.ClaimFormat, p.ContactEmail, p.Active, p.UpdatedAt, p.ID)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to update payer",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Payer updated successfully",
+		"payer": p,
+	})
+}
+
+func CreateScheme(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var s Scheme
+	if err := c.BodyParser(&s); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if msg := s.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	if _, err := fetchPayer(ctx, c.Params("id")); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Payer not found",
+		})
+	}
+
+	now := time.Now()
+	s.ID = uuid.New().String()[:8]
+	s.PayerID = c.Params("id")
+	s.Active = true
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	_, err := database.GetDB().Exec(ctx, `INSERT INTO insurance_schemes (`+schemeColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`, s.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to create scheme",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Scheme created successfully",
+		"scheme": s,
+	})
+}
+
+type schemeUpdate struct {
+	Code             *string          `json:"code"`
+	Name             *string          `json:"name"`
+	CoveredItemTypes []string         `json:"covered_item_types"`
+	CopayType        *string          `json:"copay_type"`
+	CopayValue       *decimal.Decimal `json:"copay_value"`
+	CopayCap         *decimal.Decimal `json:"copay_cap"`
+	PreauthThreshold *decimal.Decimal `json:"preauth_threshold"`
+	Active           *bool            `json:"active"`
+}
+
+// UpdateScheme changes a scheme. Issued invoices keep the split they were
+// issued with; drafts pick up the change the next time their lines change.
+func UpdateScheme(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req schemeUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	var s Scheme
+	err := database.GetDB().QueryRow(ctx, `SELECT `+schemeColumns+` FROM insurance_schemes WHERE id = $1 AND payer_id = $2`,
+		c.Params("schemeId"), c.Params("id")).Scan(s.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Scheme not found",
+		})
+	}
+
+	if req.Code != nil {
+		s.Code = *req.Code
+	}
+	if req.Name != nil {
+		s.Name = *req.Name
+	}
+	if req.CoveredItemTypes != nil {
+		s.CoveredItemTypes = req.CoveredItemTypes
+	}
+	if req.CopayType != nil {
+		s.CopayType = *req.CopayType
+	}
+	if req.CopayValue != nil {
+		s.CopayValue = *req.CopayValue
+	}
+	if req.CopayCap != nil {
+		s.CopayCap = req.CopayCap
+	}
+	if req.PreauthThreshold != nil {
+		s.PreauthThreshold = req.PreauthThreshold
+	}
+	if req.Active != nil {
+		s.Active = *req.Active
+	}
+	if msg := s.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	s.UpdatedAt = time.Now()
+
+	_, err = database.GetDB().Exec(ctx, `UPDATE insurance_schemes SET code = $1, name = $2, covered_item_types = $3, copay_type = $4,
+		copay_value = $5, copay_cap = $6, preauth_threshold = $7, active = $8, updated_at = $9 WHERE id = $10`,
+		s.Code, s.Name, s.CoveredItemTypes, s.CopayType, s.CopayValue, s.CopayCap, s.PreauthThreshold, s.Active, s.UpdatedAt, s.ID)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to update scheme",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Scheme updated successfully",
+		"scheme": s,
+	})
+}
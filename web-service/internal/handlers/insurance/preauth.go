@@ -0,0 +1,336 @@
+package insurance
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/tariff"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// Preauthorisation is the insurer's approval, sought in advance, to bill a
+// covered service priced above the scheme's threshold.
+type Preauthorisation struct {
+	ID               string           `json:"id"`
+	PreauthNumber    string           `json:"preauth_number"`
+	PatientID        string           `json:"patient_id"`
+	PatientName      string           `json:"patient_name"`
+	InsuranceID      string           `json:"insurance_id"`
+	EncounterID      *string          `json:"encounter_id,omitempty"`
+	ItemType         string           `json:"item_type"`
+	ItemID           string           `json:"item_id"`
+	Description      string           `json:"description"`
+	EstimatedAmount  decimal.Decimal  `json:"estimated_amount"`
+	ApprovedAmount   *decimal.Decimal `json:"approved_amount,omitempty"`
+	Status           string           `json:"status"`
+	InsurerReference *string          `json:"insurer_reference,omitempty"`
+	Notes            *string          `json:"notes,omitempty"`
+	DecisionNotes    *string          `json:"decision_notes,omitempty"`
+	ValidUntil       *time.Time       `json:"valid_until,omitempty"`
+	RequestedBy      string           `json:"requested_by"`
+	DecidedBy        *string          `json:"decided_by,omitempty"`
+	DecidedAt        *time.Time       `json:"decided_at,omitempty"`
+	CreatedAt        time.Time        `json:"created_at"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+
+const preauthColumns = `a.id, a.preauth_number, a.patient_id, p.first_name || ' ' || p.last_name, a.insurance_id, a.encounter_id, a.item_type,
+	a.item_id, a.description, a.estimated_amount, a.approved_amount, a.status, a.insurer_reference, a.notes, a.decision_notes,
+	a.valid_until, a.requested_by, a.decided_by, a.decided_at, a.created_at, a.updated_at`
+
+func (a *Preauthorisation) scanTargets() []any {
+	return []any{&a.ID, &a.PreauthNumber, &a.PatientID, &a.PatientName, &a.InsuranceID, &a.EncounterID, &a.ItemType,
+		&a.ItemID, &a.Description, &a.EstimatedAmount, &a.ApprovedAmount, &a.Status, &a.InsurerReference, &a.Notes, &a.DecisionNotes,
+		&a.ValidUntil, &a.RequestedBy, &a.DecidedBy, &a.DecidedAt, &a.CreatedAt, &a.UpdatedAt}
+}
+
+func fetchPreauthorisation(ctx context.Context, id string) (*Preauthorisation, error) {
+	var a Preauthorisation
+	err := database.GetDB().QueryRow(ctx, `SELECT `+preauthColumns+` FROM insurance_preauthorisations a
+		JOIN patients p ON p.id = a.patient_id WHERE a.id = $1`, id).Scan(a.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func GetPreauthorisations(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+
+	filter := `WHERE ($1 = '' OR a.patient_id = $1) AND ($2 = '' OR a.status = $2) AND ($3 = '' OR a.insurance_id = $3)`
+	args := []any{c.Query("patient_id"), c.Query("status"), c.Query("insurance_id")}
+
+	var total int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM insurance_preauthorisations a `+filter, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rows, err := db.Query(ctx, `SELECT `+preauthColumns+` FROM insurance_preauthorisations a JOIN patients p ON p.id = a.patient_id `+filter+`
+		ORDER BY a.created_at DESC LIMIT $4 OFFSET $5`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	preauths, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Preauthorisation, error) {
+		var a Preauthorisation
+		err := row.Scan(a.scanTargets()...)
+		return a, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"items": preauths,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+func GetPreauthorisation(c *fiber.Ctx) error {
+	a, err := fetchPreauthorisation(context.Background(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pre-authorisation not found",
+		})
+	}
+	return c.JSON(a)
+}
+
+type preauthRequest struct {
+	InsuranceID     string           `json:"insurance_id"`
+	EncounterID     *string          `json:"encounter_id"`
+	ItemType        string           `json:"item_type"`
+	ItemID          string           `json:"item_id"`
+	Quantity        int              `json:"quantity"`
+	EstimatedAmount *decimal.Decimal `json:"estimated_amount"`
+	Notes           *string          `json:"notes"`
+}
+
+// RequestPreauthorisation records a request to the insurer to approve a
+// service. The estimate defaults to the tariff price of the quantity asked
+// for.
+func RequestPreauthorisation(c *fiber.Ctx) error {
+	ctx := context.Background()
+	db := database.GetDB()
+	var req preauthRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	req.ItemID = strings.TrimSpace(req.ItemID)
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	if req.Quantity < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "quantity must be positive",
+		})
+	}
+
+	var patientID string
+	var schemeID *string
+	err := db.QueryRow(ctx, `SELECT patient_id, scheme_id FROM patient_insurance WHERE id = $1`, req.InsuranceID).Scan(&patientID, &schemeID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "insurance_id is not a patient's insurance cover",
+		})
+	}
+	if schemeID == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The cover is not linked to a configured scheme",
+		})
+	}
+	if req.EncounterID != nil && *req.EncounterID != "" {
+		var ok bool
+		err := db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM encounters WHERE id = $1 AND patient_id = $2)`, *req.EncounterID, patientID).Scan(&ok)
+		if err != nil || !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "encounter_id is not an encounter of this patient",
+			})
+		}
+	} else {
+		req.EncounterID = nil
+	}
+
+	// The estimate is at the insurer's agreed prices
+	var payerID, listID string
+	err = db.QueryRow(ctx, `SELECT payer_id FROM insurance_schemes WHERE id = $1`, *schemeID).Scan(&payerID)
+	if err == nil {
+		listID, err = tariff.ListForPayer(ctx, db, payerID)
+	}
+	var price *tariff.Price
+	if err == nil {
+		price, err = tariff.Lookup(ctx, db, listID, req.ItemType, req.ItemID, time.Now())
+	}
+	if errors.Is(err, tariff.ErrInvalidItem) || errors.Is(err, tariff.ErrUnknownItem) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	// Items may be asked for by code; store the id invoice lines resolve to
+	req.ItemID = price.ItemID
+	estimate := price.UnitPrice.Mul(decimal.NewFromInt(int64(req.Quantity)))
+	estimate = estimate.Add(estimate.Mul(price.TaxRate).Div(hundred)).Round(2)
+	if req.EstimatedAmount != nil {
+		estimate = req.EstimatedAmount.Round(2)
+	}
+	if !estimate.IsPositive() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "estimated_amount must be positive",
+		})
+	}
+
+	id := uuid.New().String()[:8]
+	now := time.Now()
+	_, err = db.Exec(ctx, `INSERT INTO insurance_preauthorisations (id, preauth_number, patient_id, insurance_id, encounter_id, item_type,
+			item_id, description, estimated_amount, notes, requested_by, created_at, updated_at)
+		VALUES ($1, 'PA-' || LPAD(nextval('preauth_number_seq')::text, 6, '0'), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $11)`,
+		id, patientID, req.InsuranceID, req.EncounterID, req.ItemType, req.ItemID, price.Description, estimate, req.Notes,
+		middleware.CurrentUserID(c), now)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to request pre-authorisation",
+			"details": err.Error(),
+		})
+	}
+
+	a, err := fetchPreauthorisation(ctx, id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Pre-authorisation requested successfully",
+		"preauthorisation": a,
+	})
+}
+
+type decisionRequest struct {
+	Approved         bool             `json:"approved"`
+	ApprovedAmount   *decimal.Decimal `json:"approved_amount"`
+	InsurerReference *string          `json:"insurer_reference"`
+	ValidUntil       *string          `json:"valid_until"`
+	Notes            *string          `json:"notes"`
+}
+
+// DecidePreauthorisation records the insurer's answer to a request. An
+// approval without an amount approves the estimate.
+func DecidePreauthorisation(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req decisionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	a, err := fetchPreauthorisation(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Pre-authorisation not found",
+		})
+	}
+	if a.RequestedBy == middleware.CurrentUserID(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "A pre-authorisation must be decided by someone other than who requested it",
+		})
+	}
+
+	status := "rejected"
+	var approved *decimal.Decimal
+	var validUntil *time.Time
+	if req.Approved {
+		status = "approved"
+		amount := a.EstimatedAmount
+		if req.ApprovedAmount != nil {
+			amount = req.ApprovedAmount.Round(2)
+		}
+		if !amount.IsPositive() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "approved_amount must be positive",
+			})
+		}
+		approved = &amount
+		if req.ValidUntil != nil && *req.ValidUntil != "" {
+			t, err := time.Parse("2006-01-02", *req.ValidUntil)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "valid_until must be YYYY-MM-DD",
+				})
+			}
+			validUntil = &t
+		}
+	} else if req.Notes == nil || strings.TrimSpace(*req.Notes) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "notes are required when a pre-authorisation is rejected",
+		})
+	}
+
+	now := time.Now()
+	tag, err := database.GetDB().Exec(ctx, `UPDATE insurance_preauthorisations SET status = $1, approved_amount = $2, insurer_reference = $3,
+		valid_until = $4, decision_notes = $5, decided_by = $6, decided_at = $7, updated_at = $7 WHERE id = $8 AND status = 'requested' AND requested_by <> $6`,
+		status, approved, req.InsurerReference, validUntil, req.Notes, middleware.CurrentUserID(c), now, a.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record pre-authorisation decision",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The pre-authorisation has already been decided",
+		})
+	}
+
+	a, _ = fetchPreauthorisation(ctx, a.ID)
+	return c.JSON(fiber.Map{
+		"message": "Pre-authorisation " + status,
+		"preauthorisation": a,
+	})
+}
+
+// CancelPreauthorisation withdraws a request, or an approval that will not
+// be used.
+func CancelPreauthorisation(c *fiber.Ctx) error {
+	tag, err := database.GetDB().Exec(context.Background(), `UPDATE insurance_preauthorisations SET status = 'cancelled', updated_at = $1
+		WHERE id = $2 AND status IN ('requested', 'approved')`, time.Now(), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel pre-authorisation",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only requested or approved pre-authorisations can be cancelled",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Pre-authorisation cancelled successfully",
+	})
+}
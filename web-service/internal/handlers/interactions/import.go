@@ -0,0 +1,77 @@
+package interactions
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var severities = map[string]bool{"minor": true, "moderate": true, "severe": true, "contraindicated": true}
+
+// NormaliseDrug lower-cases a drug name so pairs match regardless of how they were typed.
+func NormaliseDrug(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Import loads a drug_a,drug_b,severity,description CSV file into drug_interactions.
+// Each pair is stored once with the names in alphabetical order.
+func Import(ctx context.Context, db *pgxpool.Pool, r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 4
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+	if strings.Join(header, ",") != "drug_a,drug_b,severity,description" {
+		return 0, fmt.Errorf("unexpected header %v, expected drug_a,drug_b,severity,description", header)
+	}
+
+	batch := &pgx.Batch{}
+	now := time.Now()
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		a, b := NormaliseDrug(record[0]), NormaliseDrug(record[1])
+		severity := NormaliseDrug(record[2])
+		description := strings.TrimSpace(record[3])
+		if a == "" || b == "" || a == b || !severities[severity] || description == "" {
+			return 0, fmt.Errorf("line %d: invalid entry", line)
+		}
+		if b < a {
+			a, b = b, a
+		}
+
+		batch.Queue(`INSERT INTO drug_interactions (id, drug_a, drug_b, severity, description, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6)
+			ON CONFLICT (drug_a, drug_b) DO UPDATE SET severity=EXCLUDED.severity, description=EXCLUDED.description, updated_at=EXCLUDED.updated_at`,
+			uuid.New().String()[:8], a, b, severity, description, now)
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return batch.Len(), nil
+}
@@ -0,0 +1,269 @@
+package interactions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/patients"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Medicine is a pharmacy catalogue entry as seen by the interaction engine.
+type Medicine struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Warning is a drug-drug or drug-allergy problem found for a prescription.
+// Warnings with RequiresOverride set block the prescription until the
+// prescriber gives a reason for each of them.
+type Warning struct {
+	Key              string   `json:"key"`
+	Type             string   `json:"type"`
+	Severity         string   `json:"severity"`
+	Description      string   `json:"description"`
+	Medicines        []string `json:"medicines"`
+	RequiresOverride bool     `json:"requires_override"`
+}
+
+type Override struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+type interaction struct {
+	DrugA       string
+	DrugB       string
+	Severity    string
+	Description string
+}
+
+func (m Medicine) text() string {
+	return strings.ToLower(m.Name + " " + m.Description)
+}
+
+// LoadMedicines looks up catalogue entries by ID, failing if any is unknown.
+func LoadMedicines(ids []string) ([]Medicine, error) {
+	db := database.GetDB()
+	medicines := make([]Medicine, 0, len(ids))
+	for _, id := range ids {
+		var m Medicine
+		err := db.QueryRow(context.Background(), `SELECT id, name, COALESCE(description, '') FROM pharmacy WHERE id=$1`, id).Scan(&m.ID, &m.Name, &m.Description)
+		if err != nil {
+			return nil, fmt.Errorf("medicine %s not found", id)
+		}
+		medicines = append(medicines, m)
+	}
+	return medicines, nil
+}
+
+// currentMedicines returns what the patient is already taking from prescriptions that are still open.
+func currentMedicines(patientID string) ([]Medicine, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `
+		SELECT DISTINCT m.id, m.name, COALESCE(m.description, '')
+		FROM prescriptions p
+		JOIN prescription_items i ON i.prescription_id = p.id
+		JOIN pharmacy m ON m.id = i.medicine_id
+		WHERE p.patient_id = $1 AND p.status IN ('active', 'partially_dispensed')`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var medicines []Medicine
+	for rows.Next() {
+		var m Medicine
+		if err := rows.Scan(&m.ID, &m.Name, &m.Description); err != nil {
+			return nil, err
+		}
+		medicines = append(medicines, m)
+	}
+	return medicines, rows.Err()
+}
+
+func loadInteractions() ([]interaction, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT drug_a, drug_b, severity, description FROM drug_interactions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []interaction
+	for rows.Next() {
+		var in interaction
+		if err := rows.Scan(&in.DrugA, &in.DrugB, &in.Severity, &in.Description); err != nil {
+			return nil, err
+		}
+		list = append(list, in)
+	}
+	return list, rows.Err()
+}
+
+// pairWarning reports an interaction between two medicines, in either order.
+func pairWarning(in interaction, x, y Medicine) (Warning, bool) {
+	xt, yt := x.text(), y.text()
+	if !(strings.Contains(xt, in.DrugA) && strings.Contains(yt, in.DrugB)) &&
+		!(strings.Contains(xt, in.DrugB) && strings.Contains(yt, in.DrugA)) {
+		return Warning{}, false
+	}
+	names := []string{x.Name, y.Name}
+	sort.Strings(names)
+	return Warning{
+		Key:              "drug_drug:" + in.DrugA + "|" + in.DrugB,
+		Type:             "drug_drug",
+		Severity:         in.Severity,
+		Description:      in.Description,
+		Medicines:        names,
+		RequiresOverride: in.Severity == "severe" || in.Severity == "contraindicated",
+	}, true
+}
+
+// Check runs the proposed medicines against each other, against what the
+// patient is currently prescribed and against the patient's allergy list.
+func Check(patientID string, proposed []Medicine) ([]Warning, error) {
+	list, err := loadInteractions()
+	if err != nil {
+		return nil, err
+	}
+	current, err := currentMedicines(patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	warnings := []Warning{}
+	add := func(w Warning) {
+		if !seen[w.Key] {
+			seen[w.Key] = true
+			warnings = append(warnings, w)
+		}
+	}
+
+	for i, x := range proposed {
+		for _, y := range proposed[i+1:] {
+			for _, in := range list {
+				if w, ok := pairWarning(in, x, y); ok {
+					add(w)
+				}
+			}
+		}
+		for _, y := range current {
+			if y.ID == x.ID {
+				continue
+			}
+			for _, in := range list {
+				if w, ok := pairWarning(in, x, y); ok {
+					add(w)
+				}
+			}
+		}
+	}
+
+	texts := make([]string, len(proposed))
+	byText := map[string]Medicine{}
+	for i, m := range proposed {
+		texts[i] = strings.TrimSpace(m.Name + " " + m.Description)
+		byText[texts[i]] = m
+	}
+	allergies, err := patients.MatchAllergies(patientID, texts)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range allergies {
+		m := byText[a.Medicine]
+		add(Warning{
+			Key:              "drug_allergy:" + a.AllergyID + "|" + m.ID,
+			Type:             "drug_allergy",
+			Severity:         a.Severity,
+			Description:      fmt.Sprintf("Patient has a %s allergy to %s (%s)", a.VerificationStatus, a.Substance, a.Reaction),
+			Medicines:        []string{m.Name},
+			RequiresOverride: a.Severity == "severe" || a.Severity == "life_threatening",
+		})
+	}
+
+	return warnings, nil
+}
+
+// Unresolved returns the blocking warnings that have no override with a reason.
+func Unresolved(warnings []Warning, overrides []Override) []Warning {
+	reasons := map[string]string{}
+	for _, o := range overrides {
+		reasons[o.Key] = strings.TrimSpace(o.Reason)
+	}
+	var open []Warning
+	for _, w := range warnings {
+		if w.RequiresOverride && reasons[w.Key] == "" {
+			open = append(open, w)
+		}
+	}
+	return open
+}
+
+// RecordOverrides stores the reason given for every overridden blocking warning.
+func RecordOverrides(ctx context.Context, tx pgx.Tx, prescriptionID, staffID string, warnings []Warning, overrides []Override) error {
+	reasons := map[string]string{}
+	for _, o := range overrides {
+		reasons[o.Key] = strings.TrimSpace(o.Reason)
+	}
+	for _, w := range warnings {
+		if !w.RequiresOverride {
+			continue
+		}
+		_, err := tx.Exec(ctx, `INSERT INTO prescription_overrides
+			(id, prescription_id, warning_key, warning_type, severity, description, reason, overridden_by, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			uuid.New().String()[:8], prescriptionID, w.Key, w.Type, w.Severity, w.Description, reasons[w.Key], staffID, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type checkRequest struct {
+	PatientID   string   `json:"patient_id"`
+	MedicineIDs []string `json:"medicine_ids"`
+}
+
+// CheckInteractions lets the client show warnings while the prescription is still being written.
+func CheckInteractions(c *fiber.Ctx) error {
+	var req checkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if req.PatientID == "" || len(req.MedicineIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "patient_id and medicine_ids are required",
+		})
+	}
+
+	medicines, err := LoadMedicines(req.MedicineIDs)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	warnings, err := Check(req.PatientID, medicines)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check interactions",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"warnings": warnings,
+	})
+}
@@ -1,20 +1,58 @@
 package laboratory
 
 import (
+	"context"
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
 	"web-service/database"
+	"web-service/internal/handlers/tariff"
+	"web-service/internal/middleware"
 )
 
 type Test struct {
-	ID          string  `json:"id"`
-	TestName    string  `json:"test_name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
+	ID              string          `json:"id"`
+	Code            *string         `json:"code,omitempty"`
+	TestName        string          `json:"test_name"`
+	Description     string          `json:"description"`
+	Price           decimal.Decimal `json:"price"`
+	SpecimenType    *string         `json:"specimen_type,omitempty"`
+	TurnaroundHours *int            `json:"turnaround_hours,omitempty"`
+	Department      *string         `json:"department,omitempty"`
+	IsPanel         bool            `json:"is_panel"`
+	Active          bool            `json:"active"`
+
+	Components []Component  `json:"components,omitempty"`
+	Parameters []Parameter  `json:"parameters,omitempty"`
+	Prices     []PriceEntry `json:"prices,omitempty"`
+}
+
+// Component is a test included in a panel.
+type Component struct {
+	TestID   string `json:"test_id"`
+	TestName string `json:"test_name,omitempty"`
+	Position int    `json:"position"`
+}
+
+// Price is the cash version in effect now, so a price scheduled for a later date
+// does not show until it applies.
+var testColumns = `l.id, l.code, l.test_name, COALESCE(l.description, ''),
+	COALESCE(` + tariff.CashPriceNow("lab", "l.id") + `, l.price),
+	l.specimen_type, l.turnaround_hours, l.department, l.is_panel, l.active`
+
+func (t *Test) scanTargets() []any {
+	return []any{&t.ID, &t.Code, &t.TestName, &t.Description, &t.Price, &t.SpecimenType, &t.TurnaroundHours, &t.Department, &t.IsPanel, &t.Active}
 }
 
 func GetTests(c *fiber.Ctx) error {
 	db := database.GetDB()
-	rows, err := db.Query(c.Context(), "SELECT id, test_name, description, price FROM laboratory")
+	rows, err := db.Query(c.Context(), "SELECT "+testColumns+` FROM laboratory l
+		WHERE (l.active OR $1) AND ($2 = '' OR l.department = $2)
+		ORDER BY l.test_name`, c.QueryBool("include_inactive"), c.Query("department"))
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -23,7 +61,7 @@ func GetTests(c *fiber.Ctx) error {
 	var tests []Test
 	for rows.Next() {
 		var t Test
-		if err := rows.Scan(&t.ID, &t.TestName, &t.Description, &t.Price); err != nil {
+		if err := rows.Scan(t.scanTargets()...); err != nil {
 			continue
 		}
 		tests = append(tests, t)
@@ -33,3 +71,229 @@ func GetTests(c *fiber.Ctx) error {
 	}
 	return c.JSON(tests)
 }
+
+// Fetch loads a test with its panel components, parameters and price history.
+func Fetch(ctx context.Context, id string) (*Test, error) {
+	db := database.GetDB()
+	var t Test
+	if err := db.QueryRow(ctx, "SELECT "+testColumns+" FROM laboratory l WHERE l.id = $1", id).Scan(t.scanTargets()...); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, `SELECT c.test_id, l.test_name, c.position FROM lab_panel_components c
+		JOIN laboratory l ON l.id = c.test_id WHERE c.panel_id = $1 ORDER BY c.position, l.test_name`, id)
+	if err != nil {
+		return nil, err
+	}
+	t.Components, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Component, error) {
+		var cp Component
+		err := row.Scan(&cp.TestID, &cp.TestName, &cp.Position)
+		return cp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Parameters, err = FetchParameters(ctx, id); err != nil {
+		return nil, err
+	}
+	if t.Prices, err = fetchPrices(ctx, id); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func GetTest(c *fiber.Ctx) error {
+	t, err := Fetch(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Test not found"})
+	}
+	return c.JSON(t)
+}
+
+func validateTest(t *Test) string {
+	t.TestName = strings.TrimSpace(t.TestName)
+	if t.TestName == "" {
+		return "test_name is required"
+	}
+	if t.Price.IsNegative() {
+		return "price cannot be negative"
+	}
+	t.Price = t.Price.Round(2)
+	if t.TurnaroundHours != nil && *t.TurnaroundHours <= 0 {
+		return "turnaround_hours must be positive"
+	}
+	if t.Code != nil {
+		code := strings.ToUpper(strings.TrimSpace(*t.Code))
+		t.Code = &code
+	}
+	return ""
+}
+
+// saveComponents replaces a panel's component list. Components must be
+// existing single tests; panels cannot be nested.
+func saveComponents(ctx context.Context, tx pgx.Tx, panelID string, components []Component) (string, error) {
+	if _, err := tx.Exec(ctx, "DELETE FROM lab_panel_components WHERE panel_id = $1", panelID); err != nil {
+		return "", err
+	}
+	for i, cp := range components {
+		var isPanel bool
+		err := tx.QueryRow(ctx, "SELECT is_panel FROM laboratory WHERE id = $1", cp.TestID).Scan(&isPanel)
+		if err != nil || isPanel || cp.TestID == panelID {
+			return "component " + cp.TestID + " must be an existing single test", nil
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO lab_panel_components (panel_id, test_id, position) VALUES ($1, $2, $3)", panelID, cp.TestID, i)
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func CreateTest(c *fiber.Ctx) error {
+	var t Test
+	if err := c.BodyParser(&t); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if msg := validateTest(&t); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+	if t.IsPanel && len(t.Components) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "a panel needs at least one component"})
+	}
+	t.ID = uuid.New().String()[:8]
+	t.Active = true
+
+	db := database.GetDB()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	_, err = tx.Exec(ctx, `INSERT INTO laboratory (id, code, test_name, description, price, specimen_type, turnaround_hours, department, is_panel, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, TRUE, $10, $10)`,
+		t.ID, t.Code, t.TestName, t.Description, t.Price, t.SpecimenType, t.TurnaroundHours, t.Department, t.IsPanel, now)
+	if err == nil {
+		err = insertPrice(ctx, tx, t.ID, t.Price, now, middleware.CurrentUserID(c))
+	}
+	if err == nil && t.IsPanel {
+		var msg string
+		if msg, err = saveComponents(ctx, tx, t.ID, t.Components); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	created, err := Fetch(ctx, t.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Test created successfully", "test": created})
+}
+
+type testUpdate struct {
+	Code            *string          `json:"code"`
+	TestName        *string          `json:"test_name"`
+	Description     *string          `json:"description"`
+	Price           *decimal.Decimal `json:"price"`
+	SpecimenType    *string          `json:"specimen_type"`
+	TurnaroundHours *int             `json:"turnaround_hours"`
+	Department      *string          `json:"department"`
+	Active          *bool            `json:"active"`
+	Components      *[]Component     `json:"components"`
+}
+
+// UpdateTest edits catalogue details. Prices are versioned, so price changes
+// go through AddPrice instead.
+func UpdateTest(c *fiber.Ctx) error {
+	var req testUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Price != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "prices are versioned, add a new price instead"})
+	}
+
+	ctx := context.Background()
+	t, err := Fetch(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Test not found"})
+	}
+	if req.Code != nil {
+		t.Code = req.Code
+	}
+	if req.TestName != nil {
+		t.TestName = *req.TestName
+	}
+	if req.Description != nil {
+		t.Description = *req.Description
+	}
+	if req.SpecimenType != nil {
+		t.SpecimenType = req.SpecimenType
+	}
+	if req.TurnaroundHours != nil {
+		t.TurnaroundHours = req.TurnaroundHours
+	}
+	if req.Department != nil {
+		t.Department = req.Department
+	}
+	if req.Active != nil {
+		t.Active = *req.Active
+	}
+	if msg := validateTest(t); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+	if req.Components != nil && (!t.IsPanel || len(*req.Components) == 0) {
+		return c.Status(400).JSON(fiber.Map{"error": "components can only be set on a panel and cannot be empty"})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE laboratory SET code=$1, test_name=$2, description=$3, specimen_type=$4, turnaround_hours=$5,
+		department=$6, active=$7, updated_at=$8 WHERE id=$9`,
+		t.Code, t.TestName, t.Description, t.SpecimenType, t.TurnaroundHours, t.Department, t.Active, time.Now(), t.ID)
+	if err == nil && req.Components != nil {
+		var msg string
+		if msg, err = saveComponents(ctx, tx, t.ID, *req.Components); msg != "" {
+			return c.Status(400).JSON(fiber.Map{"error": msg})
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	updated, err := Fetch(ctx, t.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Test updated successfully", "test": updated})
+}
+
+// DeleteTest deactivates a test. Tests are never removed so that past orders
+// and invoices keep pointing at them.
+func DeleteTest(c *fiber.Ctx) error {
+	db := database.GetDB()
+	tag, err := db.Exec(c.Context(), "UPDATE laboratory SET active = FALSE, updated_at = CURRENT_TIMESTAMP WHERE id = $1", c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Test not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Test deactivated successfully"})
+}
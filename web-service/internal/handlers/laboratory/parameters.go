@@ -0,0 +1,274 @@
+package laboratory
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"web-service/database"
+)
+
+// Parameter is one value reported for a test, e.g. haemoglobin in g/dL.
+// Code is the observation code the analysers send for it.
+type Parameter struct {
+	ID        string           `json:"id"`
+	TestID    string           `json:"test_id"`
+	Name      string           `json:"name"`
+	Code      *string          `json:"code,omitempty"`
+	Unit      *string          `json:"unit,omitempty"`
+	ValueType string           `json:"value_type"`
+	Position  int              `json:"position"`
+	Ranges    []ReferenceRange `json:"reference_ranges"`
+}
+
+// ReferenceRange applies to patients of the given sex ("any" for both) whose
+// age in days is at least AgeMinDays and below AgeMaxDays. Values beyond
+// CriticalLow or CriticalHigh are reported to the clinician immediately.
+type ReferenceRange struct {
+	ID           string   `json:"id"`
+	Sex          string   `json:"sex"`
+	AgeMinDays   int      `json:"age_min_days"`
+	AgeMaxDays   *int     `json:"age_max_days,omitempty"`
+	Low          *float64 `json:"low,omitempty"`
+	High         *float64 `json:"high,omitempty"`
+	CriticalLow  *float64 `json:"critical_low,omitempty"`
+	CriticalHigh *float64 `json:"critical_high,omitempty"`
+}
+
+// FetchParameters returns a test's parameters with their reference ranges.
+func FetchParameters(ctx context.Context, testID string) ([]Parameter, error) {
+	db := database.GetDB()
+	rows, err := db.Query(ctx, `SELECT id, test_id, name, code, unit, value_type, position FROM lab_test_parameters
+		WHERE test_id = $1 ORDER BY position, name`, testID)
+	if err != nil {
+		return nil, err
+	}
+	params, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Parameter, error) {
+		var p Parameter
+		err := row.Scan(&p.ID, &p.TestID, &p.Name, &p.Code, &p.Unit, &p.ValueType, &p.Position)
+		return p, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range params {
+		rows, err := db.Query(ctx, `SELECT id, sex, age_min_days, age_max_days, low, high, critical_low, critical_high FROM lab_reference_ranges
+			WHERE parameter_id = $1 ORDER BY sex, age_min_days`, params[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		params[i].Ranges, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (ReferenceRange, error) {
+			var r ReferenceRange
+			err := row.Scan(&r.ID, &r.Sex, &r.AgeMinDays, &r.AgeMaxDays, &r.Low, &r.High, &r.CriticalLow, &r.CriticalHigh)
+			return r, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// RangeFor picks the reference range for a patient, preferring a
+// sex-specific range over one for any sex.
+func (p *Parameter) RangeFor(sex string, ageDays int) *ReferenceRange {
+	sex = strings.ToLower(sex)
+	var match *ReferenceRange
+	for i := range p.Ranges {
+		r := &p.Ranges[i]
+		if ageDays < r.AgeMinDays || (r.AgeMaxDays != nil && ageDays >= *r.AgeMaxDays) {
+			continue
+		}
+		if r.Sex == sex {
+			return r
+		}
+		if r.Sex == "any" && match == nil {
+			match = r
+		}
+	}
+	return match
+}
+
+func validateParameter(p *Parameter) string {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return "name is required"
+	}
+	if p.ValueType == "" {
+		p.ValueType = "numeric"
+	}
+	if p.ValueType != "numeric" && p.ValueType != "text" {
+		return "value_type must be numeric or text"
+	}
+	for i := range p.Ranges {
+		r := &p.Ranges[i]
+		r.Sex = strings.ToLower(strings.TrimSpace(r.Sex))
+		if r.Sex == "" {
+			r.Sex = "any"
+		}
+		if r.Sex != "any" && r.Sex != "male" && r.Sex != "female" {
+			return "reference range sex must be any, male or female"
+		}
+		if r.AgeMinDays < 0 || (r.AgeMaxDays != nil && *r.AgeMaxDays <= r.AgeMinDays) {
+			return "reference range ages are invalid"
+		}
+		if r.Low != nil && r.High != nil && *r.Low > *r.High {
+			return "reference range low cannot be above high"
+		}
+		if r.CriticalLow != nil && r.Low != nil && *r.CriticalLow > *r.Low {
+			return "critical_low cannot be above low"
+		}
+		if r.CriticalHigh != nil && r.High != nil && *r.CriticalHigh < *r.High {
+			return "critical_high cannot be below high"
+		}
+	}
+	return ""
+}
+
+func saveRanges(ctx context.Context, tx pgx.Tx, p *Parameter) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM lab_reference_ranges WHERE parameter_id = $1", p.ID); err != nil {
+		return err
+	}
+	for i := range p.Ranges {
+		r := &p.Ranges[i]
+		r.ID = uuid.New().String()[:8]
+		_, err := tx.Exec(ctx, `INSERT INTO lab_reference_ranges (id, parameter_id, sex, age_min_days, age_max_days, low, high, critical_low, critical_high)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, r.ID, p.ID, r.Sex, r.AgeMinDays, r.AgeMaxDays, r.Low, r.High, r.CriticalLow, r.CriticalHigh)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func AddParameter(c *fiber.Ctx) error {
+	var p Parameter
+	if err := c.BodyParser(&p); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if msg := validateParameter(&p); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+	p.ID = uuid.New().String()[:8]
+	p.TestID = c.Params("id")
+	if p.Ranges == nil {
+		p.Ranges = []ReferenceRange{}
+	}
+
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	var isPanel bool
+	if err := tx.QueryRow(ctx, "SELECT is_panel FROM laboratory WHERE id = $1", p.TestID).Scan(&isPanel); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Test not found"})
+	}
+	if isPanel {
+		return c.Status(400).JSON(fiber.Map{"error": "parameters belong to the panel's component tests"})
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO lab_test_parameters (id, test_id, name, code, unit, value_type, position) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		p.ID, p.TestID, p.Name, p.Code, p.Unit, p.ValueType, p.Position)
+	if err == nil {
+		err = saveRanges(ctx, tx, &p)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Parameter added successfully", "parameter": p})
+}
+
+type parameterUpdate struct {
+	Name      *string           `json:"name"`
+	Code      *string           `json:"code"`
+	Unit      *string           `json:"unit"`
+	ValueType *string           `json:"value_type"`
+	Position  *int              `json:"position"`
+	Ranges    *[]ReferenceRange `json:"reference_ranges"`
+}
+
+// UpdateParameter edits a parameter; reference ranges, when given, replace the existing set.
+func UpdateParameter(c *fiber.Ctx) error {
+	var req parameterUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	ctx := context.Background()
+	params, err := FetchParameters(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	var p *Parameter
+	for i := range params {
+		if params[i].ID == c.Params("parameterId") {
+			p = &params[i]
+		}
+	}
+	if p == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Parameter not found"})
+	}
+
+	if req.Name != nil {
+		p.Name = *req.Name
+	}
+	if req.Code != nil {
+		p.Code = req.Code
+	}
+	if req.Unit != nil {
+		p.Unit = req.Unit
+	}
+	if req.ValueType != nil {
+		p.ValueType = *req.ValueType
+	}
+	if req.Position != nil {
+		p.Position = *req.Position
+	}
+	if req.Ranges != nil {
+		p.Ranges = *req.Ranges
+	}
+	if msg := validateParameter(p); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "UPDATE lab_test_parameters SET name=$1, code=$2, unit=$3, value_type=$4, position=$5 WHERE id=$6",
+		p.Name, p.Code, p.Unit, p.ValueType, p.Position, p.ID)
+	if err == nil && req.Ranges != nil {
+		err = saveRanges(ctx, tx, p)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Parameter updated successfully", "parameter": p})
+}
+
+func DeleteParameter(c *fiber.Ctx) error {
+	db := database.GetDB()
+	tag, err := db.Exec(c.Context(), "DELETE FROM lab_test_parameters WHERE id = $1 AND test_id = $2", c.Params("parameterId"), c.Params("id"))
+	if err != nil {
+		// Parameters with recorded results cannot be removed
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Parameter not found"})
+	}
+	return c.JSON(fiber.Map{"message": "Parameter deleted successfully"})
+}
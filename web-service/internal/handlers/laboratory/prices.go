@@ -0,0 +1,111 @@
+package laboratory
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+	"web-service/database"
+	"web-service/internal/handlers/tariff"
+	"web-service/internal/middleware"
+)
+
+// PriceEntry is one version of a test's cash price. Invoices copy the price
+// in effect when the test was ordered, so later versions never change them.
+type PriceEntry struct {
+	ID            string          `json:"id"`
+	Price         decimal.Decimal `json:"price"`
+	EffectiveFrom time.Time       `json:"effective_from"`
+	CreatedBy     *string         `json:"created_by,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+func fetchPrices(ctx context.Context, testID string) ([]PriceEntry, error) {
+	rows, err := database.GetDB().Query(ctx, `SELECT id, price, effective_from, created_by, created_at FROM tariff_prices
+		WHERE price_list_id = $1 AND item_type = 'lab' AND item_id = $2 ORDER BY effective_from DESC`, tariff.CashList, testID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (PriceEntry, error) {
+		var p PriceEntry
+		err := row.Scan(&p.ID, &p.Price, &p.EffectiveFrom, &p.CreatedBy, &p.CreatedAt)
+		return p, err
+	})
+}
+
+func insertPrice(ctx context.Context, tx pgx.Tx, testID string, price decimal.Decimal, effectiveFrom time.Time, staffID string) error {
+	return tariff.Record(ctx, tx, tariff.CashList, "lab", testID, price, decimal.Zero, effectiveFrom, staffID)
+}
+
+// PriceAt returns the cash price of a test in effect at the given time.
+func PriceAt(ctx context.Context, testID string, at time.Time) (decimal.Decimal, error) {
+	var price decimal.Decimal
+	err := database.GetDB().QueryRow(ctx, `SELECT price FROM tariff_prices WHERE price_list_id = $1 AND item_type = 'lab' AND item_id = $2
+		AND effective_from <= $3 ORDER BY effective_from DESC LIMIT 1`, tariff.CashList, testID, at).Scan(&price)
+	return price, err
+}
+
+func GetPrices(c *fiber.Ctx) error {
+	prices, err := fetchPrices(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(prices)
+}
+
+type priceRequest struct {
+	Price         decimal.Decimal `json:"price"`
+	EffectiveFrom string          `json:"effective_from"`
+}
+
+// AddPrice adds a new price version, effective now or from a later date.
+func AddPrice(c *fiber.Ctx) error {
+	var req priceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Price.IsNegative() {
+		return c.Status(400).JSON(fiber.Map{"error": "price cannot be negative"})
+	}
+	req.Price = req.Price.Round(2)
+	now := time.Now()
+	effective := now
+	if req.EffectiveFrom != "" {
+		t, err := time.ParseInLocation("2006-01-02", req.EffectiveFrom, time.Local)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "effective_from must be YYYY-MM-DD"})
+		}
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+		if t.Before(today) {
+			return c.Status(400).JSON(fiber.Map{"error": "prices cannot be backdated"})
+		}
+		if t.After(now) {
+			effective = t
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	testID := c.Params("id")
+	tag, err := tx.Exec(ctx, "UPDATE laboratory SET updated_at = $1 WHERE id = $2", now, testID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Test not found"})
+	}
+	if err == nil {
+		err = insertPrice(ctx, tx, testID, req.Price, effective, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(fiber.Map{"message": "Price added successfully", "price": req.Price, "effective_from": effective})
+}
@@ -0,0 +1,283 @@
+package laborders
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// CriticalAlert tracks a critical value until a clinician acknowledges it.
+// Unacknowledged alerts are escalated to the other doctors and the admins
+// after CRITICAL_ESCALATION_AFTER.
+type CriticalAlert struct {
+	ID                  string     `json:"id"`
+	OrderID             string     `json:"order_id"`
+	ResultID            string     `json:"result_id"`
+	ClinicianID         string     `json:"clinician_id"`
+	Flag                string     `json:"flag"`
+	ValueNumeric        float64    `json:"value_numeric"`
+	Message             string     `json:"message"`
+	CreatedAt           time.Time  `json:"created_at"`
+	EscalatedAt         *time.Time `json:"escalated_at,omitempty"`
+	AcknowledgedBy      *string    `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt      *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgementNote *string    `json:"acknowledgement_note,omitempty"`
+}
+
+const alertColumns = `id, order_id, result_id, clinician_id, flag, value_numeric, message, created_at, escalated_at,
+	acknowledged_by, acknowledged_at, acknowledgement_note`
+
+func (a *CriticalAlert) scanTargets() []any {
+	return []any{&a.ID, &a.OrderID, &a.ResultID, &a.ClinicianID, &a.Flag, &a.ValueNumeric, &a.Message, &a.CreatedAt, &a.EscalatedAt,
+		&a.AcknowledgedBy, &a.AcknowledgedAt, &a.AcknowledgementNote}
+}
+
+func notify(ctx context.Context, tx pgx.Tx, staffID, message, alertID string, at time.Time) error {
+	_, err := tx.Exec(ctx, `INSERT INTO notifications (id, user_id, message, priority, reference_type, reference_id, created_at)
+		VALUES ($1, $2, $3, 'urgent', 'lab_critical_alert', $4, $5)`, uuid.New().String()[:8], staffID, message, alertID, at)
+	return err
+}
+
+// raiseCriticalAlerts sends an urgent notification to the ordering clinician
+// for each critical value. Saving the same value again does not raise a
+// second alert, but a corrected value that is still critical does.
+func raiseCriticalAlerts(ctx context.Context, tx pgx.Tx, o *Order, patientName string, results []Result) ([]CriticalAlert, error) {
+	var alerts []CriticalAlert
+	now := time.Now()
+	for _, r := range results {
+		if r.Flag == nil || !strings.HasPrefix(*r.Flag, "critical_") {
+			continue
+		}
+		var exists bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM lab_critical_alerts WHERE result_id = $1 AND value_numeric = $2)`,
+			r.ID, *r.ValueNumeric).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+
+		unit := ""
+		if r.Unit != nil {
+			unit = " " + *r.Unit
+		}
+		a := CriticalAlert{
+			ID:           uuid.New().String()[:8],
+			OrderID:      o.ID,
+			ResultID:     r.ID,
+			ClinicianID:  o.OrderedBy,
+			Flag:         *r.Flag,
+			ValueNumeric: *r.ValueNumeric,
+			Message: fmt.Sprintf("CRITICAL %s: %s %s%s for %s (%s). Please acknowledge.",
+				strings.ToUpper(strings.TrimPrefix(*r.Flag, "critical_")), r.ParameterName,
+				strconv.FormatFloat(*r.ValueNumeric, 'f', -1, 64), unit, patientName, o.OrderNumber),
+			CreatedAt: now,
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO lab_critical_alerts (id, order_id, result_id, clinician_id, flag, value_numeric, message, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, a.ID, a.OrderID, a.ResultID, a.ClinicianID, a.Flag, a.ValueNumeric, a.Message, a.CreatedAt)
+		if err == nil {
+			err = notify(ctx, tx, a.ClinicianID, a.Message, a.ID, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, nil
+}
+
+// GetCriticalAlerts lists critical alerts, by default those still awaiting
+// acknowledgement. Clinicians see the alerts for their own orders and any
+// that have been escalated.
+func GetCriticalAlerts(c *fiber.Ctx) error {
+	clinicianID := ""
+	if !middleware.HasRole(c, "lab tech", "admin") {
+		clinicianID = middleware.CurrentUserID(c)
+	}
+	rows, err := database.GetDB().Query(c.Context(), `SELECT `+alertColumns+` FROM lab_critical_alerts
+		WHERE ($1 = '' OR clinician_id = $1 OR escalated_at IS NOT NULL) AND ($2 = '' OR order_id = $2) AND (acknowledged_at IS NULL OR $3)
+		ORDER BY created_at`, clinicianID, c.Query("order_id"), c.QueryBool("include_acknowledged"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	alerts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (CriticalAlert, error) {
+		var a CriticalAlert
+		err := row.Scan(a.scanTargets()...)
+		return a, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(alerts)
+}
+
+type acknowledgeRequest struct {
+	Note string `json:"note"`
+}
+
+// AcknowledgeAlert records that a clinician has seen a critical value and
+// clears the related notifications. The ordering clinician acknowledges it,
+// or any doctor or admin once it has been escalated.
+func AcknowledgeAlert(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req acknowledgeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var a CriticalAlert
+	err = tx.QueryRow(ctx, `SELECT `+alertColumns+` FROM lab_critical_alerts WHERE id = $1 FOR UPDATE`, c.Params("id")).Scan(a.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Critical alert not found",
+		})
+	}
+	if a.AcknowledgedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Critical alert already acknowledged",
+		})
+	}
+	staffID := middleware.CurrentUserID(c)
+	if staffID != a.ClinicianID && !(a.EscalatedAt != nil && middleware.HasRole(c, "doctor", "admin")) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the ordering clinician can acknowledge this alert",
+		})
+	}
+
+	now := time.Now()
+	var note *string
+	if n := strings.TrimSpace(req.Note); n != "" {
+		note = &n
+	}
+	_, err = tx.Exec(ctx, `UPDATE lab_critical_alerts SET acknowledged_by = $1, acknowledged_at = $2, acknowledgement_note = $3 WHERE id = $4`,
+		staffID, now, note, a.ID)
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE notifications SET is_read = TRUE WHERE reference_type = 'lab_critical_alert' AND reference_id = $1`, a.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to acknowledge alert",
+			"details": err.Error(),
+		})
+	}
+
+	a.AcknowledgedBy, a.AcknowledgedAt, a.AcknowledgementNote = &staffID, &now, note
+	return c.JSON(fiber.Map{
+		"message": "Critical alert acknowledged",
+		"alert": a,
+	})
+}
+
+func escalationDelay() time.Duration {
+	d, err := time.ParseDuration(config.GetVal("CRITICAL_ESCALATION_AFTER"))
+	if err != nil || d <= 0 {
+		return 30 * time.Minute
+	}
+	return d
+}
+
+// EscalateCriticalAlerts notifies every other active doctor and admin of
+// critical alerts left unacknowledged for longer than the escalation delay.
+// Each alert is escalated once.
+func EscalateCriticalAlerts(ctx context.Context) (int, error) {
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	rows, err := tx.Query(ctx, `SELECT `+alertColumns+` FROM lab_critical_alerts
+		WHERE acknowledged_at IS NULL AND escalated_at IS NULL AND created_at <= $1
+		FOR UPDATE SKIP LOCKED`, now.Add(-escalationDelay()))
+	if err != nil {
+		return 0, err
+	}
+	alerts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (CriticalAlert, error) {
+		var a CriticalAlert
+		err := row.Scan(a.scanTargets()...)
+		return a, err
+	})
+	if err != nil || len(alerts) == 0 {
+		return 0, err
+	}
+
+	rows, err = tx.Query(ctx, `SELECT id FROM staff WHERE LOWER(role) IN ('doctor', 'admin') AND status = 'active'`)
+	if err != nil {
+		return 0, err
+	}
+	staff, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	for _, a := range alerts {
+		message := fmt.Sprintf("ESCALATED after %s without acknowledgement: %s", now.Sub(a.CreatedAt).Round(time.Minute), a.Message)
+		for _, staffID := range staff {
+			if staffID == a.ClinicianID {
+				continue
+			}
+			if err := notify(ctx, tx, staffID, message, a.ID, now); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.Exec(ctx, `UPDATE lab_critical_alerts SET escalated_at = $1 WHERE id = $2`, now, a.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(alerts), tx.Commit(ctx)
+}
+
+// StartEscalationJob checks for overdue critical alerts every
+// CRITICAL_ESCALATION_CHECK_INTERVAL (default 1m) until ctx is cancelled.
+func StartEscalationJob(ctx context.Context) {
+	interval, err := time.ParseDuration(config.GetVal("CRITICAL_ESCALATION_CHECK_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		escalated, err := EscalateCriticalAlerts(ctx)
+		if err != nil {
+			log.Printf("Critical result escalation failed: %v", err)
+		} else if escalated > 0 {
+			log.Printf("Critical result escalation: %d alerts escalated", escalated)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
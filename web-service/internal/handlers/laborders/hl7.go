@@ -0,0 +1,491 @@
+package laborders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/hl7"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// HL7Message is an entry in the log of messages exchanged with analysers.
+type HL7Message struct {
+	ID          string    `json:"id"`
+	Direction   string    `json:"direction"`
+	MessageType *string   `json:"message_type,omitempty"`
+	ControlID   *string   `json:"control_id,omitempty"`
+	Peer        *string   `json:"peer,omitempty"`
+	OrderID     *string   `json:"order_id,omitempty"`
+	Status      string    `json:"status"`
+	Error       *string   `json:"error,omitempty"`
+	Raw         string    `json:"raw"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var errHL7 = errors.New("HL7 message not processed")
+
+// hl7Identity is how this system names itself in MSH-3 and MSH-4.
+func hl7Identity() (string, string) {
+	app, facility := config.GetVal("HL7_APPLICATION"), config.GetVal("HL7_FACILITY")
+	if app == "" {
+		app = "MEDICLINIC"
+	}
+	if facility == "" {
+		facility = "LAB"
+	}
+	return app, facility
+}
+
+func logHL7(ctx context.Context, id, direction string, m *hl7.Message, raw []byte, peer string, orderID *string, status, errText string) {
+	var msgType, controlID, errPtr *string
+	if m != nil {
+		t, c := m.Type(), m.ControlID()
+		msgType, controlID = &t, &c
+	}
+	if errText != "" {
+		errPtr = &errText
+	}
+	// Segments are stored one per line so the log reads easily
+	text := strings.ReplaceAll(strings.TrimRight(string(raw), "\r"), "\r", "\n")
+	_, err := database.GetDB().Exec(ctx, `INSERT INTO hl7_messages (id, direction, message_type, control_id, peer, order_id, status, error, raw, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, id, direction, msgType, controlID, peer, orderID, status, errPtr, text, time.Now())
+	if err != nil {
+		log.Printf("Failed to log HL7 message: %v", err)
+	}
+}
+
+// HandleMessage processes a message received from an analyser and returns
+// its ACK. Only ORU^R01 result messages are accepted.
+func HandleMessage(ctx context.Context, raw []byte, peer string) []byte {
+	logID := uuid.New().String()[:8]
+	m, err := hl7.Parse(raw)
+	if err != nil {
+		// Without an MSH there is nothing to acknowledge
+		logHL7(ctx, logID, "inbound", nil, raw, peer, nil, "rejected", err.Error())
+		return nil
+	}
+
+	app, facility := hl7Identity()
+	if m.Type() != "ORU^R01" {
+		text := "unsupported message type " + m.Type()
+		logHL7(ctx, logID, "inbound", m, raw, peer, nil, "rejected", text)
+		return hl7.Ack(m, app, facility, hl7.AckReject, text, logID)
+	}
+
+	orderID, notes, err := receiveResults(ctx, m)
+	if err != nil {
+		if !errors.Is(err, errHL7) {
+			log.Printf("HL7 result message %s failed: %v", m.ControlID(), err)
+		}
+		logHL7(ctx, logID, "inbound", m, raw, peer, orderID, "error", err.Error())
+		return hl7.Ack(m, app, facility, hl7.AckError, err.Error(), logID)
+	}
+	text := strings.Join(notes, "; ")
+	logHL7(ctx, logID, "inbound", m, raw, peer, orderID, "accepted", text)
+	return hl7.Ack(m, app, facility, hl7.AckAccept, text, logID)
+}
+
+// observationGroup is an OBR segment with the OBX and SPM segments after it.
+type observationGroup struct {
+	obr hl7.Segment
+	spm *hl7.Segment
+	obx []hl7.Segment
+}
+
+func groupObservations(m *hl7.Message) []observationGroup {
+	var groups []observationGroup
+	for _, s := range m.Segments {
+		switch s.Name() {
+		case "OBR":
+			groups = append(groups, observationGroup{obr: s})
+		case "OBX":
+			if len(groups) > 0 {
+				g := &groups[len(groups)-1]
+				g.obx = append(g.obx, s)
+			}
+		case "SPM":
+			if len(groups) > 0 {
+				seg := s
+				groups[len(groups)-1].spm = &seg
+			}
+		}
+	}
+	return groups
+}
+
+// specimenNumber reads the specimen barcode from the filler order number
+// (OBR-3), the placer order number (OBR-2) or the SPM segment, whichever the
+// analyser fills in.
+func (g observationGroup) specimenNumber() string {
+	for _, v := range []string{g.obr.Component(3, 1), g.obr.Component(2, 1)} {
+		if v != "" {
+			return strings.ToUpper(strings.TrimSpace(v))
+		}
+	}
+	if g.spm != nil {
+		v, _, _ := strings.Cut(g.spm.Component(2, 1), "&")
+		return strings.ToUpper(strings.TrimSpace(v))
+	}
+	return ""
+}
+
+// receiveResults stores the observations of an ORU^R01 message against the
+// order whose specimen the analyser ran. Observations with codes that are not
+// mapped to a parameter of the order are skipped and reported in the ACK.
+func receiveResults(ctx context.Context, m *hl7.Message) (*string, []string, error) {
+	staffID := config.GetVal("HL7_INTERFACE_STAFF_ID")
+	if staffID == "" {
+		return nil, nil, fmt.Errorf("%w: HL7_INTERFACE_STAFF_ID is not configured", errHL7)
+	}
+	groups := groupObservations(m)
+	if len(groups) == 0 {
+		return nil, nil, fmt.Errorf("%w: message has no OBR segment", errHL7)
+	}
+
+	var orderID *string
+	var notes []string
+	for _, g := range groups {
+		specimen := g.specimenNumber()
+		var id string
+		err := database.GetDB().QueryRow(ctx, `SELECT order_id FROM specimens WHERE specimen_number = $1 AND rejected_reason IS NULL`, specimen).Scan(&id)
+		if err != nil {
+			return orderID, nil, fmt.Errorf("%w: unknown specimen %q", errHL7, specimen)
+		}
+		orderID = &id
+		o, err := Fetch(ctx, id, false)
+		if err != nil {
+			return orderID, nil, err
+		}
+		params, _, err := orderParameters(ctx, o)
+		if err != nil {
+			return orderID, nil, err
+		}
+
+		// Observation codes (or names, when a parameter has no code) to order item and parameter
+		type target struct{ itemID, paramID, valueType string }
+		byCode := map[string]target{}
+		for _, it := range o.Items {
+			itemID := it.ID
+			for _, p := range params[itemID] {
+				key := strings.ToLower(p.Name)
+				if p.Code != nil && *p.Code != "" {
+					key = strings.ToLower(*p.Code)
+				}
+				if _, taken := byCode[key]; !taken {
+					byCode[key] = target{itemID, p.ID, p.ValueType}
+				}
+			}
+		}
+
+		var entries []resultEntry
+		for _, obx := range g.obx {
+			// Results the analyser could not produce or has withdrawn
+			if status := obx.Field(11); status == "X" || status == "D" || status == "W" {
+				continue
+			}
+			code := obx.Component(3, 1)
+			t, ok := byCode[strings.ToLower(code)]
+			if !ok {
+				t, ok = byCode[strings.ToLower(obx.Component(3, 2))]
+			}
+			if !ok {
+				notes = append(notes, fmt.Sprintf("%s: %s not on order %s", specimen, code, o.OrderNumber))
+				continue
+			}
+
+			e := resultEntry{OrderItemID: t.itemID, ParameterID: t.paramID}
+			value := strings.TrimSpace(obx.Component(5, 1))
+			if t.valueType == "numeric" {
+				n, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					notes = append(notes, fmt.Sprintf("%s: %s value %q is not numeric", specimen, code, value))
+					continue
+				}
+				e.ValueNumeric = &n
+			} else {
+				e.ValueText = &value
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) == 0 {
+			return orderID, nil, fmt.Errorf("%w: no observations for specimen %s matched order %s", errHL7, specimen, o.OrderNumber)
+		}
+
+		if _, err := saveResults(ctx, o, staffID, entries); err != nil {
+			if errors.Is(err, errInvalidResult) || errors.Is(err, errResultState) || errors.Is(err, errStatusChanged) {
+				err = fmt.Errorf("%w: %v", errHL7, err)
+			}
+			return orderID, nil, err
+		}
+	}
+	return orderID, notes, nil
+}
+
+// knownAnalyser reports whether a connection comes from the host of one of
+// the analysers in HL7_ANALYSERS.
+func knownAnalyser(peer string) bool {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, addr := range analyserRoutes() {
+		analyser, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupHost(analyser)
+		if err != nil {
+			log.Printf("HL7 analyser %s not resolved: %v", analyser, err)
+			continue
+		}
+		for _, a := range ips {
+			if net.ParseIP(a).Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartHL7Listener accepts analyser connections on HL7_LISTEN_ADDR until ctx
+// is cancelled. The interface is off when the address is not set, and only
+// the analysers' hosts may connect.
+func StartHL7Listener(ctx context.Context) {
+	addr := config.GetVal("HL7_LISTEN_ADDR")
+	if addr == "" {
+		return
+	}
+	log.Printf("HL7 MLLP listener on %s", addr)
+	if err := hl7.Serve(ctx, addr, knownAnalyser, HandleMessage); err != nil {
+		log.Printf("HL7 listener stopped: %v", err)
+	}
+}
+
+// analyserRoutes maps lab departments to analyser addresses, read from
+// HL7_ANALYSERS as "haematology=host:port,chemistry=host:port". A "*" entry
+// takes every department not listed.
+func analyserRoutes() map[string]string {
+	routes := map[string]string{}
+	for _, entry := range strings.Split(config.GetVal("HL7_ANALYSERS"), ",") {
+		department, addr, ok := strings.Cut(entry, "=")
+		if ok && strings.TrimSpace(addr) != "" {
+			routes[strings.ToLower(strings.TrimSpace(department))] = strings.TrimSpace(addr)
+		}
+	}
+	return routes
+}
+
+// orderLine is an ordered test with the specimen it is run on.
+type orderLine struct {
+	code, name, department string
+	specimenNumber         *string
+	specimenType           *string
+	collectedAt            *time.Time
+}
+
+// SentMessage reports the outcome of sending an order to one analyser.
+type SentMessage struct {
+	ID       string `json:"id"`
+	Analyser string `json:"analyser"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SendOrder sends an ORM^O01 new order message for a lab order to each
+// analyser that runs its tests, so the analyser knows what to do with the
+// specimen when its barcode is scanned.
+func SendOrder(ctx context.Context, orderID string) ([]SentMessage, error) {
+	routes := analyserRoutes()
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("%w: HL7_ANALYSERS is not configured", errHL7)
+	}
+
+	var orderNumber, priority, orderedBy, patientID, firstName, lastName, gender, status string
+	var dob, createdAt time.Time
+	err := database.GetDB().QueryRow(ctx, `SELECT o.order_number, o.priority, o.ordered_by, o.status, o.created_at,
+			p.id, p.first_name, p.last_name, p.gender, p.date_of_birth
+		FROM lab_orders o JOIN patients p ON p.id = o.patient_id WHERE o.id = $1`, orderID).
+		Scan(&orderNumber, &priority, &orderedBy, &status, &createdAt, &patientID, &firstName, &lastName, &gender, &dob)
+	if err != nil {
+		return nil, err
+	}
+	if status == "cancelled" || status == "verified" {
+		return nil, fmt.Errorf("%w: order is %s", errHL7, status)
+	}
+
+	// Each test goes with the latest good specimen of a type it is run on
+	rows, err := database.GetDB().Query(ctx, `SELECT COALESCE(l.code, l.id), l.test_name, LOWER(COALESCE(l.department, '')),
+			s.specimen_number, s.specimen_type, s.collected_at
+		FROM lab_order_items i
+		JOIN laboratory l ON l.id = i.test_id
+		LEFT JOIN LATERAL (
+			SELECT sp.specimen_number, sp.specimen_type, sp.collected_at FROM specimens sp
+			WHERE sp.order_id = i.order_id AND sp.rejected_reason IS NULL
+				AND sp.specimen_type IN (
+					SELECT COALESCE(l.specimen_type, c.specimen_type, 'unspecified')
+					FROM (SELECT 1) one
+					LEFT JOIN lab_panel_components pc ON pc.panel_id = l.id AND l.specimen_type IS NULL
+					LEFT JOIN laboratory c ON c.id = pc.test_id)
+			ORDER BY sp.collected_at DESC LIMIT 1) s ON true
+		WHERE i.order_id = $1 ORDER BY l.test_name`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (orderLine, error) {
+		var l orderLine
+		err := row.Scan(&l.code, &l.name, &l.department, &l.specimenNumber, &l.specimenType, &l.collectedAt)
+		return l, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byAnalyser := map[string][]orderLine{}
+	var analysers []string
+	for _, l := range lines {
+		addr, ok := routes[l.department]
+		if !ok {
+			addr, ok = routes["*"]
+		}
+		if !ok || l.specimenNumber == nil {
+			continue
+		}
+		if _, seen := byAnalyser[addr]; !seen {
+			analysers = append(analysers, addr)
+		}
+		byAnalyser[addr] = append(byAnalyser[addr], l)
+	}
+	if len(analysers) == 0 {
+		return nil, fmt.Errorf("%w: no collected specimen for a test an analyser runs", errHL7)
+	}
+
+	app, facility := hl7Identity()
+	hl7Priority := map[string]string{"routine": "R", "urgent": "A", "stat": "S"}[priority]
+	sex := "U"
+	if g := strings.ToUpper(gender); g != "" && strings.ContainsRune("MF", rune(g[0])) {
+		sex = g[:1]
+	}
+
+	sent := make([]SentMessage, 0, len(analysers))
+	for _, addr := range analysers {
+		id := uuid.New().String()[:8]
+		b := hl7.NewBuilder(app, facility, "ANALYSER", addr, "ORM^O01^ORM_O01", id).
+			Add("PID", "1", "", hl7.Escape(patientID)+"^^^"+hl7.Escape(app)+"^MR", "",
+				hl7.Escape(lastName)+"^"+hl7.Escape(firstName), "", dob.Format("20060102"), sex)
+		for i, l := range byAnalyser[addr] {
+			specimenType := ""
+			if l.specimenType != nil {
+				specimenType = hl7.Escape(*l.specimenType)
+			}
+			b.Add("ORC", "NW", orderNumber, *l.specimenNumber, "", "SC", "", "^^^^^"+hl7Priority, "",
+				time.Now().Format(hl7.TimeFormat), "", "", hl7.Escape(orderedBy))
+			b.Add("OBR", strconv.Itoa(i+1), orderNumber, *l.specimenNumber, hl7.Escape(l.code)+"^"+hl7.Escape(l.name)+"^L",
+				hl7Priority, createdAt.Format(hl7.TimeFormat), l.collectedAt.Format(hl7.TimeFormat),
+				"", "", "", "", "", "", "", specimenType, hl7.Escape(orderedBy))
+		}
+		msg := b.Bytes()
+
+		result := SentMessage{ID: id, Analyser: addr, Status: "sent"}
+		ack, err := hl7.Send(ctx, addr, msg, 10*time.Second)
+		if err == nil {
+			if msa, ok := ack.Segment("MSA"); !ok || (msa.Field(1) != hl7.AckAccept && msa.Field(1) != "CA") {
+				err = fmt.Errorf("analyser did not accept the order: %s %s", msa.Field(1), msa.Field(3))
+			}
+		}
+		if err != nil {
+			result.Status, result.Error = "failed", err.Error()
+		}
+		m, _ := hl7.Parse(msg)
+		logHL7(ctx, id, "outbound", m, msg, addr, &orderID, result.Status, result.Error)
+		sent = append(sent, result)
+	}
+	return sent, nil
+}
+
+// sendOrderInBackground sends an order to the analysers once its specimens
+// reach the lab. Failures are in the HL7 log and can be resent by hand.
+func sendOrderInBackground(orderID string) {
+	if len(analyserRoutes()) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if _, err := SendOrder(ctx, orderID); err != nil {
+			log.Printf("Sending lab order %s to analysers failed: %v", orderID, err)
+		}
+	}()
+}
+
+// ResendOrder sends a lab order to the analysers again.
+func ResendOrder(c *fiber.Ctx) error {
+	sent, err := SendOrder(context.Background(), c.Params("id"))
+	if errors.Is(err, errHL7) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send lab order",
+			"details": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Lab order sent to analysers",
+		"messages": sent,
+	})
+}
+
+// GetHL7Messages lists the interface log, newest first, filtered by
+// order_id, direction and status.
+func GetHL7Messages(c *fiber.Ctx) error {
+	db := database.GetDB()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+
+	filter := `WHERE ($1 = '' OR order_id = $1) AND ($2 = '' OR direction = $2) AND ($3 = '' OR status = $3)`
+	args := []any{c.Query("order_id"), c.Query("direction"), c.Query("status")}
+
+	var total int
+	if err := db.QueryRow(c.Context(), `SELECT COUNT(*) FROM hl7_messages `+filter, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rows, err := db.Query(c.Context(), `SELECT id, direction, message_type, control_id, peer, order_id, status, error, raw, created_at
+		FROM hl7_messages `+filter+` ORDER BY created_at DESC LIMIT $4 OFFSET $5`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	list, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (HL7Message, error) {
+		var m HL7Message
+		err := row.Scan(&m.ID, &m.Direction, &m.MessageType, &m.ControlID, &m.Peer, &m.OrderID, &m.Status, &m.Error, &m.Raw, &m.CreatedAt)
+		return m, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"items": list,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
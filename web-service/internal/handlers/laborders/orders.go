@@ -0,0 +1,361 @@
+package laborders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/billing"
+	"web-service/internal/handlers/laboratory"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+type Order struct {
+	ID               string     `json:"id"`
+	OrderNumber      string     `json:"order_number"`
+	PatientID        string     `json:"patient_id"`
+	EncounterID      *string    `json:"encounter_id,omitempty"`
+	EncounterOrderID *string    `json:"encounter_order_id,omitempty"`
+	OrderedBy        string     `json:"ordered_by"`
+	Priority         string     `json:"priority"`
+	Status           string     `json:"status"`
+	ClinicalNotes    *string    `json:"clinical_notes,omitempty"`
+	InvoiceID        *string    `json:"invoice_id,omitempty"`
+	ResultedBy       *string    `json:"resulted_by,omitempty"`
+	ResultedAt       *time.Time `json:"resulted_at,omitempty"`
+	VerifiedBy       *string    `json:"verified_by,omitempty"`
+	VerifiedAt       *time.Time `json:"verified_at,omitempty"`
+	CancelReason     *string    `json:"cancel_reason,omitempty"`
+	Items            []Item     `json:"items"`
+	Specimens        []Specimen `json:"specimens,omitempty"`
+	Results          []Result   `json:"results,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+type Item struct {
+	ID           string          `json:"id"`
+	TestID       string          `json:"test_id"`
+	TestName     string          `json:"test_name,omitempty"`
+	SpecimenType *string         `json:"specimen_type,omitempty"`
+	IsPanel      bool            `json:"is_panel"`
+	Price        decimal.Decimal `json:"price"`
+}
+
+// statusFlow lists the status each step moves an order from and to.
+var statusFlow = map[string][2]string{
+	"collect": {"ordered", "collected"},
+	"receive": {"collected", "received"},
+	"start":   {"received", "in_progress"},
+}
+
+var priorities = map[string]bool{"routine": true, "urgent": true, "stat": true}
+
+var errOrder = errors.New("invalid lab order")
+
+const orderColumns = `id, order_number, patient_id, encounter_id, encounter_order_id, ordered_by, priority, status, clinical_notes, invoice_id,
+	resulted_by, resulted_at, verified_by, verified_at, cancel_reason, created_at, updated_at`
+
+func (o *Order) scanTargets() []any {
+	return []any{&o.ID, &o.OrderNumber, &o.PatientID, &o.EncounterID, &o.EncounterOrderID, &o.OrderedBy, &o.Priority, &o.Status, &o.ClinicalNotes, &o.InvoiceID,
+		&o.ResultedBy, &o.ResultedAt, &o.VerifiedBy, &o.VerifiedAt, &o.CancelReason, &o.CreatedAt, &o.UpdatedAt}
+}
+
+func fetchItems(ctx context.Context, orderID string) ([]Item, error) {
+	rows, err := database.GetDB().Query(ctx, `SELECT i.id, i.test_id, l.test_name, l.specimen_type, l.is_panel, i.price
+		FROM lab_order_items i JOIN laboratory l ON l.id = i.test_id
+		WHERE i.order_id = $1 ORDER BY l.test_name`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Item, error) {
+		var it Item
+		err := row.Scan(&it.ID, &it.TestID, &it.TestName, &it.SpecimenType, &it.IsPanel, &it.Price)
+		return it, err
+	})
+}
+
+// Fetch loads an order with its tests and specimens. Results are included
+// when withResults is set.
+func Fetch(ctx context.Context, id string, withResults bool) (*Order, error) {
+	var o Order
+	err := database.GetDB().QueryRow(ctx, `SELECT `+orderColumns+` FROM lab_orders WHERE id = $1`, id).Scan(o.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	if o.Items, err = fetchItems(ctx, o.ID); err != nil {
+		return nil, err
+	}
+	if o.Specimens, err = fetchSpecimens(ctx, o.ID); err != nil {
+		return nil, err
+	}
+	if withResults {
+		if o.Results, err = FetchResults(ctx, o.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &o, nil
+}
+
+// canSeeResults reports whether the caller may see results of the order in
+// its current state. Lab staff see results as they are entered; everyone
+// else only once a second lab user has verified them.
+func canSeeResults(c *fiber.Ctx, o *Order) bool {
+	return o.Status == "verified" || middleware.HasRole(c, "lab tech", "admin")
+}
+
+func GetOrders(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var statuses []string
+	if s := c.Query("status"); s != "" {
+		statuses = strings.Split(s, ",")
+	}
+	rows, err := database.GetDB().Query(ctx, `SELECT `+orderColumns+` FROM lab_orders
+		WHERE ($1 = '' OR patient_id = $1) AND ($2 = '' OR encounter_id = $2)
+			AND (COALESCE(cardinality($3::text[]), 0) = 0 OR status = ANY($3))
+		ORDER BY CASE priority WHEN 'stat' THEN 0 WHEN 'urgent' THEN 1 ELSE 2 END, created_at`,
+		c.Query("patient_id"), c.Query("encounter_id"), statuses)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	orders, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Order, error) {
+		var o Order
+		err := row.Scan(o.scanTargets()...)
+		return o, err
+	})
+	for i := 0; err == nil && i < len(orders); i++ {
+		orders[i].Items, err = fetchItems(ctx, orders[i].ID)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(orders)
+}
+
+func GetOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	o, err := Fetch(ctx, c.Params("id"), false)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lab order not found",
+		})
+	}
+	if canSeeResults(c, o) {
+		if o.Results, err = FetchResults(ctx, o.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	return c.JSON(o)
+}
+
+type orderRequest struct {
+	PatientID        string   `json:"patient_id"`
+	EncounterID      *string  `json:"encounter_id"`
+	EncounterOrderID *string  `json:"encounter_order_id"`
+	Priority         string   `json:"priority"`
+	ClinicalNotes    *string  `json:"clinical_notes"`
+	TestIDs          []string `json:"test_ids"`
+}
+
+// CreateOrder places a lab order for a patient, optionally from an encounter,
+// and bills the tests to the patient's open invoice at today's prices.
+func CreateOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req orderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if req.PatientID == "" || len(req.TestIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "patient_id and test_ids are required",
+		})
+	}
+	if req.Priority == "" {
+		req.Priority = "routine"
+	}
+	if !priorities[req.Priority] {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "priority must be routine, urgent or stat",
+		})
+	}
+
+	now := time.Now()
+	o := Order{
+		ID:               uuid.New().String()[:8],
+		PatientID:        req.PatientID,
+		EncounterID:      req.EncounterID,
+		EncounterOrderID: req.EncounterOrderID,
+		OrderedBy:        middleware.CurrentUserID(c),
+		Priority:         req.Priority,
+		Status:           "ordered",
+		ClinicalNotes:    req.ClinicalNotes,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+
+	seen := map[string]bool{}
+	for _, id := range req.TestIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		t, err := laboratory.Fetch(ctx, id)
+		if err != nil || !t.Active {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("test %s is not available", id),
+			})
+		}
+		o.Items = append(o.Items, Item{
+			ID: uuid.New().String()[:8], TestID: t.ID, TestName: t.TestName, SpecimenType: t.SpecimenType, IsPanel: t.IsPanel, Price: t.Price,
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	if o.EncounterID != nil {
+		var patientID string
+		err = tx.QueryRow(ctx, `SELECT patient_id FROM encounters WHERE id = $1`, *o.EncounterID).Scan(&patientID)
+		if err != nil || patientID != o.PatientID {
+			err = fmt.Errorf("%w: encounter does not belong to this patient", errOrder)
+		}
+	}
+	if err == nil && o.EncounterOrderID != nil {
+		var encounterID, orderType string
+		err = tx.QueryRow(ctx, `SELECT encounter_id, order_type FROM encounter_orders WHERE id = $1`, *o.EncounterOrderID).Scan(&encounterID, &orderType)
+		if err != nil || orderType != "lab" || o.EncounterID == nil || encounterID != *o.EncounterID {
+			err = fmt.Errorf("%w: encounter_order_id must be a lab order on the same encounter", errOrder)
+		}
+	}
+	if err == nil {
+		err = tx.QueryRow(ctx, `INSERT INTO lab_orders (id, order_number, patient_id, encounter_id, encounter_order_id, ordered_by, priority, status, clinical_notes, created_at, updated_at)
+			VALUES ($1, 'LAB-' || LPAD(nextval('lab_order_number_seq')::text, 6, '0'), $2, $3, $4, $5, $6, $7, $8, $9, $9)
+			RETURNING order_number`,
+			o.ID, o.PatientID, o.EncounterID, o.EncounterOrderID, o.OrderedBy, o.Priority, o.Status, o.ClinicalNotes, now).Scan(&o.OrderNumber)
+	}
+	var lines []billing.Line
+	for i := 0; err == nil && i < len(o.Items); i++ {
+		it := &o.Items[i]
+		_, err = tx.Exec(ctx, `INSERT INTO lab_order_items (id, order_id, test_id, price) VALUES ($1, $2, $3, $4)`, it.ID, o.ID, it.TestID, it.Price)
+		sourceType := "lab_order_item"
+		lines = append(lines, billing.Line{
+			ItemType: "lab", Description: it.TestName, Quantity: 1, UnitPrice: it.Price, SourceType: &sourceType, SourceID: &it.ID,
+		})
+	}
+	if err == nil && o.EncounterOrderID != nil {
+		_, err = tx.Exec(ctx, `UPDATE encounter_orders SET status = 'ordered' WHERE id = $1`, *o.EncounterOrderID)
+	}
+	if err == nil {
+		var invoiceID string
+		invoiceID, err = billing.AddLines(ctx, tx, o.PatientID, lines)
+		o.InvoiceID = &invoiceID
+	}
+	if err == nil {
+		_, err = tx.Exec(ctx, `UPDATE lab_orders SET invoice_id = $1 WHERE id = $2`, o.InvoiceID, o.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if errors.Is(err, errOrder) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, billing.ErrUnknownPatient) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create lab order",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Lab order created successfully",
+		"order": o,
+	})
+}
+
+type cancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CancelOrder cancels an order before the lab has started on it and credits
+// its tests at the price charged, on the invoice they were billed on.
+func CancelOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req cancelRequest
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A cancellation reason is required",
+		})
+	}
+	o, err := Fetch(ctx, c.Params("id"), false)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lab order not found",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE lab_orders SET status = 'cancelled', cancel_reason = $1, updated_at = $2
+		WHERE id = $3 AND status IN ('ordered', 'collected', 'received')`, strings.TrimSpace(req.Reason), time.Now(), o.ID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only orders the lab has not started on can be cancelled",
+		})
+	}
+	var reversals []billing.Reversal
+	for _, it := range o.Items {
+		reversals = append(reversals, billing.Reversal{SourceType: "lab_order_item", SourceID: it.ID, Quantity: 1, Description: "Cancelled: " + it.TestName})
+	}
+	var credits []billing.Credit
+	if err == nil {
+		credits, err = billing.Reverse(ctx, tx, reversals, strings.TrimSpace(req.Reason), middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel lab order",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Lab order cancelled successfully",
+		"credits": credits,
+	})
+}
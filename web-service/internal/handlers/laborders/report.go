@@ -0,0 +1,288 @@
+package laborders
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/pdfdoc"
+	"github.com/gofiber/fiber/v2"
+)
+
+var errNoReportKey = errors.New("LAB_REPORT_SIGNING_KEY is not set")
+
+// reportSignature is a keyed hash over the verified results, printed on the
+// report as a QR code. It no longer matches if the stored results differ
+// from what was printed. Reports are not signed without their own key.
+func reportSignature(o *Order) (string, error) {
+	key := config.GetVal("LAB_REPORT_SIGNING_KEY")
+	if key == "" {
+		return "", errNoReportKey
+	}
+	results := append([]Result(nil), o.Results...)
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%s|%s", o.ID, o.OrderNumber, o.PatientID)
+	if o.VerifiedBy != nil && o.VerifiedAt != nil {
+		fmt.Fprintf(&b, "|%s|%s", *o.VerifiedBy, o.VerifiedAt.UTC().Format(time.RFC3339))
+	}
+	for _, r := range results {
+		fmt.Fprintf(&b, "|%s;%s;%s;%s", r.ParameterID, formatValue(r), deref(r.Unit), deref(r.Flag))
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(b.String()))
+	// 128 bits keeps the QR code small enough to scan off a printout
+	return hex.EncodeToString(mac.Sum(nil))[:32], nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func formatNumber(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+func formatValue(r Result) string {
+	if r.ValueNumeric != nil {
+		return formatNumber(r.ValueNumeric)
+	}
+	return deref(r.ValueText)
+}
+
+func formatRange(r Result) string {
+	switch {
+	case r.RefLow != nil && r.RefHigh != nil:
+		return formatNumber(r.RefLow) + " - " + formatNumber(r.RefHigh)
+	case r.RefLow != nil:
+		return ">= " + formatNumber(r.RefLow)
+	case r.RefHigh != nil:
+		return "<= " + formatNumber(r.RefHigh)
+	}
+	return ""
+}
+
+var flagLabels = map[string]string{
+	"low": "L", "high": "H", "critical_low": "LL (critical)", "critical_high": "HH (critical)",
+}
+
+// verificationURL is where the report's QR code points.
+func verificationURL(o *Order, sig string) string {
+	return fmt.Sprintf("%s/api/lab/reports/%s/verify?sig=%s", strings.TrimRight(config.GetVal("API_URL"), "/"), o.ID, sig)
+}
+
+// reportDetails are the names printed alongside the order.
+type reportDetails struct {
+	PatientName  string
+	PatientDOB   time.Time
+	Gender       string
+	OrderedBy    string
+	VerifiedBy   string
+	CollectedAt  *time.Time
+	SpecimenList string
+}
+
+func fetchReportDetails(ctx context.Context, o *Order) (*reportDetails, error) {
+	var d reportDetails
+	err := database.GetDB().QueryRow(ctx, `SELECT p.first_name || ' ' || p.last_name, p.date_of_birth, p.gender,
+			ob.first_name || ' ' || ob.last_name, COALESCE(vb.first_name || ' ' || vb.last_name, '')
+		FROM lab_orders o
+		JOIN patients p ON p.id = o.patient_id
+		JOIN staff ob ON ob.id = o.ordered_by
+		LEFT JOIN staff vb ON vb.id = o.verified_by
+		WHERE o.id = $1`, o.ID).Scan(&d.PatientName, &d.PatientDOB, &d.Gender, &d.OrderedBy, &d.VerifiedBy)
+	if err != nil {
+		return nil, err
+	}
+	var specimens []string
+	for _, s := range o.Specimens {
+		if s.RejectedReason != nil {
+			continue
+		}
+		specimens = append(specimens, s.SpecimenNumber+" ("+s.SpecimenType+")")
+		if d.CollectedAt == nil || s.CollectedAt.Before(*d.CollectedAt) {
+			at := s.CollectedAt
+			d.CollectedAt = &at
+		}
+	}
+	d.SpecimenList = strings.Join(specimens, ", ")
+	return &d, nil
+}
+
+// ageText gives a patient's age in years, or months for infants.
+func ageText(dob, at time.Time) string {
+	months := (at.Year()-dob.Year())*12 + int(at.Month()-dob.Month())
+	if at.Day() < dob.Day() {
+		months--
+	}
+	if months < 24 {
+		return fmt.Sprintf("%d months", months)
+	}
+	return fmt.Sprintf("%d years", months/12)
+}
+
+// GetReportPDF renders a verified lab order as a printable report on the
+// clinic letterhead.
+func GetReportPDF(c *fiber.Ctx) error {
+	ctx := context.Background()
+	o, err := Fetch(ctx, c.Params("id"), true)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lab order not found",
+		})
+	}
+	if o.Status != "verified" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Reports are only available once results are verified",
+		})
+	}
+	sig, err := reportSignature(o)
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Reports cannot be signed",
+			"details": err.Error(),
+		})
+	}
+	d, err := fetchReportDetails(ctx, o)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	collected := "-"
+	if d.CollectedAt != nil {
+		collected = d.CollectedAt.Format("02 Jan 2006 15:04")
+	}
+	doc := pdfdoc.New("Laboratory Report")
+	doc.KeyValues([][2]string{
+		{"Patient", d.PatientName},
+		{"Order number", o.OrderNumber},
+		{"Patient ID", o.PatientID},
+		{"Ordered", o.CreatedAt.Format("02 Jan 2006 15:04")},
+		{"Date of birth", d.PatientDOB.Format("02 Jan 2006") + " (" + ageText(d.PatientDOB, o.CreatedAt) + ")"},
+		{"Collected", collected},
+		{"Sex", d.Gender},
+		{"Requested by", d.OrderedBy},
+		{"Specimens", d.SpecimenList},
+		{"Priority", o.Priority},
+	})
+	if o.ClinicalNotes != nil && *o.ClinicalNotes != "" {
+		doc.Paragraph("Clinical notes", *o.ClinicalNotes)
+	}
+
+	// One table per ordered test; results are already sorted by test
+	for _, it := range o.Items {
+		var rows [][]string
+		for _, r := range o.Results {
+			if r.OrderItemID != it.ID {
+				continue
+			}
+			name := r.ParameterName
+			if it.IsPanel && r.TestName != it.TestName {
+				name = r.TestName + ": " + r.ParameterName
+			}
+			rows = append(rows, []string{name, formatValue(r), deref(r.Unit), formatRange(r), flagLabels[deref(r.Flag)]})
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		doc.Heading(it.TestName)
+		doc.Table(
+			[]string{"Test", "Result", "Unit", "Reference range", "Flag"},
+			[]float64{62, 28, 28, 36, 26},
+			[]string{"L", "R", "L", "C", "C"},
+			rows,
+		)
+		for _, r := range o.Results {
+			if r.OrderItemID == it.ID && r.Comment != nil && *r.Comment != "" {
+				doc.Paragraph("", r.ParameterName+": "+*r.Comment)
+			}
+		}
+	}
+
+	// Verification block with the QR code beside it, kept on one page
+	_, pageHeight := doc.GetPageSize()
+	if doc.GetY()+36 > pageHeight-15 {
+		doc.AddPage()
+	}
+	y := doc.GetY() + 2
+	doc.QRCode(verificationURL(o, sig), 15, y, 30)
+	doc.SetXY(50, y)
+	doc.Heading("Verified by " + d.VerifiedBy)
+	doc.SetX(50)
+	doc.Paragraph("", fmt.Sprintf("Results verified on %s. Scan the code to confirm this report matches the laboratory's records (reference %s).",
+		o.VerifiedAt.Format("02 Jan 2006 15:04"), sig[:8]))
+
+	body, err := doc.Bytes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="%s.pdf"`, o.OrderNumber))
+	return c.Send(body)
+}
+
+// VerifyReport is the public endpoint behind a report's QR code. It confirms
+// the report was issued by the clinic and shows what the records hold, so
+// the reader can compare it with the printout.
+func VerifyReport(c *fiber.Ctx) error {
+	ctx := context.Background()
+	o, err := Fetch(ctx, c.Params("id"), true)
+	var sig string
+	if err == nil {
+		sig, err = reportSignature(o)
+	}
+	if err != nil || o.Status != "verified" || !hmac.Equal([]byte(sig), []byte(c.Query("sig"))) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"valid": false,
+			"error": "No matching verified report was found. The report may have been altered.",
+		})
+	}
+	d, err := fetchReportDetails(ctx, o)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	type line struct {
+		Test           string `json:"test"`
+		Result         string `json:"result"`
+		Unit           string `json:"unit,omitempty"`
+		ReferenceRange string `json:"reference_range,omitempty"`
+		Flag           string `json:"flag,omitempty"`
+	}
+	lines := make([]line, 0, len(o.Results))
+	for _, r := range o.Results {
+		lines = append(lines, line{r.TestName + ": " + r.ParameterName, formatValue(r), deref(r.Unit), formatRange(r), deref(r.Flag)})
+	}
+	name, _, _ := pdfdoc.Clinic()
+	return c.JSON(fiber.Map{
+		"valid": true,
+		"clinic": name,
+		"order_number": o.OrderNumber,
+		"patient": d.PatientName,
+		"verified_by": d.VerifiedBy,
+		"verified_at": o.VerifiedAt,
+		"results": lines,
+	})
+}
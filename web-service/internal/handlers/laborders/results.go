@@ -0,0 +1,355 @@
+package laborders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/laboratory"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Result is the value reported for one test parameter. The reference range
+// in force when the value was entered is stored with it.
+type Result struct {
+	ID            string    `json:"id"`
+	OrderItemID   string    `json:"order_item_id"`
+	ParameterID   string    `json:"parameter_id"`
+	ParameterName string    `json:"parameter_name"`
+	TestName      string    `json:"test_name"`
+	ValueNumeric  *float64  `json:"value_numeric,omitempty"`
+	ValueText     *string   `json:"value_text,omitempty"`
+	Unit          *string   `json:"unit,omitempty"`
+	RefLow        *float64  `json:"ref_low,omitempty"`
+	RefHigh       *float64  `json:"ref_high,omitempty"`
+	Flag          *string   `json:"flag,omitempty"`
+	Comment       *string   `json:"comment,omitempty"`
+	EnteredBy     string    `json:"entered_by"`
+	EnteredAt     time.Time `json:"entered_at"`
+}
+
+// FetchResults returns the results recorded on an order, grouped by test.
+func FetchResults(ctx context.Context, orderID string) ([]Result, error) {
+	rows, err := database.GetDB().Query(ctx, `SELECT r.id, r.order_item_id, r.parameter_id, p.name, l.test_name,
+			r.value_numeric, r.value_text, r.unit, r.ref_low, r.ref_high, r.flag, r.comment, r.entered_by, r.entered_at
+		FROM lab_results r
+		JOIN lab_test_parameters p ON p.id = r.parameter_id
+		JOIN laboratory l ON l.id = p.test_id
+		WHERE r.order_id = $1 ORDER BY l.test_name, p.position, p.name`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Result, error) {
+		var r Result
+		err := row.Scan(&r.ID, &r.OrderItemID, &r.ParameterID, &r.ParameterName, &r.TestName,
+			&r.ValueNumeric, &r.ValueText, &r.Unit, &r.RefLow, &r.RefHigh, &r.Flag, &r.Comment, &r.EnteredBy, &r.EnteredAt)
+		return r, err
+	})
+}
+
+// itemParameters returns the parameters reported for an ordered test. A
+// panel reports the parameters of its component tests.
+func itemParameters(ctx context.Context, it Item) ([]laboratory.Parameter, error) {
+	if !it.IsPanel {
+		return laboratory.FetchParameters(ctx, it.TestID)
+	}
+	t, err := laboratory.Fetch(ctx, it.TestID)
+	if err != nil {
+		return nil, err
+	}
+	var params []laboratory.Parameter
+	for _, cp := range t.Components {
+		p, err := laboratory.FetchParameters(ctx, cp.TestID)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, p...)
+	}
+	return params, nil
+}
+
+// flagValue compares a numeric value with the reference range, critical
+// limits first.
+func flagValue(value float64, r *laboratory.ReferenceRange) string {
+	switch {
+	case r.CriticalLow != nil && value <= *r.CriticalLow:
+		return "critical_low"
+	case r.CriticalHigh != nil && value >= *r.CriticalHigh:
+		return "critical_high"
+	case r.Low != nil && value < *r.Low:
+		return "low"
+	case r.High != nil && value > *r.High:
+		return "high"
+	}
+	return "normal"
+}
+
+// StartOrder marks that the lab has started work on a received order.
+func StartOrder(c *fiber.Ctx) error {
+	flow := statusFlow["start"]
+	tag, err := database.GetDB().Exec(context.Background(), `UPDATE lab_orders SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4`,
+		flow[1], time.Now(), c.Params("id"), flow[0])
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only orders with all specimens received can be started",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Lab order started",
+	})
+}
+
+type resultEntry struct {
+	OrderItemID  string   `json:"order_item_id"`
+	ParameterID  string   `json:"parameter_id"`
+	ValueNumeric *float64 `json:"value_numeric"`
+	ValueText    *string  `json:"value_text"`
+	Comment      *string  `json:"comment"`
+}
+
+type resultsRequest struct {
+	Results []resultEntry `json:"results"`
+}
+
+var (
+	errInvalidResult = errors.New("invalid result")
+	errResultState   = errors.New("results cannot be entered")
+)
+
+// orderParameters returns the parameters each ordered test reports, keyed by
+// order item and parameter, and how many there are in all.
+func orderParameters(ctx context.Context, o *Order) (map[string]map[string]laboratory.Parameter, int, error) {
+	params := map[string]map[string]laboratory.Parameter{}
+	expected := 0
+	for _, it := range o.Items {
+		list, err := itemParameters(ctx, it)
+		if err != nil {
+			return nil, 0, err
+		}
+		params[it.ID] = map[string]laboratory.Parameter{}
+		for _, p := range list {
+			params[it.ID][p.ID] = p
+		}
+		expected += len(list)
+	}
+	return params, expected, nil
+}
+
+// savedResults is the outcome of saving a batch of results.
+type savedResults struct {
+	Status  string
+	Results []Result
+	Alerts  []CriticalAlert
+}
+
+// saveResults records or corrects result values on an order, whether typed
+// in or received from an analyser. Each value is flagged against the
+// reference range for the patient's sex and age, and critical values alert
+// the ordering clinician straight away. The order becomes resulted once every
+// parameter has a value.
+func saveResults(ctx context.Context, o *Order, staffID string, entries []resultEntry) (*savedResults, error) {
+	if o.Status != "received" && o.Status != "in_progress" && o.Status != "resulted" {
+		return nil, fmt.Errorf("%w on a %s order", errResultState, o.Status)
+	}
+
+	var patientName, sex string
+	var ageDays int
+	err := database.GetDB().QueryRow(ctx, `SELECT first_name || ' ' || last_name, gender, CURRENT_DATE - date_of_birth FROM patients WHERE id = $1`,
+		o.PatientID).Scan(&patientName, &sex, &ageDays)
+	if err != nil {
+		return nil, err
+	}
+	params, expected, err := orderParameters(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	saved := &savedResults{Results: make([]Result, 0, len(entries))}
+	for _, e := range entries {
+		p, ok := params[e.OrderItemID][e.ParameterID]
+		if !ok {
+			return nil, fmt.Errorf("%w: parameter %s is not part of order item %s", errInvalidResult, e.ParameterID, e.OrderItemID)
+		}
+		if e.ValueText != nil && strings.TrimSpace(*e.ValueText) == "" {
+			e.ValueText = nil
+		}
+		if p.ValueType == "numeric" && e.ValueNumeric == nil || p.ValueType == "text" && e.ValueText == nil {
+			return nil, fmt.Errorf("%w: %s needs a %s value", errInvalidResult, p.Name, p.ValueType)
+		}
+		r := Result{
+			ID: uuid.New().String()[:8], OrderItemID: e.OrderItemID, ParameterID: p.ID, ParameterName: p.Name,
+			ValueNumeric: e.ValueNumeric, ValueText: e.ValueText, Unit: p.Unit, Comment: e.Comment, EnteredBy: staffID, EnteredAt: now,
+		}
+		if rng := p.RangeFor(sex, ageDays); rng != nil {
+			r.RefLow, r.RefHigh = rng.Low, rng.High
+			if r.ValueNumeric != nil {
+				flag := flagValue(*r.ValueNumeric, rng)
+				r.Flag = &flag
+			}
+		}
+		saved.Results = append(saved.Results, r)
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the order so verification cannot happen mid-entry
+	var status string
+	err = tx.QueryRow(ctx, `SELECT status FROM lab_orders WHERE id = $1 FOR UPDATE`, o.ID).Scan(&status)
+	if err == nil && status != o.Status {
+		err = errStatusChanged
+	}
+	for i := 0; err == nil && i < len(saved.Results); i++ {
+		r := &saved.Results[i]
+		err = tx.QueryRow(ctx, `INSERT INTO lab_results (id, order_id, order_item_id, parameter_id, value_numeric, value_text, unit, ref_low, ref_high, flag, comment, entered_by, entered_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			ON CONFLICT (order_item_id, parameter_id) DO UPDATE SET value_numeric = EXCLUDED.value_numeric, value_text = EXCLUDED.value_text,
+				unit = EXCLUDED.unit, ref_low = EXCLUDED.ref_low, ref_high = EXCLUDED.ref_high, flag = EXCLUDED.flag, comment = EXCLUDED.comment,
+				entered_by = EXCLUDED.entered_by, entered_at = EXCLUDED.entered_at
+			RETURNING id`,
+			r.ID, o.ID, r.OrderItemID, r.ParameterID, r.ValueNumeric, r.ValueText, r.Unit, r.RefLow, r.RefHigh, r.Flag, r.Comment, r.EnteredBy, r.EnteredAt).Scan(&r.ID)
+	}
+	if err == nil {
+		saved.Alerts, err = raiseCriticalAlerts(ctx, tx, o, patientName, saved.Results)
+	}
+	var entered int
+	if err == nil {
+		err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM lab_results WHERE order_id = $1`, o.ID).Scan(&entered)
+	}
+	if err == nil {
+		saved.Status = "in_progress"
+		if entered >= expected {
+			saved.Status = "resulted"
+		}
+		_, err = tx.Exec(ctx, `UPDATE lab_orders SET status = $1, resulted_by = $2, resulted_at = $3, updated_at = $3 WHERE id = $4`,
+			saved.Status, staffID, now, o.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// EnterResults records or corrects result values typed in by the lab.
+// Results can still be corrected until they are verified.
+func EnterResults(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req resultsRequest
+	if err := c.BodyParser(&req); err != nil || len(req.Results) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "results are required",
+		})
+	}
+	o, err := Fetch(ctx, c.Params("id"), false)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lab order not found",
+		})
+	}
+
+	saved, err := saveResults(ctx, o, middleware.CurrentUserID(c), req.Results)
+	if errors.Is(err, errInvalidResult) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, errResultState) || errors.Is(err, errStatusChanged) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save results",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Results saved successfully",
+		"status": saved.Status,
+		"results": saved.Results,
+		"critical_alerts": saved.Alerts,
+	})
+}
+
+var errStatusChanged = errors.New("the order changed while results were being entered, reload it and try again")
+
+// VerifyOrder releases resulted tests to the clinicians. The verifier must
+// not have entered any of the results.
+func VerifyOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	staffID := middleware.CurrentUserID(c)
+	var status string
+	var entered bool
+	err := database.GetDB().QueryRow(ctx, `SELECT status, EXISTS (SELECT 1 FROM lab_results WHERE order_id = o.id AND entered_by = $2)
+		FROM lab_orders o WHERE id = $1`, c.Params("id"), staffID).Scan(&status, &entered)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Lab order not found",
+		})
+	}
+	if status != "resulted" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only fully resulted orders can be verified",
+		})
+	}
+	if entered {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Results must be verified by someone other than who entered them",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	var encounterOrderID *string
+	err = tx.QueryRow(ctx, `UPDATE lab_orders SET status = 'verified', verified_by = $1, verified_at = $2, updated_at = $2
+		WHERE id = $3 AND status = 'resulted' AND NOT EXISTS (SELECT 1 FROM lab_results WHERE order_id = $3 AND entered_by = $1)
+		RETURNING encounter_order_id`, staffID, now, c.Params("id")).Scan(&encounterOrderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The order changed before it could be verified",
+		})
+	}
+	if err == nil && encounterOrderID != nil {
+		_, err = tx.Exec(ctx, `UPDATE encounter_orders SET status = 'completed' WHERE id = $1`, *encounterOrderID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify results",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Results verified successfully",
+	})
+}
@@ -0,0 +1,278 @@
+package laborders
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/go-pdf/fpdf"
+	"github.com/go-pdf/fpdf/contrib/barcode"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type Specimen struct {
+	ID             string     `json:"id"`
+	SpecimenNumber string     `json:"specimen_number"`
+	OrderID        string     `json:"order_id"`
+	SpecimenType   string     `json:"specimen_type"`
+	CollectedBy    string     `json:"collected_by"`
+	CollectedAt    time.Time  `json:"collected_at"`
+	ReceivedBy     *string    `json:"received_by,omitempty"`
+	ReceivedAt     *time.Time `json:"received_at,omitempty"`
+	RejectedReason *string    `json:"rejected_reason,omitempty"`
+}
+
+const specimenColumns = `id, specimen_number, order_id, specimen_type, collected_by, collected_at, received_by, received_at, rejected_reason`
+
+func (s *Specimen) scanTargets() []any {
+	return []any{&s.ID, &s.SpecimenNumber, &s.OrderID, &s.SpecimenType, &s.CollectedBy, &s.CollectedAt, &s.ReceivedBy, &s.ReceivedAt, &s.RejectedReason}
+}
+
+func fetchSpecimens(ctx context.Context, orderID string) ([]Specimen, error) {
+	rows, err := database.GetDB().Query(ctx, `SELECT `+specimenColumns+` FROM specimens WHERE order_id = $1 ORDER BY specimen_number`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Specimen, error) {
+		var s Specimen
+		err := row.Scan(s.scanTargets()...)
+		return s, err
+	})
+}
+
+// specimenTypes lists the distinct specimens an order still needs. A panel
+// uses its own specimen type if set, otherwise those of its component tests.
+// Types that already have a specimen which was not rejected are left out.
+func specimenTypes(ctx context.Context, tx pgx.Tx, orderID string) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT DISTINCT COALESCE(l.specimen_type, c.specimen_type, 'unspecified')
+		FROM lab_order_items i
+		JOIN laboratory l ON l.id = i.test_id
+		LEFT JOIN lab_panel_components pc ON pc.panel_id = l.id AND l.specimen_type IS NULL
+		LEFT JOIN laboratory c ON c.id = pc.test_id
+		WHERE i.order_id = $1`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	all, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	rows, err = tx.Query(ctx, `SELECT specimen_type FROM specimens WHERE order_id = $1 AND rejected_reason IS NULL`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	taken, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	var types []string
+	for _, t := range all {
+		if !slices.Contains(taken, t) {
+			types = append(types, t)
+		}
+	}
+	sort.Strings(types)
+	return types, nil
+}
+
+// CollectSpecimens records specimen collection for an order, one specimen per
+// specimen type, each with its own barcode number.
+func CollectSpecimens(c *fiber.Ctx) error {
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	orderID := c.Params("id")
+	now := time.Now()
+	flow := statusFlow["collect"]
+	tag, err := tx.Exec(ctx, `UPDATE lab_orders SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4`, flow[1], now, orderID, flow[0])
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Specimens can only be collected for a newly ordered test",
+		})
+	}
+
+	var specimens []Specimen
+	var types []string
+	if err == nil {
+		types, err = specimenTypes(ctx, tx, orderID)
+	}
+	for i := 0; err == nil && i < len(types); i++ {
+		s := Specimen{
+			ID:           uuid.New().String()[:8],
+			OrderID:      orderID,
+			SpecimenType: types[i],
+			CollectedBy:  middleware.CurrentUserID(c),
+			CollectedAt:  now,
+		}
+		err = tx.QueryRow(ctx, `INSERT INTO specimens (id, specimen_number, order_id, specimen_type, collected_by, collected_at)
+			VALUES ($1, 'S' || TO_CHAR($2::timestamp, 'YY') || LPAD(nextval('specimen_number_seq')::text, 7, '0'), $3, $4, $5, $2)
+			RETURNING specimen_number`, s.ID, now, s.OrderID, s.SpecimenType, s.CollectedBy).Scan(&s.SpecimenNumber)
+		specimens = append(specimens, s)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record specimen collection",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Specimens collected successfully",
+		"specimens": specimens,
+	})
+}
+
+type receiveRequest struct {
+	SpecimenNumber string `json:"specimen_number"`
+	RejectedReason string `json:"rejected_reason"`
+}
+
+// ReceiveSpecimen is called when the lab scans a specimen barcode. The order
+// moves to received once every specimen for it has arrived. A rejected
+// specimen sends the order back for recollection.
+func ReceiveSpecimen(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req receiveRequest
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.SpecimenNumber) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "specimen_number is required",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var s Specimen
+	var tag pgconn.CommandTag
+	err = tx.QueryRow(ctx, `SELECT `+specimenColumns+` FROM specimens WHERE specimen_number = $1 FOR UPDATE`,
+		strings.ToUpper(strings.TrimSpace(req.SpecimenNumber))).Scan(s.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Specimen not found",
+		})
+	}
+	if s.ReceivedAt != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Specimen already received",
+		})
+	}
+
+	now := time.Now()
+	staffID := middleware.CurrentUserID(c)
+	flow := statusFlow["receive"]
+	reason := strings.TrimSpace(req.RejectedReason)
+	if reason != "" {
+		// The rejected specimen is kept for the record and the order goes back
+		// to ordered; collecting again only replaces the rejected specimen type
+		_, err = tx.Exec(ctx, `UPDATE specimens SET received_by = $1, received_at = $2, rejected_reason = $3 WHERE id = $4`, staffID, now, reason, s.ID)
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE lab_orders SET status = $1, updated_at = $2 WHERE id = $3 AND status = $4`, statusFlow["collect"][0], now, s.OrderID, flow[0])
+		}
+	} else {
+		_, err = tx.Exec(ctx, `UPDATE specimens SET received_by = $1, received_at = $2 WHERE id = $3`, staffID, now, s.ID)
+		if err == nil {
+			tag, err = tx.Exec(ctx, `UPDATE lab_orders SET status = $1, updated_at = $2
+				WHERE id = $3 AND status = $4
+					AND NOT EXISTS (SELECT 1 FROM specimens WHERE order_id = $3 AND received_at IS NULL)`,
+				flow[1], now, s.OrderID, flow[0])
+		}
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to receive specimen",
+			"details": err.Error(),
+		})
+	}
+
+	// With every specimen in, the analysers can be told what to run
+	if tag.RowsAffected() > 0 {
+		sendOrderInBackground(s.OrderID)
+	}
+
+	s.ReceivedBy, s.ReceivedAt = &staffID, &now
+	if reason != "" {
+		s.RejectedReason = &reason
+		return c.JSON(fiber.Map{
+			"message": "Specimen rejected, the order needs a new collection",
+			"specimen": s,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Specimen received successfully",
+		"specimen": s,
+	})
+}
+
+// GetSpecimenLabel renders a 50 x 25 mm label with a Code 128 barcode of the
+// specimen number, for a label printer.
+func GetSpecimenLabel(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var s Specimen
+	err := database.GetDB().QueryRow(ctx, `SELECT `+specimenColumns+` FROM specimens WHERE id = $1 OR specimen_number = $1`, c.Params("id")).Scan(s.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Specimen not found",
+		})
+	}
+
+	var orderNumber, patientName, gender string
+	var dob time.Time
+	err = database.GetDB().QueryRow(ctx, `SELECT o.order_number, p.first_name || ' ' || p.last_name, p.gender, p.date_of_birth
+		FROM lab_orders o JOIN patients p ON p.id = o.patient_id WHERE o.id = $1`, s.OrderID).Scan(&orderNumber, &patientName, &gender, &dob)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	pdf := fpdf.NewCustom(&fpdf.InitType{UnitStr: "mm", Size: fpdf.SizeType{Wd: 50, Ht: 25}})
+	pdf.SetMargins(2, 2, 2)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.SetFont("Helvetica", "B", 7)
+	pdf.CellFormat(46, 3, tr(patientName), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 6)
+	pdf.CellFormat(46, 3, tr(fmt.Sprintf("DOB %s  %s  %s", dob.Format("02/01/2006"), strings.ToUpper(gender[:min(1, len(gender))]), orderNumber)), "", 1, "L", false, 0, "")
+	barcode.Barcode(pdf, barcode.RegisterCode128(pdf, s.SpecimenNumber), 3, 8.5, 44, 10, false)
+	pdf.SetXY(2, 19.5)
+	pdf.CellFormat(46, 3, s.SpecimenNumber+"  "+tr(s.SpecimenType), "", 1, "C", false, 0, "")
+	pdf.CellFormat(46, 2.5, s.CollectedAt.Format("02/01/2006 15:04"), "", 1, "C", false, 0, "")
+
+	var buf strings.Builder
+	if err := pdf.Output(&buf); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="%s.pdf"`, s.SpecimenNumber))
+	return c.SendString(buf.String())
+}
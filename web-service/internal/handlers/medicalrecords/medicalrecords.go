@@ -0,0 +1,274 @@
+package medicalrecords
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// MedicalRecord is one version of a clinical record. Amendments never
+// overwrite a row, they add a new version with the same RecordID.
+type MedicalRecord struct {
+	ID              string     `json:"id"`
+	RecordID        string     `json:"record_id"`
+	Version         int        `json:"version"`
+	PatientID       string     `json:"patient_id"`
+	StaffID         string     `json:"staff_id"`
+	Diagnosis       string     `json:"diagnosis"`
+	Treatment       string     `json:"treatment"`
+	Prescription    *string    `json:"prescription,omitempty"`
+	AmendmentReason *string    `json:"amendment_reason,omitempty"`
+	AmendedBy       *string    `json:"amended_by,omitempty"`
+	SupersededAt    *time.Time `json:"superseded_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// Page is a slice of records together with the paging information the client needs.
+type Page struct {
+	Items []MedicalRecord `json:"items"`
+	Page  int             `json:"page"`
+	Limit int             `json:"limit"`
+	Total int             `json:"total"`
+}
+
+const recordColumns = `id, record_id, version, patient_id, staff_id, diagnosis, treatment, prescription, amendment_reason, amended_by, superseded_at, created_at, updated_at`
+
+func (r *MedicalRecord) scanTargets() []any {
+	return []any{&r.ID, &r.RecordID, &r.Version, &r.PatientID, &r.StaffID, &r.Diagnosis, &r.Treatment, &r.Prescription,
+		&r.AmendmentReason, &r.AmendedBy, &r.SupersededAt, &r.CreatedAt, &r.UpdatedAt}
+}
+
+func validate(r *MedicalRecord) string {
+	if strings.TrimSpace(r.Diagnosis) == "" {
+		return "Diagnosis is required"
+	}
+	if strings.TrimSpace(r.Treatment) == "" {
+		return "Treatment is required"
+	}
+	return ""
+}
+
+// FetchHistory returns the current version of every record for a patient, newest first.
+func FetchHistory(patientID string, page, limit int) (Page, error) {
+	db := database.GetDB()
+	result := Page{Items: []MedicalRecord{}, Page: page, Limit: limit}
+
+	err := db.QueryRow(context.Background(), `SELECT COUNT(*) FROM medical_records WHERE patient_id=$1 AND superseded_at IS NULL`, patientID).Scan(&result.Total)
+	if err != nil {
+		return result, err
+	}
+
+	rows, err := db.Query(context.Background(), `SELECT `+recordColumns+` FROM medical_records
+		WHERE patient_id=$1 AND superseded_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT $2 OFFSET $3`, patientID, limit, paging.Offset(page, limit))
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r MedicalRecord
+		if err := rows.Scan(r.scanTargets()...); err != nil {
+			return result, err
+		}
+		result.Items = append(result.Items, r)
+	}
+	return result, rows.Err()
+}
+
+func GetMedicalRecords(c *fiber.Ctx) error {
+	patientID := c.Query("patient_id")
+	if patientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "patient_id is required",
+		})
+	}
+
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+	result, err := FetchHistory(patientID, page, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch medical records",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(result)
+}
+
+// GetMedicalRecord returns the current version of a record along with all earlier versions.
+func GetMedicalRecord(c *fiber.Ctx) error {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT `+recordColumns+` FROM medical_records WHERE record_id=$1 ORDER BY version DESC`, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	versions := []MedicalRecord{}
+	for rows.Next() {
+		var r MedicalRecord
+		if err := rows.Scan(r.scanTargets()...); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		versions = append(versions, r)
+	}
+
+	if len(versions) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medical record not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"record":   versions[0],
+		"versions": versions,
+	})
+}
+
+func AddMedicalRecord(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var r MedicalRecord
+	if err := c.BodyParser(&r); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if r.PatientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Patient ID is required",
+		})
+	}
+	if msg := validate(&r); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	// The author is always the signed in staff member
+	r.ID = uuid.New().String()[:8]
+	r.RecordID = r.ID
+	r.Version = 1
+	r.StaffID = middleware.CurrentUserID(c)
+	r.AmendmentReason = nil
+	r.AmendedBy = nil
+	r.SupersededAt = nil
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = time.Now()
+
+	_, err := db.Exec(context.Background(), `INSERT INTO medical_records (`+recordColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		r.ID, r.RecordID, r.Version, r.PatientID, r.StaffID, r.Diagnosis, r.Treatment, r.Prescription,
+		r.AmendmentReason, r.AmendedBy, r.SupersededAt, r.CreatedAt, r.UpdatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add medical record",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Medical record added successfully",
+		"record": r,
+	})
+}
+
+// AmendMedicalRecord stores the corrected record as a new version and marks the previous one as superseded.
+func AmendMedicalRecord(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var r MedicalRecord
+	if err := c.BodyParser(&r); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validate(&r); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	if r.AmendmentReason == nil || strings.TrimSpace(*r.AmendmentReason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Amendment reason is required",
+		})
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var current MedicalRecord
+	err = tx.QueryRow(ctx, `SELECT `+recordColumns+` FROM medical_records WHERE record_id=$1 AND superseded_at IS NULL FOR UPDATE`, c.Params("id")).Scan(current.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medical record not found",
+			"details": err.Error(),
+		})
+	}
+
+	userID := middleware.CurrentUserID(c)
+	if current.StaffID != userID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the authoring staff member can amend this record",
+		})
+	}
+
+	now := time.Now()
+	amended := MedicalRecord{
+		ID:              uuid.New().String()[:8],
+		RecordID:        current.RecordID,
+		Version:         current.Version + 1,
+		PatientID:       current.PatientID,
+		StaffID:         current.StaffID,
+		Diagnosis:       r.Diagnosis,
+		Treatment:       r.Treatment,
+		Prescription:    r.Prescription,
+		AmendmentReason: r.AmendmentReason,
+		AmendedBy:       &userID,
+		CreatedAt:       current.CreatedAt,
+		UpdatedAt:       now,
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE medical_records SET superseded_at=$1 WHERE id=$2`, now, current.ID)
+	if err == nil {
+		_, err = tx.Exec(ctx, `INSERT INTO medical_records (`+recordColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+			amended.ID, amended.RecordID, amended.Version, amended.PatientID, amended.StaffID, amended.Diagnosis, amended.Treatment, amended.Prescription,
+			amended.AmendmentReason, amended.AmendedBy, amended.SupersededAt, amended.CreatedAt, amended.UpdatedAt)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to amend medical record",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Medical record amended successfully",
+		"record": amended,
+	})
+}
@@ -0,0 +1,273 @@
+package patients
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type Allergy struct {
+	ID                 string    `json:"id"`
+	PatientID          string    `json:"patient_id"`
+	Substance          string    `json:"substance"`
+	SubstanceCode      *string   `json:"substance_code,omitempty"`
+	Reaction           string    `json:"reaction"`
+	Severity           string    `json:"severity"`
+	VerificationStatus string    `json:"verification_status"`
+	RecordedBy         *string   `json:"recorded_by,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// AllergyWarning is raised when a medicine matches one of the patient's recorded allergies.
+type AllergyWarning struct {
+	Medicine           string `json:"medicine"`
+	AllergyID          string `json:"allergy_id"`
+	Substance          string `json:"substance"`
+	Reaction           string `json:"reaction"`
+	Severity           string `json:"severity"`
+	VerificationStatus string `json:"verification_status"`
+}
+
+var allergySeverities = map[string]bool{"mild": true, "moderate": true, "severe": true, "life_threatening": true}
+
+var verificationStatuses = map[string]bool{"unconfirmed": true, "confirmed": true, "refuted": true, "entered_in_error": true}
+
+const allergyColumns = `id, patient_id, substance, substance_code, reaction, severity, verification_status, recorded_by, created_at, updated_at`
+
+func (a *Allergy) scanTargets() []any {
+	return []any{&a.ID, &a.PatientID, &a.Substance, &a.SubstanceCode, &a.Reaction, &a.Severity, &a.VerificationStatus, &a.RecordedBy, &a.CreatedAt, &a.UpdatedAt}
+}
+
+func validateAllergy(a *Allergy) string {
+	a.Substance = strings.TrimSpace(a.Substance)
+	if a.Substance == "" {
+		return "Substance is required"
+	}
+	if strings.TrimSpace(a.Reaction) == "" {
+		return "Reaction is required"
+	}
+	a.Severity = strings.ToLower(a.Severity)
+	if !allergySeverities[a.Severity] {
+		return "Severity must be one of mild, moderate, severe, life_threatening"
+	}
+	a.VerificationStatus = strings.ToLower(a.VerificationStatus)
+	if a.VerificationStatus == "" {
+		a.VerificationStatus = "unconfirmed"
+	}
+	if !verificationStatuses[a.VerificationStatus] {
+		return "Verification status must be one of unconfirmed, confirmed, refuted, entered_in_error"
+	}
+	return ""
+}
+
+func fetchAllergies(patientID string) ([]Allergy, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT `+allergyColumns+` FROM patient_allergies WHERE patient_id = $1 ORDER BY created_at DESC`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	allergies := []Allergy{}
+	for rows.Next() {
+		var a Allergy
+		if err := rows.Scan(a.scanTargets()...); err != nil {
+			return nil, err
+		}
+		allergies = append(allergies, a)
+	}
+	return allergies, rows.Err()
+}
+
+// MatchAllergies checks each medicine description against the patient's
+// allergies that have not been refuted or entered in error.
+func MatchAllergies(patientID string, medicines []string) ([]AllergyWarning, error) {
+	allergies, err := fetchAllergies(patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := []AllergyWarning{}
+	for _, m := range medicines {
+		med := strings.ToLower(m)
+		for _, a := range allergies {
+			if a.VerificationStatus == "refuted" || a.VerificationStatus == "entered_in_error" {
+				continue
+			}
+			substance := strings.ToLower(a.Substance)
+			if strings.Contains(med, substance) || (len(med) > 0 && strings.Contains(substance, med)) {
+				warnings = append(warnings, AllergyWarning{
+					Medicine:           m,
+					AllergyID:          a.ID,
+					Substance:          a.Substance,
+					Reaction:           a.Reaction,
+					Severity:           a.Severity,
+					VerificationStatus: a.VerificationStatus,
+				})
+			}
+		}
+	}
+	return warnings, nil
+}
+
+func GetAllergies(c *fiber.Ctx) error {
+	allergies, err := fetchAllergies(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch allergies",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(allergies)
+}
+
+func AddAllergy(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var a Allergy
+	if err := c.BodyParser(&a); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateAllergy(&a); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	a.ID = uuid.New().String()[:8]
+	a.PatientID = c.Params("id")
+	a.RecordedBy = nullIfEmpty(middleware.CurrentUserID(c))
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = time.Now()
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO patient_allergies (`+allergyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		a.ID, a.PatientID, a.Substance, a.SubstanceCode, a.Reaction, a.Severity, a.VerificationStatus, a.RecordedBy, a.CreatedAt, a.UpdatedAt)
+	if err == nil {
+		err = recordHistory(ctx, tx, a.PatientID, "allergy", a.ID, "created", a, a.RecordedBy)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add allergy",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Allergy added successfully",
+		"allergy": a,
+	})
+}
+
+func EditAllergy(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var a Allergy
+	if err := c.BodyParser(&a); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateAllergy(&a); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var updated Allergy
+	err = tx.QueryRow(ctx, `UPDATE patient_allergies SET substance=$1, substance_code=$2, reaction=$3, severity=$4, verification_status=$5, updated_at=$6
+		WHERE id=$7 AND patient_id=$8 RETURNING `+allergyColumns,
+		a.Substance, a.SubstanceCode, a.Reaction, a.Severity, a.VerificationStatus, time.Now(), c.Params("allergyId"), c.Params("id"),
+	).Scan(updated.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Allergy not found",
+			"details": err.Error(),
+		})
+	}
+
+	err = recordHistory(ctx, tx, updated.PatientID, "allergy", updated.ID, "updated", updated, nullIfEmpty(middleware.CurrentUserID(c)))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update allergy",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Allergy updated successfully",
+		"allergy": updated,
+	})
+}
+
+func DeleteAllergy(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var deleted Allergy
+	err = tx.QueryRow(ctx, `DELETE FROM patient_allergies WHERE id=$1 AND patient_id=$2 RETURNING `+allergyColumns,
+		c.Params("allergyId"), c.Params("id"),
+	).Scan(deleted.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Allergy not found",
+			"details": err.Error(),
+		})
+	}
+
+	err = recordHistory(ctx, tx, deleted.PatientID, "allergy", deleted.ID, "deleted", deleted, nullIfEmpty(middleware.CurrentUserID(c)))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete allergy",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Allergy deleted successfully",
+	})
+}
@@ -0,0 +1,227 @@
+package patients
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Condition is an entry on the patient's problem list.
+type Condition struct {
+	ID            string     `json:"id"`
+	PatientID     string     `json:"patient_id"`
+	Condition     string     `json:"condition"`
+	ConditionCode *string    `json:"condition_code,omitempty"`
+	OnsetDate     *time.Time `json:"onset_date,omitempty"`
+	Status        string     `json:"status"`
+	Notes         *string    `json:"notes,omitempty"`
+	RecordedBy    *string    `json:"recorded_by,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+var conditionStatuses = map[string]bool{"active": true, "remission": true, "resolved": true, "inactive": true, "entered_in_error": true}
+
+const conditionColumns = `id, patient_id, condition, condition_code, onset_date, status, notes, recorded_by, created_at, updated_at`
+
+func (cd *Condition) scanTargets() []any {
+	return []any{&cd.ID, &cd.PatientID, &cd.Condition, &cd.ConditionCode, &cd.OnsetDate, &cd.Status, &cd.Notes, &cd.RecordedBy, &cd.CreatedAt, &cd.UpdatedAt}
+}
+
+func validateCondition(cd *Condition) string {
+	cd.Condition = strings.TrimSpace(cd.Condition)
+	if cd.Condition == "" {
+		return "Condition is required"
+	}
+	cd.Status = strings.ToLower(cd.Status)
+	if cd.Status == "" {
+		cd.Status = "active"
+	}
+	if !conditionStatuses[cd.Status] {
+		return "Status must be one of active, remission, resolved, inactive, entered_in_error"
+	}
+	if cd.OnsetDate != nil && cd.OnsetDate.After(time.Now()) {
+		return "Onset date cannot be in the future"
+	}
+	return ""
+}
+
+func fetchConditions(patientID string) ([]Condition, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT `+conditionColumns+` FROM patient_conditions WHERE patient_id = $1 ORDER BY created_at DESC`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conditions := []Condition{}
+	for rows.Next() {
+		var cd Condition
+		if err := rows.Scan(cd.scanTargets()...); err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, cd)
+	}
+	return conditions, rows.Err()
+}
+
+func GetConditions(c *fiber.Ctx) error {
+	conditions, err := fetchConditions(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch conditions",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(conditions)
+}
+
+func AddCondition(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var cd Condition
+	if err := c.BodyParser(&cd); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateCondition(&cd); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	cd.ID = uuid.New().String()[:8]
+	cd.PatientID = c.Params("id")
+	cd.RecordedBy = nullIfEmpty(middleware.CurrentUserID(c))
+	cd.CreatedAt = time.Now()
+	cd.UpdatedAt = time.Now()
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO patient_conditions (`+conditionColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		cd.ID, cd.PatientID, cd.Condition, cd.ConditionCode, cd.OnsetDate, cd.Status, cd.Notes, cd.RecordedBy, cd.CreatedAt, cd.UpdatedAt)
+	if err == nil {
+		err = recordHistory(ctx, tx, cd.PatientID, "condition", cd.ID, "created", cd, cd.RecordedBy)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add condition",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Condition added successfully",
+		"condition": cd,
+	})
+}
+
+func EditCondition(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var cd Condition
+	if err := c.BodyParser(&cd); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateCondition(&cd); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var updated Condition
+	err = tx.QueryRow(ctx, `UPDATE patient_conditions SET condition=$1, condition_code=$2, onset_date=$3, status=$4, notes=$5, updated_at=$6
+		WHERE id=$7 AND patient_id=$8 RETURNING `+conditionColumns,
+		cd.Condition, cd.ConditionCode, cd.OnsetDate, cd.Status, cd.Notes, time.Now(), c.Params("conditionId"), c.Params("id"),
+	).Scan(updated.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Condition not found",
+			"details": err.Error(),
+		})
+	}
+
+	err = recordHistory(ctx, tx, updated.PatientID, "condition", updated.ID, "updated", updated, nullIfEmpty(middleware.CurrentUserID(c)))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update condition",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Condition updated successfully",
+		"condition": updated,
+	})
+}
+
+func DeleteCondition(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	var deleted Condition
+	err = tx.QueryRow(ctx, `DELETE FROM patient_conditions WHERE id=$1 AND patient_id=$2 RETURNING `+conditionColumns,
+		c.Params("conditionId"), c.Params("id"),
+	).Scan(deleted.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Condition not found",
+			"details": err.Error(),
+		})
+	}
+
+	err = recordHistory(ctx, tx, deleted.PatientID, "condition", deleted.ID, "deleted", deleted, nullIfEmpty(middleware.CurrentUserID(c)))
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete condition",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Condition deleted successfully",
+	})
+}
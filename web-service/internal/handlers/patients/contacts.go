@@ -0,0 +1,188 @@
+package patients
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Contact is a next of kin or an emergency contact for a patient.
+type Contact struct {
+	ID           string    `json:"id"`
+	PatientID    string    `json:"patient_id"`
+	ContactType  string    `json:"contact_type"`
+	Name         string    `json:"name"`
+	Relationship string    `json:"relationship"`
+	PhoneNumber  string    `json:"phone_number"`
+	Email        *string   `json:"email,omitempty"`
+	Address      *string   `json:"address,omitempty"`
+	IsPrimary    bool      `json:"is_primary"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func validateContact(ct *Contact) string {
+	ct.ContactType = strings.ToLower(strings.TrimSpace(ct.ContactType))
+	if ct.ContactType != "next_of_kin" && ct.ContactType != "emergency" {
+		return "Contact type must be next_of_kin or emergency"
+	}
+	if strings.TrimSpace(ct.Name) == "" {
+		return "Contact name is required"
+	}
+	if strings.TrimSpace(ct.Relationship) == "" {
+		return "Relationship is required"
+	}
+	if strings.TrimSpace(ct.PhoneNumber) == "" {
+		return "Contact phone number is required"
+	}
+	return ""
+}
+
+// isUnknownPatient reports whether an insert failed because the patient it
+// names does not exist.
+func isUnknownPatient(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && strings.HasSuffix(pgErr.ConstraintName, "_patient_id_fkey")
+}
+
+func fetchContacts(patientID string) ([]Contact, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `
+		SELECT id, patient_id, contact_type, name, relationship, phone_number, email, address, is_primary, created_at, updated_at
+		FROM patient_contacts
+		WHERE patient_id = $1
+		ORDER BY is_primary DESC, created_at ASC
+	`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var ct Contact
+		if err := rows.Scan(&ct.ID, &ct.PatientID, &ct.ContactType, &ct.Name, &ct.Relationship, &ct.PhoneNumber,
+			&ct.Email, &ct.Address, &ct.IsPrimary, &ct.CreatedAt, &ct.UpdatedAt); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, ct)
+	}
+	return contacts, rows.Err()
+}
+
+func GetContacts(c *fiber.Ctx) error {
+	contacts, err := fetchContacts(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch contacts",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(contacts)
+}
+
+func AddContact(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var ct Contact
+	if err := c.BodyParser(&ct); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateContact(&ct); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	ct.ID = uuid.New().String()[:8]
+	ct.PatientID = c.Params("id")
+	ct.CreatedAt = time.Now()
+	ct.UpdatedAt = time.Now()
+
+	_, err := db.Exec(context.Background(), `INSERT INTO patient_contacts
+		(id, patient_id, contact_type, name, relationship, phone_number, email, address, is_primary, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		ct.ID, ct.PatientID, ct.ContactType, ct.Name, ct.Relationship, ct.PhoneNumber, ct.Email, ct.Address, ct.IsPrimary, ct.CreatedAt, ct.UpdatedAt)
+	if isUnknownPatient(err) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add contact",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Contact added successfully",
+		"contact": ct,
+	})
+}
+
+func EditContact(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var ct Contact
+	if err := c.BodyParser(&ct); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateContact(&ct); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	tag, err := db.Exec(context.Background(), `UPDATE patient_contacts SET contact_type=$1, name=$2, relationship=$3, phone_number=$4, email=$5, address=$6, is_primary=$7, updated_at=$8 WHERE id=$9 AND patient_id=$10`,
+		ct.ContactType, ct.Name, ct.Relationship, ct.PhoneNumber, ct.Email, ct.Address, ct.IsPrimary, time.Now(), c.Params("contactId"), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update contact",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Contact not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Contact updated successfully",
+	})
+}
+
+func DeleteContact(c *fiber.Ctx) error {
+	db := database.GetDB()
+
+	tag, err := db.Exec(context.Background(), `DELETE FROM patient_contacts WHERE id=$1 AND patient_id=$2`, c.Params("contactId"), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete contact",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Contact not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Contact deleted successfully",
+	})
+}
@@ -0,0 +1,138 @@
+package patients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+type Demographics struct {
+	PreferredLanguage *string `json:"preferred_language"`
+	BloodGroup        *string `json:"blood_group"`
+	Occupation        *string `json:"occupation"`
+}
+
+var bloodGroups = map[string]bool{
+	"A+": true, "A-": true, "B+": true, "B-": true,
+	"AB+": true, "AB-": true, "O+": true, "O-": true,
+}
+
+// validateBloodGroup normalises the blood group in place and reports whether it is a known ABO/Rh group.
+func validateBloodGroup(bg *string) bool {
+	if bg == nil {
+		return true
+	}
+	*bg = strings.ToUpper(strings.TrimSpace(*bg))
+	return *bg == "" || bloodGroups[*bg]
+}
+
+func validateDemographics(p *Patient) string {
+	if !validateBloodGroup(p.BloodGroup) {
+		return "Invalid blood group, expected one of A+, A-, B+, B-, AB+, AB-, O+, O-"
+	}
+	return ""
+}
+
+// sentFields returns the top-level keys of the JSON body, so a field sent as
+// null, which clears it, can be told apart from one that was left out.
+func sentFields(c *fiber.Ctx) (map[string]bool, error) {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return nil, err
+	}
+	sent := make(map[string]bool, len(body))
+	for k := range body {
+		sent[k] = true
+	}
+	return sent, nil
+}
+
+// setDemographics lists the assignments for the demographics fields that
+// were sent, numbering their parameters after the args already given.
+func setDemographics(sent map[string]bool, d Demographics, args []any) ([]string, []any) {
+	var sets []string
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"preferred_language", d.PreferredLanguage},
+		{"blood_group", d.BloodGroup},
+		{"occupation", d.Occupation},
+	} {
+		if sent[f.column] {
+			args = append(args, f.value)
+			sets = append(sets, fmt.Sprintf("%s=$%d", f.column, len(args)))
+		}
+	}
+	return sets, args
+}
+
+func GetDemographics(c *fiber.Ctx) error {
+	db := database.GetDB()
+	id := c.Params("id")
+
+	var d Demographics
+	err := db.QueryRow(context.Background(), `SELECT preferred_language, blood_group, occupation FROM patients WHERE id=$1`, id).Scan(
+		&d.PreferredLanguage, &d.BloodGroup, &d.Occupation,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(d)
+}
+
+func UpdateDemographics(c *fiber.Ctx) error {
+	db := database.GetDB()
+	id := c.Params("id")
+	var d Demographics
+
+	if err := c.BodyParser(&d); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+	sent, err := sentFields(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if !validateBloodGroup(d.BloodGroup) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid blood group, expected one of A+, A-, B+, B-, AB+, AB-, O+, O-",
+		})
+	}
+
+	// Only the fields that were sent are written; null clears a field
+	sets, args := setDemographics(sent, d, nil)
+	args = append(args, time.Now(), id)
+	sets = append(sets, fmt.Sprintf("updated_at=$%d", len(args)-1))
+	tag, err := db.Exec(context.Background(), `UPDATE patients SET `+strings.Join(sets, ", ")+fmt.Sprintf(` WHERE id=$%d`, len(args)), args...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update demographics",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Demographics updated successfully",
+	})
+}
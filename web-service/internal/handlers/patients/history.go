@@ -0,0 +1,92 @@
+package patients
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// RegistryChange is one entry in the history of an allergy or condition.
+type RegistryChange struct {
+	ID         string          `json:"id"`
+	PatientID  string          `json:"patient_id"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Action     string          `json:"action"`
+	Snapshot   json.RawMessage `json:"snapshot"`
+	ChangedBy  *string         `json:"changed_by,omitempty"`
+	ChangedAt  time.Time       `json:"changed_at"`
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// recordHistory stores a full snapshot of the entity as it stands after the change.
+func recordHistory(ctx context.Context, tx pgx.Tx, patientID, entityType, entityID, action string, snapshot any, changedBy *string) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO patient_registry_history
+		(id, patient_id, entity_type, entity_id, action, snapshot, changed_by, changed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		uuid.New().String()[:8], patientID, entityType, entityID, action, data, changedBy, time.Now())
+	return err
+}
+
+func fetchHistory(patientID, entityType, entityID string) ([]RegistryChange, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `
+		SELECT id, patient_id, entity_type, entity_id, action, snapshot, changed_by, changed_at
+		FROM patient_registry_history
+		WHERE patient_id = $1 AND entity_type = $2 AND entity_id = $3
+		ORDER BY changed_at ASC
+	`, patientID, entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []RegistryChange{}
+	for rows.Next() {
+		var h RegistryChange
+		if err := rows.Scan(&h.ID, &h.PatientID, &h.EntityType, &h.EntityID, &h.Action, &h.Snapshot, &h.ChangedBy, &h.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+func GetAllergyHistory(c *fiber.Ctx) error {
+	history, err := fetchHistory(c.Params("id"), "allergy", c.Params("allergyId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch allergy history",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(history)
+}
+
+func GetConditionHistory(c *fiber.Ctx) error {
+	history, err := fetchHistory(c.Params("id"), "condition", c.Params("conditionId"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch condition history",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(history)
+}
@@ -0,0 +1,214 @@
+package patients
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Insurance is a patient's cover with a payer under a given scheme. Covers
+// linked to a configured scheme through SchemeID can be billed to the payer.
+type Insurance struct {
+	ID                    string     `json:"id"`
+	PatientID             string     `json:"patient_id"`
+	Payer                 string     `json:"payer"`
+	Scheme                string     `json:"scheme"`
+	SchemeID              *string    `json:"scheme_id,omitempty"`
+	MemberNumber          string     `json:"member_number"`
+	ValidFrom             time.Time  `json:"valid_from"`
+	ValidTo               *time.Time `json:"valid_to,omitempty"`
+	PrincipalMemberName   string     `json:"principal_member_name"`
+	PrincipalRelationship string     `json:"principal_relationship"`
+	IsActive              bool       `json:"is_active"`
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+func validateInsurance(ins *Insurance) string {
+	if ins.SchemeID != nil && *ins.SchemeID == "" {
+		ins.SchemeID = nil
+	}
+	// A configured scheme names the payer and scheme
+	if ins.SchemeID != nil {
+		err := database.GetDB().QueryRow(context.Background(), `SELECT p.name, s.name FROM insurance_schemes s
+			JOIN insurance_payers p ON p.id = s.payer_id WHERE s.id = $1`, *ins.SchemeID).Scan(&ins.Payer, &ins.Scheme)
+		if err != nil {
+			return "scheme_id is not a configured insurance scheme"
+		}
+	}
+	if strings.TrimSpace(ins.Payer) == "" {
+		return "Payer is required"
+	}
+	if strings.TrimSpace(ins.Scheme) == "" {
+		return "Scheme is required"
+	}
+	if strings.TrimSpace(ins.MemberNumber) == "" {
+		return "Member number is required"
+	}
+	if ins.ValidFrom.IsZero() {
+		return "Valid from date is required"
+	}
+	if ins.ValidTo != nil && ins.ValidTo.Before(ins.ValidFrom) {
+		return "Valid to date cannot be before valid from date"
+	}
+	if strings.TrimSpace(ins.PrincipalMemberName) == "" {
+		return "Principal member name is required"
+	}
+	if strings.TrimSpace(ins.PrincipalRelationship) == "" {
+		ins.PrincipalRelationship = "self"
+	}
+	return ""
+}
+
+// isActive reports whether cover is valid on the given day. Cover dates are
+// whole days, valid_to included, so only the calendar date of on counts.
+func (ins *Insurance) isActive(on time.Time) bool {
+	day := on.Format("2006-01-02")
+	if day < ins.ValidFrom.Format("2006-01-02") {
+		return false
+	}
+	return ins.ValidTo == nil || day <= ins.ValidTo.Format("2006-01-02")
+}
+
+func fetchInsurance(patientID string) ([]Insurance, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `
+		SELECT id, patient_id, payer, scheme, scheme_id, member_number, valid_from, valid_to, principal_member_name, principal_relationship, created_at, updated_at
+		FROM patient_insurance
+		WHERE patient_id = $1
+		ORDER BY valid_from DESC
+	`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	insurance := []Insurance{}
+	for rows.Next() {
+		var ins Insurance
+		if err := rows.Scan(&ins.ID, &ins.PatientID, &ins.Payer, &ins.Scheme, &ins.SchemeID, &ins.MemberNumber, &ins.ValidFrom, &ins.ValidTo,
+			&ins.PrincipalMemberName, &ins.PrincipalRelationship, &ins.CreatedAt, &ins.UpdatedAt); err != nil {
+			return nil, err
+		}
+		ins.IsActive = ins.isActive(now)
+		insurance = append(insurance, ins)
+	}
+	return insurance, rows.Err()
+}
+
+func GetInsurance(c *fiber.Ctx) error {
+	insurance, err := fetchInsurance(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch insurance",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(insurance)
+}
+
+func AddInsurance(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var ins Insurance
+	if err := c.BodyParser(&ins); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateInsurance(&ins); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	ins.ID = uuid.New().String()[:8]
+	ins.PatientID = c.Params("id")
+	ins.CreatedAt = time.Now()
+	ins.UpdatedAt = time.Now()
+	ins.IsActive = ins.isActive(time.Now())
+
+	_, err := db.Exec(context.Background(), `INSERT INTO patient_insurance
+		(id, patient_id, payer, scheme, scheme_id, member_number, valid_from, valid_to, principal_member_name, principal_relationship, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		ins.ID, ins.PatientID, ins.Payer, ins.Scheme, ins.SchemeID, ins.MemberNumber, ins.ValidFrom, ins.ValidTo, ins.PrincipalMemberName, ins.PrincipalRelationship, ins.CreatedAt, ins.UpdatedAt)
+	if isUnknownPatient(err) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add insurance",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Insurance added successfully",
+		"insurance": ins,
+	})
+}
+
+func EditInsurance(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var ins Insurance
+	if err := c.BodyParser(&ins); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateInsurance(&ins); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	tag, err := db.Exec(context.Background(), `UPDATE patient_insurance SET payer=$1, scheme=$2, scheme_id=$3, member_number=$4, valid_from=$5, valid_to=$6, principal_member_name=$7, principal_relationship=$8, updated_at=$9 WHERE id=$10 AND patient_id=$11`,
+		ins.Payer, ins.Scheme, ins.SchemeID, ins.MemberNumber, ins.ValidFrom, ins.ValidTo, ins.PrincipalMemberName, ins.PrincipalRelationship, time.Now(), c.Params("insuranceId"), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update insurance",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Insurance not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Insurance updated successfully",
+	})
+}
+
+func DeleteInsurance(c *fiber.Ctx) error {
+	db := database.GetDB()
+
+	tag, err := db.Exec(context.Background(), `DELETE FROM patient_insurance WHERE id=$1 AND patient_id=$2`, c.Params("insuranceId"), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete insurance",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Insurance not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Insurance deleted successfully",
+	})
+}
@@ -2,9 +2,13 @@ package patients
 
 import (
 	"context"
+	"fmt"
 	"time"
 	
 	"web-service/database"
+	"web-service/internal/handlers/medicalrecords"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
@@ -21,6 +25,9 @@ type Patient struct {
 	Status       string    `json:"status"`
 	Department   string    `json:"department"`
 	Email        string    `json:"email"`
+	PreferredLanguage *string `json:"preferred_language,omitempty"`
+	BloodGroup   *string   `json:"blood_group,omitempty"`
+	Occupation   *string   `json:"occupation,omitempty"`
 	CreatedAt    time.Time    `json:"created_at"`
 	UpdatedAt    time.Time    `json:"updated_at"`
 }
@@ -40,9 +47,18 @@ type Appointment struct {
 func GetPatient(c *fiber.Ctx) error {
 	db := database.GetDB()
 	id:=c.Params("id")
+
+	// Clinical history is opt-in with ?include=history and only for clinical roles
+	includeHistory := c.Query("include") == "history"
+	if includeHistory && !middleware.HasRole(c, middleware.ClinicalRoles...) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Your role is not allowed to view clinical history",
+		})
+	}
 	rows, err := db.Query(context.Background(), `
 		SELECT 
-			p.id, p.first_name, p.last_name, p.phone_number, p.date_of_birth, p.national_id, p.address, p.gender, p.status, p.department, p.email, p.created_at, p.updated_at,
+			p.id, p.first_name, p.last_name, p.phone_number, p.date_of_birth, p.national_id, p.address, p.gender, p.status, p.department, p.email,
+			p.preferred_language, p.blood_group, p.occupation, p.created_at, p.updated_at,
 			a.id, a.patient_email, a.appointment_date, a.appointment_time, a.staff_id, a.department, a.status, a.created_at, a.updated_at
 		FROM patients p
 		LEFT JOIN appointments a
@@ -71,7 +87,7 @@ func GetPatient(c *fiber.Ctx) error {
 
 		err := rows.Scan(
 			&p.ID, &p.FirstName, &p.LastName, &p.PhoneNumber, &p.DateOfBirth, &p.NationalID, &p.Address,
-			&p.Gender, &p.Status, &p.Department, &p.Email, &p.CreatedAt, &p.UpdatedAt,
+			&p.Gender, &p.Status, &p.Department, &p.Email, &p.PreferredLanguage, &p.BloodGroup, &p.Occupation, &p.CreatedAt, &p.UpdatedAt,
 			&apptID, &apptPatientEmail, &apptDate, &apptTime, &apptStaffId, &apptDepartment, &apptStatus, &apptCreatedAt, &apptUpdatedAt,
 		)
 		if err != nil {
@@ -83,9 +99,47 @@ func GetPatient(c *fiber.Ctx) error {
 		// Use patient ID as key
 		pm, exists := patientMap[p.ID]
 		if !exists {
+			contacts, err := fetchContacts(p.ID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			insurance, err := fetchInsurance(p.ID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			allergies, err := fetchAllergies(p.ID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			conditions, err := fetchConditions(p.ID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
 			pm = map[string]any{
 				"patient":      p,
 				"appointments": []Appointment{},
+				"contacts":     contacts,
+				"insurance":    insurance,
+				"allergies":    allergies,
+				"conditions":   conditions,
+			}
+			if includeHistory {
+				page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+				history, err := medicalrecords.FetchHistory(p.ID, page, limit)
+				if err != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+						"error": err.Error(),
+					})
+				}
+				pm["clinical_history"] = history
 			}
 			patientMap[p.ID] = pm
 		}
@@ -145,13 +199,19 @@ func AddPatient(c *fiber.Ctx) error {
 		})
 	}
 
+	if msg := validateDemographics(&p); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
 	p.ID = uuid.New().String()[:8]
 
 	var err error
 	_, err = db.Exec(context.Background(), `INSERT INTO patients 
-		(id, first_name, last_name, phone_number, date_of_birth, national_id, address, gender, status, department, email, created_at, updated_at) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`, 
-		p.ID, p.FirstName, p.LastName, p.PhoneNumber, p.DateOfBirth, p.NationalID, p.Address, p.Gender, p.Status, p.Department, p.Email, p.CreatedAt, p.UpdatedAt)
+		(id, first_name, last_name, phone_number, date_of_birth, national_id, address, gender, status, department, email, preferred_language, blood_group, occupation, created_at, updated_at) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`, 
+		p.ID, p.FirstName, p.LastName, p.PhoneNumber, p.DateOfBirth, p.NationalID, p.Address, p.Gender, p.Status, p.Department, p.Email, p.PreferredLanguage, p.BloodGroup, p.Occupation, p.CreatedAt, p.UpdatedAt)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to add patient",
@@ -177,14 +237,40 @@ func EditPatient(c *fiber.Ctx) error {
 		})
 	}
 
-	_, err := db.Exec(context.Background(), `UPDATE patients SET first_name=$1, last_name=$2, phone_number=$3, date_of_birth=$4, national_id=$5, address=$6, gender=$7, status=$8, department=$9, email=$10, updated_at=$11 WHERE id=$12`,
-		p.FirstName, p.LastName, p.PhoneNumber, p.DateOfBirth, p.NationalID, p.Address, p.Gender, p.Status, p.Department, p.Email, time.Now(), id)
+	sent, err := sentFields(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input",
+			"details": err.Error(),
+		})
+	}
+
+	if msg := validateDemographics(&p); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	// Demographics left out of the request keep their values; null clears them
+	args := []any{p.FirstName, p.LastName, p.PhoneNumber, p.DateOfBirth, p.NationalID, p.Address, p.Gender, p.Status, p.Department, p.Email, time.Now()}
+	sets, args := setDemographics(sent, Demographics{PreferredLanguage: p.PreferredLanguage, BloodGroup: p.BloodGroup, Occupation: p.Occupation}, args)
+	query := `UPDATE patients SET first_name=$1, last_name=$2, phone_number=$3, date_of_birth=$4, national_id=$5, address=$6, gender=$7, status=$8, department=$9, email=$10, updated_at=$11`
+	for _, set := range sets {
+		query += ", " + set
+	}
+	args = append(args, id)
+	tag, err := db.Exec(context.Background(), query+fmt.Sprintf(` WHERE id=$%d`, len(args)), args...)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update patient",
 			"details": err.Error(),
 		})
 	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+		})
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Patient updated successfully",
@@ -194,7 +280,8 @@ func EditPatient(c *fiber.Ctx) error {
 func GetAllPatients(c *fiber.Ctx) error {
 	db := database.GetDB()
 	rows, err := db.Query(context.Background(), `
-		SELECT id, first_name, last_name, phone_number, date_of_birth, national_id, address, gender, status, department, email, created_at, updated_at 
+		SELECT id, first_name, last_name, phone_number, date_of_birth, national_id, address, gender, status, department, email,
+			preferred_language, blood_group, occupation, created_at, updated_at 
 		FROM patients
 		ORDER BY created_at DESC
 	`)
@@ -211,7 +298,7 @@ func GetAllPatients(c *fiber.Ctx) error {
 		var p Patient
 		err := rows.Scan(
 			&p.ID, &p.FirstName, &p.LastName, &p.PhoneNumber, &p.DateOfBirth, &p.NationalID, &p.Address,
-			&p.Gender, &p.Status, &p.Department, &p.Email, &p.CreatedAt, &p.UpdatedAt,
+			&p.Gender, &p.Status, &p.Department, &p.Email, &p.PreferredLanguage, &p.BloodGroup, &p.Occupation, &p.CreatedAt, &p.UpdatedAt,
 		)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -0,0 +1,154 @@
+package pharmacy
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shopspring/decimal"
+	"web-service/database"
+)
+
+type Batch struct {
+	ID           string           `json:"id"`
+	MedicineID   string           `json:"medicine_id"`
+	MedicineName string           `json:"medicine_name,omitempty"`
+	BatchNumber  string           `json:"batch_number"`
+	ExpiryDate   *time.Time       `json:"expiry_date"`
+	Supplier     *string          `json:"supplier,omitempty"`
+	UnitCost     *decimal.Decimal `json:"unit_cost,omitempty"`
+	Quantity     int              `json:"quantity"`
+	ReceivedAt   time.Time        `json:"received_at"`
+}
+
+const batchColumns = "b.id, b.medicine_id, m.name, b.batch_number, b.expiry_date, b.supplier, b.unit_cost, b.quantity, b.received_at"
+
+func (b *Batch) scanTargets() []any {
+	return []any{&b.ID, &b.MedicineID, &b.MedicineName, &b.BatchNumber, &b.ExpiryDate, &b.Supplier, &b.UnitCost, &b.Quantity, &b.ReceivedAt}
+}
+
+// GetBatches lists a medicine's batches in the order FEFO allocation uses them.
+func GetBatches(c *fiber.Ctx) error {
+	db := database.GetDB()
+	rows, err := db.Query(c.Context(), "SELECT "+batchColumns+` FROM stock_batches b JOIN pharmacy m ON m.id = b.medicine_id
+		WHERE b.medicine_id = $1 AND (b.quantity > 0 OR $2)
+		ORDER BY b.expiry_date NULLS LAST, b.received_at, b.id`, c.Params("id"), c.QueryBool("include_empty"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	batches := []Batch{}
+	for rows.Next() {
+		var b Batch
+		if err := rows.Scan(b.scanTargets()...); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		batches = append(batches, b)
+	}
+	return c.JSON(batches)
+}
+
+type ExpiringBatch struct {
+	Batch
+	DaysToExpiry int  `json:"days_to_expiry"`
+	Expired      bool `json:"expired"`
+}
+
+// GetExpiringBatches reports batches still in stock that expire within the
+// next `days` days (default 90), including any that have already expired.
+func GetExpiringBatches(c *fiber.Ctx) error {
+	days, err := strconv.Atoi(c.Query("days", "90"))
+	if err != nil || days < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be a non-negative number"})
+	}
+
+	db := database.GetDB()
+	rows, err := db.Query(c.Context(), "SELECT "+batchColumns+`, b.expiry_date - CURRENT_DATE
+		FROM stock_batches b JOIN pharmacy m ON m.id = b.medicine_id
+		WHERE b.quantity > 0 AND b.expiry_date <= CURRENT_DATE + $1::int
+		ORDER BY b.expiry_date, m.name`, days)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	batches := []ExpiringBatch{}
+	for rows.Next() {
+		var b ExpiringBatch
+		if err := rows.Scan(append(b.scanTargets(), &b.DaysToExpiry)...); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		b.Expired = b.DaysToExpiry < 0
+		batches = append(batches, b)
+	}
+	return c.JSON(fiber.Map{"days": days, "batches": batches})
+}
+
+type RecallRecipient struct {
+	PatientID    string    `json:"patient_id"`
+	PatientName  string    `json:"patient_name"`
+	PhoneNumber  string    `json:"phone_number"`
+	BatchID      string    `json:"batch_id"`
+	MedicineName string    `json:"medicine_name"`
+	Quantity     int       `json:"quantity"`
+	LastIssuedAt time.Time `json:"last_issued_at"`
+}
+
+// GetRecall finds every patient who was dispensed stock from batches with the
+// given batch number, net of anything they returned, so they can be contacted.
+func GetRecall(c *fiber.Ctx) error {
+	batchNumber := strings.TrimSpace(c.Query("batch_number"))
+	if batchNumber == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "batch_number is required"})
+	}
+	medicineID := c.Query("medicine_id")
+
+	db := database.GetDB()
+	rows, err := db.Query(c.Context(), "SELECT "+batchColumns+` FROM stock_batches b JOIN pharmacy m ON m.id = b.medicine_id
+		WHERE b.batch_number = $1 AND ($2 = '' OR b.medicine_id = $2) ORDER BY m.name`, batchNumber, medicineID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	batches := []Batch{}
+	for rows.Next() {
+		var b Batch
+		if err := rows.Scan(b.scanTargets()...); err != nil {
+			rows.Close()
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		batches = append(batches, b)
+	}
+	rows.Close()
+	if len(batches) == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "No batch with that number"})
+	}
+
+	rows, err = db.Query(c.Context(), `
+		SELECT p.id, p.first_name || ' ' || p.last_name, p.phone_number, b.id, m.name,
+			-SUM(s.quantity)::int, MAX(s.created_at) FILTER (WHERE s.movement_type = 'dispense')
+		FROM stock_movements s
+		JOIN stock_batches b ON b.id = s.batch_id
+		JOIN pharmacy m ON m.id = b.medicine_id
+		JOIN patients p ON p.id = s.patient_id
+		WHERE b.batch_number = $1 AND ($2 = '' OR b.medicine_id = $2)
+			AND s.movement_type IN ('dispense', 'return')
+		GROUP BY p.id, b.id, m.name
+		HAVING -SUM(s.quantity) > 0
+		ORDER BY p.last_name, p.first_name`, batchNumber, medicineID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	recipients := []RecallRecipient{}
+	for rows.Next() {
+		var r RecallRecipient
+		if err := rows.Scan(&r.PatientID, &r.PatientName, &r.PhoneNumber, &r.BatchID, &r.MedicineName, &r.Quantity, &r.LastIssuedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		recipients = append(recipients, r)
+	}
+	return c.JSON(fiber.Map{"batches": batches, "recipients": recipients})
+}
@@ -0,0 +1,300 @@
+package pharmacy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
+	"web-service/database"
+	"web-service/internal/middleware"
+)
+
+// Movement is one entry in the append-only stock ledger. Quantity is signed,
+// positive for stock coming in and negative for stock going out. Every
+// movement is booked against a single batch.
+type Movement struct {
+	ID           string    `json:"id"`
+	MedicineID   string    `json:"medicine_id"`
+	BatchID      string    `json:"batch_id"`
+	BatchNumber  string    `json:"batch_number,omitempty"`
+	MovementType string    `json:"movement_type"`
+	Quantity     int       `json:"quantity"`
+	ReasonCode   string    `json:"reason_code"`
+	PatientID    *string   `json:"patient_id,omitempty"`
+	Reference    *string   `json:"reference,omitempty"`
+	Notes        *string   `json:"notes,omitempty"`
+	StaffID      *string   `json:"staff_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// Batch details for stock coming in under a batch number not seen before
+	ExpiryDate *string          `json:"expiry_date,omitempty"`
+	Supplier   *string          `json:"supplier,omitempty"`
+	UnitCost   *decimal.Decimal `json:"unit_cost,omitempty"`
+}
+
+// movementReasons lists the reason codes allowed for each movement type and the
+// direction each one moves stock: +1 in, -1 out, 0 when the caller's sign decides.
+var movementReasons = map[string]map[string]int{
+	"receipt":          {"purchase": +1, "donation": +1, "initial_stock": +1},
+	"dispense":         {"prescription": -1, "otc_sale": -1},
+	"adjustment":       {"stock_count": 0, "correction": 0, "damaged": -1},
+	"transfer":         {"to_ward": -1, "from_ward": +1, "to_branch": -1, "from_branch": +1},
+	"return":           {"patient_return": +1, "supplier_return": -1},
+	"expiry_write_off": {"expired": -1, "recalled": -1},
+}
+
+var (
+	ErrInvalidMovement   = errors.New("invalid stock movement")
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrUnknownMedicine   = errors.New("medicine not found")
+	ErrBatchMismatch     = errors.New("batch already recorded with a different expiry date")
+)
+
+// normaliseMovement checks the type and reason code and gives the quantity its sign.
+// Callers send a positive quantity except for stock count and correction adjustments,
+// where the sign says which way the count was wrong.
+func normaliseMovement(m *Movement) error {
+	m.MovementType = strings.ToLower(strings.TrimSpace(m.MovementType))
+	reasons, ok := movementReasons[m.MovementType]
+	if !ok {
+		return fmt.Errorf("%w: unknown movement type %q", ErrInvalidMovement, m.MovementType)
+	}
+	m.ReasonCode = strings.ToLower(strings.TrimSpace(m.ReasonCode))
+	direction, ok := reasons[m.ReasonCode]
+	if !ok {
+		return fmt.Errorf("%w: reason code %q is not valid for %s", ErrInvalidMovement, m.ReasonCode, m.MovementType)
+	}
+	if m.Quantity == 0 {
+		return fmt.Errorf("%w: quantity cannot be zero", ErrInvalidMovement)
+	}
+	if direction == 0 {
+		return nil
+	}
+	if m.Quantity < 0 {
+		return fmt.Errorf("%w: quantity must be positive for %s", ErrInvalidMovement, m.ReasonCode)
+	}
+	m.Quantity *= direction
+	return nil
+}
+
+// RecordMovement appends a movement inside the caller's transaction and
+// returns the ledger rows written. Outgoing stock without a batch_id is
+// allocated first-expiry-first-out and may be split across several batches.
+// The ledger trigger keeps batch and medicine totals and refuses to take
+// either below zero.
+func RecordMovement(ctx context.Context, tx pgx.Tx, m Movement) ([]Movement, error) {
+	if err := normaliseMovement(&m); err != nil {
+		return nil, err
+	}
+
+	if m.BatchID != "" {
+		err := tx.QueryRow(ctx, `SELECT batch_number FROM stock_batches WHERE id = $1 AND medicine_id = $2`, m.BatchID, m.MedicineID).Scan(&m.BatchNumber)
+		if err != nil {
+			return nil, fmt.Errorf("%w: batch %s does not belong to medicine %s", ErrInvalidMovement, m.BatchID, m.MedicineID)
+		}
+		if err := insertMovement(ctx, tx, &m); err != nil {
+			return nil, err
+		}
+		return []Movement{m}, nil
+	}
+
+	if m.Quantity > 0 {
+		if err := openBatch(ctx, tx, &m); err != nil {
+			return nil, err
+		}
+		if err := insertMovement(ctx, tx, &m); err != nil {
+			return nil, err
+		}
+		return []Movement{m}, nil
+	}
+
+	allocations, err := allocateFEFO(ctx, tx, m.MedicineID, -m.Quantity, m.MovementType == "dispense")
+	if err != nil {
+		return nil, err
+	}
+	written := make([]Movement, 0, len(allocations))
+	for _, a := range allocations {
+		part := m
+		part.BatchID, part.BatchNumber, part.Quantity = a.BatchID, a.BatchNumber, -a.Quantity
+		if err := insertMovement(ctx, tx, &part); err != nil {
+			return nil, err
+		}
+		written = append(written, part)
+	}
+	return written, nil
+}
+
+// openBatch finds or creates the batch incoming stock is booked against.
+// Receipts must name their batch and expiry; other incoming stock with no
+// batch number goes into the medicine's UNBATCHED batch. A batch number
+// already on record with another expiry date is refused, as FEFO and the
+// expiry report go by the batch's date.
+func openBatch(ctx context.Context, tx pgx.Tx, m *Movement) error {
+	m.BatchNumber = strings.TrimSpace(m.BatchNumber)
+	var expiry *time.Time
+	if m.ExpiryDate != nil && *m.ExpiryDate != "" {
+		t, err := time.Parse("2006-01-02", *m.ExpiryDate)
+		if err != nil {
+			return fmt.Errorf("%w: expiry_date must be YYYY-MM-DD", ErrInvalidMovement)
+		}
+		expiry = &t
+	}
+	if m.MovementType == "receipt" && (m.BatchNumber == "" || expiry == nil) {
+		return fmt.Errorf("%w: batch_number and expiry_date are required for receipts", ErrInvalidMovement)
+	}
+	if m.BatchNumber == "" {
+		m.BatchNumber = "UNBATCHED"
+	}
+
+	var recorded *time.Time
+	err := tx.QueryRow(ctx, `INSERT INTO stock_batches (id, medicine_id, batch_number, expiry_date, supplier, unit_cost, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (medicine_id, batch_number) DO UPDATE SET
+			expiry_date = COALESCE(stock_batches.expiry_date, EXCLUDED.expiry_date),
+			supplier = COALESCE(EXCLUDED.supplier, stock_batches.supplier),
+			unit_cost = COALESCE(EXCLUDED.unit_cost, stock_batches.unit_cost)
+		RETURNING id, expiry_date`,
+		uuid.New().String()[:8], m.MedicineID, m.BatchNumber, expiry, m.Supplier, m.UnitCost, time.Now()).Scan(&m.BatchID, &recorded)
+	if err != nil {
+		return pgError(err)
+	}
+	if expiry != nil && recorded != nil && recorded.Format("2006-01-02") != expiry.Format("2006-01-02") {
+		return fmt.Errorf("%w: batch %s is recorded as expiring on %s", ErrBatchMismatch, m.BatchNumber, recorded.Format("2006-01-02"))
+	}
+	return nil
+}
+
+type allocation struct {
+	BatchID     string
+	BatchNumber string
+	Quantity    int
+}
+
+// allocateFEFO takes quantity from the batches that expire first, locking
+// them for the rest of the transaction. Expired batches are skipped when
+// dispensing so they can only leave stock through a write-off.
+func allocateFEFO(ctx context.Context, tx pgx.Tx, medicineID string, quantity int, skipExpired bool) ([]allocation, error) {
+	rows, err := tx.Query(ctx, `SELECT id, batch_number, quantity FROM stock_batches
+		WHERE medicine_id = $1 AND quantity > 0
+			AND (NOT $2 OR expiry_date IS NULL OR expiry_date >= CURRENT_DATE)
+		ORDER BY expiry_date NULLS LAST, received_at, id
+		FOR UPDATE`, medicineID, skipExpired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var allocations []allocation
+	remaining := quantity
+	for rows.Next() && remaining > 0 {
+		var a allocation
+		if err := rows.Scan(&a.BatchID, &a.BatchNumber, &a.Quantity); err != nil {
+			return nil, err
+		}
+		a.Quantity = min(a.Quantity, remaining)
+		remaining -= a.Quantity
+		allocations = append(allocations, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if remaining > 0 {
+		return nil, ErrInsufficientStock
+	}
+	return allocations, nil
+}
+
+func insertMovement(ctx context.Context, tx pgx.Tx, m *Movement) error {
+	m.ID = uuid.New().String()[:8]
+	m.CreatedAt = time.Now()
+	_, err := tx.Exec(ctx, `INSERT INTO stock_movements (id, medicine_id, batch_id, movement_type, quantity, reason_code, patient_id, reference, notes, staff_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		m.ID, m.MedicineID, m.BatchID, m.MovementType, m.Quantity, m.ReasonCode, m.PatientID, m.Reference, m.Notes, m.StaffID, m.CreatedAt)
+	return pgError(err)
+}
+
+// pgError maps constraint violations from the ledger to the package errors.
+func pgError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23514":
+			return ErrInsufficientStock
+		case "23503":
+			if pgErr.ConstraintName == "stock_movements_patient_id_fkey" {
+				return fmt.Errorf("%w: patient not found", ErrInvalidMovement)
+			}
+			return ErrUnknownMedicine
+		}
+	}
+	return err
+}
+
+func GetMovements(c *fiber.Ctx) error {
+	db := database.GetDB()
+	rows, err := db.Query(c.Context(), `SELECT m.id, m.medicine_id, m.batch_id, b.batch_number, m.movement_type, m.quantity, m.reason_code,
+			m.patient_id, m.reference, m.notes, m.staff_id, m.created_at
+		FROM stock_movements m JOIN stock_batches b ON b.id = m.batch_id
+		WHERE m.medicine_id = $1 ORDER BY m.created_at DESC`, c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	movements := []Movement{}
+	for rows.Next() {
+		var m Movement
+		if err := rows.Scan(&m.ID, &m.MedicineID, &m.BatchID, &m.BatchNumber, &m.MovementType, &m.Quantity, &m.ReasonCode,
+			&m.PatientID, &m.Reference, &m.Notes, &m.StaffID, &m.CreatedAt); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		movements = append(movements, m)
+	}
+	return c.JSON(movements)
+}
+
+func AddMovement(c *fiber.Ctx) error {
+	var m Movement
+	if err := c.BodyParser(&m); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	m.MedicineID = c.Params("id")
+	if id := middleware.CurrentUserID(c); id != "" {
+		m.StaffID = &id
+	}
+
+	db := database.GetDB()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	movements, err := RecordMovement(ctx, tx, m)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	switch {
+	case errors.Is(err, ErrInvalidMovement):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, ErrUnknownMedicine):
+		return c.Status(404).JSON(fiber.Map{"error": "Medicine not found"})
+	case errors.Is(err, ErrInsufficientStock):
+		return c.Status(409).JSON(fiber.Map{"error": "Movement would take stock below zero"})
+	case errors.Is(err, ErrBatchMismatch):
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(201).JSON(fiber.Map{"message": "Stock movement recorded successfully", "movements": movements})
+}
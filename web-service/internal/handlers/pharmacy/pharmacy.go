@@ -1,21 +1,44 @@
 package pharmacy
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
 	"web-service/database"
+	"web-service/internal/handlers/patients"
+	"web-service/internal/handlers/tariff"
+	"web-service/internal/middleware"
 )
 
 type Medicine struct {
-	ID          string  `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Stock       int     `json:"stock"`
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Price       decimal.Decimal `json:"price"`
+	Stock       int             `json:"stock"`
+	Active      bool            `json:"active"`
+
+	ReorderLevel        int     `json:"reorder_level"`
+	LeadTimeDays        int     `json:"lead_time_days"`
+	AvgDailyConsumption float64 `json:"avg_daily_consumption"`
+}
+
+// Price is the cash price in effect now.
+var medicineColumns = "id, name, COALESCE(description, ''), COALESCE(" + tariff.CashPriceNow("medicine", "pharmacy.id") + ", price), stock, active, reorder_level, lead_time_days, avg_daily_consumption"
+
+func (m *Medicine) scanTargets() []any {
+	return []any{&m.ID, &m.Name, &m.Description, &m.Price, &m.Stock, &m.Active, &m.ReorderLevel, &m.LeadTimeDays, &m.AvgDailyConsumption}
 }
 
 func GetMedicines(c *fiber.Ctx) error {
 	db := database.GetDB()
-	rows, err := db.Query(c.Context(), "SELECT id, name, description, price, stock FROM pharmacy")
+	// Deactivated medicines stay in the catalogue for their history but are hidden unless asked for
+	rows, err := db.Query(c.Context(), "SELECT "+medicineColumns+" FROM pharmacy WHERE active OR $1 ORDER BY name", c.QueryBool("include_inactive"))
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -24,7 +47,7 @@ func GetMedicines(c *fiber.Ctx) error {
 	var medicines []Medicine
 	for rows.Next() {
 		var m Medicine
-		if err := rows.Scan(&m.ID, &m.Name, &m.Description, &m.Price, &m.Stock); err != nil {
+		if err := rows.Scan(m.scanTargets()...); err != nil {
 			continue
 		}
 		medicines = append(medicines, m)
@@ -34,3 +57,240 @@ func GetMedicines(c *fiber.Ctx) error {
 	}
 	return c.JSON(medicines)
 }
+
+func GetMedicine(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var m Medicine
+	err := db.QueryRow(c.Context(), "SELECT "+medicineColumns+" FROM pharmacy WHERE id = $1", c.Params("id")).Scan(m.scanTargets()...)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Medicine not found"})
+	}
+	return c.JSON(m)
+}
+
+func validateMedicine(m *Medicine) string {
+	m.Name = strings.TrimSpace(m.Name)
+	if m.Name == "" {
+		return "name is required"
+	}
+	if m.Price.IsNegative() {
+		return "price cannot be negative"
+	}
+	m.Price = m.Price.Round(2)
+	if m.ReorderLevel < 0 || m.LeadTimeDays < 0 {
+		return "reorder_level and lead_time_days cannot be negative"
+	}
+	return ""
+}
+
+type createMedicineRequest struct {
+	Medicine
+	// Batch details for the opening stock, if any
+	BatchNumber string           `json:"batch_number"`
+	ExpiryDate  *string          `json:"expiry_date"`
+	Supplier    *string          `json:"supplier"`
+	UnitCost    *decimal.Decimal `json:"unit_cost"`
+}
+
+// CreateMedicine adds a catalogue entry. Stock always starts at zero; a
+// non-zero stock in the request is booked as an initial receipt against the
+// given batch so the ledger accounts for it.
+func CreateMedicine(c *fiber.Ctx) error {
+	var req createMedicineRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	m := req.Medicine
+	if msg := validateMedicine(&m); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+	if m.Stock < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "stock cannot be negative"})
+	}
+	openingStock := m.Stock
+	m.ID = uuid.New().String()[:8]
+	m.Stock = 0
+	m.Active = true
+	if m.LeadTimeDays == 0 {
+		m.LeadTimeDays = 7
+	}
+
+	db := database.GetDB()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	_, err = tx.Exec(ctx, `INSERT INTO pharmacy (id, name, description, price, stock, active, reorder_level, lead_time_days, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, 0, TRUE, $5, $6, $7, $7)`, m.ID, m.Name, m.Description, m.Price, m.ReorderLevel, m.LeadTimeDays, now)
+	if err == nil {
+		err = tariff.Record(ctx, tx, tariff.CashList, "medicine", m.ID, m.Price, decimal.Zero, now, middleware.CurrentUserID(c))
+	}
+	if err == nil && openingStock > 0 {
+		movement := Movement{
+			MedicineID: m.ID, MovementType: "receipt", Quantity: openingStock, ReasonCode: "initial_stock",
+			BatchNumber: req.BatchNumber, ExpiryDate: req.ExpiryDate, Supplier: req.Supplier, UnitCost: req.UnitCost,
+		}
+		if id := middleware.CurrentUserID(c); id != "" {
+			movement.StaffID = &id
+		}
+		_, err = RecordMovement(ctx, tx, movement)
+		m.Stock = openingStock
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if errors.Is(err, ErrInvalidMovement) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(201).JSON(fiber.Map{"message": "Medicine created successfully", "medicine": m})
+}
+
+type medicineUpdate struct {
+	Name        *string          `json:"name"`
+	Description *string          `json:"description"`
+	Price       *decimal.Decimal `json:"price"`
+	Active      *bool            `json:"active"`
+	Stock       *int             `json:"stock"`
+
+	ReorderLevel *int `json:"reorder_level"`
+	LeadTimeDays *int `json:"lead_time_days"`
+}
+
+// UpdateMedicine edits catalogue details. Stock can only change through movements.
+func UpdateMedicine(c *fiber.Ctx) error {
+	var req medicineUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.Stock != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "stock cannot be edited directly, record a stock movement instead"})
+	}
+
+	db := database.GetDB()
+	var m Medicine
+	err := db.QueryRow(c.Context(), "SELECT "+medicineColumns+" FROM pharmacy WHERE id = $1", c.Params("id")).Scan(m.scanTargets()...)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Medicine not found"})
+	}
+	if req.Name != nil {
+		m.Name = *req.Name
+	}
+	if req.Description != nil {
+		m.Description = *req.Description
+	}
+	repriced := req.Price != nil && !req.Price.Round(2).Equal(m.Price)
+	if req.Price != nil {
+		m.Price = *req.Price
+	}
+	if req.Active != nil {
+		m.Active = *req.Active
+	}
+	if req.ReorderLevel != nil {
+		m.ReorderLevel = *req.ReorderLevel
+	}
+	if req.LeadTimeDays != nil {
+		m.LeadTimeDays = *req.LeadTimeDays
+	}
+	if msg := validateMedicine(&m); msg != "" {
+		return c.Status(400).JSON(fiber.Map{"error": msg})
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer tx.Rollback(ctx)
+
+	// A new price goes on the cash list effective now; the list also
+	// takes prices scheduled for later dates
+	now := time.Now()
+	_, err = tx.Exec(ctx, `UPDATE pharmacy SET name=$1, description=$2, active=$3, reorder_level=$4, lead_time_days=$5, updated_at=$6 WHERE id=$7`,
+		m.Name, m.Description, m.Active, m.ReorderLevel, m.LeadTimeDays, now, m.ID)
+	if err == nil && repriced {
+		err = tariff.Record(ctx, tx, tariff.CashList, "medicine", m.ID, m.Price, decimal.Zero, now, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Medicine updated successfully", "medicine": m})
+}
+
+// DeleteMedicine removes a medicine that was never stocked or prescribed.
+// Anything with history is deactivated instead so the ledger stays intact.
+func DeleteMedicine(c *fiber.Ctx) error {
+	db := database.GetDB()
+	id := c.Params("id")
+
+	var used bool
+	err := db.QueryRow(c.Context(), `SELECT EXISTS (SELECT 1 FROM stock_movements WHERE medicine_id = $1)
+		OR EXISTS (SELECT 1 FROM prescription_items WHERE medicine_id = $1)`, id).Scan(&used)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query := "DELETE FROM pharmacy WHERE id = $1"
+	message := "Medicine deleted successfully"
+	if used {
+		query = "UPDATE pharmacy SET active = FALSE, updated_at = CURRENT_TIMESTAMP WHERE id = $1"
+		message = "Medicine has stock history and was deactivated"
+	}
+	tag, err := db.Exec(c.Context(), query, id)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Medicine not found"})
+	}
+	return c.JSON(fiber.Map{"message": message})
+}
+
+type AllergyCheckRequest struct {
+	PatientID   string   `json:"patient_id"`
+	MedicineIDs []string `json:"medicine_ids"`
+}
+
+// CheckAllergies warns the prescriber when any of the selected medicines
+// matches an allergy recorded against the patient.
+func CheckAllergies(c *fiber.Ctx) error {
+	var req AllergyCheckRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.PatientID == "" || len(req.MedicineIDs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "patient_id and medicine_ids are required"})
+	}
+
+	db := database.GetDB()
+	rows, err := db.Query(c.Context(), "SELECT name, COALESCE(description, '') FROM pharmacy WHERE id = ANY($1)", req.MedicineIDs)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	defer rows.Close()
+
+	var medicines []string
+	for rows.Next() {
+		var name, description string
+		if err := rows.Scan(&name, &description); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		medicines = append(medicines, strings.TrimSpace(name+" "+description))
+	}
+
+	warnings, err := patients.MatchAllergies(req.PatientID, medicines)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"warnings": warnings})
+}
@@ -0,0 +1,191 @@
+package pharmacy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"web-service/config"
+	"web-service/database"
+)
+
+// LowStockItem is a medicine at or below its reorder point. The reorder
+// point is the reorder level (kept as safety stock) plus what is expected to
+// be used while an order is on its way. The suggested quantity brings stock
+// back up to the reorder point plus coverDays of consumption.
+type LowStockItem struct {
+	MedicineID          string     `json:"medicine_id"`
+	Name                string     `json:"name"`
+	Stock               int        `json:"stock"`
+	ReorderLevel        int        `json:"reorder_level"`
+	LeadTimeDays        int        `json:"lead_time_days"`
+	AvgDailyConsumption float64    `json:"avg_daily_consumption"`
+	ReorderPoint        int        `json:"reorder_point"`
+	SuggestedQuantity   int        `json:"suggested_quantity"`
+	AlertedAt           *time.Time `json:"alerted_at,omitempty"`
+}
+
+const lowStockQuery = `
+	SELECT id, name, stock, reorder_level, lead_time_days, avg_daily_consumption, low_stock_alerted_at,
+		reorder_level + CEIL(avg_daily_consumption * lead_time_days)::int AS reorder_point
+	FROM pharmacy
+	WHERE active AND stock <= reorder_level + CEIL(avg_daily_consumption * lead_time_days)::int
+		AND (reorder_level > 0 OR avg_daily_consumption > 0)
+	ORDER BY stock - (reorder_level + CEIL(avg_daily_consumption * lead_time_days)::int), name`
+
+func configInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(config.GetVal(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// LowStock returns every active medicine that has reached its reorder point.
+func LowStock(ctx context.Context) ([]LowStockItem, error) {
+	coverDays := configInt("REORDER_COVER_DAYS", 30)
+	db := database.GetDB()
+	rows, err := db.Query(ctx, lowStockQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []LowStockItem{}
+	for rows.Next() {
+		var i LowStockItem
+		if err := rows.Scan(&i.MedicineID, &i.Name, &i.Stock, &i.ReorderLevel, &i.LeadTimeDays, &i.AvgDailyConsumption, &i.AlertedAt, &i.ReorderPoint); err != nil {
+			return nil, err
+		}
+		target := i.ReorderPoint + int(math.Ceil(i.AvgDailyConsumption*float64(coverDays)))
+		i.SuggestedQuantity = max(target-i.Stock, 1)
+		items = append(items, i)
+	}
+	return items, rows.Err()
+}
+
+func GetLowStock(c *fiber.Ctx) error {
+	items, err := LowStock(c.Context())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(items)
+}
+
+// updateConsumption recalculates each medicine's average daily consumption
+// from net dispensing (dispensed less patient returns) over the last windowDays.
+func updateConsumption(ctx context.Context, windowDays int) error {
+	db := database.GetDB()
+	_, err := db.Exec(ctx, `
+		UPDATE pharmacy p SET avg_daily_consumption = GREATEST(COALESCE((
+				SELECT -SUM(s.quantity) FROM stock_movements s
+				WHERE s.medicine_id = p.id
+					AND (s.movement_type = 'dispense' OR s.reason_code = 'patient_return')
+					AND s.created_at >= CURRENT_TIMESTAMP - make_interval(days => $1)
+			), 0), 0)::numeric / $1,
+			consumption_updated_at = CURRENT_TIMESTAMP`, windowDays)
+	return err
+}
+
+// raiseAlerts notifies every active pharmacist and admin once per item when it
+// goes low, and re-arms the alert for items that have since been restocked.
+func raiseAlerts(ctx context.Context, items []LowStockItem) (int, error) {
+	db := database.GetDB()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	low := make([]string, 0, len(items))
+	for _, i := range items {
+		low = append(low, i.MedicineID)
+	}
+	_, err = tx.Exec(ctx, `UPDATE pharmacy SET low_stock_alerted_at = NULL
+		WHERE low_stock_alerted_at IS NOT NULL AND NOT (id = ANY($1))`, low)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(ctx, `SELECT id FROM staff WHERE role IN ('pharmacist', 'admin') AND status = 'active'`)
+	if err != nil {
+		return 0, err
+	}
+	var recipients []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		recipients = append(recipients, id)
+	}
+	rows.Close()
+
+	raised := 0
+	now := time.Now()
+	for _, i := range items {
+		if i.AlertedAt != nil {
+			continue
+		}
+		message := fmt.Sprintf("Low stock: %s has %d left (reorder point %d). Suggested order: %d.",
+			i.Name, i.Stock, i.ReorderPoint, i.SuggestedQuantity)
+		for _, staffID := range recipients {
+			_, err := tx.Exec(ctx, `INSERT INTO notifications (id, user_id, message, created_at) VALUES ($1, $2, $3, $4)`,
+				uuid.New().String()[:8], staffID, message, now)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.Exec(ctx, `UPDATE pharmacy SET low_stock_alerted_at = $1 WHERE id = $2`, now, i.MedicineID); err != nil {
+			return 0, err
+		}
+		raised++
+	}
+	return raised, tx.Commit(ctx)
+}
+
+// RunReorderCheck refreshes consumption figures and raises low-stock alerts.
+func RunReorderCheck(ctx context.Context) error {
+	if err := updateConsumption(ctx, configInt("CONSUMPTION_WINDOW_DAYS", 30)); err != nil {
+		return err
+	}
+	items, err := LowStock(ctx)
+	if err != nil {
+		return err
+	}
+	raised, err := raiseAlerts(ctx, items)
+	if err != nil {
+		return err
+	}
+	if raised > 0 {
+		log.Printf("Reorder check: %d new low-stock alerts", raised)
+	}
+	return nil
+}
+
+// StartReorderJob runs the reorder check straight away and then every
+// REORDER_CHECK_INTERVAL (default 1h) until ctx is cancelled.
+func StartReorderJob(ctx context.Context) {
+	interval, err := time.ParseDuration(config.GetVal("REORDER_CHECK_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := RunReorderCheck(ctx); err != nil {
+			log.Printf("Reorder check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
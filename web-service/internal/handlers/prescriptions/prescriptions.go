@@ -0,0 +1,443 @@
+package prescriptions
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"web-service/config"
+	"web-service/database"
+	"web-service/internal/handlers/interactions"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type Prescription struct {
+	ID           string     `json:"id"`
+	PatientID    string     `json:"patient_id"`
+	EncounterID  *string    `json:"encounter_id,omitempty"`
+	PrescriberID string     `json:"prescriber_id"`
+	Status       string     `json:"status"`
+	Notes        *string    `json:"notes,omitempty"`
+	Signature    string     `json:"signature"`
+	SignedAt     time.Time  `json:"signed_at"`
+	CancelReason *string    `json:"cancel_reason,omitempty"`
+	Items        []Item     `json:"items"`
+	Overrides    []interactions.Override `json:"overrides,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type Item struct {
+	ID                string  `json:"id"`
+	PrescriptionID    string  `json:"prescription_id"`
+	MedicineID        string  `json:"medicine_id"`
+	MedicineName      string  `json:"medicine_name,omitempty"`
+	Dose              string  `json:"dose"`
+	Route             string  `json:"route"`
+	Frequency         string  `json:"frequency"`
+	DurationDays      int     `json:"duration_days"`
+	Quantity          int     `json:"quantity"`
+	Refills           int     `json:"refills"`
+	DispensedQuantity int     `json:"dispensed_quantity"`
+	Instructions      *string `json:"instructions,omitempty"`
+}
+
+var routes = map[string]bool{
+	"oral": true, "iv": true, "im": true, "sc": true, "topical": true, "inhaled": true,
+	"rectal": true, "sublingual": true, "ophthalmic": true, "otic": true, "nasal": true, "vaginal": true,
+}
+
+const prescriptionColumns = `id, patient_id, encounter_id, prescriber_id, status, notes, signature, signed_at, cancel_reason, created_at, updated_at`
+
+func (p *Prescription) scanTargets() []any {
+	return []any{&p.ID, &p.PatientID, &p.EncounterID, &p.PrescriberID, &p.Status, &p.Notes, &p.Signature, &p.SignedAt, &p.CancelReason, &p.CreatedAt, &p.UpdatedAt}
+}
+
+func validateItem(it *Item) string {
+	if it.MedicineID == "" {
+		return "Each item needs a medicine_id"
+	}
+	if strings.TrimSpace(it.Dose) == "" || strings.TrimSpace(it.Frequency) == "" {
+		return "Each item needs a dose and frequency"
+	}
+	it.Route = strings.ToLower(strings.TrimSpace(it.Route))
+	if !routes[it.Route] {
+		return fmt.Sprintf("Unknown route %q", it.Route)
+	}
+	if it.DurationDays <= 0 || it.Quantity <= 0 {
+		return "Duration and quantity must be greater than zero"
+	}
+	if it.Refills < 0 {
+		return "Refills cannot be negative"
+	}
+	return ""
+}
+
+// ErrNoSigningKey is returned when PRESCRIPTION_SIGNING_KEY is not set.
+// Prescriptions are neither signed nor accepted as valid without it.
+var ErrNoSigningKey = errors.New("PRESCRIPTION_SIGNING_KEY is not set")
+
+// sign computes the prescriber's signature over the prescription content, so
+// any later change to what was prescribed can be detected. Free text is
+// quoted so no value can run into the next.
+func sign(p *Prescription) (string, error) {
+	key := config.GetVal("PRESCRIPTION_SIGNING_KEY")
+	if key == "" {
+		return "", ErrNoSigningKey
+	}
+	items := append([]Item(nil), p.Items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s|%s|%q|%s|%s|%q", p.ID, p.PatientID, deref(p.EncounterID), p.PrescriberID, p.SignedAt.UTC().Format(time.RFC3339), deref(p.Notes))
+	for _, it := range items {
+		fmt.Fprintf(&b, "|%s;%s;%q;%q;%q;%d;%d;%d;%q", it.ID, it.MedicineID, it.Dose, it.Route, it.Frequency, it.DurationDays, it.Quantity, it.Refills,
+			deref(it.Instructions))
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(b.String()))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// Verify reports whether the stored signature still matches the prescription
+// content. Nothing verifies while the signing key is not set.
+func Verify(p *Prescription) bool {
+	sig, err := sign(p)
+	return err == nil && hmac.Equal([]byte(sig), []byte(p.Signature))
+}
+
+func fetchItems(prescriptionID string) ([]Item, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `
+		SELECT i.id, i.prescription_id, i.medicine_id, m.name, i.dose, i.route, i.frequency, i.duration_days, i.quantity, i.refills, i.dispensed_quantity, i.instructions
+		FROM prescription_items i
+		JOIN pharmacy m ON m.id = i.medicine_id
+		WHERE i.prescription_id = $1
+		ORDER BY i.id`, prescriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		var it Item
+		if err := rows.Scan(&it.ID, &it.PrescriptionID, &it.MedicineID, &it.MedicineName, &it.Dose, &it.Route, &it.Frequency,
+			&it.DurationDays, &it.Quantity, &it.Refills, &it.DispensedQuantity, &it.Instructions); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// OverrideRecord is a blocking interaction warning the prescriber chose to override.
+type OverrideRecord struct {
+	ID           string    `json:"id"`
+	WarningKey   string    `json:"warning_key"`
+	WarningType  string    `json:"warning_type"`
+	Severity     string    `json:"severity"`
+	Description  string    `json:"description"`
+	Reason       string    `json:"reason"`
+	OverriddenBy string    `json:"overridden_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func fetchOverrides(prescriptionID string) ([]OverrideRecord, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT id, warning_key, warning_type, severity, description, reason, overridden_by, created_at
+		FROM prescription_overrides WHERE prescription_id=$1 ORDER BY created_at`, prescriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []OverrideRecord{}
+	for rows.Next() {
+		var o OverrideRecord
+		if err := rows.Scan(&o.ID, &o.WarningKey, &o.WarningType, &o.Severity, &o.Description, &o.Reason, &o.OverriddenBy, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// Fetch loads a prescription with its line items.
+func Fetch(id string) (*Prescription, error) {
+	db := database.GetDB()
+	var p Prescription
+	err := db.QueryRow(context.Background(), `SELECT `+prescriptionColumns+` FROM prescriptions WHERE id=$1`, id).Scan(p.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	p.Items, err = fetchItems(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// List returns prescriptions with their items, filtered by patient, encounter or status.
+func List(patientID, encounterID string, statuses []string) ([]Prescription, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT `+prescriptionColumns+` FROM prescriptions
+		WHERE ($1 = '' OR patient_id = $1) AND ($2 = '' OR encounter_id = $2) AND (COALESCE(cardinality($3::text[]), 0) = 0 OR status = ANY($3))
+		ORDER BY created_at ASC`, patientID, encounterID, statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Prescription{}
+	for rows.Next() {
+		var p Prescription
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		if list[i].Items, err = fetchItems(list[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func GetPrescriptions(c *fiber.Ctx) error {
+	var statuses []string
+	if s := c.Query("status"); s != "" {
+		statuses = strings.Split(s, ",")
+	}
+	list, err := List(c.Query("patient_id"), c.Query("encounter_id"), statuses)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch prescriptions",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(list)
+}
+
+// GetQueue lists prescriptions waiting to be dispensed, oldest first.
+func GetQueue(c *fiber.Ctx) error {
+	list, err := List("", "", []string{"active", "partially_dispensed"})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch dispensing queue",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(list)
+}
+
+func GetPrescription(c *fiber.Ctx) error {
+	p, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Prescription not found",
+			"details": err.Error(),
+		})
+	}
+
+	overrides, err := fetchOverrides(p.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"prescription":    p,
+		"signature_valid": Verify(p),
+		"overrides":       overrides,
+	})
+}
+
+func CreatePrescription(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var p Prescription
+	if err := c.BodyParser(&p); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if p.PatientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Patient ID is required",
+		})
+	}
+	if len(p.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one item is required",
+		})
+	}
+	for i := range p.Items {
+		if msg := validateItem(&p.Items[i]); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+	}
+
+	ctx := context.Background()
+	if p.EncounterID != nil && *p.EncounterID != "" {
+		var encounterPatient string
+		err := db.QueryRow(ctx, `SELECT patient_id FROM encounters WHERE id=$1`, *p.EncounterID).Scan(&encounterPatient)
+		if err != nil || encounterPatient != p.PatientID {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Encounter not found for this patient",
+			})
+		}
+	} else {
+		p.EncounterID = nil
+	}
+
+	// Resolve the catalogue entries for the interaction check and the response
+	ids := make([]string, len(p.Items))
+	for i := range p.Items {
+		ids[i] = p.Items[i].MedicineID
+	}
+	medicines, err := interactions.LoadMedicines(ids)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	for i := range p.Items {
+		p.Items[i].MedicineName = medicines[i].Name
+	}
+
+	warnings, err := interactions.Check(p.PatientID, medicines)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check interactions",
+			"details": err.Error(),
+		})
+	}
+	if open := interactions.Unresolved(warnings, p.Overrides); len(open) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Severe interactions need an override reason",
+			"warnings": warnings,
+			"unresolved": open,
+		})
+	}
+
+	now := time.Now()
+	p.ID = uuid.New().String()[:8]
+	p.PrescriberID = middleware.CurrentUserID(c)
+	p.Status = "active"
+	p.CancelReason = nil
+	// Stored in UTC to the second so the signature verifies after a round trip
+	p.SignedAt = now.UTC().Truncate(time.Second)
+	p.CreatedAt = now
+	p.UpdatedAt = now
+	for i := range p.Items {
+		p.Items[i].ID = uuid.New().String()[:8]
+		p.Items[i].PrescriptionID = p.ID
+		p.Items[i].DispensedQuantity = 0
+	}
+	if p.Signature, err = sign(&p); err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Prescriptions cannot be signed",
+			"details": err.Error(),
+		})
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `INSERT INTO prescriptions (`+prescriptionColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		p.ID, p.PatientID, p.EncounterID, p.PrescriberID, p.Status, p.Notes, p.Signature, p.SignedAt, p.CancelReason, p.CreatedAt, p.UpdatedAt)
+	if err == nil {
+		err = interactions.RecordOverrides(ctx, tx, p.ID, p.PrescriberID, warnings, p.Overrides)
+	}
+	for _, it := range p.Items {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(ctx, `INSERT INTO prescription_items
+			(id, prescription_id, medicine_id, dose, route, frequency, duration_days, quantity, refills, dispensed_quantity, instructions)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			it.ID, it.PrescriptionID, it.MedicineID, it.Dose, it.Route, it.Frequency, it.DurationDays, it.Quantity, it.Refills, it.DispensedQuantity, it.Instructions)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create prescription",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Prescription created successfully",
+		"prescription": p,
+		"warnings": warnings,
+	})
+}
+
+type cancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+func CancelPrescription(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var req cancelRequest
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A cancellation reason is required",
+		})
+	}
+
+	// Anything already handed over stays on record, only undispensed prescriptions can be cancelled
+	tag, err := db.Exec(context.Background(), `UPDATE prescriptions SET status='cancelled', cancel_reason=$1, updated_at=$2
+		WHERE id=$3 AND status='active' AND prescriber_id=$4`,
+		req.Reason, time.Now(), c.Params("id"), middleware.CurrentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel prescription",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only the prescriber can cancel an active, undispensed prescription",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Prescription cancelled successfully",
+	})
+}
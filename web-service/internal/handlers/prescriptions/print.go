@@ -0,0 +1,114 @@
+package prescriptions
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"time"
+
+	"web-service/config"
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+var printTemplate = template.Must(template.New("prescription").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Prescription {{.Prescription.ID}}</title>
+<style>
+  body { font-family: Arial, sans-serif; margin: 32px; color: #111; }
+  header { border-bottom: 2px solid #111; margin-bottom: 16px; }
+  h1 { margin: 0; font-size: 22px; }
+  table { width: 100%; border-collapse: collapse; margin-top: 16px; }
+  th, td { border: 1px solid #999; padding: 6px; text-align: left; font-size: 13px; }
+  .meta td { border: none; padding: 2px 6px 2px 0; }
+  .signature { margin-top: 32px; font-size: 12px; word-break: break-all; }
+  @media print { button { display: none; } }
+</style>
+</head>
+<body>
+<header>
+  <h1>{{.ClinicName}}</h1>
+  <p>{{.ClinicAddress}} &middot; {{.ClinicPhone}}</p>
+</header>
+<h2>Prescription</h2>
+<table class="meta">
+  <tr><td><strong>No.</strong></td><td>{{.Prescription.ID}}</td><td><strong>Date</strong></td><td>{{.Prescription.SignedAt.Format "02 Jan 2006 15:04"}}</td></tr>
+  <tr><td><strong>Patient</strong></td><td>{{.PatientName}}</td><td><strong>Date of birth</strong></td><td>{{.PatientDOB.Format "02 Jan 2006"}}</td></tr>
+  <tr><td><strong>Status</strong></td><td>{{.Prescription.Status}}</td><td></td><td></td></tr>
+</table>
+<table>
+  <thead>
+    <tr><th>Medicine</th><th>Dose</th><th>Route</th><th>Frequency</th><th>Duration</th><th>Qty</th><th>Refills</th><th>Instructions</th></tr>
+  </thead>
+  <tbody>
+  {{range .Prescription.Items}}
+    <tr>
+      <td>{{.MedicineName}}</td><td>{{.Dose}}</td><td>{{.Route}}</td><td>{{.Frequency}}</td>
+      <td>{{.DurationDays}} days</td><td>{{.Quantity}}</td><td>{{.Refills}}</td><td>{{if .Instructions}}{{.Instructions}}{{end}}</td>
+    </tr>
+  {{end}}
+  </tbody>
+</table>
+{{if .Prescription.Notes}}<p><strong>Notes:</strong> {{.Prescription.Notes}}</p>{{end}}
+<div class="signature">
+  <p><strong>Prescriber:</strong> {{.PrescriberName}}</p>
+  <p><strong>Electronic signature:</strong> {{.Prescription.Signature}} {{if .SignatureValid}}(verified){{else}}(NOT VALID){{end}}</p>
+</div>
+<button onclick="window.print()">Print</button>
+</body>
+</html>
+`))
+
+// PrintPrescription renders the prescription as a printable HTML document.
+func PrintPrescription(c *fiber.Ctx) error {
+	db := database.GetDB()
+	p, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Prescription not found",
+			"details": err.Error(),
+		})
+	}
+
+	data := struct {
+		ClinicName     string
+		ClinicAddress  string
+		ClinicPhone    string
+		Prescription   *Prescription
+		PatientName    string
+		PatientDOB     time.Time
+		PrescriberName string
+		SignatureValid bool
+	}{
+		ClinicName:     config.GetVal("CLINIC_NAME"),
+		ClinicAddress:  config.GetVal("CLINIC_ADDRESS"),
+		ClinicPhone:    config.GetVal("CLINIC_PHONE"),
+		Prescription:   p,
+		SignatureValid: Verify(p),
+	}
+	if data.ClinicName == "" {
+		data.ClinicName = "Triple Ts Mediclinic"
+	}
+
+	err = db.QueryRow(context.Background(), `SELECT first_name || ' ' || last_name, date_of_birth FROM patients WHERE id=$1`, p.PatientID).Scan(&data.PatientName, &data.PatientDOB)
+	if err == nil {
+		err = db.QueryRow(context.Background(), `SELECT first_name || ' ' || last_name FROM staff WHERE id=$1`, p.PrescriberID).Scan(&data.PrescriberName)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := printTemplate.Execute(&buf, data); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,481 @@
+package purchasing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+type PurchaseOrder struct {
+	ID           string          `json:"id"`
+	PONumber     string          `json:"po_number"`
+	SupplierID   string          `json:"supplier_id"`
+	SupplierName string          `json:"supplier_name,omitempty"`
+	Status       string          `json:"status"`
+	ExpectedDate *time.Time      `json:"expected_date,omitempty"`
+	Notes        *string         `json:"notes,omitempty"`
+	CreatedBy    string          `json:"created_by"`
+	SentAt       *time.Time      `json:"sent_at,omitempty"`
+	CancelledAt  *time.Time      `json:"cancelled_at,omitempty"`
+	CancelReason *string         `json:"cancel_reason,omitempty"`
+	Items        []Item          `json:"items"`
+	Total        decimal.Decimal `json:"total"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+type Item struct {
+	ID               string          `json:"id"`
+	PurchaseOrderID  string          `json:"purchase_order_id"`
+	ItemType         string          `json:"item_type"`
+	MedicineID       *string         `json:"medicine_id,omitempty"`
+	Description      string          `json:"description"`
+	Quantity         int             `json:"quantity"`
+	ReceivedQuantity int             `json:"received_quantity"`
+	UnitCost         decimal.Decimal `json:"unit_cost"`
+}
+
+const orderColumns = `o.id, o.po_number, o.supplier_id, s.name, o.status, o.expected_date, o.notes, o.created_by,
+	o.sent_at, o.cancelled_at, o.cancel_reason, o.created_at, o.updated_at`
+
+func (o *PurchaseOrder) scanTargets() []any {
+	return []any{&o.ID, &o.PONumber, &o.SupplierID, &o.SupplierName, &o.Status, &o.ExpectedDate, &o.Notes, &o.CreatedBy,
+		&o.SentAt, &o.CancelledAt, &o.CancelReason, &o.CreatedAt, &o.UpdatedAt}
+}
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+}
+
+func fetchItems(ctx context.Context, q querier, orderID string) ([]Item, error) {
+	rows, err := q.Query(ctx, `SELECT id, purchase_order_id, item_type, medicine_id, description, quantity, received_quantity, unit_cost
+		FROM purchase_order_items WHERE purchase_order_id=$1 ORDER BY description, id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		var it Item
+		if err := rows.Scan(&it.ID, &it.PurchaseOrderID, &it.ItemType, &it.MedicineID, &it.Description, &it.Quantity, &it.ReceivedQuantity, &it.UnitCost); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// Fetch loads a purchase order with its lines.
+func Fetch(id string) (*PurchaseOrder, error) {
+	db := database.GetDB()
+	ctx := context.Background()
+	var o PurchaseOrder
+	err := db.QueryRow(ctx, `SELECT `+orderColumns+` FROM purchase_orders o JOIN suppliers s ON s.id = o.supplier_id WHERE o.id=$1`, id).Scan(o.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	if o.Items, err = fetchItems(ctx, db, o.ID); err != nil {
+		return nil, err
+	}
+	o.total()
+	return &o, nil
+}
+
+func (o *PurchaseOrder) total() {
+	o.Total = decimal.Zero
+	for _, it := range o.Items {
+		o.Total = o.Total.Add(it.amount())
+	}
+}
+
+// amount is the line's cost, quantity times unit cost.
+func (it Item) amount() decimal.Decimal {
+	return it.UnitCost.Mul(decimal.NewFromInt(int64(it.Quantity)))
+}
+
+// validateItems checks each line and fills in medicine names as descriptions.
+func validateItems(ctx context.Context, items []Item) string {
+	if len(items) == 0 {
+		return "At least one item is required"
+	}
+	db := database.GetDB()
+	for i := range items {
+		it := &items[i]
+		it.Description = strings.TrimSpace(it.Description)
+		switch it.ItemType {
+		case "medicine":
+			if it.MedicineID == nil || *it.MedicineID == "" {
+				return fmt.Sprintf("item %d: medicine_id is required for medicine lines", i+1)
+			}
+			var name string
+			if err := db.QueryRow(ctx, `SELECT name FROM pharmacy WHERE id=$1`, *it.MedicineID).Scan(&name); err != nil {
+				return fmt.Sprintf("item %d: medicine %s not found", i+1, *it.MedicineID)
+			}
+			if it.Description == "" {
+				it.Description = name
+			}
+		case "lab_consumable":
+			it.MedicineID = nil
+			if it.Description == "" {
+				return fmt.Sprintf("item %d: description is required for lab consumables", i+1)
+			}
+		default:
+			return fmt.Sprintf("item %d: item_type must be medicine or lab_consumable", i+1)
+		}
+		if it.Quantity <= 0 {
+			return fmt.Sprintf("item %d: quantity must be positive", i+1)
+		}
+		if it.UnitCost.IsNegative() {
+			return fmt.Sprintf("item %d: unit_cost cannot be negative", i+1)
+		}
+		it.UnitCost = it.UnitCost.Round(2)
+	}
+	return ""
+}
+
+func insertItems(ctx context.Context, tx pgx.Tx, orderID string, items []Item) error {
+	for i := range items {
+		items[i].ID = uuid.New().String()[:8]
+		items[i].PurchaseOrderID = orderID
+		items[i].ReceivedQuantity = 0
+		_, err := tx.Exec(ctx, `INSERT INTO purchase_order_items (id, purchase_order_id, item_type, medicine_id, description, quantity, unit_cost)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			items[i].ID, orderID, items[i].ItemType, items[i].MedicineID, items[i].Description, items[i].Quantity, items[i].UnitCost)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetPurchaseOrders(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	rows, err := db.Query(ctx, `SELECT `+orderColumns+` FROM purchase_orders o JOIN suppliers s ON s.id = o.supplier_id
+		WHERE ($1 = '' OR o.status=$1) AND ($2 = '' OR o.supplier_id=$2)
+		ORDER BY o.created_at DESC`, c.Query("status"), c.Query("supplier_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	orders := []PurchaseOrder{}
+	for rows.Next() {
+		var o PurchaseOrder
+		if err := rows.Scan(o.scanTargets()...); err != nil {
+			rows.Close()
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+
+	for i := range orders {
+		if orders[i].Items, err = fetchItems(ctx, db, orders[i].ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		orders[i].total()
+	}
+	return c.JSON(orders)
+}
+
+func GetPurchaseOrder(c *fiber.Ctx) error {
+	o, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Purchase order not found",
+		})
+	}
+	receipts, err := fetchReceipts(o.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"purchase_order": o,
+		"goods_received": receipts,
+	})
+}
+
+type orderRequest struct {
+	SupplierID   string  `json:"supplier_id"`
+	ExpectedDate *string `json:"expected_date"`
+	Notes        *string `json:"notes"`
+	Items        []Item  `json:"items"`
+}
+
+func (r *orderRequest) expectedDate() (*time.Time, error) {
+	if r.ExpectedDate == nil || *r.ExpectedDate == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", *r.ExpectedDate)
+	if err != nil {
+		return nil, fmt.Errorf("expected_date must be YYYY-MM-DD")
+	}
+	return &t, nil
+}
+
+// CreatePurchaseOrder starts a draft order. Lines can be changed until it is sent.
+func CreatePurchaseOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req orderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	supplier, err := fetchSupplier(req.SupplierID)
+	if err != nil || !supplier.Active {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "An active supplier is required",
+		})
+	}
+	expected, err := req.expectedDate()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if msg := validateItems(ctx, req.Items); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	now := time.Now()
+	o := PurchaseOrder{
+		ID:           uuid.New().String()[:8],
+		SupplierID:   supplier.ID,
+		SupplierName: supplier.Name,
+		Status:       "draft",
+		ExpectedDate: expected,
+		Notes:        req.Notes,
+		CreatedBy:    middleware.CurrentUserID(c),
+		Items:        req.Items,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `INSERT INTO purchase_orders (id, po_number, supplier_id, status, expected_date, notes, created_by, created_at, updated_at)
+		VALUES ($1, 'PO-' || LPAD(nextval('purchase_order_number_seq')::text, 6, '0'), $2, $3, $4, $5, $6, $7, $7)
+		RETURNING po_number`,
+		o.ID, o.SupplierID, o.Status, o.ExpectedDate, o.Notes, o.CreatedBy, now).Scan(&o.PONumber)
+	if err == nil {
+		err = insertItems(ctx, tx, o.ID, o.Items)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create purchase order",
+			"details": err.Error(),
+		})
+	}
+
+	o.total()
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Purchase order created successfully",
+		"purchase_order": o,
+	})
+}
+
+// UpdatePurchaseOrder edits a draft order, replacing its lines when items are given.
+func UpdatePurchaseOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req orderRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	o, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Purchase order not found",
+		})
+	}
+	if o.Status != "draft" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only draft purchase orders can be edited",
+		})
+	}
+
+	if req.SupplierID != "" {
+		supplier, err := fetchSupplier(req.SupplierID)
+		if err != nil || !supplier.Active {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "An active supplier is required",
+			})
+		}
+		o.SupplierID, o.SupplierName = supplier.ID, supplier.Name
+	}
+	if req.ExpectedDate != nil {
+		if o.ExpectedDate, err = req.expectedDate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	if req.Notes != nil {
+		o.Notes = req.Notes
+	}
+	if req.Items != nil {
+		if msg := validateItems(ctx, req.Items); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+	}
+	o.UpdatedAt = time.Now()
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE purchase_orders SET supplier_id=$1, expected_date=$2, notes=$3, updated_at=$4 WHERE id=$5 AND status='draft'`,
+		o.SupplierID, o.ExpectedDate, o.Notes, o.UpdatedAt, o.ID)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = fmt.Errorf("purchase order is no longer a draft")
+	}
+	if err == nil && req.Items != nil {
+		_, err = tx.Exec(ctx, `DELETE FROM purchase_order_items WHERE purchase_order_id=$1`, o.ID)
+		if err == nil {
+			err = insertItems(ctx, tx, o.ID, req.Items)
+		}
+		o.Items = req.Items
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update purchase order",
+			"details": err.Error(),
+		})
+	}
+
+	o.total()
+	return c.JSON(fiber.Map{
+		"message": "Purchase order updated successfully",
+		"purchase_order": o,
+	})
+}
+
+// SendPurchaseOrder marks a draft as sent to the supplier and records the
+// quoted costs in the supplier's price history.
+func SendPurchaseOrder(c *fiber.Ctx) error {
+	ctx := context.Background()
+	o, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Purchase order not found",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	tag, err := tx.Exec(ctx, `UPDATE purchase_orders SET status='sent', sent_at=$1, updated_at=$1 WHERE id=$2 AND status='draft'`, now, o.ID)
+	if err == nil && tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only draft purchase orders can be sent",
+		})
+	}
+	for _, it := range o.Items {
+		if err != nil {
+			break
+		}
+		err = recordPrice(ctx, tx, o.SupplierID, it, it.UnitCost, "purchase_order", o.PONumber, now)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send purchase order",
+			"details": err.Error(),
+		})
+	}
+
+	o.Status, o.SentAt, o.UpdatedAt = "sent", &now, now
+	return c.JSON(fiber.Map{
+		"message": "Purchase order sent successfully",
+		"purchase_order": o,
+	})
+}
+
+type cancelRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CancelPurchaseOrder cancels an order nothing has been received against yet.
+func CancelPurchaseOrder(c *fiber.Ctx) error {
+	var req cancelRequest
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A cancellation reason is required",
+		})
+	}
+
+	now := time.Now()
+	tag, err := database.GetDB().Exec(context.Background(), `UPDATE purchase_orders SET status='cancelled', cancelled_at=$1, cancel_reason=$2, updated_at=$1
+		WHERE id=$3 AND status IN ('draft', 'sent')`, now, strings.TrimSpace(req.Reason), c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel purchase order",
+			"details": err.Error(),
+		})
+	}
+	if tag.RowsAffected() == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Only draft or sent purchase orders with nothing received can be cancelled",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Purchase order cancelled successfully",
+	})
+}
+
+func recordPrice(ctx context.Context, tx pgx.Tx, supplierID string, it Item, unitCost decimal.Decimal, source, reference string, at time.Time) error {
+	_, err := tx.Exec(ctx, `INSERT INTO supplier_prices (id, supplier_id, item_type, medicine_id, description, unit_cost, source, reference, recorded_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		uuid.New().String()[:8], supplierID, it.ItemType, it.MedicineID, it.Description, unitCost, source, reference, at)
+	return err
+}
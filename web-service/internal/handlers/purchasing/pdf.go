@@ -0,0 +1,80 @@
+package purchasing
+
+import (
+	"fmt"
+	"strconv"
+
+	"web-service/internal/pdfdoc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/shopspring/decimal"
+)
+
+func money(v decimal.Decimal) string {
+	return v.StringFixed(2)
+}
+
+// GetPurchaseOrderPDF renders the order on the clinic letterhead for sending to the supplier.
+func GetPurchaseOrderPDF(c *fiber.Ctx) error {
+	o, err := Fetch(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Purchase order not found",
+		})
+	}
+	supplier, err := fetchSupplier(o.SupplierID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	deref := func(s *string) string {
+		if s == nil {
+			return "-"
+		}
+		return *s
+	}
+	expected := "-"
+	if o.ExpectedDate != nil {
+		expected = o.ExpectedDate.Format("02 Jan 2006")
+	}
+
+	doc := pdfdoc.New("Purchase Order " + o.PONumber)
+	doc.KeyValues([][2]string{
+		{"PO number", o.PONumber},
+		{"Date", o.CreatedAt.Format("02 Jan 2006")},
+		{"Supplier", supplier.Name},
+		{"Status", o.Status},
+		{"Contact", deref(supplier.ContactPerson)},
+		{"Expected", expected},
+		{"Phone", deref(supplier.PhoneNumber)},
+		{"Terms", deref(supplier.PaymentTerms)},
+	})
+
+	rows := make([][]string, 0, len(o.Items)+1)
+	for i, it := range o.Items {
+		rows = append(rows, []string{
+			strconv.Itoa(i + 1), it.Description, strconv.Itoa(it.Quantity), money(it.UnitCost), money(it.amount()),
+		})
+	}
+	rows = append(rows, []string{"", "Total", "", "", money(o.Total)})
+	doc.Table(
+		[]string{"#", "Item", "Qty", "Unit cost", "Amount"},
+		[]float64{10, 95, 20, 27, 28},
+		[]string{"C", "L", "R", "R", "R"},
+		rows,
+	)
+	if o.Notes != nil && *o.Notes != "" {
+		doc.Paragraph("Notes", *o.Notes)
+	}
+
+	body, err := doc.Bytes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, "application/pdf")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`inline; filename="%s.pdf"`, o.PONumber))
+	return c.Send(body)
+}
@@ -0,0 +1,256 @@
+package purchasing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/handlers/pharmacy"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// GoodsReceived is a goods-received note: one delivery against a purchase order.
+type GoodsReceived struct {
+	ID              string         `json:"id"`
+	GRNNumber       string         `json:"grn_number"`
+	PurchaseOrderID string         `json:"purchase_order_id"`
+	DeliveryNote    *string        `json:"delivery_note,omitempty"`
+	Notes           *string        `json:"notes,omitempty"`
+	ReceivedBy      string         `json:"received_by"`
+	ReceivedAt      time.Time      `json:"received_at"`
+	Items           []ReceivedItem `json:"items"`
+}
+
+type ReceivedItem struct {
+	ID          string           `json:"id"`
+	POItemID    string           `json:"po_item_id"`
+	Quantity    int              `json:"quantity"`
+	BatchNumber *string          `json:"batch_number,omitempty"`
+	ExpiryDate  *string          `json:"expiry_date,omitempty"`
+	UnitCost    *decimal.Decimal `json:"unit_cost,omitempty"`
+	BatchID     *string          `json:"batch_id,omitempty"`
+}
+
+func fetchReceipts(orderID string) ([]GoodsReceived, error) {
+	db := database.GetDB()
+	ctx := context.Background()
+	rows, err := db.Query(ctx, `SELECT id, grn_number, purchase_order_id, delivery_note, notes, received_by, received_at
+		FROM goods_received_notes WHERE purchase_order_id=$1 ORDER BY received_at`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	receipts := []GoodsReceived{}
+	for rows.Next() {
+		var g GoodsReceived
+		if err := rows.Scan(&g.ID, &g.GRNNumber, &g.PurchaseOrderID, &g.DeliveryNote, &g.Notes, &g.ReceivedBy, &g.ReceivedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		receipts = append(receipts, g)
+	}
+	rows.Close()
+
+	for i := range receipts {
+		rows, err := db.Query(ctx, `SELECT id, po_item_id, quantity, batch_number, TO_CHAR(expiry_date, 'YYYY-MM-DD'), unit_cost, batch_id
+			FROM goods_received_items WHERE grn_id=$1`, receipts[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		receipts[i].Items = []ReceivedItem{}
+		for rows.Next() {
+			var it ReceivedItem
+			if err := rows.Scan(&it.ID, &it.POItemID, &it.Quantity, &it.BatchNumber, &it.ExpiryDate, &it.UnitCost, &it.BatchID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			receipts[i].Items = append(receipts[i].Items, it)
+		}
+		rows.Close()
+	}
+	return receipts, nil
+}
+
+type receiveRequest struct {
+	DeliveryNote *string        `json:"delivery_note"`
+	Notes        *string        `json:"notes"`
+	Items        []ReceivedItem `json:"items"`
+}
+
+var errReceive = errors.New("cannot receive")
+
+// ReceiveGoods records a delivery against a sent purchase order. Medicine
+// lines are booked into pharmacy stock as batch receipts; every line updates
+// the supplier's price history with the cost actually charged.
+func ReceiveGoods(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req receiveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if len(req.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one received item is required",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the order so two deliveries cannot over-receive the same lines
+	var o PurchaseOrder
+	err = tx.QueryRow(ctx, `SELECT `+orderColumns+` FROM purchase_orders o JOIN suppliers s ON s.id = o.supplier_id
+		WHERE o.id=$1 FOR UPDATE OF o`, c.Params("id")).Scan(o.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Purchase order not found",
+		})
+	}
+	if o.Status != "sent" && o.Status != "partially_received" {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Goods can only be received against a sent purchase order",
+		})
+	}
+	if o.Items, err = fetchItems(ctx, tx, o.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	lines := map[string]*Item{}
+	for i := range o.Items {
+		lines[o.Items[i].ID] = &o.Items[i]
+	}
+
+	now := time.Now()
+	staffID := middleware.CurrentUserID(c)
+	g := GoodsReceived{
+		ID:              uuid.New().String()[:8],
+		PurchaseOrderID: o.ID,
+		DeliveryNote:    req.DeliveryNote,
+		Notes:           req.Notes,
+		ReceivedBy:      staffID,
+		ReceivedAt:      now,
+		Items:           req.Items,
+	}
+	err = tx.QueryRow(ctx, `INSERT INTO goods_received_notes (id, grn_number, purchase_order_id, delivery_note, notes, received_by, received_at)
+		VALUES ($1, 'GRN-' || LPAD(nextval('goods_received_number_seq')::text, 6, '0'), $2, $3, $4, $5, $6)
+		RETURNING grn_number`, g.ID, g.PurchaseOrderID, g.DeliveryNote, g.Notes, g.ReceivedBy, g.ReceivedAt).Scan(&g.GRNNumber)
+
+	for i := range g.Items {
+		if err != nil {
+			break
+		}
+		it := &g.Items[i]
+		line, ok := lines[it.POItemID]
+		switch {
+		case !ok:
+			err = fmt.Errorf("%w: item %s is not on this purchase order", errReceive, it.POItemID)
+		case it.Quantity <= 0:
+			err = fmt.Errorf("%w: quantity must be positive for %s", errReceive, line.Description)
+		case it.Quantity > line.Quantity-line.ReceivedQuantity:
+			err = fmt.Errorf("%w: only %d of %s still outstanding", errReceive, line.Quantity-line.ReceivedQuantity, line.Description)
+		}
+		if err != nil {
+			break
+		}
+		if it.UnitCost == nil {
+			it.UnitCost = &line.UnitCost
+		}
+		if it.UnitCost.IsNegative() {
+			err = fmt.Errorf("%w: unit_cost cannot be negative for %s", errReceive, line.Description)
+			break
+		}
+		cost := it.UnitCost.Round(2)
+		it.UnitCost = &cost
+		line.ReceivedQuantity += it.Quantity
+
+		if line.ItemType == "medicine" {
+			movement := pharmacy.Movement{
+				MedicineID:   *line.MedicineID,
+				MovementType: "receipt",
+				Quantity:     it.Quantity,
+				ReasonCode:   "purchase",
+				Reference:    &g.GRNNumber,
+				StaffID:      &staffID,
+				ExpiryDate:   it.ExpiryDate,
+				Supplier:     &o.SupplierName,
+				UnitCost:     it.UnitCost,
+			}
+			if it.BatchNumber != nil {
+				movement.BatchNumber = *it.BatchNumber
+			}
+			var written []pharmacy.Movement
+			written, err = pharmacy.RecordMovement(ctx, tx, movement)
+			if errors.Is(err, pharmacy.ErrInvalidMovement) {
+				err = fmt.Errorf("%w: %s: %v", errReceive, line.Description, err)
+			}
+			if errors.Is(err, pharmacy.ErrBatchMismatch) {
+				err = fmt.Errorf("%s: %w", line.Description, err)
+			}
+			if err != nil {
+				break
+			}
+			it.BatchID = &written[0].BatchID
+		}
+
+		it.ID = uuid.New().String()[:8]
+		_, err = tx.Exec(ctx, `INSERT INTO goods_received_items (id, grn_id, po_item_id, quantity, batch_number, expiry_date, unit_cost, batch_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			it.ID, g.ID, it.POItemID, it.Quantity, it.BatchNumber, it.ExpiryDate, *it.UnitCost, it.BatchID)
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE purchase_order_items SET received_quantity=$1 WHERE id=$2`, line.ReceivedQuantity, line.ID)
+		}
+		if err == nil {
+			err = recordPrice(ctx, tx, o.SupplierID, *line, *it.UnitCost, "goods_received", g.GRNNumber, now)
+		}
+	}
+
+	if err == nil {
+		o.Status = "received"
+		for _, line := range o.Items {
+			if line.ReceivedQuantity < line.Quantity {
+				o.Status = "partially_received"
+			}
+		}
+		_, err = tx.Exec(ctx, `UPDATE purchase_orders SET status=$1, updated_at=$2 WHERE id=$3`, o.Status, now, o.ID)
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if errors.Is(err, errReceive) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, pharmacy.ErrBatchMismatch) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to record goods received",
+			"details": err.Error(),
+		})
+	}
+
+	o.UpdatedAt = now
+	o.total()
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Goods received successfully",
+		"goods_received": g,
+		"purchase_order": o,
+	})
+}
@@ -0,0 +1,216 @@
+package purchasing
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type Supplier struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	ContactPerson *string   `json:"contact_person,omitempty"`
+	PhoneNumber   *string   `json:"phone_number,omitempty"`
+	Email         *string   `json:"email,omitempty"`
+	Address       *string   `json:"address,omitempty"`
+	PaymentTerms  *string   `json:"payment_terms,omitempty"`
+	Active        bool      `json:"active"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+const supplierColumns = `id, name, contact_person, phone_number, email, address, payment_terms, active, created_at, updated_at`
+
+func (s *Supplier) scanTargets() []any {
+	return []any{&s.ID, &s.Name, &s.ContactPerson, &s.PhoneNumber, &s.Email, &s.Address, &s.PaymentTerms, &s.Active, &s.CreatedAt, &s.UpdatedAt}
+}
+
+func fetchSupplier(id string) (*Supplier, error) {
+	var s Supplier
+	err := database.GetDB().QueryRow(context.Background(), `SELECT `+supplierColumns+` FROM suppliers WHERE id=$1`, id).Scan(s.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func GetSuppliers(c *fiber.Ctx) error {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT `+supplierColumns+` FROM suppliers WHERE active OR $1 ORDER BY name`, c.QueryBool("include_inactive"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	suppliers := []Supplier{}
+	for rows.Next() {
+		var s Supplier
+		if err := rows.Scan(s.scanTargets()...); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		suppliers = append(suppliers, s)
+	}
+	return c.JSON(suppliers)
+}
+
+func GetSupplier(c *fiber.Ctx) error {
+	s, err := fetchSupplier(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Supplier not found",
+		})
+	}
+	return c.JSON(s)
+}
+
+func CreateSupplier(c *fiber.Ctx) error {
+	var s Supplier
+	if err := c.BodyParser(&s); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "name is required",
+		})
+	}
+
+	now := time.Now()
+	s.ID = uuid.New().String()[:8]
+	s.Active = true
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	_, err := database.GetDB().Exec(context.Background(), `INSERT INTO suppliers (`+supplierColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		s.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to create supplier",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Supplier created successfully",
+		"supplier": s,
+	})
+}
+
+type supplierUpdate struct {
+	Name          *string `json:"name"`
+	ContactPerson *string `json:"contact_person"`
+	PhoneNumber   *string `json:"phone_number"`
+	Email         *string `json:"email"`
+	Address       *string `json:"address"`
+	PaymentTerms  *string `json:"payment_terms"`
+	Active        *bool   `json:"active"`
+}
+
+func UpdateSupplier(c *fiber.Ctx) error {
+	var req supplierUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	s, err := fetchSupplier(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Supplier not found",
+		})
+	}
+
+	if req.Name != nil {
+		s.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.ContactPerson != nil {
+		s.ContactPerson = req.ContactPerson
+	}
+	if req.PhoneNumber != nil {
+		s.PhoneNumber = req.PhoneNumber
+	}
+	if req.Email != nil {
+		s.Email = req.Email
+	}
+	if req.Address != nil {
+		s.Address = req.Address
+	}
+	if req.PaymentTerms != nil {
+		s.PaymentTerms = req.PaymentTerms
+	}
+	if req.Active != nil {
+		s.Active = *req.Active
+	}
+	if s.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "name is required",
+		})
+	}
+	s.UpdatedAt = time.Now()
+
+	_, err = database.GetDB().Exec(context.Background(), `UPDATE suppliers SET name=$1, contact_person=$2, phone_number=$3, email=$4,
+		address=$5, payment_terms=$6, active=$7, updated_at=$8 WHERE id=$9`,
+		s.Name, s.ContactPerson, s.PhoneNumber, s.Email, s.Address, s.PaymentTerms, s.Active, s.UpdatedAt, s.ID)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to update supplier",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Supplier updated successfully",
+		"supplier": s,
+	})
+}
+
+type PriceEntry struct {
+	ID          string          `json:"id"`
+	SupplierID  string          `json:"supplier_id"`
+	ItemType    string          `json:"item_type"`
+	MedicineID  *string         `json:"medicine_id,omitempty"`
+	Description string          `json:"description"`
+	UnitCost    decimal.Decimal `json:"unit_cost"`
+	Source      string          `json:"source"`
+	Reference   string          `json:"reference"`
+	RecordedAt  time.Time       `json:"recorded_at"`
+}
+
+// GetSupplierPrices returns the supplier's cost history, newest first,
+// optionally for one medicine.
+func GetSupplierPrices(c *fiber.Ctx) error {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT id, supplier_id, item_type, medicine_id, description, unit_cost, source, reference, recorded_at
+		FROM supplier_prices WHERE supplier_id=$1 AND ($2 = '' OR medicine_id=$2)
+		ORDER BY recorded_at DESC`, c.Params("id"), c.Query("medicine_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	prices := []PriceEntry{}
+	for rows.Next() {
+		var p PriceEntry
+		if err := rows.Scan(&p.ID, &p.SupplierID, &p.ItemType, &p.MedicineID, &p.Description, &p.UnitCost, &p.Source, &p.Reference, &p.RecordedAt); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		prices = append(prices, p)
+	}
+	return c.JSON(prices)
+}
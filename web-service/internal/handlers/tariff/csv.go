@@ -0,0 +1,201 @@
+package tariff
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+// csvHeader is the layout of exported price lists, which import reads back.
+var csvHeader = []string{"item_type", "item_id", "item_code", "description", "price", "tax_rate", "effective_from"}
+
+// ExportPriceList downloads a list's prices in effect now and those
+// scheduled for later dates as CSV.
+func ExportPriceList(c *fiber.Ctx) error {
+	ctx := context.Background()
+	l, err := fetchPriceList(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Price list not found",
+		})
+	}
+	rows, err := database.GetDB().Query(ctx, versions+` ORDER BY t.item_type, c.name, t.effective_from`,
+		l.ID, c.Query("item_type"), time.Now(), true)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	prices, err := pgx.CollectRows(rows, scanPrice)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvHeader)
+	for _, p := range prices {
+		w.Write([]string{p.ItemType, p.ItemID, p.Code, p.Description, p.UnitPrice.StringFixed(2), p.TaxRate.StringFixed(2),
+			p.EffectiveFrom.Format("2006-01-02")})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s-prices.csv"`, strings.ToLower(l.Code)))
+	return c.Send(buf.Bytes())
+}
+
+// Import loads prices into a list from CSV in the export layout. Items are
+// matched by item_id, or by item_code when the id is blank; description is
+// ignored. An effective_from that is blank or already past means now.
+// Prices the same as those already in effect are skipped. Nothing is saved
+// if any line is wrong.
+func Import(ctx context.Context, db *pgxpool.Pool, listID string, r io.Reader, staffID string) (imported, unchanged int, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(csvHeader)
+
+	header, err := reader.Read()
+	if err != nil {
+		return 0, 0, fmt.Errorf("reading header: %w", err)
+	}
+	for i, name := range csvHeader {
+		if strings.ToLower(strings.TrimSpace(header[i])) != name {
+			return 0, 0, fmt.Errorf("unexpected header %v, expected %s", header, strings.Join(csvHeader, ","))
+		}
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		ref := strings.TrimSpace(record[1])
+		if ref == "" {
+			ref = strings.TrimSpace(record[2])
+		}
+		it, err := FindItem(ctx, tx, strings.TrimSpace(record[0]), ref)
+		if err != nil {
+			return 0, 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		price, err := decimal.NewFromString(strings.TrimSpace(record[4]))
+		if err != nil || price.IsNegative() {
+			return 0, 0, fmt.Errorf("line %d: invalid price %q", line, record[4])
+		}
+		taxRate := decimal.Zero
+		if s := strings.TrimSpace(record[5]); s != "" {
+			taxRate, err = decimal.NewFromString(s)
+			if err != nil || taxRate.IsNegative() {
+				return 0, 0, fmt.Errorf("line %d: invalid tax_rate %q", line, record[5])
+			}
+		}
+		effective := now
+		if s := strings.TrimSpace(record[6]); s != "" {
+			t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+			if err != nil {
+				return 0, 0, fmt.Errorf("line %d: effective_from must be YYYY-MM-DD", line)
+			}
+			if t.After(now) {
+				effective = t
+			}
+		}
+
+		var same bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM (SELECT price, tax_rate FROM tariff_prices
+				WHERE price_list_id = $1 AND item_type = $2 AND item_id = $3 AND effective_from <= $4
+				ORDER BY effective_from DESC LIMIT 1) p WHERE p.price = $5 AND p.tax_rate = $6)`,
+			listID, it.Type, it.ID, effective, price.Round(2), taxRate.Round(2)).Scan(&same)
+		if err != nil {
+			return 0, 0, err
+		}
+		if same {
+			unchanged++
+			continue
+		}
+		if err := Record(ctx, tx, listID, it.Type, it.ID, price, taxRate, effective, staffID); err != nil {
+			return 0, 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		imported++
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, err
+	}
+	return imported, unchanged, nil
+}
+
+// ImportPriceList loads prices into a list from a CSV file, sent as the
+// "file" field of a form or as the request body.
+func ImportPriceList(c *fiber.Ctx) error {
+	ctx := context.Background()
+	l, err := fetchPriceList(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Price list not found",
+		})
+	}
+
+	var r io.Reader = bytes.NewReader(c.Body())
+	if fh, err := c.FormFile("file"); err == nil {
+		f, err := fh.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		defer f.Close()
+		r = f
+	}
+
+	imported, unchanged, err := Import(ctx, database.GetDB(), l.ID, r, middleware.CurrentUserID(c))
+	// Database errors are ours; anything else is a fault in the file
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to import price list",
+			"details": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Failed to import price list",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Price list imported successfully",
+		"imported": imported,
+		"unchanged": unchanged,
+	})
+}
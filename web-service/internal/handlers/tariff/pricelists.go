@@ -0,0 +1,407 @@
+package tariff
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"web-service/internal/paging"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// PriceList is a set of prices agreed with a payer, or the cash list.
+type PriceList struct {
+	ID        string    `json:"id"`
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	Kind      string    `json:"kind"`
+	PayerID   *string   `json:"payer_id,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const priceListColumns = `id, code, name, kind, payer_id, active, created_at, updated_at`
+
+func (l *PriceList) scanTargets() []any {
+	return []any{&l.ID, &l.Code, &l.Name, &l.Kind, &l.PayerID, &l.Active, &l.CreatedAt, &l.UpdatedAt}
+}
+
+func (l *PriceList) validate() string {
+	l.Code = strings.ToUpper(strings.TrimSpace(l.Code))
+	l.Name = strings.TrimSpace(l.Name)
+	switch {
+	case l.Code == "" || l.Name == "":
+		return "code and name are required"
+	case l.ID == CashList:
+		if !l.Active {
+			return "The cash list cannot be deactivated"
+		}
+	case l.Kind != "corporate" && l.Kind != "insurer":
+		return "kind must be corporate or insurer"
+	case l.PayerID == nil || *l.PayerID == "":
+		return "payer_id is required"
+	}
+	return ""
+}
+
+func fetchPriceList(ctx context.Context, id string) (*PriceList, error) {
+	var l PriceList
+	err := database.GetDB().QueryRow(ctx, `SELECT `+priceListColumns+` FROM price_lists WHERE id = $1`, id).Scan(l.scanTargets()...)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// versions are the prices on a list at a time, joined to the catalogue for
+// their names: the version in effect for each item, and with $4 those
+// scheduled after it too.
+const versions = `SELECT t.price_list_id, t.item_type, t.item_id, c.code, c.name, t.price, t.tax_rate, t.effective_from
+	FROM tariff_prices t JOIN ` + catalogue + ` c ON c.item_type = t.item_type AND c.item_id = t.item_id
+	WHERE t.price_list_id = $1 AND ($2 = '' OR t.item_type = $2) AND (t.effective_from <= $3 OR $4)
+		AND t.effective_from >= COALESCE((SELECT MAX(v.effective_from) FROM tariff_prices v WHERE v.price_list_id = t.price_list_id
+			AND v.item_type = t.item_type AND v.item_id = t.item_id AND v.effective_from <= $3), '-infinity')`
+
+func scanPrice(row pgx.CollectableRow) (Price, error) {
+	var p Price
+	err := row.Scan(&p.PriceListID, &p.ItemType, &p.ItemID, &p.Code, &p.Description, &p.UnitPrice, &p.TaxRate, &p.EffectiveFrom)
+	return p, err
+}
+
+// parseDate reads the YYYY-MM-DD date prices are wanted for, taking the
+// prices in effect by the end of that day. No date means now.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, errors.New("date must be YYYY-MM-DD")
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Microsecond), nil
+}
+
+func GetPriceLists(c *fiber.Ctx) error {
+	rows, err := database.GetDB().Query(context.Background(), `SELECT `+priceListColumns+` FROM price_lists
+		WHERE active OR $1 ORDER BY kind = 'cash' DESC, name`, c.QueryBool("include_inactive"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	lists, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PriceList, error) {
+		var l PriceList
+		err := row.Scan(l.scanTargets()...)
+		return l, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(lists)
+}
+
+// CreatePriceList starts a payer's price list. It prices nothing until
+// prices are added or imported; until then its items are charged at cash
+// prices.
+func CreatePriceList(c *fiber.Ctx) error {
+	var l PriceList
+	if err := c.BodyParser(&l); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	l.ID = ""
+	if msg := l.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	now := time.Now()
+	l.ID = uuid.New().String()[:8]
+	l.Active = true
+	l.CreatedAt = now
+	l.UpdatedAt = now
+	_, err := database.GetDB().Exec(context.Background(), `INSERT INTO price_lists (`+priceListColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		l.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to create price list",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Price list created successfully",
+		"price_list": l,
+	})
+}
+
+type priceListUpdate struct {
+	Code   *string `json:"code"`
+	Name   *string `json:"name"`
+	Active *bool   `json:"active"`
+}
+
+// UpdatePriceList renames a price list or takes it out of use. The payer
+// of an inactive list is charged cash prices.
+func UpdatePriceList(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req priceListUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	l, err := fetchPriceList(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Price list not found",
+		})
+	}
+
+	if req.Code != nil {
+		l.Code = *req.Code
+	}
+	if req.Name != nil {
+		l.Name = *req.Name
+	}
+	if req.Active != nil {
+		l.Active = *req.Active
+	}
+	if msg := l.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	l.UpdatedAt = time.Now()
+
+	_, err = database.GetDB().Exec(ctx, `UPDATE price_lists SET code = $1, name = $2, active = $3, updated_at = $4 WHERE id = $5`,
+		l.Code, l.Name, l.Active, l.UpdatedAt, l.ID)
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to update price list",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Price list updated successfully",
+		"price_list": l,
+	})
+}
+
+// GetListPrices lists the prices on a list in effect on ?date=, today by
+// default. Items the list does not price are charged at cash prices.
+func GetListPrices(c *fiber.Ctx) error {
+	db := database.GetDB()
+	ctx := context.Background()
+	page, limit := paging.Parse(c.Query("page"), c.Query("limit"))
+	at, err := parseDate(c.Query("date"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if _, err := fetchPriceList(ctx, c.Params("id")); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Price list not found",
+		})
+	}
+
+	args := []any{c.Params("id"), c.Query("item_type"), at, false}
+	var total int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM (`+versions+`) v`, args...).Scan(&total); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rows, err := db.Query(ctx, versions+` ORDER BY t.item_type, c.name LIMIT $5 OFFSET $6`, append(args, limit, paging.Offset(page, limit))...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	prices, err := pgx.CollectRows(rows, scanPrice)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"items": prices,
+		"page":  page,
+		"limit": limit,
+		"total": total,
+	})
+}
+
+type priceRequest struct {
+	ItemType      string           `json:"item_type"`
+	ItemID        string           `json:"item_id"`
+	Price         decimal.Decimal  `json:"price"`
+	TaxRate       *decimal.Decimal `json:"tax_rate"`
+	EffectiveFrom string           `json:"effective_from"`
+}
+
+// SetPrice adds a version of an item's price to a list, effective now or
+// from a later date. Without a tax rate the item's current one is kept.
+func SetPrice(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req priceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if req.Price.IsNegative() || (req.TaxRate != nil && req.TaxRate.IsNegative()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "price and tax_rate cannot be negative",
+		})
+	}
+	effective, err := parseEffective(req.EffectiveFrom)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	l, err := fetchPriceList(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Price list not found",
+		})
+	}
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	it, err := FindItem(ctx, tx, req.ItemType, strings.TrimSpace(req.ItemID))
+	if errors.Is(err, ErrInvalidItem) || errors.Is(err, ErrUnknownItem) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	taxRate := decimal.Zero
+	if err == nil && req.TaxRate != nil {
+		taxRate = *req.TaxRate
+	} else if err == nil {
+		err = tx.QueryRow(ctx, `SELECT COALESCE((SELECT tax_rate FROM tariff_prices WHERE price_list_id IN ($1, $2) AND item_type = $3
+			AND item_id = $4 AND effective_from <= $5 ORDER BY price_list_id = $1 DESC, effective_from DESC LIMIT 1), 0)`,
+			l.ID, CashList, it.Type, it.ID, effective).Scan(&taxRate)
+	}
+	if err == nil {
+		err = Record(ctx, tx, l.ID, it.Type, it.ID, req.Price, taxRate, effective, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to set price",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Price set successfully",
+		"price": Price{PriceListID: l.ID, ItemType: it.Type, ItemID: it.ID, Code: it.Code, Description: it.Name,
+			UnitPrice: req.Price.Round(2), TaxRate: taxRate.Round(2), EffectiveFrom: effective},
+	})
+}
+
+// GetItemPrices lists every version of an item's price on every list,
+// newest first.
+func GetItemPrices(c *fiber.Ctx) error {
+	ctx := context.Background()
+	db := database.GetDB()
+	it, err := FindItem(ctx, db, c.Query("item_type"), c.Query("item_id"))
+	if errors.Is(err, ErrInvalidItem) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, ErrUnknownItem) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	rows, err := db.Query(ctx, `SELECT price_list_id, item_type, item_id, $3::text, $4::text, price, tax_rate, effective_from FROM tariff_prices
+		WHERE item_type = $1 AND item_id = $2 ORDER BY price_list_id = $5 DESC, price_list_id, effective_from DESC`,
+		it.Type, it.ID, it.Code, it.Name, CashList)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	prices, err := pgx.CollectRows(rows, scanPrice)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(prices)
+}
+
+// LookupPrice returns what an item is charged on ?date=, today by default,
+// from ?price_list_id= or the list of ?payer_id=, falling back to the cash
+// list. Invoicing prices lines the same way.
+func LookupPrice(c *fiber.Ctx) error {
+	ctx := context.Background()
+	db := database.GetDB()
+	at, err := parseDate(c.Query("date"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	listID := c.Query("price_list_id")
+	if payerID := c.Query("payer_id"); listID == "" && payerID != "" {
+		if listID, err = ListForPayer(ctx, db, payerID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	p, err := Lookup(ctx, db, listID, c.Query("item_type"), c.Query("item_id"), at)
+	if errors.Is(err, ErrInvalidItem) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if errors.Is(err, ErrUnknownItem) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(p)
+}
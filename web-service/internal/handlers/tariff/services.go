@@ -0,0 +1,209 @@
+package tariff
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// ServiceItem is a consultation or procedure the clinic charges for. Price
+// and TaxRate are its current cash price.
+type ServiceItem struct {
+	ID        string          `json:"id"`
+	Code      string          `json:"code"`
+	Name      string          `json:"name"`
+	ItemType  string          `json:"item_type"`
+	Price     decimal.Decimal `json:"price"`
+	TaxRate   decimal.Decimal `json:"tax_rate"`
+	Active    bool            `json:"active"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+const serviceItemColumns = `id, code, name, item_type, price, tax_rate, active, created_at, updated_at`
+
+func (s *ServiceItem) scanTargets() []any {
+	return []any{&s.ID, &s.Code, &s.Name, &s.ItemType, &s.Price, &s.TaxRate, &s.Active, &s.CreatedAt, &s.UpdatedAt}
+}
+
+func (s *ServiceItem) validate() string {
+	s.Code = strings.ToUpper(strings.TrimSpace(s.Code))
+	s.Name = strings.TrimSpace(s.Name)
+	switch {
+	case s.Code == "" || s.Name == "":
+		return "code and name are required"
+	case s.ItemType != "consultation" && s.ItemType != "procedure":
+		return "item_type must be consultation or procedure"
+	case s.Price.IsNegative() || s.TaxRate.IsNegative():
+		return "price and tax_rate cannot be negative"
+	}
+	s.Price = s.Price.Round(2)
+	s.TaxRate = s.TaxRate.Round(2)
+	return ""
+}
+
+func GetServiceItems(c *fiber.Ctx) error {
+	rows, err := database.GetDB().Query(context.Background(), `SELECT `+serviceItemColumns+` FROM service_items
+		WHERE (active OR $1) AND ($2 = '' OR item_type = $2) ORDER BY item_type, name`,
+		c.QueryBool("include_inactive"), c.Query("item_type"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ServiceItem, error) {
+		var s ServiceItem
+		err := row.Scan(s.scanTargets()...)
+		return s, err
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(items)
+}
+
+func CreateServiceItem(c *fiber.Ctx) error {
+	var s ServiceItem
+	if err := c.BodyParser(&s); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	if msg := s.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	ctx := context.Background()
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	s.ID = uuid.New().String()[:8]
+	s.Active = true
+	s.CreatedAt = now
+	s.UpdatedAt = now
+	_, err = tx.Exec(ctx, `INSERT INTO service_items (`+serviceItemColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		s.scanTargets()...)
+	if err == nil {
+		err = Record(ctx, tx, CashList, s.ItemType, s.ID, s.Price, s.TaxRate, now, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to create service item",
+			"details": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "Service item created successfully",
+		"service_item": s,
+	})
+}
+
+type serviceItemUpdate struct {
+	Code     *string          `json:"code"`
+	Name     *string          `json:"name"`
+	ItemType *string          `json:"item_type"`
+	Price    *decimal.Decimal `json:"price"`
+	TaxRate  *decimal.Decimal `json:"tax_rate"`
+	Active   *bool            `json:"active"`
+}
+
+// UpdateServiceItem changes a service item. A new price or tax rate is added
+// to the cash list effective now, so it applies to lines added from then on;
+// lines already on invoices keep the price they were billed at. Later or
+// other lists' prices are set through the price lists.
+func UpdateServiceItem(c *fiber.Ctx) error {
+	ctx := context.Background()
+	var req serviceItemUpdate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+	var s ServiceItem
+	err := database.GetDB().QueryRow(ctx, `SELECT `+serviceItemColumns+` FROM service_items WHERE id = $1`, c.Params("id")).Scan(s.scanTargets()...)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Service item not found",
+		})
+	}
+
+	if req.Code != nil {
+		s.Code = *req.Code
+	}
+	if req.Name != nil {
+		s.Name = *req.Name
+	}
+	oldType := s.ItemType
+	if req.ItemType != nil {
+		s.ItemType = *req.ItemType
+	}
+	if req.Price != nil {
+		s.Price = *req.Price
+	}
+	if req.TaxRate != nil {
+		s.TaxRate = *req.TaxRate
+	}
+	if req.Active != nil {
+		s.Active = *req.Active
+	}
+	if msg := s.validate(); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	s.UpdatedAt = time.Now()
+
+	tx, err := database.GetDB().Begin(ctx)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE service_items SET code = $1, name = $2, item_type = $3, active = $4, updated_at = $5 WHERE id = $6`,
+		s.Code, s.Name, s.ItemType, s.Active, s.UpdatedAt, s.ID)
+	if err == nil && s.ItemType != oldType {
+		_, err = tx.Exec(ctx, `UPDATE tariff_prices SET item_type = $1 WHERE item_type = $2 AND item_id = $3`, s.ItemType, oldType, s.ID)
+	}
+	if err == nil && (req.Price != nil || req.TaxRate != nil) {
+		err = Record(ctx, tx, CashList, s.ItemType, s.ID, s.Price, s.TaxRate, s.UpdatedAt, middleware.CurrentUserID(c))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Failed to update service item",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Service item updated successfully",
+		"service_item": s,
+	})
+}
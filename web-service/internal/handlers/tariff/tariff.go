@@ -0,0 +1,172 @@
+// Package tariff keeps what the clinic charges: the service items for
+// consultations and procedures, and price lists that price them, lab tests
+// and medicines. Each price is versioned by the date it takes effect.
+package tariff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// CashList is the price list everyone is charged from unless a payer has
+// agreed other prices. Items another list does not price fall back to it.
+const CashList = "cash"
+
+// querier is satisfied by both the pool and a transaction.
+type querier interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+var (
+	// ErrInvalidItem is returned for an item type the tariff does not know.
+	ErrInvalidItem = errors.New("item_type must be consultation, lab, medicine or procedure")
+	// ErrUnknownItem is returned when an item is not in the catalogue or has no price.
+	ErrUnknownItem = errors.New("item not found in tariff")
+)
+
+var itemTypes = map[string]bool{"consultation": true, "lab": true, "medicine": true, "procedure": true}
+
+// catalogue names every item that can be priced, by type and id.
+const catalogue = `(SELECT 'lab' AS item_type, id AS item_id, COALESCE(code, '') AS code, test_name AS name, active FROM laboratory
+	UNION ALL SELECT 'medicine', id, '', name, active FROM pharmacy
+	UNION ALL SELECT item_type, id, code, name, active FROM service_items)`
+
+// Item is an entry in the catalogue.
+type Item struct {
+	Type   string
+	ID     string
+	Code   string
+	Name   string
+	Active bool
+}
+
+// FindItem looks up a catalogue item by id, or for lab tests and service
+// items by code.
+func FindItem(ctx context.Context, q querier, itemType, ref string) (*Item, error) {
+	if !itemTypes[itemType] {
+		return nil, ErrInvalidItem
+	}
+	it := Item{Type: itemType}
+	err := q.QueryRow(ctx, `SELECT item_id, code, name, active FROM `+catalogue+` c
+		WHERE item_type = $1 AND (item_id = $2 OR (code <> '' AND code = $2)) ORDER BY item_id = $2 DESC LIMIT 1`, itemType, ref).
+		Scan(&it.ID, &it.Code, &it.Name, &it.Active)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s %s", ErrUnknownItem, itemType, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// CashPriceNow is a subquery for the cash price in effect now of the item
+// of the given type whose id is in column, so catalogues list a price
+// scheduled for a later date only once it applies.
+func CashPriceNow(itemType, column string) string {
+	return `(SELECT t.price FROM tariff_prices t WHERE t.price_list_id = '` + CashList + `' AND t.item_type = '` + itemType + `'
+		AND t.item_id = ` + column + ` AND t.effective_from <= CURRENT_TIMESTAMP ORDER BY t.effective_from DESC LIMIT 1)`
+}
+
+// Price is what a price list charges for one unit of an item.
+type Price struct {
+	PriceListID   string          `json:"price_list_id"`
+	ItemType      string          `json:"item_type"`
+	ItemID        string          `json:"item_id"`
+	Code          string          `json:"code,omitempty"`
+	Description   string          `json:"description"`
+	UnitPrice     decimal.Decimal `json:"unit_price"`
+	TaxRate       decimal.Decimal `json:"tax_rate"`
+	EffectiveFrom time.Time       `json:"effective_from"`
+}
+
+// Lookup returns the price of an active catalogue item in effect at the
+// given time on a price list, or on the cash list if the list does not
+// price it.
+func Lookup(ctx context.Context, q querier, listID, itemType, ref string, at time.Time) (*Price, error) {
+	it, err := FindItem(ctx, q, itemType, ref)
+	if err != nil {
+		return nil, err
+	}
+	if !it.Active {
+		return nil, fmt.Errorf("%w: %s %s is inactive", ErrUnknownItem, itemType, ref)
+	}
+	if listID == "" {
+		listID = CashList
+	}
+	p := Price{ItemType: itemType, ItemID: it.ID, Code: it.Code, Description: it.Name}
+	err = q.QueryRow(ctx, `SELECT price_list_id, price, tax_rate, effective_from FROM tariff_prices
+		WHERE price_list_id IN ($1, $2) AND item_type = $3 AND item_id = $4 AND effective_from <= $5
+		ORDER BY price_list_id = $1 DESC, effective_from DESC LIMIT 1`, listID, CashList, itemType, it.ID, at).
+		Scan(&p.PriceListID, &p.UnitPrice, &p.TaxRate, &p.EffectiveFrom)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s %s has no price", ErrUnknownItem, itemType, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ListForPayer is the price list a payer's patients are charged from: its
+// own active list, or the cash list.
+func ListForPayer(ctx context.Context, q querier, payerID string) (string, error) {
+	var id string
+	err := q.QueryRow(ctx, `SELECT COALESCE((SELECT id FROM price_lists WHERE payer_id = $1 AND active), $2)`, payerID, CashList).Scan(&id)
+	return id, err
+}
+
+// Record adds a version of an item's price to a list. A version already
+// recorded for the same moment is replaced. Cash prices in effect now are
+// copied to the catalogue tables for older readers.
+func Record(ctx context.Context, tx pgx.Tx, listID, itemType, itemID string, price, taxRate decimal.Decimal, effective time.Time, staffID string) error {
+	var createdBy *string
+	if staffID != "" {
+		createdBy = &staffID
+	}
+	price, taxRate = price.Round(2), taxRate.Round(2)
+	_, err := tx.Exec(ctx, `INSERT INTO tariff_prices (id, price_list_id, item_type, item_id, price, tax_rate, effective_from, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (price_list_id, item_type, item_id, effective_from) DO UPDATE SET price = EXCLUDED.price, tax_rate = EXCLUDED.tax_rate,
+			created_by = EXCLUDED.created_by, created_at = EXCLUDED.created_at`,
+		uuid.New().String()[:8], listID, itemType, itemID, price, taxRate, effective, createdBy, time.Now())
+	if err != nil || listID != CashList || effective.After(time.Now()) {
+		return err
+	}
+	switch itemType {
+	case "lab":
+		_, err = tx.Exec(ctx, `UPDATE laboratory SET price = $1 WHERE id = $2`, price, itemID)
+	case "medicine":
+		_, err = tx.Exec(ctx, `UPDATE pharmacy SET price = $1 WHERE id = $2`, price, itemID)
+	default:
+		_, err = tx.Exec(ctx, `UPDATE service_items SET price = $1, tax_rate = $2 WHERE id = $3`, price, taxRate, itemID)
+	}
+	return err
+}
+
+// parseEffective reads a YYYY-MM-DD effective date. Prices cannot be
+// backdated; an empty date or today means now.
+func parseEffective(s string) (time.Time, error) {
+	now := time.Now()
+	if s == "" {
+		return now, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return now, errors.New("effective_from must be YYYY-MM-DD")
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if t.Before(today) {
+		return now, errors.New("prices cannot be backdated")
+	}
+	if t.After(now) {
+		return t, nil
+	}
+	return now, nil
+}
@@ -0,0 +1,201 @@
+package vitals
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+type Flag struct {
+	Field   string  `json:"field"`
+	Value   float64 `json:"value"`
+	Level   string  `json:"level"`
+	Message string  `json:"message"`
+}
+
+type band struct {
+	Min float64
+	Max float64
+}
+
+// Plausible limits, anything outside these is almost certainly a typo or a wrong unit
+var plausible = map[string]band{
+	"systolic":    {50, 300},
+	"diastolic":   {20, 200},
+	"temperature": {25, 45},
+	"pulse":       {20, 300},
+	"spo2":        {50, 100},
+	"weight":      {0.3, 400},
+	"height":      {20, 250},
+}
+
+// Reference ranges per age group, a value outside its band is flagged as abnormal
+var normal = map[string]map[string]band{
+	"infant": {
+		"systolic":  {65, 100},
+		"diastolic": {35, 65},
+		"pulse":     {100, 160},
+	},
+	"child": {
+		"systolic":  {80, 115},
+		"diastolic": {50, 80},
+		"pulse":     {70, 130},
+	},
+	"adolescent": {
+		"systolic":  {90, 130},
+		"diastolic": {55, 85},
+		"pulse":     {60, 100},
+	},
+	"adult": {
+		"systolic":  {90, 139},
+		"diastolic": {60, 89},
+		"pulse":     {60, 100},
+		"bmi":       {18.5, 24.9},
+	},
+}
+
+// Ranges shared by every age group
+var normalAllAges = map[string]band{
+	"temperature": {36.1, 37.8},
+	"spo2":        {94, 100},
+}
+
+// ageGroup is the reference band for the patient's age in whole years on
+// the day of the reading. The birthday is compared by month and day, as the
+// day of the year shifts after Feb 29 in leap years.
+func ageGroup(dob, at time.Time) string {
+	years := at.Year() - dob.Year()
+	if at.Month() < dob.Month() || (at.Month() == dob.Month() && at.Day() < dob.Day()) {
+		years--
+	}
+	switch {
+	case years < 1:
+		return "infant"
+	case years < 13:
+		return "child"
+	case years < 18:
+		return "adolescent"
+	default:
+		return "adult"
+	}
+}
+
+// normalise converts the submitted measurements to canonical units.
+func normalise(v *Vitals) error {
+	if v.Temperature != nil {
+		switch strings.ToUpper(v.TemperatureUnit) {
+		case "", "C":
+		case "F":
+			t := round1((*v.Temperature - 32) * 5 / 9)
+			v.Temperature = &t
+		default:
+			return fmt.Errorf("unsupported temperature unit %q, expected C or F", v.TemperatureUnit)
+		}
+	}
+	if v.Weight != nil {
+		switch strings.ToLower(v.WeightUnit) {
+		case "", "kg":
+		case "lb", "lbs":
+			w := math.Round(*v.Weight*0.45359237*100) / 100
+			v.Weight = &w
+		default:
+			return fmt.Errorf("unsupported weight unit %q, expected kg or lb", v.WeightUnit)
+		}
+	}
+	if v.Height != nil {
+		switch strings.ToLower(v.HeightUnit) {
+		case "", "cm":
+		case "in":
+			h := round1(*v.Height * 2.54)
+			v.Height = &h
+		case "m":
+			h := round1(*v.Height * 100)
+			v.Height = &h
+		default:
+			return fmt.Errorf("unsupported height unit %q, expected cm, m or in", v.HeightUnit)
+		}
+	}
+	v.TemperatureUnit, v.WeightUnit, v.HeightUnit = "", "", ""
+	return nil
+}
+
+func (v *Vitals) measurements() map[string]*float64 {
+	asFloat := func(i *int) *float64 {
+		if i == nil {
+			return nil
+		}
+		f := float64(*i)
+		return &f
+	}
+	return map[string]*float64{
+		"systolic":    asFloat(v.Systolic),
+		"diastolic":   asFloat(v.Diastolic),
+		"temperature": v.Temperature,
+		"pulse":       asFloat(v.Pulse),
+		"spo2":        asFloat(v.SpO2),
+		"weight":      v.Weight,
+		"height":      v.Height,
+		"bmi":         v.BMI,
+	}
+}
+
+// validate rejects physiologically implausible values.
+func validate(v *Vitals) string {
+	empty := true
+	for field, value := range v.measurements() {
+		if value == nil {
+			continue
+		}
+		empty = false
+		if b, ok := plausible[field]; ok && (*value < b.Min || *value > b.Max) {
+			return fmt.Sprintf("Implausible %s value %g, expected between %g and %g", field, *value, b.Min, b.Max)
+		}
+	}
+	if empty {
+		return "At least one measurement is required"
+	}
+	if v.Systolic != nil && v.Diastolic != nil && *v.Diastolic >= *v.Systolic {
+		return "Diastolic pressure must be lower than systolic pressure"
+	}
+	return ""
+}
+
+func computeBMI(v *Vitals) {
+	v.BMI = nil
+	if v.Weight == nil || v.Height == nil || *v.Height == 0 {
+		return
+	}
+	m := *v.Height / 100
+	bmi := round1(*v.Weight / (m * m))
+	v.BMI = &bmi
+}
+
+// flag compares each measurement with the reference range for the patient's age group.
+func flag(v *Vitals, group string) []Flag {
+	flags := []Flag{}
+	for _, field := range []string{"systolic", "diastolic", "temperature", "pulse", "spo2", "bmi"} {
+		value := v.measurements()[field]
+		if value == nil {
+			continue
+		}
+		b, ok := normal[group][field]
+		if !ok {
+			b, ok = normalAllAges[field]
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case *value < b.Min:
+			flags = append(flags, Flag{Field: field, Value: *value, Level: "low", Message: fmt.Sprintf("%s below %g for %s", field, b.Min, group)})
+		case *value > b.Max:
+			flags = append(flags, Flag{Field: field, Value: *value, Level: "high", Message: fmt.Sprintf("%s above %g for %s", field, b.Max, group)})
+		}
+	}
+	return flags
+}
+
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
+}
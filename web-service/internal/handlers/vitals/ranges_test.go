@@ -0,0 +1,41 @@
+package vitals
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgeGroup(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		name    string
+		dob, at string
+		want    string
+	}{
+		{"newborn", "2026-10-01", "2026-10-19", "infant"},
+		{"day before first birthday", "2025-10-19", "2026-10-18", "infant"},
+		{"first birthday", "2025-10-19", "2026-10-19", "child"},
+		{"day before 13th birthday", "2013-10-19", "2026-10-18", "child"},
+		{"13th birthday", "2013-10-19", "2026-10-19", "adolescent"},
+		{"18th birthday", "2008-10-19", "2026-10-19", "adult"},
+		{"born in a leap year, birthday in a common year", "2008-03-01", "2026-03-01", "adult"},
+		{"born in a leap year, day before birthday", "2008-03-01", "2026-02-28", "adolescent"},
+		{"reading in a leap year, birthday not yet reached", "2010-03-02", "2028-03-01", "adolescent"},
+		{"reading in a leap year on the birthday", "2010-03-01", "2028-03-01", "adult"},
+		{"born on Feb 29, before Mar 1 in a common year", "2008-02-29", "2026-02-28", "adolescent"},
+		{"born on Feb 29, Mar 1 in a common year", "2008-02-29", "2026-03-01", "adult"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ageGroup(day(tt.dob), day(tt.at)); got != tt.want {
+				t.Errorf("ageGroup(%s, %s) = %q, want %q", tt.dob, tt.at, got, tt.want)
+			}
+		})
+	}
+}
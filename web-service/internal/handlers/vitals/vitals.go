@@ -0,0 +1,261 @@
+package vitals
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"web-service/database"
+	"web-service/internal/middleware"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type Vitals struct {
+	ID              string    `json:"id"`
+	PatientID       string    `json:"patient_id"`
+	EncounterID     *string   `json:"encounter_id,omitempty"`
+	Systolic        *int      `json:"systolic,omitempty"`
+	Diastolic       *int      `json:"diastolic,omitempty"`
+	Temperature     *float64  `json:"temperature,omitempty"`
+	TemperatureUnit string    `json:"temperature_unit,omitempty"`
+	Pulse           *int      `json:"pulse,omitempty"`
+	SpO2            *int      `json:"spo2,omitempty"`
+	Weight          *float64  `json:"weight,omitempty"`
+	WeightUnit      string    `json:"weight_unit,omitempty"`
+	Height          *float64  `json:"height,omitempty"`
+	HeightUnit      string    `json:"height_unit,omitempty"`
+	BMI             *float64  `json:"bmi,omitempty"`
+	Flags           []Flag    `json:"flags"`
+	RecordedBy      *string   `json:"recorded_by,omitempty"`
+	RecordedAt      time.Time `json:"recorded_at"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Point is one sample of a time series.
+type Point struct {
+	RecordedAt time.Time `json:"recorded_at"`
+	Value      float64   `json:"value"`
+}
+
+const vitalsColumns = `id, patient_id, encounter_id, systolic, diastolic, temperature, pulse, spo2, weight, height, bmi, flags, recorded_by, recorded_at, created_at`
+
+// Metrics that can be charted, mapped to their column
+var seriesColumns = map[string]string{
+	"systolic":    "systolic",
+	"diastolic":   "diastolic",
+	"temperature": "temperature",
+	"pulse":       "pulse",
+	"spo2":        "spo2",
+	"weight":      "weight",
+	"height":      "height",
+	"bmi":         "bmi",
+}
+
+func (v *Vitals) scanTargets(flags *[]byte) []any {
+	return []any{&v.ID, &v.PatientID, &v.EncounterID, &v.Systolic, &v.Diastolic, &v.Temperature, &v.Pulse, &v.SpO2,
+		&v.Weight, &v.Height, &v.BMI, flags, &v.RecordedBy, &v.RecordedAt, &v.CreatedAt}
+}
+
+func scanVitals(scan func(dest ...any) error) (Vitals, error) {
+	var v Vitals
+	var flags []byte
+	if err := scan(v.scanTargets(&flags)...); err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(flags, &v.Flags); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+func AddVitals(c *fiber.Ctx) error {
+	db := database.GetDB()
+	var v Vitals
+	if err := c.BodyParser(&v); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid input:",
+			"details": err.Error(),
+		})
+	}
+
+	if v.PatientID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Patient ID is required",
+		})
+	}
+
+	if err := normalise(&v); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	computeBMI(&v)
+	if msg := validate(&v); msg != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	var dob time.Time
+	err := db.QueryRow(context.Background(), `SELECT date_of_birth FROM patients WHERE id=$1`, v.PatientID).Scan(&dob)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Patient not found",
+			"details": err.Error(),
+		})
+	}
+	if v.EncounterID != nil && *v.EncounterID == "" {
+		v.EncounterID = nil
+	}
+	if v.EncounterID != nil {
+		var ok bool
+		err := db.QueryRow(context.Background(), `SELECT EXISTS (SELECT 1 FROM encounters WHERE id=$1 AND patient_id=$2)`, *v.EncounterID, v.PatientID).Scan(&ok)
+		if err != nil || !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "encounter_id is not an encounter of this patient",
+			})
+		}
+	}
+
+	v.ID = uuid.New().String()[:8]
+	if v.RecordedAt.IsZero() {
+		v.RecordedAt = time.Now()
+	}
+	v.CreatedAt = time.Now()
+	if id := middleware.CurrentUserID(c); id != "" {
+		v.RecordedBy = &id
+	}
+	v.Flags = flag(&v, ageGroup(dob, v.RecordedAt))
+
+	flags, err := json.Marshal(v.Flags)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	_, err = db.Exec(context.Background(), `INSERT INTO vitals (`+vitalsColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		v.ID, v.PatientID, v.EncounterID, v.Systolic, v.Diastolic, v.Temperature, v.Pulse, v.SpO2,
+		v.Weight, v.Height, v.BMI, flags, v.RecordedBy, v.RecordedAt, v.CreatedAt)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add vitals",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Vitals added successfully",
+		"vitals": v,
+	})
+}
+
+func GetVitalsByID(c *fiber.Ctx) error {
+	db := database.GetDB()
+	row := db.QueryRow(context.Background(), `SELECT `+vitalsColumns+` FROM vitals WHERE id=$1`, c.Params("id"))
+	v, err := scanVitals(row.Scan)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Vitals not found",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(v)
+}
+
+// FetchVitals lists the readings for a patient, optionally restricted to one encounter.
+func FetchVitals(patientID string, encounterID string) ([]Vitals, error) {
+	db := database.GetDB()
+	rows, err := db.Query(context.Background(), `SELECT `+vitalsColumns+` FROM vitals
+		WHERE patient_id=$1 AND ($2 = '' OR encounter_id = $2)
+		ORDER BY recorded_at DESC`, patientID, encounterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Vitals{}
+	for rows.Next() {
+		v, err := scanVitals(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+func GetPatientVitals(c *fiber.Ctx) error {
+	list, err := FetchVitals(c.Params("id"), c.Query("encounter_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch vitals",
+			"details": err.Error(),
+		})
+	}
+
+	return c.JSON(list)
+}
+
+// GetVitalsSeries returns a single metric over time in chronological order for charting.
+func GetVitalsSeries(c *fiber.Ctx) error {
+	db := database.GetDB()
+	metric := c.Query("metric")
+	column, ok := seriesColumns[metric]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unknown metric, expected one of systolic, diastolic, temperature, pulse, spo2, weight, height, bmi",
+		})
+	}
+
+	from := time.Time{}
+	to := time.Now()
+	if q := c.Query("from"); q != "" {
+		t, err := time.Parse("2006-01-02", q)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from date, expected YYYY-MM-DD",
+			})
+		}
+		from = t
+	}
+	if q := c.Query("to"); q != "" {
+		t, err := time.Parse("2006-01-02", q)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to date, expected YYYY-MM-DD",
+			})
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+
+	rows, err := db.Query(context.Background(), `SELECT recorded_at, `+column+`::float8 FROM vitals
+		WHERE patient_id=$1 AND `+column+` IS NOT NULL AND recorded_at >= $2 AND recorded_at < $3
+		ORDER BY recorded_at ASC`, c.Params("id"), from, to)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch vitals series",
+			"details": err.Error(),
+		})
+	}
+	defer rows.Close()
+
+	points := []Point{}
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.RecordedAt, &p.Value); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		points = append(points, p)
+	}
+
+	return c.JSON(fiber.Map{
+		"metric": metric,
+		"points": points,
+	})
+}
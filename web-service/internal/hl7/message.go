@@ -0,0 +1,179 @@
+// Package hl7 reads and writes HL7 v2 messages and carries them over MLLP,
+// the framing lab analysers use on a TCP connection.
+package hl7
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeFormat is the HL7 TS format used for message and observation times.
+const TimeFormat = "20060102150405"
+
+// Delimiters used in outgoing messages; incoming ones are read from MSH.
+const (
+	fieldSep      = '|'
+	encodingChars = `^~\&`
+)
+
+var ErrInvalidMessage = errors.New("invalid HL7 message")
+
+// Segment is one line of a message split into fields. Fields are numbered
+// as in the HL7 standard, so Field(3) of PID is the patient identifier list.
+type Segment struct {
+	fields []string
+	// delims are the message's field separator and MSH-2 encoding
+	// characters: component, repetition, escape and subcomponent
+	delims string
+}
+
+// Name is the three letter segment ID, e.g. "OBX".
+func (s Segment) Name() string {
+	return s.fields[0]
+}
+
+// Field returns field n, or "" when the segment is shorter.
+func (s Segment) Field(n int) string {
+	if s.fields[0] == "MSH" {
+		// MSH-1 is the field separator itself, so MSH-2 is fields[1]
+		if n == 1 {
+			return s.delims[:1]
+		}
+		n--
+	}
+	if n < 0 || n >= len(s.fields) {
+		return ""
+	}
+	return s.fields[n]
+}
+
+// Component returns component c (from 1) of the first repetition of field n.
+func (s Segment) Component(n, c int) string {
+	field := s.Field(n)
+	if s.fields[0] == "MSH" && n == 2 {
+		return field
+	}
+	if i := strings.IndexByte(field, s.delims[2]); i >= 0 {
+		field = field[:i]
+	}
+	parts := strings.Split(field, s.delims[1:2])
+	if c < 1 || c > len(parts) {
+		return ""
+	}
+	return unescape(parts[c-1], s.delims)
+}
+
+// Message is a parsed HL7 v2 message.
+type Message struct {
+	Segments []Segment
+}
+
+// Parse splits a message into segments. Segments may end in CR, LF or CRLF.
+func Parse(raw []byte) (*Message, error) {
+	text := strings.ReplaceAll(strings.ReplaceAll(string(raw), "\r\n", "\r"), "\n", "\r")
+	if !strings.HasPrefix(text, "MSH") || len(text) < 8 {
+		return nil, fmt.Errorf("%w: message must start with an MSH segment", ErrInvalidMessage)
+	}
+	sep := string(text[3])
+	enc := text[4:8]
+
+	m := &Message{}
+	for _, line := range strings.Split(text, "\r") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, sep)
+		if len(fields[0]) != 3 {
+			return nil, fmt.Errorf("%w: bad segment %q", ErrInvalidMessage, fields[0])
+		}
+		m.Segments = append(m.Segments, Segment{fields: fields, delims: sep + enc})
+	}
+	return m, nil
+}
+
+// Segment returns the first segment with the given name.
+func (m *Message) Segment(name string) (Segment, bool) {
+	for _, s := range m.Segments {
+		if s.Name() == name {
+			return s, true
+		}
+	}
+	return Segment{}, false
+}
+
+// Type returns the message type and trigger event from MSH-9, e.g. "ORU^R01".
+func (m *Message) Type() string {
+	msh, _ := m.Segment("MSH")
+	return msh.Component(9, 1) + "^" + msh.Component(9, 2)
+}
+
+// ControlID returns MSH-10, which the receiver echoes back in its ACK.
+func (m *Message) ControlID() string {
+	msh, _ := m.Segment("MSH")
+	return msh.Field(10)
+}
+
+// Escape replaces the delimiter characters in a value with HL7 escape sequences.
+func Escape(v string) string {
+	return strings.NewReplacer(`\`, `\E\`, "|", `\F\`, "^", `\S\`, "&", `\T\`, "~", `\R\`, "\r", " ", "\n", " ").Replace(v)
+}
+
+// Unescape reverses Escape.
+func Unescape(v string) string {
+	return unescape(v, string(fieldSep)+encodingChars)
+}
+
+// unescape turns escape sequences back into the delimiters they stand for,
+// given as the field separator followed by the four encoding characters.
+func unescape(v, delims string) string {
+	e := delims[3:4]
+	if !strings.Contains(v, e) {
+		return v
+	}
+	return strings.NewReplacer(e+"F"+e, delims[0:1], e+"S"+e, delims[1:2], e+"T"+e, delims[4:5], e+"R"+e, delims[2:3], e+"E"+e, e).Replace(v)
+}
+
+// Builder assembles an outgoing message segment by segment.
+type Builder struct {
+	lines []string
+}
+
+// NewBuilder starts a message with its MSH segment. msgType is the full
+// MSH-9 value, e.g. "ORM^O01^ORM_O01".
+func NewBuilder(sendingApp, sendingFacility, receivingApp, receivingFacility, msgType, controlID string) *Builder {
+	b := &Builder{}
+	b.lines = append(b.lines, strings.Join([]string{
+		"MSH", encodingChars, Escape(sendingApp), Escape(sendingFacility), Escape(receivingApp), Escape(receivingFacility),
+		time.Now().Format(TimeFormat), "", msgType, controlID, "P", "2.5.1",
+	}, string(fieldSep)))
+	return b
+}
+
+// Add appends a segment. Values are used as given, so callers escape free
+// text with Escape and join components with "^".
+func (b *Builder) Add(name string, fields ...string) *Builder {
+	b.lines = append(b.lines, name+string(fieldSep)+strings.Join(fields, string(fieldSep)))
+	return b
+}
+
+// Bytes returns the message with CR segment terminators.
+func (b *Builder) Bytes() []byte {
+	return []byte(strings.Join(b.lines, "\r") + "\r")
+}
+
+// ACK codes for MSA-1.
+const (
+	AckAccept = "AA"
+	AckError  = "AE"
+	AckReject = "AR"
+)
+
+// Ack builds the acknowledgement for a received message.
+func Ack(m *Message, sendingApp, sendingFacility, code, text, controlID string) []byte {
+	msh, _ := m.Segment("MSH")
+	return NewBuilder(sendingApp, sendingFacility, msh.Component(3, 1), msh.Component(4, 1), "ACK^"+msh.Component(9, 2)+"^ACK", controlID).
+		Add("MSA", code, m.ControlID(), Escape(text)).
+		Bytes()
+}
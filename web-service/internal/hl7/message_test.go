@@ -0,0 +1,153 @@
+package hl7
+
+import (
+	"errors"
+	"testing"
+)
+
+const oru = "MSH|^~\\&|ANALYSER|LAB|MEDICLINIC|CLINIC|20261019101500||ORU^R01^ORU_R01|MSG0001|P|2.5.1\r" +
+	"PID|1||P001^^^CLINIC~N123^^^NATIONAL||Doe^Jane\r" +
+	"OBX|1|NM|HGB^Haemoglobin||13.5|g/dL|12\\T\\15|N|||F\r" +
+	"NTE|1||Result \\F\\ checked\\E\\verified \\S\\ see \\R\\ notes\r"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+		count   int
+	}{
+		{name: "CR terminated", raw: oru, count: 4},
+		{name: "LF terminated", raw: "MSH|^~\\&|A|B\nPID|1\n", count: 2},
+		{name: "CRLF terminated", raw: "MSH|^~\\&|A|B\r\nPID|1\r\n", count: 2},
+		{name: "blank lines skipped", raw: "MSH|^~\\&|A|B\r\r\nPID|1\r", count: 2},
+		{name: "no MSH", raw: "PID|1||P001\r", wantErr: true},
+		{name: "MSH too short", raw: "MSH|^~", wantErr: true},
+		{name: "bad segment name", raw: "MSH|^~\\&|A\rPIDX|1\r", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Parse([]byte(tt.raw))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidMessage) {
+					t.Fatalf("Parse() error = %v, want ErrInvalidMessage", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if len(m.Segments) != tt.count {
+				t.Errorf("got %d segments, want %d", len(m.Segments), tt.count)
+			}
+		})
+	}
+}
+
+func TestSegmentFields(t *testing.T) {
+	m, err := Parse([]byte(oru))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msh, _ := m.Segment("MSH")
+	pid, _ := m.Segment("PID")
+	obx, _ := m.Segment("OBX")
+	nte, _ := m.Segment("NTE")
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"MSH-1 is the field separator", msh.Field(1), "|"},
+		{"MSH-2 is the encoding characters", msh.Field(2), "^~\\&"},
+		{"MSH-2 component is not split", msh.Component(2, 1), "^~\\&"},
+		{"MSH-3 sending application", msh.Field(3), "ANALYSER"},
+		{"MSH-7 message time", msh.Field(7), "20261019101500"},
+		{"MSH-9 message type", msh.Component(9, 1), "ORU"},
+		{"MSH-9 trigger event", msh.Component(9, 2), "R01"},
+		{"MSH-10 control id", msh.Field(10), "MSG0001"},
+		{"MSH-12 version", msh.Field(12), "2.5.1"},
+		{"past the last field", msh.Field(40), ""},
+		{"negative field", msh.Field(-1), ""},
+		{"first repetition only", pid.Component(3, 1), "P001"},
+		{"component of the first repetition", pid.Component(3, 4), "CLINIC"},
+		{"missing component", pid.Component(5, 3), ""},
+		{"component zero", pid.Component(5, 0), ""},
+		{"OBX-3 code", obx.Component(3, 1), "HGB"},
+		{"OBX-5 value", obx.Field(5), "13.5"},
+		{"subcomponent escape", obx.Component(7, 1), "12&15"},
+		{"field, escape, component and repetition escapes", nte.Component(3, 1), "Result | checked\\verified ^ see ~ notes"},
+		{"type", m.Type(), "ORU^R01"},
+		{"control id", m.ControlID(), "MSG0001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomDelimiters(t *testing.T) {
+	// Field #, component $, repetition *, escape @, subcomponent %
+	raw := "MSH#$*@%#ANALYSER#LAB#MEDICLINIC#CLINIC#20261019101500##ORU$R01#MSG0002#P#2.5.1\r" +
+		"PID#1##P002$$$CLINIC*N456$$$NATIONAL\r" +
+		"NTE#1##A@F@B@S@C@T@D@R@E@E@F|^~\\&\r"
+	m, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msh, _ := m.Segment("MSH")
+	pid, _ := m.Segment("PID")
+	nte, _ := m.Segment("NTE")
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"MSH-1", msh.Field(1), "#"},
+		{"MSH-2", msh.Field(2), "$*@%"},
+		{"MSH-10", msh.Field(10), "MSG0002"},
+		{"type", m.Type(), "ORU^R01"},
+		{"first repetition", pid.Component(3, 1), "P002"},
+		{"component", pid.Component(3, 4), "CLINIC"},
+		{"escapes stand for the message's delimiters, standard ones are text", nte.Component(3, 1), "A#B$C%D*E@F|^~\\&"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in, escaped string
+	}{
+		{"plain text", "plain text"},
+		{"a|b", "a\\F\\b"},
+		{"a^b", "a\\S\\b"},
+		{"a&b", "a\\T\\b"},
+		{"a~b", "a\\R\\b"},
+		{"a\\b", "a\\E\\b"},
+		{"\\F\\", "\\E\\F\\E\\"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := Escape(tt.in); got != tt.escaped {
+				t.Errorf("Escape(%q) = %q, want %q", tt.in, got, tt.escaped)
+			}
+			if got := Unescape(tt.escaped); got != tt.in {
+				t.Errorf("Unescape(%q) = %q, want %q", tt.escaped, got, tt.in)
+			}
+		})
+	}
+	if got := Escape("line one\rline two\n"); got != "line one line two " {
+		t.Errorf("Escape() kept line breaks: %q", got)
+	}
+}
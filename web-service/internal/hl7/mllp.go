@@ -0,0 +1,148 @@
+package hl7
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// MLLP wraps each message in a start block and an end block plus CR.
+const (
+	startBlock     = 0x0b
+	endBlock       = 0x1c
+	carriageReturn = 0x0d
+)
+
+// MaxFrameSize is the largest message accepted. Result messages from an
+// analyser are a few kilobytes.
+const MaxFrameSize = 1 << 20
+
+// IdleTimeout is how long a connection may wait for its next message before
+// it is closed; analysers reconnect when they have more to send.
+const IdleTimeout = 10 * time.Minute
+
+// ReadFrame reads the next MLLP framed message. Bytes before the start
+// block are skipped. Messages over MaxFrameSize are refused.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == startBlock {
+			break
+		}
+	}
+	var msg []byte
+	for {
+		chunk, err := r.ReadSlice(endBlock)
+		if len(msg)+len(chunk) > MaxFrameSize+1 {
+			return nil, fmt.Errorf("%w: MLLP frame larger than %d bytes", ErrInvalidMessage, MaxFrameSize)
+		}
+		msg = append(msg, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+	if b, err := r.ReadByte(); err != nil || b != carriageReturn {
+		return nil, fmt.Errorf("%w: MLLP frame not terminated by CR", ErrInvalidMessage)
+	}
+	return msg[:len(msg)-1], nil
+}
+
+// WriteFrame writes one message in an MLLP frame.
+func WriteFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 0, len(msg)+3)
+	frame = append(frame, startBlock)
+	frame = append(frame, msg...)
+	frame = append(frame, endBlock, carriageReturn)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Handler processes a received message and returns the ACK to send back.
+type Handler func(ctx context.Context, raw []byte, peer string) []byte
+
+// Serve accepts MLLP connections on addr until ctx is cancelled. Each
+// connection is read message by message, and every message gets its reply
+// before the next one is read, as analysers expect. When allow is set,
+// connections from peers it refuses are closed unread.
+func Serve(ctx context.Context, addr string, allow func(peer string) bool, handle Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("MLLP accept failed: %v", err)
+			continue
+		}
+		if allow != nil && !allow(conn.RemoteAddr().String()) {
+			log.Printf("MLLP connection from %s refused", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go serveConn(ctx, conn, handle)
+	}
+}
+
+func serveConn(ctx context.Context, conn net.Conn, handle Handler) {
+	defer conn.Close()
+	peer := conn.RemoteAddr().String()
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(IdleTimeout))
+		msg, err := ReadFrame(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("MLLP read from %s failed: %v", peer, err)
+			}
+			return
+		}
+		reply := handle(ctx, msg, peer)
+		if reply == nil {
+			continue
+		}
+		if err := WriteFrame(conn, reply); err != nil {
+			log.Printf("MLLP write to %s failed: %v", peer, err)
+			return
+		}
+	}
+}
+
+// Send delivers one message to addr and waits for its acknowledgement.
+func Send(ctx context.Context, addr string, msg []byte, timeout time.Duration) (*Message, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := WriteFrame(conn, msg); err != nil {
+		return nil, err
+	}
+	reply, err := ReadFrame(bufio.NewReader(conn))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(reply)
+}
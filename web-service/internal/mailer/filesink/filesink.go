@@ -0,0 +1,52 @@
+// Package filesink is a mailer that writes each message to a .eml file
+// instead of sending it, for development and for clinics without a mail
+// server. The files open in any mail client.
+package filesink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"web-service/config"
+	"web-service/internal/mailer"
+	"github.com/google/uuid"
+)
+
+type Sink struct {
+	Dir string
+}
+
+// FromConfig writes to MAIL_DIR, by default mail/ in the working directory.
+func FromConfig() *Sink {
+	dir := config.GetVal("MAIL_DIR")
+	if dir == "" {
+		dir = "mail"
+	}
+	return &Sink{Dir: dir}
+}
+
+func (s *Sink) Name() string {
+	return "file"
+}
+
+func (s *Sink) Send(ctx context.Context, m mailer.Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0o750); err != nil {
+		return err
+	}
+	to := strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, m.To)
+	name := fmt.Sprintf("%s-%s-%s.eml", time.Now().Format("20060102-150405"), to, uuid.New().String()[:8])
+	return os.WriteFile(filepath.Join(s.Dir, name), data, 0o640)
+}
@@ -0,0 +1,58 @@
+// Package smtp sends mail through an SMTP server.
+package smtp
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+
+	"web-service/config"
+	"web-service/internal/mailer"
+)
+
+type Client struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+// FromConfig builds a client from the SMTP_* settings. SMTP_PORT defaults
+// to 587; without SMTP_USERNAME mail is sent unauthenticated.
+func FromConfig() *Client {
+	port := config.GetVal("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &Client{
+		Host:     config.GetVal("SMTP_HOST"),
+		Port:     port,
+		Username: config.GetVal("SMTP_USERNAME"),
+		Password: config.GetVal("SMTP_PASSWORD"),
+	}
+}
+
+func (c *Client) Name() string {
+	return "smtp"
+}
+
+func (c *Client) Send(ctx context.Context, m mailer.Message) error {
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(c.Host, c.Port), auth, from.Address, []string{to.Address}, data)
+}
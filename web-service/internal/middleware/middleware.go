@@ -1,12 +1,16 @@
 package middleware
 
 import (
+    "strings"
     "time"
     "web-service/config"
     "github.com/gofiber/fiber/v2"
     "github.com/golang-jwt/jwt/v5"
 )
 
+// Roles allowed to read and write clinical documentation
+var ClinicalRoles = []string{"doctor", "nurse"}
+
 // Generate JWT Token
 func GenerateToken(id string, role string) (string, error) {
     secretKey := []byte(config.GetVal("JWT_SECRET"))
@@ -67,6 +71,46 @@ func AuthMiddleware(c *fiber.Ctx) error {
         })
     }
 
+    // Expose the caller to downstream handlers
+    id, _ := claims["id"].(string)
+    c.Locals("user_id", id)
+    c.Locals("role", role)
+
     // Proceed to the next request handler
     return c.Next()
 }
+
+// Get the authenticated staff ID set by AuthMiddleware
+func CurrentUserID(c *fiber.Ctx) string {
+    id, _ := c.Locals("user_id").(string)
+    return id
+}
+
+// Get the authenticated staff role set by AuthMiddleware
+func CurrentRole(c *fiber.Ctx) string {
+    role, _ := c.Locals("role").(string)
+    return role
+}
+
+// Restrict a route to the given staff roles, must run after AuthMiddleware
+func RequireRoles(roles ...string) fiber.Handler {
+    return func(c *fiber.Ctx) error {
+        if HasRole(c, roles...) {
+            return c.Next()
+        }
+        return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+            "error": "Your role is not allowed to access this resource",
+        })
+    }
+}
+
+// Check whether the caller has one of the given roles
+func HasRole(c *fiber.Ctx, roles ...string) bool {
+    role := CurrentRole(c)
+    for _, r := range roles {
+        if strings.EqualFold(r, role) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,24 @@
+package paging
+
+import "strconv"
+
+// Parse reads page and limit query values, defaulting to the first 20 entries.
+func Parse(pageValue, limitValue string) (int, int) {
+	page, err := strconv.Atoi(pageValue)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(limitValue)
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	return page, limit
+}
+
+// Offset is the number of rows to skip for the given page.
+func Offset(page, limit int) int {
+	return (page - 1) * limit
+}
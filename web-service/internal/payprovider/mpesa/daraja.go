@@ -0,0 +1,327 @@
+// Package mpesa is the M-Pesa payment provider, using the Daraja API's
+// Lipa na M-Pesa Online (STK push) to prompt patients on their phones.
+package mpesa
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"web-service/config"
+	"web-service/internal/payprovider"
+	"github.com/shopspring/decimal"
+)
+
+// Daraja timestamps and transaction dates are in East Africa Time.
+var eat = time.FixedZone("EAT", 3*60*60)
+
+const timestampFormat = "20060102150405"
+
+// errProcessing is the error code Daraja gives while the payer has not yet
+// answered the prompt.
+const errProcessing = "500.001.1001"
+
+type Client struct {
+	BaseURL        string
+	ConsumerKey    string
+	ConsumerSecret string
+	ShortCode      string
+	PassKey        string
+	CallbackURL    string
+	HTTP           *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// FromConfig builds a client from the MPESA_* settings. MPESA_BASE_URL
+// defaults to the Daraja sandbox; point it at cmd/darajamock to test locally.
+func FromConfig() *Client {
+	base := config.GetVal("MPESA_BASE_URL")
+	if base == "" {
+		base = "https://sandbox.safaricom.co.ke"
+	}
+	callback := config.GetVal("MPESA_CALLBACK_URL")
+	if callback == "" {
+		callback = strings.TrimRight(config.GetVal("API_URL"), "/") + "/api/payments/mpesa/callback"
+		if token := config.GetVal("MPESA_CALLBACK_TOKEN"); token != "" {
+			callback += "?token=" + token
+		}
+	}
+	return &Client{
+		BaseURL:        strings.TrimRight(base, "/"),
+		ConsumerKey:    config.GetVal("MPESA_CONSUMER_KEY"),
+		ConsumerSecret: config.GetVal("MPESA_CONSUMER_SECRET"),
+		ShortCode:      config.GetVal("MPESA_SHORTCODE"),
+		PassKey:        config.GetVal("MPESA_PASSKEY"),
+		CallbackURL:    callback,
+		HTTP:           &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) Name() string {
+	return "mpesa"
+}
+
+// NormalisePhone puts a Kenyan mobile number in the 2547XXXXXXXX form
+// Daraja expects.
+func NormalisePhone(phone string) (string, error) {
+	p := strings.NewReplacer(" ", "", "-", "", "+", "").Replace(strings.TrimSpace(phone))
+	switch {
+	case strings.HasPrefix(p, "0") && len(p) == 10:
+		p = "254" + p[1:]
+	case (strings.HasPrefix(p, "7") || strings.HasPrefix(p, "1")) && len(p) == 9:
+		p = "254" + p
+	}
+	if len(p) != 12 || !strings.HasPrefix(p, "254") {
+		return "", fmt.Errorf("%q is not a Kenyan mobile number", phone)
+	}
+	if _, err := strconv.ParseUint(p, 10, 64); err != nil {
+		return "", fmt.Errorf("%q is not a Kenyan mobile number", phone)
+	}
+	return p, nil
+}
+
+// code reads result codes, which Daraja sends as numbers or strings.
+type code string
+
+func (c *code) UnmarshalJSON(b []byte) error {
+	*c = code(strings.Trim(string(b), `"`))
+	return nil
+}
+
+// apiError is the body Daraja returns with a failed request.
+type apiError struct {
+	RequestID    string `json:"requestId"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("daraja: %s %s", e.ErrorCode, e.ErrorMessage)
+}
+
+// accessToken returns the OAuth token, fetching a new one shortly before
+// the current one expires.
+func (c *Client) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/oauth/v1/generate?grant_type=client_credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(c.ConsumerKey, c.ConsumerSecret)
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("daraja: access token request failed with status %d", res.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   code   `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	seconds, _ := strconv.Atoi(string(body.ExpiresIn))
+	if seconds <= 0 {
+		seconds = 3599
+	}
+	c.token = body.AccessToken
+	c.expires = time.Now().Add(time.Duration(seconds)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// password is the STK push password for a request made at timestamp.
+func (c *Client) password(timestamp string) string {
+	return base64.StdEncoding.EncodeToString([]byte(c.ShortCode + c.PassKey + timestamp))
+}
+
+func (c *Client) post(ctx context.Context, path string, in, out any) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e apiError
+		if json.NewDecoder(res.Body).Decode(&e) == nil && e.ErrorCode != "" {
+			return &e
+		}
+		return fmt.Errorf("daraja: %s failed with status %d", path, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Request sends an STK push to the payer's phone. M-Pesa takes whole
+// shillings, so the amount is rounded up.
+func (c *Client) Request(ctx context.Context, r payprovider.Request) (*payprovider.Pending, error) {
+	phone, err := NormalisePhone(r.PhoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	// The reference shows on the payer's phone and is cut off after 12 characters
+	reference := r.Reference
+	if len(reference) > 12 {
+		reference = reference[:12]
+	}
+	description := r.Description
+	if len(description) > 13 {
+		description = description[:13]
+	}
+	timestamp := time.Now().In(eat).Format(timestampFormat)
+	in := map[string]any{
+		"BusinessShortCode": c.ShortCode,
+		"Password":          c.password(timestamp),
+		"Timestamp":         timestamp,
+		"TransactionType":   "CustomerPayBillOnline",
+		"Amount":            r.Amount.Ceil().IntPart(),
+		"PartyA":            phone,
+		"PartyB":            c.ShortCode,
+		"PhoneNumber":       phone,
+		"CallBackURL":       c.CallbackURL,
+		"AccountReference":  reference,
+		"TransactionDesc":   description,
+	}
+	var out struct {
+		MerchantRequestID   string `json:"MerchantRequestID"`
+		CheckoutRequestID   string `json:"CheckoutRequestID"`
+		ResponseCode        code   `json:"ResponseCode"`
+		ResponseDescription string `json:"ResponseDescription"`
+		CustomerMessage     string `json:"CustomerMessage"`
+	}
+	if err := c.post(ctx, "/mpesa/stkpush/v1/processrequest", in, &out); err != nil {
+		return nil, err
+	}
+	if out.ResponseCode != "0" || out.CheckoutRequestID == "" {
+		return nil, fmt.Errorf("daraja: STK push rejected: %s", out.ResponseDescription)
+	}
+	return &payprovider.Pending{
+		CheckoutID:        out.CheckoutRequestID,
+		MerchantRequestID: out.MerchantRequestID,
+		Message:           out.CustomerMessage,
+	}, nil
+}
+
+type callback struct {
+	Body struct {
+		StkCallback struct {
+			MerchantRequestID string `json:"MerchantRequestID"`
+			CheckoutRequestID string `json:"CheckoutRequestID"`
+			ResultCode        code   `json:"ResultCode"`
+			ResultDesc        string `json:"ResultDesc"`
+			CallbackMetadata  struct {
+				Item []struct {
+					Name  string          `json:"Name"`
+					Value json.RawMessage `json:"Value"`
+				} `json:"Item"`
+			} `json:"CallbackMetadata"`
+		} `json:"stkCallback"`
+	} `json:"Body"`
+}
+
+// ParseCallback reads the result Daraja posts to the callback URL.
+func (c *Client) ParseCallback(body []byte) (*payprovider.Result, error) {
+	var cb callback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		return nil, err
+	}
+	stk := cb.Body.StkCallback
+	if stk.CheckoutRequestID == "" {
+		return nil, errors.New("daraja: callback has no CheckoutRequestID")
+	}
+	res := &payprovider.Result{
+		CheckoutID:  stk.CheckoutRequestID,
+		Status:      payprovider.StatusFailed,
+		ResultCode:  string(stk.ResultCode),
+		Description: stk.ResultDesc,
+	}
+	if stk.ResultCode != "0" {
+		return res, nil
+	}
+
+	res.Status = payprovider.StatusCompleted
+	for _, item := range stk.CallbackMetadata.Item {
+		value := strings.Trim(string(item.Value), `"`)
+		switch item.Name {
+		case "Amount":
+			res.Amount, _ = decimal.NewFromString(value)
+		case "MpesaReceiptNumber":
+			res.Receipt = value
+		case "PhoneNumber":
+			res.PhoneNumber = value
+		case "TransactionDate":
+			res.PaidAt, _ = time.ParseInLocation(timestampFormat, value, eat)
+		}
+	}
+	if res.Receipt == "" {
+		return nil, errors.New("daraja: successful callback has no MpesaReceiptNumber")
+	}
+	return res, nil
+}
+
+// Query asks Daraja for the outcome of an STK push. The query response
+// does not carry the M-Pesa receipt number.
+func (c *Client) Query(ctx context.Context, checkoutID string) (*payprovider.Result, error) {
+	timestamp := time.Now().In(eat).Format(timestampFormat)
+	in := map[string]any{
+		"BusinessShortCode": c.ShortCode,
+		"Password":          c.password(timestamp),
+		"Timestamp":         timestamp,
+		"CheckoutRequestID": checkoutID,
+	}
+	var out struct {
+		ResponseCode code   `json:"ResponseCode"`
+		ResultCode   code   `json:"ResultCode"`
+		ResultDesc   string `json:"ResultDesc"`
+	}
+	err := c.post(ctx, "/mpesa/stkpushquery/v1/query", in, &out)
+	var e *apiError
+	if errors.As(err, &e) && e.ErrorCode == errProcessing {
+		return &payprovider.Result{CheckoutID: checkoutID, Status: payprovider.StatusPending, Description: e.ErrorMessage}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := &payprovider.Result{CheckoutID: checkoutID, ResultCode: string(out.ResultCode), Description: out.ResultDesc}
+	switch out.ResultCode {
+	case "0":
+		res.Status = payprovider.StatusCompleted
+	case "":
+		res.Status = payprovider.StatusPending
+	default:
+		res.Status = payprovider.StatusFailed
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+// Package payprovider is the interface to services patients pay through
+// from their phones. A provider sends the payer a prompt, then reports the
+// outcome through a callback or when asked.
+package payprovider
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Request asks a payer to approve a payment.
+type Request struct {
+	PhoneNumber string
+	Amount      decimal.Decimal
+	// Reference is shown to the payer, e.g. the invoice number
+	Reference   string
+	Description string
+}
+
+// Pending identifies a request the payer has not answered yet.
+type Pending struct {
+	CheckoutID        string
+	MerchantRequestID string
+	Message           string
+}
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+)
+
+// Result is the outcome of a request. Receipt is the provider's reference
+// for the money received and is only set when the payment completed.
+type Result struct {
+	CheckoutID  string
+	Status      Status
+	ResultCode  string
+	Description string
+	Receipt     string
+	Amount      decimal.Decimal
+	PhoneNumber string
+	PaidAt      time.Time
+}
+
+type Provider interface {
+	// Name is stored with each request, e.g. "mpesa".
+	Name() string
+	// Request prompts the payer to approve the payment.
+	Request(ctx context.Context, r Request) (*Pending, error)
+	// ParseCallback reads the outcome the provider posts back.
+	ParseCallback(body []byte) (*Result, error)
+	// Query asks the provider for the outcome of a request.
+	Query(ctx context.Context, checkoutID string) (*Result, error)
+}
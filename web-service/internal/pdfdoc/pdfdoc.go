@@ -0,0 +1,144 @@
+// Package pdfdoc builds the clinic's printed documents: purchase orders, lab
+// reports, invoices and receipts all share the same letterhead and tables.
+package pdfdoc
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/go-pdf/fpdf"
+	"github.com/go-pdf/fpdf/contrib/barcode"
+	"web-service/config"
+)
+
+type Document struct {
+	*fpdf.Fpdf
+	tr func(string) string
+}
+
+// Clinic returns the letterhead details from config.
+func Clinic() (name, address, phone string) {
+	name = config.GetVal("CLINIC_NAME")
+	if name == "" {
+		name = "Triple Ts Mediclinic"
+	}
+	return name, config.GetVal("CLINIC_ADDRESS"), config.GetVal("CLINIC_PHONE")
+}
+
+// New starts an A4 document with the letterhead and the given title.
+func New(title string) *Document {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	d := &Document{Fpdf: pdf, tr: pdf.UnicodeTranslatorFromDescriptor("")}
+	pdf.SetTitle(title, true)
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "I", 8)
+		pdf.CellFormat(0, 5, d.tr(title)+fmt.Sprintf(" - page %d of {nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	name, address, phone := Clinic()
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 8, d.tr(name), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 9)
+	contact := address
+	if phone != "" {
+		if contact != "" {
+			contact += "  |  "
+		}
+		contact += phone
+	}
+	pdf.CellFormat(0, 5, d.tr(contact), "B", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	pdf.SetFont("Helvetica", "B", 13)
+	pdf.CellFormat(0, 8, d.tr(title), "", 1, "L", false, 0, "")
+	pdf.Ln(1)
+	return d
+}
+
+// KeyValues prints label/value pairs two to a line.
+func (d *Document) KeyValues(pairs [][2]string) {
+	for i, p := range pairs {
+		d.SetFont("Helvetica", "B", 9)
+		d.CellFormat(30, 5, d.tr(p[0]), "", 0, "L", false, 0, "")
+		d.SetFont("Helvetica", "", 9)
+		ln := 0
+		if i%2 == 1 || i == len(pairs)-1 {
+			ln = 1
+		}
+		d.CellFormat(60, 5, d.tr(p[1]), "", ln, "L", false, 0, "")
+	}
+	d.Ln(3)
+}
+
+// Table prints a bordered table. align holds one fpdf alignment per column
+// ("L", "C" or "R"); missing entries default to left.
+func (d *Document) Table(headers []string, widths []float64, align []string, rows [][]string) {
+	alignOf := func(i int) string {
+		if i < len(align) && align[i] != "" {
+			return align[i]
+		}
+		return "L"
+	}
+	header := func() {
+		d.SetFont("Helvetica", "B", 9)
+		d.SetFillColor(230, 230, 230)
+		for i, h := range headers {
+			d.CellFormat(widths[i], 6, d.tr(h), "1", 0, alignOf(i), true, 0, "")
+		}
+		d.Ln(-1)
+	}
+
+	header()
+	d.SetFont("Helvetica", "", 9)
+	_, pageHeight := d.GetPageSize()
+	_, _, _, bottom := d.GetMargins()
+	for _, row := range rows {
+		if d.GetY()+6 > pageHeight-bottom {
+			d.AddPage()
+			header()
+			d.SetFont("Helvetica", "", 9)
+		}
+		for i, cell := range row {
+			d.CellFormat(widths[i], 6, d.tr(cell), "1", 0, alignOf(i), false, 0, "")
+		}
+		d.Ln(-1)
+	}
+	d.Ln(3)
+}
+
+// Paragraph prints wrapped text with an optional bold label.
+func (d *Document) Paragraph(label, text string) {
+	if label != "" {
+		d.SetFont("Helvetica", "B", 9)
+		d.CellFormat(0, 5, d.tr(label), "", 1, "L", false, 0, "")
+	}
+	d.SetFont("Helvetica", "", 9)
+	d.MultiCell(0, 5, d.tr(text), "", "L", false)
+	d.Ln(2)
+}
+
+// Heading prints a bold section heading.
+func (d *Document) Heading(text string) {
+	d.SetFont("Helvetica", "B", 10)
+	d.CellFormat(0, 6, d.tr(text), "", 1, "L", false, 0, "")
+}
+
+// QRCode draws a QR code of content with its top left corner at x, y.
+func (d *Document) QRCode(content string, x, y, size float64) {
+	barcode.Barcode(d.Fpdf, barcode.RegisterQR(d.Fpdf, content, qr.M, qr.Auto), x, y, size, size, false)
+}
+
+// Bytes renders the finished document.
+func (d *Document) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := d.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
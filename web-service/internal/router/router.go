@@ -3,10 +3,22 @@ package router
 import (
         "web-service/internal/handlers/appointments"
         "web-service/internal/handlers/billing"
+        "web-service/internal/handlers/dispensing"
+        "web-service/internal/handlers/encounters"
+        "web-service/internal/handlers/finance"
+        "web-service/internal/handlers/icd10"
+        "web-service/internal/handlers/insurance"
+        "web-service/internal/handlers/interactions"
         "web-service/internal/handlers/laboratory"
+        "web-service/internal/handlers/laborders"
+        "web-service/internal/handlers/medicalrecords"
         "web-service/internal/handlers/patients"
         "web-service/internal/handlers/pharmacy"
+        "web-service/internal/handlers/prescriptions"
+        "web-service/internal/handlers/purchasing"
         "web-service/internal/handlers/staff"
+        "web-service/internal/handlers/tariff"
+        "web-service/internal/handlers/vitals"
         "web-service/internal/middleware"
 
         "github.com/gofiber/fiber/v2"
@@ -31,18 +43,213 @@ func SetupRoutes(app *fiber.App) {
         api.Get("/appointments", middleware.AuthMiddleware, appointments.GetAppointments)
         api.Get("/appointments/:id", middleware.AuthMiddleware, appointments.GetAppointmentByID)
         api.Post("/appointments", middleware.AuthMiddleware, appointments.AddAppointment)
+        api.Patch("/appointments/:id/check-in", middleware.AuthMiddleware, appointments.CheckInAppointment)
 
         api.Get("/patients", middleware.AuthMiddleware, patients.GetAllPatients)
         api.Get("/patients/:id", middleware.AuthMiddleware, patients.GetPatient)
         api.Patch("/patients/:id", middleware.AuthMiddleware, patients.EditPatient)
         api.Post("/patients", middleware.AuthMiddleware, patients.AddPatient)
         api.Delete("/patients/:id", middleware.AuthMiddleware, patients.DeletePatient)
+        api.Get("/patients/:id/demographics", middleware.AuthMiddleware, patients.GetDemographics)
+        api.Patch("/patients/:id/demographics", middleware.AuthMiddleware, patients.UpdateDemographics)
+        api.Get("/patients/:id/contacts", middleware.AuthMiddleware, patients.GetContacts)
+        api.Post("/patients/:id/contacts", middleware.AuthMiddleware, patients.AddContact)
+        api.Patch("/patients/:id/contacts/:contactId", middleware.AuthMiddleware, patients.EditContact)
+        api.Delete("/patients/:id/contacts/:contactId", middleware.AuthMiddleware, patients.DeleteContact)
+        api.Get("/patients/:id/insurance", middleware.AuthMiddleware, patients.GetInsurance)
+        api.Post("/patients/:id/insurance", middleware.AuthMiddleware, patients.AddInsurance)
+        api.Patch("/patients/:id/insurance/:insuranceId", middleware.AuthMiddleware, patients.EditInsurance)
+        api.Delete("/patients/:id/insurance/:insuranceId", middleware.AuthMiddleware, patients.DeleteInsurance)
+        // Allergies and conditions feed the prescribing safety checks, so only clinicians change them
+        clinical := middleware.RequireRoles(middleware.ClinicalRoles...)
+        api.Get("/patients/:id/allergies", middleware.AuthMiddleware, patients.GetAllergies)
+        api.Post("/patients/:id/allergies", middleware.AuthMiddleware, clinical, patients.AddAllergy)
+        api.Patch("/patients/:id/allergies/:allergyId", middleware.AuthMiddleware, clinical, patients.EditAllergy)
+        api.Delete("/patients/:id/allergies/:allergyId", middleware.AuthMiddleware, clinical, patients.DeleteAllergy)
+        api.Get("/patients/:id/allergies/:allergyId/history", middleware.AuthMiddleware, patients.GetAllergyHistory)
+        api.Get("/patients/:id/conditions", middleware.AuthMiddleware, patients.GetConditions)
+        api.Post("/patients/:id/conditions", middleware.AuthMiddleware, clinical, patients.AddCondition)
+        api.Patch("/patients/:id/conditions/:conditionId", middleware.AuthMiddleware, clinical, patients.EditCondition)
+        api.Delete("/patients/:id/conditions/:conditionId", middleware.AuthMiddleware, clinical, patients.DeleteCondition)
+        api.Get("/patients/:id/conditions/:conditionId/history", middleware.AuthMiddleware, patients.GetConditionHistory)
+        api.Get("/patients/:id/vitals", middleware.AuthMiddleware, vitals.GetPatientVitals)
+        api.Get("/patients/:id/vitals/series", middleware.AuthMiddleware, vitals.GetVitalsSeries)
 
+        api.Get("/medical-records", middleware.AuthMiddleware, clinical, medicalrecords.GetMedicalRecords)
+        api.Post("/medical-records", middleware.AuthMiddleware, clinical, medicalrecords.AddMedicalRecord)
+        api.Get("/medical-records/:id", middleware.AuthMiddleware, clinical, medicalrecords.GetMedicalRecord)
+        api.Post("/medical-records/:id/amend", middleware.AuthMiddleware, clinical, medicalrecords.AmendMedicalRecord)
+
+        api.Get("/encounters", middleware.AuthMiddleware, clinical, encounters.GetEncounters)
+        api.Post("/encounters", middleware.AuthMiddleware, clinical, encounters.OpenEncounter)
+        api.Get("/encounters/:id", middleware.AuthMiddleware, clinical, encounters.GetEncounter)
+        api.Patch("/encounters/:id", middleware.AuthMiddleware, clinical, encounters.UpdateNote)
+        api.Post("/encounters/:id/sign", middleware.AuthMiddleware, clinical, encounters.SignEncounter)
+        api.Post("/encounters/:id/addenda", middleware.AuthMiddleware, clinical, encounters.AddAddendum)
+        api.Post("/encounters/:id/diagnoses", middleware.AuthMiddleware, clinical, encounters.AddDiagnosis)
+        api.Delete("/encounters/:id/diagnoses/:diagnosisId", middleware.AuthMiddleware, clinical, encounters.DeleteDiagnosis)
+        api.Post("/encounters/:id/orders", middleware.AuthMiddleware, clinical, encounters.AddOrder)
+        api.Delete("/encounters/:id/orders/:orderId", middleware.AuthMiddleware, clinical, encounters.DeleteOrder)
+
+        prescriber := middleware.RequireRoles("doctor")
+        dispenser := middleware.RequireRoles("pharmacist", "admin")
+        prescriptionReader := middleware.RequireRoles("doctor", "nurse", "pharmacist", "admin")
+        api.Get("/prescriptions", middleware.AuthMiddleware, prescriptionReader, prescriptions.GetPrescriptions)
+        api.Post("/prescriptions", middleware.AuthMiddleware, prescriber, prescriptions.CreatePrescription)
+        api.Get("/prescriptions/queue", middleware.AuthMiddleware, dispenser, prescriptions.GetQueue)
+        api.Get("/prescriptions/:id", middleware.AuthMiddleware, prescriptionReader, prescriptions.GetPrescription)
+        api.Get("/prescriptions/:id/print", middleware.AuthMiddleware, prescriptionReader, prescriptions.PrintPrescription)
+        api.Post("/prescriptions/:id/cancel", middleware.AuthMiddleware, prescriber, prescriptions.CancelPrescription)
+
+        api.Post("/interactions/check", middleware.AuthMiddleware, prescriptionReader, interactions.CheckInteractions)
+
+        api.Get("/icd10", middleware.AuthMiddleware, icd10.SearchCodes)
+        api.Get("/icd10/:code", middleware.AuthMiddleware, icd10.GetCode)
+        api.Get("/reports/morbidity", middleware.AuthMiddleware, icd10.GetMorbidityReport)
+
+        api.Post("/vitals", middleware.AuthMiddleware, clinical, vitals.AddVitals)
+        api.Get("/vitals/:id", middleware.AuthMiddleware, vitals.GetVitalsByID)
+
+        // Billing: voids and refunds need a supervisor
+        supervisor := middleware.RequireRoles("admin")
         api.Get("/billing", middleware.AuthMiddleware, billing.GetInvoices)
         api.Post("/billing", middleware.AuthMiddleware, billing.CreateInvoice)
+        api.Get("/billing/services", middleware.AuthMiddleware, tariff.GetServiceItems)
+        api.Post("/billing/services", middleware.AuthMiddleware, supervisor, tariff.CreateServiceItem)
+        api.Patch("/billing/services/:id", middleware.AuthMiddleware, supervisor, tariff.UpdateServiceItem)
+        api.Get("/billing/:id", middleware.AuthMiddleware, billing.GetInvoice)
+        api.Patch("/billing/:id", middleware.AuthMiddleware, billing.UpdateInvoice)
+        api.Post("/billing/:id/lines", middleware.AuthMiddleware, billing.AddInvoiceLines)
+        api.Delete("/billing/:id/lines/:lineId", middleware.AuthMiddleware, billing.RemoveInvoiceLine)
+        api.Post("/billing/:id/issue", middleware.AuthMiddleware, billing.IssueInvoice)
+        api.Post("/billing/:id/insurance", middleware.AuthMiddleware, billing.SetInvoiceInsurance)
+        api.Delete("/billing/:id/insurance", middleware.AuthMiddleware, billing.RemoveInvoiceInsurance)
+        api.Post("/billing/:id/mpesa", middleware.AuthMiddleware, billing.RequestMobilePayment)
+        api.Get("/billing/:id/pdf", middleware.AuthMiddleware, billing.GetInvoicePDF)
+        api.Post("/billing/:id/email", middleware.AuthMiddleware, billing.EmailInvoice)
+        api.Post("/billing/:id/void", middleware.AuthMiddleware, supervisor, billing.VoidInvoice)
+
+        api.Get("/payments", middleware.AuthMiddleware, billing.GetPayments)
+        api.Post("/payments", middleware.AuthMiddleware, billing.CreatePayment)
+        api.Post("/payments/mpesa/callback", billing.MobileMoneyCallback) // Public, called by Daraja; checks MPESA_CALLBACK_TOKEN
+        api.Get("/payments/mpesa/:id", middleware.AuthMiddleware, billing.GetMobilePayment)
+        api.Get("/payments/:id", middleware.AuthMiddleware, billing.GetPayment)
+        api.Get("/payments/:id/receipt", middleware.AuthMiddleware, billing.GetReceiptPDF)
+        api.Post("/payments/:id/email", middleware.AuthMiddleware, billing.EmailReceipt)
+        api.Post("/payments/:id/allocate", middleware.AuthMiddleware, billing.AllocatePayment)
+        api.Post("/payments/:id/refund", middleware.AuthMiddleware, supervisor, billing.RefundPayment)
+        api.Post("/payments/:id/void", middleware.AuthMiddleware, supervisor, billing.VoidPayment)
+
+        // Cashier shifts: each cashier opens and closes their own drawer
+        api.Get("/cashier/shifts", middleware.AuthMiddleware, supervisor, finance.GetShifts)
+        api.Post("/cashier/shifts", middleware.AuthMiddleware, finance.OpenShift)
+        api.Get("/cashier/shifts/current", middleware.AuthMiddleware, finance.GetCurrentShift)
+        api.Get("/cashier/shifts/:id", middleware.AuthMiddleware, finance.GetShift)
+        api.Post("/cashier/shifts/:id/close", middleware.AuthMiddleware, finance.CloseShift)
+
+        // Finance reports, as JSON or ?format=csv|pdf
+        api.Get("/reports/receivables", middleware.AuthMiddleware, supervisor, finance.GetReceivables)
+        api.Get("/reports/collections", middleware.AuthMiddleware, supervisor, finance.GetCollections)
+        api.Get("/reports/shifts", middleware.AuthMiddleware, supervisor, finance.GetShiftReport)
+
+        // Insurance: payers and schemes are set up, and pre-authorisations, claims
+        // and batches decided and sent, by admins
+        api.Get("/insurance/payers", middleware.AuthMiddleware, insurance.GetPayers)
+        api.Post("/insurance/payers", middleware.AuthMiddleware, supervisor, insurance.CreatePayer)
+        api.Get("/insurance/payers/:id", middleware.AuthMiddleware, insurance.GetPayer)
+        api.Patch("/insurance/payers/:id", middleware.AuthMiddleware, supervisor, insurance.UpdatePayer)
+        api.Post("/insurance/payers/:id/schemes", middleware.AuthMiddleware, supervisor, insurance.CreateScheme)
+        api.Patch("/insurance/payers/:id/schemes/:schemeId", middleware.AuthMiddleware, supervisor, insurance.UpdateScheme)
+        api.Get("/insurance/preauthorisations", middleware.AuthMiddleware, insurance.GetPreauthorisations)
+        api.Post("/insurance/preauthorisations", middleware.AuthMiddleware, insurance.RequestPreauthorisation)
+        api.Get("/insurance/preauthorisations/:id", middleware.AuthMiddleware, insurance.GetPreauthorisation)
+        api.Post("/insurance/preauthorisations/:id/decision", middleware.AuthMiddleware, supervisor, insurance.DecidePreauthorisation)
+        api.Post("/insurance/preauthorisations/:id/cancel", middleware.AuthMiddleware, insurance.CancelPreauthorisation)
+        api.Get("/insurance/claims", middleware.AuthMiddleware, insurance.GetClaims)
+        api.Get("/insurance/claims/:id", middleware.AuthMiddleware, insurance.GetClaim)
+        api.Post("/insurance/claims/:id/query", middleware.AuthMiddleware, insurance.QueryClaim)
+        api.Post("/insurance/claims/:id/respond", middleware.AuthMiddleware, insurance.RespondToClaimQuery)
+        api.Post("/insurance/claims/:id/approve", middleware.AuthMiddleware, supervisor, insurance.ApproveClaim)
+        api.Post("/insurance/claims/:id/reject", middleware.AuthMiddleware, supervisor, insurance.RejectClaim)
+        api.Post("/insurance/claims/:id/pay", middleware.AuthMiddleware, supervisor, insurance.PayClaim)
+        api.Get("/insurance/batches", middleware.AuthMiddleware, insurance.GetBatches)
+        api.Post("/insurance/batches", middleware.AuthMiddleware, supervisor, insurance.CreateBatch)
+        api.Get("/insurance/batches/:id", middleware.AuthMiddleware, insurance.GetBatch)
+        api.Post("/insurance/batches/:id/submit", middleware.AuthMiddleware, supervisor, insurance.SubmitBatch)
+        api.Get("/insurance/batches/:id/export", middleware.AuthMiddleware, insurance.ExportBatch)
+
+        // Tariff: prices are changed by admins only
+        api.Get("/tariff/lookup", middleware.AuthMiddleware, tariff.LookupPrice)
+        api.Get("/tariff/prices", middleware.AuthMiddleware, tariff.GetItemPrices)
+        api.Get("/tariff/price-lists", middleware.AuthMiddleware, tariff.GetPriceLists)
+        api.Post("/tariff/price-lists", middleware.AuthMiddleware, supervisor, tariff.CreatePriceList)
+        api.Patch("/tariff/price-lists/:id", middleware.AuthMiddleware, supervisor, tariff.UpdatePriceList)
+        api.Get("/tariff/price-lists/:id/prices", middleware.AuthMiddleware, tariff.GetListPrices)
+        api.Post("/tariff/price-lists/:id/prices", middleware.AuthMiddleware, supervisor, tariff.SetPrice)
+        api.Get("/tariff/price-lists/:id/export", middleware.AuthMiddleware, supervisor, tariff.ExportPriceList)
+        api.Post("/tariff/price-lists/:id/import", middleware.AuthMiddleware, supervisor, tariff.ImportPriceList)
 
         api.Get("/pharmacy", middleware.AuthMiddleware, pharmacy.GetMedicines)
+        api.Post("/pharmacy", middleware.AuthMiddleware, dispenser, pharmacy.CreateMedicine)
+        api.Post("/pharmacy/allergy-check", middleware.AuthMiddleware, pharmacy.CheckAllergies)
+        api.Get("/pharmacy/expiring", middleware.AuthMiddleware, dispenser, pharmacy.GetExpiringBatches)
+        api.Post("/pharmacy/dispense", middleware.AuthMiddleware, dispenser, dispensing.Dispense)
+        api.Get("/pharmacy/dispensations", middleware.AuthMiddleware, dispenser, dispensing.GetDispensations)
+        api.Get("/pharmacy/dispensations/:id", middleware.AuthMiddleware, dispenser, dispensing.GetDispensation)
+        api.Post("/pharmacy/dispensations/:id/returns", middleware.AuthMiddleware, dispenser, dispensing.ReturnItems)
+        api.Get("/pharmacy/low-stock", middleware.AuthMiddleware, dispenser, pharmacy.GetLowStock)
+        api.Get("/pharmacy/recall", middleware.AuthMiddleware, dispenser, pharmacy.GetRecall)
+        api.Get("/pharmacy/:id", middleware.AuthMiddleware, pharmacy.GetMedicine)
+        api.Patch("/pharmacy/:id", middleware.AuthMiddleware, dispenser, pharmacy.UpdateMedicine)
+        api.Delete("/pharmacy/:id", middleware.AuthMiddleware, dispenser, pharmacy.DeleteMedicine)
+        api.Get("/pharmacy/:id/batches", middleware.AuthMiddleware, dispenser, pharmacy.GetBatches)
+        api.Get("/pharmacy/:id/movements", middleware.AuthMiddleware, dispenser, pharmacy.GetMovements)
+        api.Post("/pharmacy/:id/movements", middleware.AuthMiddleware, dispenser, pharmacy.AddMovement)
         api.Get("/laboratory", middleware.AuthMiddleware, laboratory.GetTests)
+        labManager := middleware.RequireRoles("lab tech", "admin")
+        api.Post("/laboratory", middleware.AuthMiddleware, labManager, laboratory.CreateTest)
+        api.Get("/laboratory/:id", middleware.AuthMiddleware, laboratory.GetTest)
+        api.Patch("/laboratory/:id", middleware.AuthMiddleware, labManager, laboratory.UpdateTest)
+        api.Delete("/laboratory/:id", middleware.AuthMiddleware, labManager, laboratory.DeleteTest)
+        api.Post("/laboratory/:id/parameters", middleware.AuthMiddleware, labManager, laboratory.AddParameter)
+        api.Patch("/laboratory/:id/parameters/:parameterId", middleware.AuthMiddleware, labManager, laboratory.UpdateParameter)
+        api.Delete("/laboratory/:id/parameters/:parameterId", middleware.AuthMiddleware, labManager, laboratory.DeleteParameter)
+        api.Get("/laboratory/:id/prices", middleware.AuthMiddleware, laboratory.GetPrices)
+        api.Post("/laboratory/:id/prices", middleware.AuthMiddleware, labManager, laboratory.AddPrice)
+        // Lab orders: clinicians order and read, the lab processes and verifies
+        labOrderer := middleware.RequireRoles("doctor", "nurse", "lab tech", "admin")
+        labStaff := middleware.RequireRoles("lab tech", "admin")
+        api.Get("/lab/orders", middleware.AuthMiddleware, labOrderer, laborders.GetOrders)
+        api.Post("/lab/orders", middleware.AuthMiddleware, labOrderer, laborders.CreateOrder)
+        api.Post("/lab/specimens/receive", middleware.AuthMiddleware, labStaff, laborders.ReceiveSpecimen)
+        api.Get("/lab/specimens/:id/label", middleware.AuthMiddleware, labOrderer, laborders.GetSpecimenLabel)
+        api.Get("/lab/orders/:id", middleware.AuthMiddleware, labOrderer, laborders.GetOrder)
+        api.Post("/lab/orders/:id/cancel", middleware.AuthMiddleware, labOrderer, laborders.CancelOrder)
+        api.Post("/lab/orders/:id/collect", middleware.AuthMiddleware, middleware.RequireRoles("nurse", "lab tech", "admin"), laborders.CollectSpecimens)
+        api.Post("/lab/orders/:id/start", middleware.AuthMiddleware, labStaff, laborders.StartOrder)
+        api.Put("/lab/orders/:id/results", middleware.AuthMiddleware, labStaff, laborders.EnterResults)
+        api.Post("/lab/orders/:id/verify", middleware.AuthMiddleware, labStaff, laborders.VerifyOrder)
+        api.Get("/lab/orders/:id/report", middleware.AuthMiddleware, labOrderer, laborders.GetReportPDF)
+        api.Get("/lab/reports/:id/verify", laborders.VerifyReport) // Public, linked from the report's QR code
+        api.Post("/lab/orders/:id/hl7", middleware.AuthMiddleware, labStaff, laborders.ResendOrder)
+        api.Get("/lab/hl7/messages", middleware.AuthMiddleware, labStaff, laborders.GetHL7Messages)
+        api.Get("/lab/critical-alerts", middleware.AuthMiddleware, labOrderer, laborders.GetCriticalAlerts)
+        api.Post("/lab/critical-alerts/:id/acknowledge", middleware.AuthMiddleware, middleware.RequireRoles("doctor", "nurse", "admin"), laborders.AcknowledgeAlert)
+
+        purchaser := middleware.RequireRoles("pharmacist", "lab tech", "admin")
+        api.Get("/suppliers", middleware.AuthMiddleware, purchaser, purchasing.GetSuppliers)
+        api.Post("/suppliers", middleware.AuthMiddleware, purchaser, purchasing.CreateSupplier)
+        api.Get("/suppliers/:id", middleware.AuthMiddleware, purchaser, purchasing.GetSupplier)
+        api.Patch("/suppliers/:id", middleware.AuthMiddleware, purchaser, purchasing.UpdateSupplier)
+        api.Get("/suppliers/:id/prices", middleware.AuthMiddleware, purchaser, purchasing.GetSupplierPrices)
+        api.Get("/purchase-orders", middleware.AuthMiddleware, purchaser, purchasing.GetPurchaseOrders)
+        api.Post("/purchase-orders", middleware.AuthMiddleware, purchaser, purchasing.CreatePurchaseOrder)
+        api.Get("/purchase-orders/:id", middleware.AuthMiddleware, purchaser, purchasing.GetPurchaseOrder)
+        api.Patch("/purchase-orders/:id", middleware.AuthMiddleware, purchaser, purchasing.UpdatePurchaseOrder)
+        api.Get("/purchase-orders/:id/pdf", middleware.AuthMiddleware, purchaser, purchasing.GetPurchaseOrderPDF)
+        api.Post("/purchase-orders/:id/send", middleware.AuthMiddleware, purchaser, purchasing.SendPurchaseOrder)
+        api.Post("/purchase-orders/:id/cancel", middleware.AuthMiddleware, purchaser, purchasing.CancelPurchaseOrder)
+        api.Post("/purchase-orders/:id/receipts", middleware.AuthMiddleware, purchaser, purchasing.ReceiveGoods)
 
         admin.Delete("/staff", middleware.AuthMiddleware, staff.DeleteAllStaff)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+        "context"
         "log"
         "os"
         "os/signal"
@@ -8,6 +9,9 @@ import (
 
         "web-service/config"
         "web-service/database"
+        "web-service/internal/handlers/billing"
+        "web-service/internal/handlers/laborders"
+        "web-service/internal/handlers/pharmacy"
         "web-service/internal/router"
 
         "github.com/gofiber/fiber/v2"
@@ -38,6 +42,13 @@ func main() {
         // Routes
         router.SetupRoutes(app)
 
+        // Background jobs
+        jobs, stopJobs := context.WithCancel(context.Background())
+        go pharmacy.StartReorderJob(jobs)
+        go laborders.StartEscalationJob(jobs)
+        go laborders.StartHL7Listener(jobs)
+        go billing.StartMobileMoneyJob(jobs)
+
         // Graceful shutdown handling
         go func() {
                 port := config.GetVal("PORT")
@@ -54,6 +65,7 @@ func main() {
         <-quit
 
         log.Println("Shutting down server...")
+        stopJobs()
         if err := app.Shutdown(); err != nil {
                 log.Fatalf("Error shutting down: %v\n", err)
         }
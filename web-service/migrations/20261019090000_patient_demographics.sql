@@ -0,0 +1,37 @@
+-- +goose Up
+ALTER TABLE patients ADD COLUMN preferred_language TEXT;
+ALTER TABLE patients ADD COLUMN blood_group TEXT;
+ALTER TABLE patients ADD COLUMN occupation TEXT;
+
+-- Create patient_contacts table (next of kin and emergency contacts)
+CREATE TABLE patient_contacts (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+    contact_type TEXT NOT NULL CHECK (contact_type IN ('next_of_kin', 'emergency')),
+    name TEXT NOT NULL,
+    relationship TEXT NOT NULL,
+    phone_number TEXT NOT NULL,
+    email TEXT,
+    address TEXT,
+    is_primary BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_patient_contacts_patient_id ON patient_contacts(patient_id);
+
+-- Create patient_insurance table
+CREATE TABLE patient_insurance (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+    payer TEXT NOT NULL,
+    scheme TEXT NOT NULL,
+    member_number TEXT NOT NULL,
+    valid_from DATE NOT NULL,
+    valid_to DATE,
+    principal_member_name TEXT NOT NULL,
+    principal_relationship TEXT NOT NULL DEFAULT 'self',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (payer, member_number)
+);
+CREATE INDEX idx_patient_insurance_patient_id ON patient_insurance(patient_id);
@@ -0,0 +1,45 @@
+-- +goose Up
+-- Create patient_allergies table
+CREATE TABLE patient_allergies (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+    substance TEXT NOT NULL,
+    substance_code TEXT,
+    reaction TEXT NOT NULL,
+    severity TEXT NOT NULL CHECK (severity IN ('mild', 'moderate', 'severe', 'life_threatening')),
+    verification_status TEXT NOT NULL DEFAULT 'unconfirmed' CHECK (verification_status IN ('unconfirmed', 'confirmed', 'refuted', 'entered_in_error')),
+    recorded_by TEXT REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_patient_allergies_patient_id ON patient_allergies(patient_id);
+CREATE INDEX idx_patient_allergies_substance ON patient_allergies(LOWER(substance));
+
+-- Create patient_conditions table (problem list)
+CREATE TABLE patient_conditions (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+    condition TEXT NOT NULL,
+    condition_code TEXT,
+    onset_date DATE,
+    status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'remission', 'resolved', 'inactive', 'entered_in_error')),
+    notes TEXT,
+    recorded_by TEXT REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_patient_conditions_patient_id ON patient_conditions(patient_id);
+
+-- Create patient_registry_history table, one row per change to an allergy or condition
+CREATE TABLE patient_registry_history (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+    entity_type TEXT NOT NULL CHECK (entity_type IN ('allergy', 'condition')),
+    entity_id TEXT NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('created', 'updated', 'deleted')),
+    snapshot JSONB NOT NULL,
+    changed_by TEXT REFERENCES staff(id),
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_patient_registry_history_entity ON patient_registry_history(entity_type, entity_id);
+CREATE INDEX idx_patient_registry_history_patient_id ON patient_registry_history(patient_id);
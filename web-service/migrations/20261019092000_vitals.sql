@@ -0,0 +1,21 @@
+-- +goose Up
+-- Create vitals table, measurements are stored in canonical units (mmHg, °C, bpm, %, kg, cm)
+CREATE TABLE vitals (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id) ON DELETE CASCADE,
+    encounter_id TEXT,
+    systolic INT,
+    diastolic INT,
+    temperature DECIMAL(4, 1),
+    pulse INT,
+    spo2 INT,
+    weight DECIMAL(6, 2),
+    height DECIMAL(5, 1),
+    bmi DECIMAL(5, 1),
+    flags JSONB NOT NULL DEFAULT '[]',
+    recorded_by TEXT REFERENCES staff(id),
+    recorded_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_vitals_patient_id_recorded_at ON vitals(patient_id, recorded_at);
+CREATE INDEX idx_vitals_encounter_id ON vitals(encounter_id);
@@ -0,0 +1,11 @@
+-- +goose Up
+-- Amendments are stored as new rows sharing the record_id of the original entry
+ALTER TABLE medical_records ADD COLUMN record_id TEXT;
+ALTER TABLE medical_records ADD COLUMN version INT NOT NULL DEFAULT 1;
+ALTER TABLE medical_records ADD COLUMN amendment_reason TEXT;
+ALTER TABLE medical_records ADD COLUMN amended_by TEXT REFERENCES staff(id);
+ALTER TABLE medical_records ADD COLUMN superseded_at TIMESTAMP;
+UPDATE medical_records SET record_id = id WHERE record_id IS NULL;
+ALTER TABLE medical_records ALTER COLUMN record_id SET NOT NULL;
+ALTER TABLE medical_records ADD CONSTRAINT uq_medical_records_record_version UNIQUE (record_id, version);
+CREATE INDEX idx_medical_records_current ON medical_records(patient_id, created_at) WHERE superseded_at IS NULL;
@@ -0,0 +1,55 @@
+-- +goose Up
+-- Create encounters table, a visit opened from a checked-in appointment or a walk-in
+CREATE TABLE encounters (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    appointment_id TEXT REFERENCES appointments(id),
+    clinician_id TEXT NOT NULL REFERENCES staff(id),
+    encounter_type TEXT NOT NULL CHECK (encounter_type IN ('appointment', 'walk_in')),
+    status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'signed')),
+    subjective TEXT,
+    objective TEXT,
+    assessment TEXT,
+    plan TEXT,
+    opened_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    signed_at TIMESTAMP,
+    signed_by TEXT REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_encounters_patient_id ON encounters(patient_id, opened_at);
+CREATE INDEX idx_encounters_clinician_id ON encounters(clinician_id, opened_at);
+CREATE UNIQUE INDEX uq_encounters_appointment_id ON encounters(appointment_id) WHERE appointment_id IS NOT NULL;
+
+-- Create encounter_diagnoses table
+CREATE TABLE encounter_diagnoses (
+    id TEXT PRIMARY KEY,
+    encounter_id TEXT NOT NULL REFERENCES encounters(id) ON DELETE CASCADE,
+    description TEXT NOT NULL,
+    is_primary BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_encounter_diagnoses_encounter_id ON encounter_diagnoses(encounter_id);
+
+-- Create encounter_orders table (investigations, procedures and referrals requested during the visit)
+CREATE TABLE encounter_orders (
+    id TEXT PRIMARY KEY,
+    encounter_id TEXT NOT NULL REFERENCES encounters(id) ON DELETE CASCADE,
+    order_type TEXT NOT NULL CHECK (order_type IN ('lab', 'imaging', 'procedure', 'referral', 'other')),
+    description TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'requested',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_encounter_orders_encounter_id ON encounter_orders(encounter_id);
+
+-- Create encounter_addenda table, the only way to add to a signed note
+CREATE TABLE encounter_addenda (
+    id TEXT PRIMARY KEY,
+    encounter_id TEXT NOT NULL REFERENCES encounters(id) ON DELETE CASCADE,
+    author_id TEXT NOT NULL REFERENCES staff(id),
+    content TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_encounter_addenda_encounter_id ON encounter_addenda(encounter_id);
+
+ALTER TABLE vitals ADD CONSTRAINT fk_vitals_encounter FOREIGN KEY (encounter_id) REFERENCES encounters(id);
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Create icd10_codes table, loaded with `go run ./cmd/icd10import`
+CREATE TABLE icd10_codes (
+    code TEXT PRIMARY KEY,
+    description TEXT NOT NULL,
+    chapter TEXT NOT NULL,
+    chapter_title TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_icd10_codes_code_prefix ON icd10_codes(code text_pattern_ops);
+CREATE INDEX idx_icd10_codes_description_fts ON icd10_codes USING GIN (to_tsvector('english', description));
+CREATE INDEX idx_icd10_codes_chapter ON icd10_codes(chapter);
+
+ALTER TABLE encounter_diagnoses ADD COLUMN icd10_code TEXT REFERENCES icd10_codes(code);
+CREATE INDEX idx_encounter_diagnoses_icd10_code ON encounter_diagnoses(icd10_code);
@@ -0,0 +1,34 @@
+-- +goose Up
+-- Create prescriptions table
+CREATE TABLE prescriptions (
+    id TEXT PRIMARY KEY,
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    encounter_id TEXT REFERENCES encounters(id),
+    prescriber_id TEXT NOT NULL REFERENCES staff(id),
+    status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'partially_dispensed', 'dispensed', 'cancelled')),
+    notes TEXT,
+    signature TEXT NOT NULL,
+    signed_at TIMESTAMP NOT NULL,
+    cancel_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_prescriptions_patient_id ON prescriptions(patient_id);
+CREATE INDEX idx_prescriptions_encounter_id ON prescriptions(encounter_id);
+CREATE INDEX idx_prescriptions_queue ON prescriptions(created_at) WHERE status IN ('active', 'partially_dispensed');
+
+-- Create prescription_items table, one line per medicine from the pharmacy catalogue
+CREATE TABLE prescription_items (
+    id TEXT PRIMARY KEY,
+    prescription_id TEXT NOT NULL REFERENCES prescriptions(id) ON DELETE CASCADE,
+    medicine_id TEXT NOT NULL REFERENCES pharmacy(id),
+    dose TEXT NOT NULL,
+    route TEXT NOT NULL,
+    frequency TEXT NOT NULL,
+    duration_days INT NOT NULL CHECK (duration_days > 0),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    refills INT NOT NULL DEFAULT 0 CHECK (refills >= 0),
+    dispensed_quantity INT NOT NULL DEFAULT 0,
+    instructions TEXT
+);
+CREATE INDEX idx_prescription_items_prescription_id ON prescription_items(prescription_id);
@@ -0,0 +1,27 @@
+-- +goose Up
+-- Create drug_interactions table, loaded with `go run ./cmd/interactionsimport`
+CREATE TABLE drug_interactions (
+    id TEXT PRIMARY KEY,
+    drug_a TEXT NOT NULL,
+    drug_b TEXT NOT NULL,
+    severity TEXT NOT NULL CHECK (severity IN ('minor', 'moderate', 'severe', 'contraindicated')),
+    description TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (drug_a, drug_b),
+    CHECK (drug_a < drug_b)
+);
+
+-- Create prescription_overrides table, one row per severe warning the prescriber chose to override
+CREATE TABLE prescription_overrides (
+    id TEXT PRIMARY KEY,
+    prescription_id TEXT NOT NULL REFERENCES prescriptions(id) ON DELETE CASCADE,
+    warning_key TEXT NOT NULL,
+    warning_type TEXT NOT NULL CHECK (warning_type IN ('drug_drug', 'drug_allergy')),
+    severity TEXT NOT NULL,
+    description TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    overridden_by TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_prescription_overrides_prescription_id ON prescription_overrides(prescription_id);
@@ -0,0 +1,47 @@
+-- +goose Up
+ALTER TABLE pharmacy ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE pharmacy ADD CONSTRAINT chk_pharmacy_stock_non_negative CHECK (stock >= 0);
+
+-- Create stock_movements table, the append-only ledger that pharmacy.stock is derived from
+CREATE TABLE stock_movements (
+    id TEXT PRIMARY KEY,
+    medicine_id TEXT NOT NULL REFERENCES pharmacy(id),
+    movement_type TEXT NOT NULL CHECK (movement_type IN ('receipt', 'dispense', 'adjustment', 'transfer', 'return', 'expiry_write_off')),
+    quantity INT NOT NULL CHECK (quantity <> 0),
+    reason_code TEXT NOT NULL,
+    reference TEXT,
+    notes TEXT,
+    staff_id TEXT REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_stock_movements_medicine_id ON stock_movements(medicine_id, created_at);
+CREATE INDEX idx_stock_movements_type ON stock_movements(movement_type, created_at);
+
+-- Opening balances so the ledger agrees with the stock already on hand
+INSERT INTO stock_movements (id, medicine_id, movement_type, quantity, reason_code, notes)
+SELECT 'ob-' || id, id, 'adjustment', stock, 'opening_balance', 'Balance carried over when the ledger was introduced'
+FROM pharmacy WHERE stock <> 0;
+
+-- +goose StatementBegin
+CREATE FUNCTION apply_stock_movement() RETURNS TRIGGER AS $$
+BEGIN
+    -- The row lock taken by this UPDATE serialises concurrent movements and
+    -- chk_pharmacy_stock_non_negative rejects any that would go below zero
+    UPDATE pharmacy SET stock = stock + NEW.quantity, updated_at = CURRENT_TIMESTAMP WHERE id = NEW.medicine_id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE FUNCTION forbid_stock_movement_change() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'stock_movements is append-only, record a correcting movement instead';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER trg_stock_movements_apply AFTER INSERT ON stock_movements
+    FOR EACH ROW EXECUTE FUNCTION apply_stock_movement();
+CREATE TRIGGER trg_stock_movements_append_only BEFORE UPDATE OR DELETE ON stock_movements
+    FOR EACH ROW EXECUTE FUNCTION forbid_stock_movement_change();
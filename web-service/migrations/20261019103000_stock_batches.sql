@@ -0,0 +1,44 @@
+-- +goose Up
+-- Create stock_batches table, stock on hand per batch of a medicine
+CREATE TABLE stock_batches (
+    id TEXT PRIMARY KEY,
+    medicine_id TEXT NOT NULL REFERENCES pharmacy(id),
+    batch_number TEXT NOT NULL,
+    expiry_date DATE,
+    supplier TEXT,
+    unit_cost DECIMAL(10, 2),
+    quantity INT NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (medicine_id, batch_number)
+);
+CREATE INDEX idx_stock_batches_expiry_date ON stock_batches(expiry_date) WHERE quantity > 0;
+CREATE INDEX idx_stock_batches_batch_number ON stock_batches(batch_number);
+
+ALTER TABLE stock_movements ADD COLUMN batch_id TEXT REFERENCES stock_batches(id);
+ALTER TABLE stock_movements ADD COLUMN patient_id TEXT REFERENCES patients(id);
+CREATE INDEX idx_stock_movements_batch_id ON stock_movements(batch_id);
+CREATE INDEX idx_stock_movements_patient_id ON stock_movements(patient_id);
+
+-- Stock received before batches were tracked goes into one UNBATCHED batch per
+-- medicine with no expiry date, which FEFO allocation uses last. Medicines now
+-- out of stock get one too if they have movements to point at it
+INSERT INTO stock_batches (id, medicine_id, batch_number, quantity)
+SELECT 'ub-' || p.id, p.id, 'UNBATCHED', p.stock FROM pharmacy p
+WHERE p.stock > 0 OR EXISTS (SELECT 1 FROM stock_movements m WHERE m.medicine_id = p.id);
+
+ALTER TABLE stock_movements DISABLE TRIGGER trg_stock_movements_append_only;
+UPDATE stock_movements SET batch_id = 'ub-' || medicine_id;
+ALTER TABLE stock_movements ENABLE TRIGGER trg_stock_movements_append_only;
+ALTER TABLE stock_movements ALTER COLUMN batch_id SET NOT NULL;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION apply_stock_movement() RETURNS TRIGGER AS $$
+BEGIN
+    -- Both row locks serialise concurrent movements and the CHECK constraints
+    -- on pharmacy.stock and stock_batches.quantity reject any that go below zero
+    UPDATE stock_batches SET quantity = quantity + NEW.quantity WHERE id = NEW.batch_id;
+    UPDATE pharmacy SET stock = stock + NEW.quantity, updated_at = CURRENT_TIMESTAMP WHERE id = NEW.medicine_id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE pharmacy ADD COLUMN reorder_level INT NOT NULL DEFAULT 0 CHECK (reorder_level >= 0);
+ALTER TABLE pharmacy ADD COLUMN lead_time_days INT NOT NULL DEFAULT 7 CHECK (lead_time_days >= 0);
+-- Maintained by the reorder job from dispensing history
+ALTER TABLE pharmacy ADD COLUMN avg_daily_consumption DECIMAL(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE pharmacy ADD COLUMN consumption_updated_at TIMESTAMP;
+-- Set when pharmacy staff were told the item is low, cleared once it is restocked
+ALTER TABLE pharmacy ADD COLUMN low_stock_alerted_at TIMESTAMP;
@@ -0,0 +1,88 @@
+-- +goose Up
+-- Create suppliers table
+CREATE TABLE suppliers (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    contact_person TEXT,
+    phone_number TEXT,
+    email TEXT,
+    address TEXT,
+    payment_terms TEXT,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE SEQUENCE purchase_order_number_seq;
+CREATE SEQUENCE goods_received_number_seq;
+
+-- Create purchase_orders table
+CREATE TABLE purchase_orders (
+    id TEXT PRIMARY KEY,
+    po_number TEXT NOT NULL UNIQUE,
+    supplier_id TEXT NOT NULL REFERENCES suppliers(id),
+    status TEXT NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'sent', 'partially_received', 'received', 'cancelled')),
+    expected_date DATE,
+    notes TEXT,
+    created_by TEXT NOT NULL REFERENCES staff(id),
+    sent_at TIMESTAMP,
+    cancelled_at TIMESTAMP,
+    cancel_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_purchase_orders_supplier_id ON purchase_orders(supplier_id);
+CREATE INDEX idx_purchase_orders_status ON purchase_orders(status);
+
+-- Lab consumables are not in the pharmacy catalogue, so those lines carry a description only
+CREATE TABLE purchase_order_items (
+    id TEXT PRIMARY KEY,
+    purchase_order_id TEXT NOT NULL REFERENCES purchase_orders(id) ON DELETE CASCADE,
+    item_type TEXT NOT NULL CHECK (item_type IN ('medicine', 'lab_consumable')),
+    medicine_id TEXT REFERENCES pharmacy(id),
+    description TEXT NOT NULL,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    received_quantity INT NOT NULL DEFAULT 0 CHECK (received_quantity >= 0 AND received_quantity <= quantity),
+    unit_cost DECIMAL(10, 2) NOT NULL CHECK (unit_cost >= 0),
+    CHECK ((item_type = 'medicine') = (medicine_id IS NOT NULL))
+);
+CREATE INDEX idx_purchase_order_items_purchase_order_id ON purchase_order_items(purchase_order_id);
+
+-- Create goods_received_notes table
+CREATE TABLE goods_received_notes (
+    id TEXT PRIMARY KEY,
+    grn_number TEXT NOT NULL UNIQUE,
+    purchase_order_id TEXT NOT NULL REFERENCES purchase_orders(id),
+    delivery_note TEXT,
+    notes TEXT,
+    received_by TEXT NOT NULL REFERENCES staff(id),
+    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_goods_received_notes_purchase_order_id ON goods_received_notes(purchase_order_id);
+
+CREATE TABLE goods_received_items (
+    id TEXT PRIMARY KEY,
+    grn_id TEXT NOT NULL REFERENCES goods_received_notes(id),
+    po_item_id TEXT NOT NULL REFERENCES purchase_order_items(id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    batch_number TEXT,
+    expiry_date DATE,
+    unit_cost DECIMAL(10, 2) NOT NULL CHECK (unit_cost >= 0),
+    batch_id TEXT REFERENCES stock_batches(id)
+);
+CREATE INDEX idx_goods_received_items_grn_id ON goods_received_items(grn_id);
+
+-- Create supplier_prices table, the cost history of each item per supplier
+CREATE TABLE supplier_prices (
+    id TEXT PRIMARY KEY,
+    supplier_id TEXT NOT NULL REFERENCES suppliers(id),
+    item_type TEXT NOT NULL CHECK (item_type IN ('medicine', 'lab_consumable')),
+    medicine_id TEXT REFERENCES pharmacy(id),
+    description TEXT NOT NULL,
+    unit_cost DECIMAL(10, 2) NOT NULL,
+    source TEXT NOT NULL CHECK (source IN ('purchase_order', 'goods_received')),
+    reference TEXT NOT NULL,
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_supplier_prices_supplier_id ON supplier_prices(supplier_id, recorded_at);
+CREATE INDEX idx_supplier_prices_medicine_id ON supplier_prices(medicine_id);
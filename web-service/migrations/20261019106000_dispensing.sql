@@ -0,0 +1,47 @@
+-- +goose Up
+-- Invoices can be opened outside an appointment, e.g. for a pharmacy sale
+ALTER TABLE billing ALTER COLUMN appointment_id DROP NOT NULL;
+
+-- Create invoice_items table, the priced lines that make up billing.amount
+CREATE TABLE invoice_items (
+    id TEXT PRIMARY KEY,
+    invoice_id TEXT NOT NULL REFERENCES billing(id) ON DELETE CASCADE,
+    item_type TEXT NOT NULL CHECK (item_type IN ('consultation', 'lab', 'medicine', 'procedure')),
+    description TEXT NOT NULL,
+    quantity INT NOT NULL CHECK (quantity <> 0),
+    unit_price DECIMAL(10, 2) NOT NULL CHECK (unit_price >= 0),
+    amount DECIMAL(12, 2) NOT NULL,
+    source_type TEXT,
+    source_id TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_invoice_items_invoice_id ON invoice_items(invoice_id);
+CREATE INDEX idx_invoice_items_source ON invoice_items(source_type, source_id);
+
+-- Create dispensations table, one handover of medicines to a patient or OTC customer
+CREATE TABLE dispensations (
+    id TEXT PRIMARY KEY,
+    dispense_type TEXT NOT NULL CHECK (dispense_type IN ('prescription', 'otc')),
+    prescription_id TEXT REFERENCES prescriptions(id),
+    patient_id TEXT REFERENCES patients(id),
+    customer_name TEXT,
+    invoice_id TEXT REFERENCES billing(id),
+    notes TEXT,
+    dispensed_by TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (dispense_type = 'otc' OR (prescription_id IS NOT NULL AND patient_id IS NOT NULL)),
+    CHECK (patient_id IS NOT NULL OR customer_name IS NOT NULL)
+);
+CREATE INDEX idx_dispensations_patient_id ON dispensations(patient_id);
+CREATE INDEX idx_dispensations_prescription_id ON dispensations(prescription_id);
+
+CREATE TABLE dispensation_items (
+    id TEXT PRIMARY KEY,
+    dispensation_id TEXT NOT NULL REFERENCES dispensations(id),
+    prescription_item_id TEXT REFERENCES prescription_items(id),
+    medicine_id TEXT NOT NULL REFERENCES pharmacy(id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    returned_quantity INT NOT NULL DEFAULT 0 CHECK (returned_quantity >= 0 AND returned_quantity <= quantity),
+    unit_price DECIMAL(10, 2) NOT NULL
+);
+CREATE INDEX idx_dispensation_items_dispensation_id ON dispensation_items(dispensation_id);
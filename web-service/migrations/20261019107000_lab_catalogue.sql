@@ -0,0 +1,55 @@
+-- +goose Up
+ALTER TABLE laboratory ADD COLUMN code TEXT UNIQUE;
+ALTER TABLE laboratory ADD COLUMN specimen_type TEXT;
+ALTER TABLE laboratory ADD COLUMN turnaround_hours INT CHECK (turnaround_hours > 0);
+ALTER TABLE laboratory ADD COLUMN department TEXT;
+ALTER TABLE laboratory ADD COLUMN is_panel BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE laboratory ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
+CREATE INDEX idx_laboratory_department ON laboratory(department);
+
+-- Create lab_panel_components table, the tests a panel is made of
+CREATE TABLE lab_panel_components (
+    panel_id TEXT NOT NULL REFERENCES laboratory(id) ON DELETE CASCADE,
+    test_id TEXT NOT NULL REFERENCES laboratory(id),
+    position INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (panel_id, test_id),
+    CHECK (panel_id <> test_id)
+);
+
+-- Create lab_test_parameters table, the values reported for a test
+CREATE TABLE lab_test_parameters (
+    id TEXT PRIMARY KEY,
+    test_id TEXT NOT NULL REFERENCES laboratory(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    unit TEXT,
+    value_type TEXT NOT NULL DEFAULT 'numeric' CHECK (value_type IN ('numeric', 'text')),
+    position INT NOT NULL DEFAULT 0,
+    UNIQUE (test_id, name)
+);
+
+-- Reference ranges by sex and age in days; NULL bounds are open-ended
+CREATE TABLE lab_reference_ranges (
+    id TEXT PRIMARY KEY,
+    parameter_id TEXT NOT NULL REFERENCES lab_test_parameters(id) ON DELETE CASCADE,
+    sex TEXT NOT NULL DEFAULT 'any' CHECK (sex IN ('any', 'male', 'female')),
+    age_min_days INT NOT NULL DEFAULT 0 CHECK (age_min_days >= 0),
+    age_max_days INT CHECK (age_max_days IS NULL OR age_max_days > age_min_days),
+    low DECIMAL(12, 4),
+    high DECIMAL(12, 4),
+    CHECK (low IS NULL OR high IS NULL OR low <= high)
+);
+CREATE INDEX idx_lab_reference_ranges_parameter_id ON lab_reference_ranges(parameter_id);
+
+-- Create lab_test_prices table; laboratory.price is the version in effect now
+CREATE TABLE lab_test_prices (
+    id TEXT PRIMARY KEY,
+    test_id TEXT NOT NULL REFERENCES laboratory(id) ON DELETE CASCADE,
+    price DECIMAL(10, 2) NOT NULL CHECK (price >= 0),
+    effective_from TIMESTAMP NOT NULL,
+    created_by TEXT REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (test_id, effective_from)
+);
+
+INSERT INTO lab_test_prices (id, test_id, price, effective_from)
+SELECT 'p0-' || id, id, price, COALESCE(created_at, CURRENT_TIMESTAMP) FROM laboratory;
@@ -0,0 +1,71 @@
+-- +goose Up
+CREATE SEQUENCE lab_order_number_seq;
+CREATE SEQUENCE specimen_number_seq;
+
+-- Create lab_orders table
+CREATE TABLE lab_orders (
+    id TEXT PRIMARY KEY,
+    order_number TEXT NOT NULL UNIQUE,
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    encounter_id TEXT REFERENCES encounters(id),
+    encounter_order_id TEXT REFERENCES encounter_orders(id),
+    ordered_by TEXT NOT NULL REFERENCES staff(id),
+    priority TEXT NOT NULL DEFAULT 'routine' CHECK (priority IN ('routine', 'urgent', 'stat')),
+    status TEXT NOT NULL DEFAULT 'ordered' CHECK (status IN ('ordered', 'collected', 'received', 'in_progress', 'resulted', 'verified', 'cancelled')),
+    clinical_notes TEXT,
+    invoice_id TEXT REFERENCES billing(id),
+    resulted_by TEXT REFERENCES staff(id),
+    resulted_at TIMESTAMP,
+    verified_by TEXT REFERENCES staff(id),
+    verified_at TIMESTAMP,
+    cancel_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (verified_by IS NULL OR verified_by <> resulted_by)
+);
+CREATE INDEX idx_lab_orders_patient_id ON lab_orders(patient_id);
+CREATE INDEX idx_lab_orders_status ON lab_orders(status);
+CREATE INDEX idx_lab_orders_encounter_id ON lab_orders(encounter_id);
+
+-- Create lab_order_items table, the tests ordered with the price charged at the time
+CREATE TABLE lab_order_items (
+    id TEXT PRIMARY KEY,
+    order_id TEXT NOT NULL REFERENCES lab_orders(id) ON DELETE CASCADE,
+    test_id TEXT NOT NULL REFERENCES laboratory(id),
+    price DECIMAL(10, 2) NOT NULL
+);
+CREATE INDEX idx_lab_order_items_order_id ON lab_order_items(order_id);
+
+-- Create specimens table; specimen_number is printed as the barcode on the label
+CREATE TABLE specimens (
+    id TEXT PRIMARY KEY,
+    specimen_number TEXT NOT NULL UNIQUE,
+    order_id TEXT NOT NULL REFERENCES lab_orders(id),
+    specimen_type TEXT NOT NULL,
+    collected_by TEXT NOT NULL REFERENCES staff(id),
+    collected_at TIMESTAMP NOT NULL,
+    received_by TEXT REFERENCES staff(id),
+    received_at TIMESTAMP,
+    rejected_reason TEXT
+);
+CREATE INDEX idx_specimens_order_id ON specimens(order_id);
+
+-- Create lab_results table, one value per test parameter with the range and flag applied
+CREATE TABLE lab_results (
+    id TEXT PRIMARY KEY,
+    order_id TEXT NOT NULL REFERENCES lab_orders(id) ON DELETE CASCADE,
+    order_item_id TEXT NOT NULL REFERENCES lab_order_items(id) ON DELETE CASCADE,
+    parameter_id TEXT NOT NULL REFERENCES lab_test_parameters(id) ON DELETE RESTRICT,
+    value_numeric DECIMAL(14, 4),
+    value_text TEXT,
+    unit TEXT,
+    ref_low DECIMAL(12, 4),
+    ref_high DECIMAL(12, 4),
+    flag TEXT CHECK (flag IN ('normal', 'low', 'high')),
+    comment TEXT,
+    entered_by TEXT NOT NULL REFERENCES staff(id),
+    entered_at TIMESTAMP NOT NULL,
+    UNIQUE (order_item_id, parameter_id),
+    CHECK (value_numeric IS NOT NULL OR value_text IS NOT NULL)
+);
+CREATE INDEX idx_lab_results_order_id ON lab_results(order_id);
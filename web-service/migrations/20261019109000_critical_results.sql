@@ -0,0 +1,35 @@
+-- +goose Up
+-- Values beyond the critical limits need to reach a clinician straight away
+ALTER TABLE lab_reference_ranges
+    ADD COLUMN critical_low DECIMAL(12, 4),
+    ADD COLUMN critical_high DECIMAL(12, 4),
+    ADD CHECK (critical_low IS NULL OR low IS NULL OR critical_low <= low),
+    ADD CHECK (critical_high IS NULL OR high IS NULL OR critical_high >= high);
+
+ALTER TABLE lab_results DROP CONSTRAINT lab_results_flag_check;
+ALTER TABLE lab_results ADD CONSTRAINT lab_results_flag_check
+    CHECK (flag IN ('normal', 'low', 'high', 'critical_low', 'critical_high'));
+
+-- Urgent notifications point at the record they are about
+ALTER TABLE notifications
+    ADD COLUMN priority TEXT NOT NULL DEFAULT 'normal' CHECK (priority IN ('normal', 'urgent')),
+    ADD COLUMN reference_type TEXT,
+    ADD COLUMN reference_id TEXT;
+
+-- Create lab_critical_alerts table, one per critical value entered, kept until a clinician acknowledges it
+CREATE TABLE lab_critical_alerts (
+    id TEXT PRIMARY KEY,
+    order_id TEXT NOT NULL REFERENCES lab_orders(id),
+    result_id TEXT NOT NULL REFERENCES lab_results(id) ON DELETE CASCADE,
+    clinician_id TEXT NOT NULL REFERENCES staff(id),
+    flag TEXT NOT NULL CHECK (flag IN ('critical_low', 'critical_high')),
+    value_numeric DECIMAL(14, 4) NOT NULL,
+    message TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    escalated_at TIMESTAMP,
+    acknowledged_by TEXT REFERENCES staff(id),
+    acknowledged_at TIMESTAMP,
+    acknowledgement_note TEXT
+);
+CREATE INDEX idx_lab_critical_alerts_order_id ON lab_critical_alerts(order_id);
+CREATE INDEX idx_lab_critical_alerts_open ON lab_critical_alerts(created_at) WHERE acknowledged_at IS NULL;
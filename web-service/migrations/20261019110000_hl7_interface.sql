@@ -0,0 +1,20 @@
+-- +goose Up
+-- Analysers report each observation by code (OBX-3), matched to the parameter here
+ALTER TABLE lab_test_parameters ADD COLUMN code TEXT;
+CREATE INDEX idx_lab_test_parameters_code ON lab_test_parameters(LOWER(code));
+
+-- Create hl7_messages table, a log of every message exchanged with the analysers
+CREATE TABLE hl7_messages (
+    id TEXT PRIMARY KEY,
+    direction TEXT NOT NULL CHECK (direction IN ('inbound', 'outbound')),
+    message_type TEXT,
+    control_id TEXT,
+    peer TEXT,
+    order_id TEXT REFERENCES lab_orders(id),
+    status TEXT NOT NULL CHECK (status IN ('accepted', 'error', 'rejected', 'sent', 'failed')),
+    error TEXT,
+    raw TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_hl7_messages_order_id ON hl7_messages(order_id);
+CREATE INDEX idx_hl7_messages_created_at ON hl7_messages(created_at);
@@ -0,0 +1,55 @@
+-- +goose Up
+CREATE SEQUENCE invoice_number_seq;
+
+-- Invoices get their number when issued, so issued numbers run without gaps
+ALTER TABLE billing
+    ADD COLUMN invoice_number TEXT UNIQUE,
+    ADD COLUMN encounter_id TEXT REFERENCES encounters(id),
+    ADD COLUMN subtotal DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN discount_total DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN tax_total DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN amount_paid DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN notes TEXT,
+    ADD COLUMN due_date DATE,
+    ADD COLUMN created_by TEXT REFERENCES staff(id),
+    ADD COLUMN issued_by TEXT REFERENCES staff(id),
+    ADD COLUMN issued_at TIMESTAMP,
+    ADD COLUMN void_reason TEXT,
+    ADD COLUMN voided_by TEXT REFERENCES staff(id),
+    ADD COLUMN voided_at TIMESTAMP;
+ALTER TABLE billing ALTER COLUMN amount TYPE DECIMAL(12, 2);
+CREATE INDEX idx_billing_encounter_id ON billing(encounter_id);
+
+-- Existing invoices were created as unpaid, pending or paid; anything not a draft or paid counts as issued
+UPDATE billing SET status = LOWER(status);
+UPDATE billing SET status = 'issued' WHERE status NOT IN ('draft', 'paid');
+UPDATE billing SET amount_paid = amount WHERE status = 'paid';
+UPDATE billing b SET invoice_number = n.number, issued_at = b.created_at
+FROM (SELECT id, 'INV-' || LPAD(nextval('invoice_number_seq')::text, 6, '0') AS number
+      FROM (SELECT id FROM billing WHERE status <> 'draft' ORDER BY created_at, id) ordered) n
+WHERE b.id = n.id;
+UPDATE billing SET subtotal = amount;
+ALTER TABLE billing ALTER COLUMN status SET DEFAULT 'draft';
+ALTER TABLE billing ALTER COLUMN status SET NOT NULL;
+ALTER TABLE billing ADD CONSTRAINT billing_status_check
+    CHECK (status IN ('draft', 'issued', 'partially_paid', 'paid', 'void'));
+ALTER TABLE billing ADD CHECK (status = 'draft' OR status = 'void' OR invoice_number IS NOT NULL);
+
+-- Lines carry their own discount and tax; amount is the line total before tax
+ALTER TABLE invoice_items
+    ADD COLUMN discount DECIMAL(12, 2) NOT NULL DEFAULT 0 CHECK (discount >= 0),
+    ADD COLUMN tax_rate DECIMAL(5, 2) NOT NULL DEFAULT 0 CHECK (tax_rate >= 0),
+    ADD COLUMN tax_amount DECIMAL(12, 2) NOT NULL DEFAULT 0;
+
+-- Create service_items table, the priced consultations and procedures that are not lab tests or medicines
+CREATE TABLE service_items (
+    id TEXT PRIMARY KEY,
+    code TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    item_type TEXT NOT NULL CHECK (item_type IN ('consultation', 'procedure')),
+    price DECIMAL(10, 2) NOT NULL CHECK (price >= 0),
+    tax_rate DECIMAL(5, 2) NOT NULL DEFAULT 0 CHECK (tax_rate >= 0),
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,52 @@
+-- +goose Up
+CREATE SEQUENCE receipt_number_seq;
+
+-- Create payments table, money received from a patient; each payment is one numbered receipt
+CREATE TABLE payments (
+    id TEXT PRIMARY KEY,
+    receipt_number TEXT NOT NULL UNIQUE,
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    method TEXT NOT NULL CHECK (method IN ('cash', 'card', 'mobile_money', 'insurance')),
+    amount DECIMAL(12, 2) NOT NULL CHECK (amount > 0),
+    reference TEXT,
+    notes TEXT,
+    status TEXT NOT NULL DEFAULT 'received' CHECK (status IN ('received', 'partially_refunded', 'refunded', 'void')),
+    received_by TEXT NOT NULL REFERENCES staff(id),
+    received_at TIMESTAMP NOT NULL,
+    void_reason TEXT,
+    voided_by TEXT REFERENCES staff(id),
+    voided_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (method = 'cash' OR reference IS NOT NULL)
+);
+CREATE INDEX idx_payments_patient_id ON payments(patient_id, received_at);
+CREATE INDEX idx_payments_received_at ON payments(received_at);
+-- The same card slip or mobile money code cannot be recorded twice
+CREATE UNIQUE INDEX uq_payments_reference ON payments(method, reference) WHERE reference IS NOT NULL AND status <> 'void';
+
+-- Create payment_refunds table, money given back from a payment
+CREATE TABLE payment_refunds (
+    id TEXT PRIMARY KEY,
+    payment_id TEXT NOT NULL REFERENCES payments(id),
+    amount DECIMAL(12, 2) NOT NULL CHECK (amount > 0),
+    method TEXT NOT NULL CHECK (method IN ('cash', 'card', 'mobile_money', 'insurance')),
+    reference TEXT,
+    reason TEXT NOT NULL,
+    refunded_by TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_payment_refunds_payment_id ON payment_refunds(payment_id);
+
+-- Allocations are a ledger: refunds and voids add negative entries, and an invoice's amount_paid is their sum
+CREATE TABLE payment_allocations (
+    id TEXT PRIMARY KEY,
+    payment_id TEXT NOT NULL REFERENCES payments(id),
+    invoice_id TEXT NOT NULL REFERENCES billing(id),
+    amount DECIMAL(12, 2) NOT NULL CHECK (amount <> 0),
+    refund_id TEXT REFERENCES payment_refunds(id),
+    created_by TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_payment_allocations_payment_id ON payment_allocations(payment_id);
+CREATE INDEX idx_payment_allocations_invoice_id ON payment_allocations(invoice_id);
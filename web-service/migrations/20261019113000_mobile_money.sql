@@ -0,0 +1,26 @@
+-- +goose Up
+-- Create mobile_money_requests table, payment prompts sent to a patient's phone for an invoice
+CREATE TABLE mobile_money_requests (
+    id TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    invoice_id TEXT NOT NULL REFERENCES billing(id),
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    phone_number TEXT NOT NULL,
+    amount DECIMAL(12, 2) NOT NULL CHECK (amount > 0),
+    checkout_id TEXT NOT NULL,
+    merchant_request_id TEXT,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed', 'timed_out')),
+    result_code TEXT,
+    result_description TEXT,
+    provider_receipt TEXT,
+    payment_id TEXT REFERENCES payments(id),
+    callback_count INT NOT NULL DEFAULT 0,
+    requested_by TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP,
+    UNIQUE (provider, checkout_id)
+);
+CREATE INDEX idx_mobile_money_requests_invoice_id ON mobile_money_requests(invoice_id);
+CREATE INDEX idx_mobile_money_requests_pending ON mobile_money_requests(created_at) WHERE status = 'pending';
+-- At most one request per invoice is waiting for the patient at a time
+CREATE UNIQUE INDEX idx_mobile_money_requests_pending_invoice ON mobile_money_requests(invoice_id) WHERE status = 'pending';
@@ -0,0 +1,116 @@
+-- +goose Up
+CREATE SEQUENCE claim_number_seq;
+CREATE SEQUENCE claim_batch_number_seq;
+CREATE SEQUENCE preauth_number_seq;
+
+-- Create insurance_payers table, the insurers and corporates claims are sent to
+CREATE TABLE insurance_payers (
+    id TEXT PRIMARY KEY,
+    code TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    claim_format TEXT NOT NULL DEFAULT 'csv' CHECK (claim_format IN ('csv', 'json', 'xml')),
+    contact_email TEXT,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Schemes carry the co-pay rule: none, a fixed amount or a percentage of covered charges, optionally capped
+CREATE TABLE insurance_schemes (
+    id TEXT PRIMARY KEY,
+    payer_id TEXT NOT NULL REFERENCES insurance_payers(id),
+    code TEXT NOT NULL,
+    name TEXT NOT NULL,
+    covered_item_types TEXT[] NOT NULL DEFAULT ARRAY['consultation', 'lab', 'medicine', 'procedure'],
+    copay_type TEXT NOT NULL DEFAULT 'none' CHECK (copay_type IN ('none', 'fixed', 'percentage')),
+    copay_value DECIMAL(12, 2) NOT NULL DEFAULT 0 CHECK (copay_value >= 0),
+    copay_cap DECIMAL(12, 2) CHECK (copay_cap >= 0),
+    preauth_threshold DECIMAL(12, 2) CHECK (preauth_threshold >= 0),
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (payer_id, code),
+    CHECK (copay_type <> 'percentage' OR copay_value <= 100)
+);
+
+ALTER TABLE patient_insurance ADD COLUMN scheme_id TEXT REFERENCES insurance_schemes(id);
+
+-- An insured invoice is split: the insurer pays insurer_share, the patient the rest
+ALTER TABLE billing
+    ADD COLUMN insurance_id TEXT REFERENCES patient_insurance(id),
+    ADD COLUMN scheme_id TEXT REFERENCES insurance_schemes(id),
+    ADD COLUMN insurer_share DECIMAL(12, 2) NOT NULL DEFAULT 0 CHECK (insurer_share >= 0),
+    ADD CHECK ((insurance_id IS NULL) = (scheme_id IS NULL));
+
+-- Create insurance_preauthorisations table, approval sought from the insurer before an expensive service
+CREATE TABLE insurance_preauthorisations (
+    id TEXT PRIMARY KEY,
+    preauth_number TEXT NOT NULL UNIQUE,
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    insurance_id TEXT NOT NULL REFERENCES patient_insurance(id),
+    encounter_id TEXT REFERENCES encounters(id),
+    item_type TEXT NOT NULL CHECK (item_type IN ('consultation', 'lab', 'medicine', 'procedure')),
+    item_id TEXT NOT NULL,
+    description TEXT NOT NULL,
+    estimated_amount DECIMAL(12, 2) NOT NULL CHECK (estimated_amount > 0),
+    approved_amount DECIMAL(12, 2),
+    status TEXT NOT NULL DEFAULT 'requested' CHECK (status IN ('requested', 'approved', 'rejected', 'cancelled')),
+    insurer_reference TEXT,
+    notes TEXT,
+    decision_notes TEXT,
+    valid_until DATE,
+    requested_by TEXT NOT NULL REFERENCES staff(id),
+    decided_by TEXT REFERENCES staff(id),
+    decided_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_insurance_preauthorisations_patient_id ON insurance_preauthorisations(patient_id, status);
+
+-- Create insurance_claim_batches table, claims sent to one payer together
+CREATE TABLE insurance_claim_batches (
+    id TEXT PRIMARY KEY,
+    batch_number TEXT NOT NULL UNIQUE,
+    payer_id TEXT NOT NULL REFERENCES insurance_payers(id),
+    status TEXT NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'submitted', 'queried', 'approved', 'rejected', 'paid')),
+    created_by TEXT NOT NULL REFERENCES staff(id),
+    submitted_by TEXT REFERENCES staff(id),
+    submitted_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_insurance_claim_batches_payer_id ON insurance_claim_batches(payer_id, status);
+
+-- Create insurance_claims table, the insurer's share of one issued invoice
+CREATE TABLE insurance_claims (
+    id TEXT PRIMARY KEY,
+    claim_number TEXT NOT NULL UNIQUE,
+    invoice_id TEXT NOT NULL UNIQUE REFERENCES billing(id),
+    patient_id TEXT NOT NULL REFERENCES patients(id),
+    insurance_id TEXT NOT NULL REFERENCES patient_insurance(id),
+    scheme_id TEXT NOT NULL REFERENCES insurance_schemes(id),
+    payer_id TEXT NOT NULL REFERENCES insurance_payers(id),
+    batch_id TEXT REFERENCES insurance_claim_batches(id),
+    status TEXT NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'submitted', 'queried', 'approved', 'rejected', 'paid')),
+    claimed_amount DECIMAL(12, 2) NOT NULL CHECK (claimed_amount > 0),
+    approved_amount DECIMAL(12, 2),
+    paid_amount DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    query_note TEXT,
+    query_response TEXT,
+    rejection_reason TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_insurance_claims_payer_id ON insurance_claims(payer_id, status);
+CREATE INDEX idx_insurance_claims_batch_id ON insurance_claims(batch_id);
+
+-- Create insurance_claim_events table, the history of each claim
+CREATE TABLE insurance_claim_events (
+    id TEXT PRIMARY KEY,
+    claim_id TEXT NOT NULL REFERENCES insurance_claims(id) ON DELETE CASCADE,
+    status TEXT NOT NULL,
+    note TEXT,
+    staff_id TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_insurance_claim_events_claim_id ON insurance_claim_events(claim_id);
@@ -0,0 +1,46 @@
+-- +goose Up
+-- Create price_lists table: the cash list, and corporate and insurer lists agreed with payers
+CREATE TABLE price_lists (
+    id TEXT PRIMARY KEY,
+    code TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('cash', 'corporate', 'insurer')),
+    payer_id TEXT UNIQUE REFERENCES insurance_payers(id),
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((kind = 'cash') = (payer_id IS NULL))
+);
+CREATE UNIQUE INDEX uq_price_lists_cash ON price_lists(kind) WHERE kind = 'cash';
+
+INSERT INTO price_lists (id, code, name, kind) VALUES ('cash', 'CASH', 'Cash', 'cash');
+
+-- Create tariff_prices table, every version of every price; the latest one effective at a time applies
+CREATE TABLE tariff_prices (
+    id TEXT PRIMARY KEY,
+    price_list_id TEXT NOT NULL REFERENCES price_lists(id),
+    item_type TEXT NOT NULL CHECK (item_type IN ('consultation', 'lab', 'medicine', 'procedure')),
+    item_id TEXT NOT NULL,
+    price DECIMAL(12, 2) NOT NULL CHECK (price >= 0),
+    tax_rate DECIMAL(5, 2) NOT NULL DEFAULT 0 CHECK (tax_rate >= 0),
+    effective_from TIMESTAMP NOT NULL,
+    created_by TEXT REFERENCES staff(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (price_list_id, item_type, item_id, effective_from)
+);
+CREATE INDEX idx_tariff_prices_item ON tariff_prices(item_type, item_id, effective_from);
+
+-- The cash list starts from the prices kept with each catalogue until now
+INSERT INTO tariff_prices (id, price_list_id, item_type, item_id, price, tax_rate, effective_from, created_by, created_at)
+SELECT 'lab-' || id, 'cash', 'lab', test_id, price, 0, effective_from, created_by, created_at FROM lab_test_prices;
+
+INSERT INTO tariff_prices (id, price_list_id, item_type, item_id, price, tax_rate, effective_from)
+SELECT 'med-' || id, 'cash', 'medicine', id, price, 0, COALESCE(created_at, CURRENT_TIMESTAMP) FROM pharmacy;
+
+INSERT INTO tariff_prices (id, price_list_id, item_type, item_id, price, tax_rate, effective_from)
+SELECT 'svc-' || id, 'cash', item_type, id, price, tax_rate, COALESCE(created_at, CURRENT_TIMESTAMP) FROM service_items;
+
+DROP TABLE lab_test_prices;
+
+-- The price list an invoice is charged from
+ALTER TABLE billing ADD COLUMN price_list_id TEXT NOT NULL DEFAULT 'cash' REFERENCES price_lists(id);
@@ -0,0 +1,25 @@
+-- +goose Up
+-- Create cashier_shifts table; cash figures are worked out from payments and refunds while open and kept when the drawer is counted
+CREATE TABLE cashier_shifts (
+    id TEXT PRIMARY KEY,
+    cashier_id TEXT NOT NULL REFERENCES staff(id),
+    status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'closed')),
+    opening_float DECIMAL(12, 2) NOT NULL DEFAULT 0 CHECK (opening_float >= 0),
+    opened_at TIMESTAMP NOT NULL,
+    cash_received DECIMAL(12, 2),
+    cash_refunded DECIMAL(12, 2),
+    expected_cash DECIMAL(12, 2),
+    counted_cash DECIMAL(12, 2) CHECK (counted_cash >= 0),
+    variance DECIMAL(12, 2),
+    closed_at TIMESTAMP,
+    closed_by TEXT REFERENCES staff(id),
+    notes TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((status = 'closed') = (closed_at IS NOT NULL AND counted_cash IS NOT NULL))
+);
+-- A cashier has at most one drawer open
+CREATE UNIQUE INDEX uq_cashier_shifts_open ON cashier_shifts(cashier_id) WHERE status = 'open';
+CREATE INDEX idx_cashier_shifts_opened_at ON cashier_shifts(opened_at);
+
+CREATE INDEX idx_payment_refunds_created_at ON payment_refunds(created_at);
@@ -0,0 +1,34 @@
+-- +goose Up
+CREATE SEQUENCE credit_note_number_seq;
+
+-- Create credit_notes table, charges taken back off an issued invoice, e.g. for returned medicines or cancelled tests
+CREATE TABLE credit_notes (
+    id TEXT PRIMARY KEY,
+    credit_note_number TEXT NOT NULL UNIQUE,
+    invoice_id TEXT NOT NULL REFERENCES billing(id),
+    reason TEXT NOT NULL,
+    subtotal DECIMAL(12, 2) NOT NULL,
+    tax_total DECIMAL(12, 2) NOT NULL,
+    amount DECIMAL(12, 2) NOT NULL CHECK (amount > 0),
+    created_by TEXT NOT NULL REFERENCES staff(id),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_credit_notes_invoice_id ON credit_notes(invoice_id);
+
+-- Each line credits part of an invoice line at the price and tax it was charged
+CREATE TABLE credit_note_items (
+    id TEXT PRIMARY KEY,
+    credit_note_id TEXT NOT NULL REFERENCES credit_notes(id),
+    invoice_item_id TEXT NOT NULL REFERENCES invoice_items(id),
+    description TEXT NOT NULL,
+    quantity INT NOT NULL CHECK (quantity > 0),
+    unit_price DECIMAL(10, 2) NOT NULL CHECK (unit_price >= 0),
+    tax_rate DECIMAL(5, 2) NOT NULL CHECK (tax_rate >= 0),
+    tax_amount DECIMAL(12, 2) NOT NULL,
+    amount DECIMAL(12, 2) NOT NULL
+);
+CREATE INDEX idx_credit_note_items_credit_note_id ON credit_note_items(credit_note_id);
+CREATE INDEX idx_credit_note_items_invoice_item_id ON credit_note_items(invoice_item_id);
+
+-- What is due on an invoice is its amount less credit notes and payments
+ALTER TABLE billing ADD COLUMN amount_credited DECIMAL(12, 2) NOT NULL DEFAULT 0 CHECK (amount_credited >= 0);